@@ -0,0 +1,123 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// IPPolicy decides which client addresses may open a session. An address
+// in any of Deny is rejected; if Allow is not empty, an address must also
+// be in one of Allow.
+type IPPolicy struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// NewIPPolicy parses the given CIDRs, or single addresses, into an
+// IPPolicy.
+func NewIPPolicy(allow, deny []string) (*IPPolicy, error) {
+	p := &IPPolicy{}
+	for _, s := range allow {
+		n, err := parseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("allow %q err:%s", s, err)
+		}
+		p.Allow = append(p.Allow, n)
+	}
+	for _, s := range deny {
+		n, err := parseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("deny %q err:%s", s, err)
+		}
+		p.Deny = append(p.Deny, n)
+	}
+	return p, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid address")
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// Check returns an error if ip may not connect.
+func (p *IPPolicy) Check(ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("client address %q is not an ip", ip)
+	}
+	for _, n := range p.Deny {
+		if n.Contains(addr) {
+			return fmt.Errorf("client address %s denied by %s", ip, n)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, n := range p.Allow {
+		if n.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("client address %s not allowed", ip)
+}
+
+// OriginPolicy selects how Handler checks the Origin header.
+type OriginPolicy int
+
+const (
+	// OriginSameHost接受和请求Host相同的Origin或者没有Origin，设置了AllowedOrigins时按列表匹配
+	OriginSameHost OriginPolicy = iota
+	// OriginStrict要求必须带Origin，并且在AllowedOrigins中（为空时和请求Host相同），不接受"*"
+	OriginStrict
+	// OriginAny接受所有来源
+	OriginAny
+)
+
+// matchOrigin reports whether origin, e.g. "https://a.example.com", matches
+// pattern. A pattern without a scheme matches any scheme, and "*." in front
+// of the host matches its subdomains.
+func matchOrigin(pattern, origin string) bool {
+	if strings.EqualFold(pattern, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if !strings.EqualFold(pattern[:i], u.Scheme) {
+			return false
+		}
+		host = pattern[i+3:]
+	}
+	if strings.HasPrefix(host, "*.") {
+		return len(u.Host) > len(host)-1 && strings.EqualFold(u.Host[len(u.Host)-len(host)+1:], host[1:])
+	}
+	return strings.EqualFold(host, u.Host)
+}
+
+// rejectUpgrade answers a request refused by the access policies with 403
+// and records it with the AuditLogger.
+func (h *handler) rejectUpgrade(rw http.ResponseWriter, r *http.Request, event string, err error) {
+	h.opts.WebSSHConfig.logger().Warn("reject upgrade", "path", r.URL.Path, "remote", h.clientIP(r), "event", event, "err", err)
+	if l, ok := h.opts.WebSSHConfig.AuditLogger.(AuditEventLogger); ok {
+		l.LogEvent("", event, fmt.Sprintf("%s %s", h.clientIP(r), err))
+	}
+	http.Error(rw, err.Error(), http.StatusForbidden)
+}
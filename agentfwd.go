@@ -0,0 +1,127 @@
+package webssh
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentSource returns the ssh-agent whose keys the remote session of owner
+// may use, e.g. to hop on to further hosts without copying keys there.
+// owner is TurnConfig.Owner, empty without an Authorizer.
+type AgentSource func(owner string) (agent.Agent, error)
+
+// SocketAgent forwards the ssh-agent listening on the unix socket path,
+// SSH_AUTH_SOCK if empty, to every session. The socket is dialed for each
+// request, so the agent may be restarted.
+func SocketAgent(path string) AgentSource {
+	return func(string) (agent.Agent, error) {
+		if path == "" {
+			path = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if path == "" {
+			return nil, errors.New("no ssh-agent socket")
+		}
+		return socketAgent(path), nil
+	}
+}
+
+// UserKeyrings keeps an in-memory agent per owner, so each user only
+// forwards their own keys. Keys are added with Keyring(owner).Add.
+type UserKeyrings struct {
+	mu       sync.Mutex
+	keyrings map[string]agent.Agent
+}
+
+// Keyring returns the agent of owner, creating it if needed.
+func (u *UserKeyrings) Keyring(owner string) agent.Agent {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.keyrings == nil {
+		u.keyrings = make(map[string]agent.Agent)
+	}
+	k := u.keyrings[owner]
+	if k == nil {
+		k = agent.NewKeyring()
+		u.keyrings[owner] = k
+	}
+	return k
+}
+
+// Source forwards the keyring of the owner of each session.
+func (u *UserKeyrings) Source() AgentSource {
+	return func(owner string) (agent.Agent, error) {
+		return u.Keyring(owner), nil
+	}
+}
+
+// forwardAgent serves the agent of conf.Owner on client. The session still
+// has to ask for it with agent.RequestAgentForwarding.
+func forwardAgent(client *ssh.Client, conf *TurnConfig) error {
+	a, err := conf.ForwardAgent(conf.Owner)
+	if err != nil {
+		return err
+	}
+	return agent.ForwardToAgent(client, a)
+}
+
+// socketAgent talks to the agent at a unix socket, one connection per call.
+type socketAgent string
+
+func (s socketAgent) do(f func(agent.ExtendedAgent) error) error {
+	conn, err := net.Dial("unix", string(s))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return f(agent.NewClient(conn))
+}
+
+func (s socketAgent) List() (keys []*agent.Key, err error) {
+	err = s.do(func(a agent.ExtendedAgent) error { keys, err = a.List(); return err })
+	return
+}
+
+func (s socketAgent) Sign(key ssh.PublicKey, data []byte) (sig *ssh.Signature, err error) {
+	err = s.do(func(a agent.ExtendedAgent) error { sig, err = a.Sign(key, data); return err })
+	return
+}
+
+func (s socketAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (sig *ssh.Signature, err error) {
+	err = s.do(func(a agent.ExtendedAgent) error { sig, err = a.SignWithFlags(key, data, flags); return err })
+	return
+}
+
+func (s socketAgent) Add(key agent.AddedKey) error {
+	return s.do(func(a agent.ExtendedAgent) error { return a.Add(key) })
+}
+
+func (s socketAgent) Remove(key ssh.PublicKey) error {
+	return s.do(func(a agent.ExtendedAgent) error { return a.Remove(key) })
+}
+
+func (s socketAgent) RemoveAll() error {
+	return s.do(func(a agent.ExtendedAgent) error { return a.RemoveAll() })
+}
+
+func (s socketAgent) Lock(passphrase []byte) error {
+	return s.do(func(a agent.ExtendedAgent) error { return a.Lock(passphrase) })
+}
+
+func (s socketAgent) Unlock(passphrase []byte) error {
+	return s.do(func(a agent.ExtendedAgent) error { return a.Unlock(passphrase) })
+}
+
+// Signers is not used when serving the agent to the remote side.
+func (s socketAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errors.New("signers not supported by a forwarded agent")
+}
+
+func (s socketAgent) Extension(extensionType string, contents []byte) (out []byte, err error) {
+	err = s.do(func(a agent.ExtendedAgent) error { out, err = a.Extension(extensionType, contents); return err })
+	return
+}
@@ -0,0 +1,224 @@
+// Package api exposes sessions and recordings of a WebSSH over REST, for
+// platforms that need an admin console without writing the handlers
+// themselves:
+//
+//	GET    /sessions                   live sessions, see webssh.Result; ?cluster=1 of all instances
+//	GET    /sessions/:id               one session
+//	GET    /sessions/:id/stats         state of one session, see webssh.Stats
+//	GET    /sessions/:id/screen        terminal contents, ?format=html and ?scrollback=1
+//	GET    /health                     state of every session, see webssh.Health
+//	GET    /profiles                   names and descriptions of the profiles
+//	DELETE /sessions/:id               kill a session
+//	GET    /recordings                 recording names, oldest first
+//	GET    /recordings/:name           download a recording
+//	GET    /recordings/:name/replay    link to replay a recording
+//	GET    /recordings/:name/verify    check the signatures of a recording
+//
+// Every request must pass the Authorizer of the API, which is for
+// administrators only: the endpoints see the sessions and recordings of
+// every user.
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"github.com/widaT/webssh"
+)
+
+// ErrNoAuthorizer is returned by Register when the API has no Authorizer.
+var ErrNoAuthorizer = errors.New("api: Authorizer is required")
+
+type API struct {
+	WebSSH *webssh.WebSSH
+	// Authorizer只应放行管理员，必须设置。不使用WebSSH.Authorizer，能开终端的用户不一定能管理所有会话
+	Authorizer webssh.Authorizer
+	// ReplayPath是ServeReplay注册的路径前缀，默认/replay/
+	ReplayPath string
+	// Verifier用于校验录像签名，为空时verify返回404
+	Verifier webssh.RecordingVerifier
+}
+
+func New(w *webssh.WebSSH) *API {
+	return &API{WebSSH: w}
+}
+
+// Register adds the endpoints to r, e.g. a gin.RouterGroup under /api. It
+// adds none without an Authorizer.
+func (a *API) Register(r gin.IRouter) error {
+	if a.Authorizer == nil {
+		return ErrNoAuthorizer
+	}
+	g := r.Group("", a.authorize)
+	g.GET("/sessions", a.listSessions)
+	g.GET("/sessions/:id", a.getSession)
+	g.DELETE("/sessions/:id", a.killSession)
+	g.GET("/sessions/:id/stats", a.sessionStats)
+	g.GET("/sessions/:id/screen", a.sessionScreen)
+	g.GET("/health", a.health)
+	g.GET("/profiles", a.listProfiles)
+	g.GET("/recordings", a.listRecordings)
+	g.GET("/recordings/:name", a.downloadRecording)
+	g.GET("/recordings/:name/replay", a.replayLink)
+	g.GET("/recordings/:name/verify", a.verifyRecording)
+	return nil
+}
+
+func (a *API) authorize(c *gin.Context) {
+	if a.Authorizer == nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": webssh.ErrUnauthorized.Error()})
+		return
+	}
+	if _, err := a.Authorizer.Authorize(c.Request); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	c.Next()
+}
+
+func (a *API) listSessions(c *gin.Context) {
+	if c.Query("cluster") != "" {
+		list, err := a.WebSSH.ClusterSessions()
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"ok": false, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+		return
+	}
+	c.JSON(http.StatusOK, a.WebSSH.Sessions.List())
+}
+
+func (a *API) getSession(c *gin.Context) {
+	t := a.WebSSH.Sessions.Get(c.Param("id"))
+	if t == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": webssh.ErrSessionNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t.Result())
+}
+
+func (a *API) sessionStats(c *gin.Context) {
+	t := a.WebSSH.Sessions.Get(c.Param("id"))
+	if t == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": webssh.ErrSessionNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, t.Stats())
+}
+
+// sessionScreen answers with the screen of a session with
+// TurnConfig.VirtualTerminal, as text or, with ?format=html, HTML. The
+// scrollback comes first with ?scrollback=1, and ?download=1 makes it an
+// attachment.
+func (a *API) sessionScreen(c *gin.Context) {
+	t := a.WebSSH.Sessions.Get(c.Param("id"))
+	if t == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": webssh.ErrSessionNotFound.Error()})
+		return
+	}
+	scrollback := c.Query("scrollback") == "1" || c.Query("scrollback") == "true"
+	capture, contentType, ext := t.CaptureText, "text/plain; charset=utf-8", ".txt"
+	if c.Query("format") == "html" {
+		capture, contentType, ext = t.CaptureHTML, "text/html; charset=utf-8", ".html"
+	}
+	s, err := capture(scrollback)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	if c.Query("download") == "1" {
+		c.Header("Content-Disposition", `attachment; filename="`+t.ID+ext+`"`)
+	}
+	c.Data(http.StatusOK, contentType, []byte(s))
+}
+
+func (a *API) health(c *gin.Context) {
+	c.JSON(http.StatusOK, a.WebSSH.Sessions.Health())
+}
+
+// listProfiles answers with the profiles, without their hosts and
+// credentials.
+func (a *API) listProfiles(c *gin.Context) {
+	if a.WebSSH.Profiles == nil {
+		c.JSON(http.StatusOK, []*webssh.Profile{})
+		return
+	}
+	c.JSON(http.StatusOK, a.WebSSH.Profiles.List(""))
+}
+
+func (a *API) killSession(c *gin.Context) {
+	if err := a.WebSSH.Sessions.Kill(c.Param("id")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, webssh.ErrSessionNotFound) {
+			status = http.StatusNotFound
+		}
+		c.AbortWithStatusJSON(status, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (a *API) listRecordings(c *gin.Context) {
+	names, err := a.WebSSH.Recordings()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, names)
+}
+
+func (a *API) downloadRecording(c *gin.Context) {
+	name := path.Base(c.Param("name"))
+	f, err := a.WebSSH.OpenRecording(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	defer f.Close()
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Header("Content-Type", "application/x-asciicast")
+	c.Status(http.StatusOK)
+	io.Copy(c.Writer, f)
+}
+
+func (a *API) replayLink(c *gin.Context) {
+	name := path.Base(c.Param("name"))
+	f, err := a.WebSSH.OpenRecording(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	f.Close()
+	prefix := a.ReplayPath
+	if prefix == "" {
+		prefix = "/replay/"
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "url": path.Join(prefix, url.PathEscape(name))})
+}
+
+// verifyRecording answers with webssh.VerifyResult; ok is true only if the
+// recording is signed and untampered.
+func (a *API) verifyRecording(c *gin.Context) {
+	if a.Verifier == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": "no verifier configured"})
+		return
+	}
+	name := path.Base(c.Param("name"))
+	f, err := a.WebSSH.OpenRecording(name)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	f.Close()
+	res, err := a.WebSSH.VerifyRecording(name, a.Verifier)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": res.OK, "result": res})
+}
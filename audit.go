@@ -0,0 +1,218 @@
+package webssh
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 单行命令的默认长度上限，超过后分段输出
+const defaultMaxCommandLength = 4096
+
+const truncatedMarker = " [...]"
+
+// AuditLogger receives the command lines a user types, reconstructed from
+// the raw input.
+type AuditLogger interface {
+	// LogCommand is called once per line. truncated is set when the line
+	// was longer than MaxCommandLength and line is only one part of it.
+	LogCommand(sessionID, line string, truncated bool)
+}
+
+// AuditEventLogger may be implemented by an AuditLogger that also records
+// session events, e.g. why the server closed a session.
+type AuditEventLogger interface {
+	LogEvent(sessionID, event, reason string)
+}
+
+// JSONAuditLogger writes one json object per command line to W, apart
+// from the recording, e.g.
+// {"time":"...","session":"...","line":"ls -l","truncated":false}, and
+// events as {"time":"...","session":"...","event":"closed","reason":"idle"}.
+type JSONAuditLogger struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Line      string    `json:"line,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Event     string    `json:"event,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+func (l *JSONAuditLogger) LogCommand(sessionID, line string, truncated bool) {
+	l.write(auditEntry{Time: time.Now(), Session: sessionID, Line: line, Truncated: truncated})
+}
+
+func (l *JSONAuditLogger) LogEvent(sessionID, event, reason string) {
+	l.write(auditEntry{Time: time.Now(), Session: sessionID, Event: event, Reason: reason})
+}
+
+func (l *JSONAuditLogger) write(e auditEntry) {
+	b, _ := json.Marshal(e)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.W.Write(append(b, '\n'))
+}
+
+// auditEvent records a session event if the AuditLogger supports it.
+func (t *Turn) auditEvent(event, reason string) {
+	if l, ok := t.AuditLogger.(AuditEventLogger); ok {
+		l.LogEvent(t.ID, event, reason)
+	}
+}
+
+// lineBuffer turns raw terminal input into lines, applying the usual
+// readline editing keys. Its memory use is bounded by max: longer lines are
+// emitted in parts.
+type lineBuffer struct {
+	buf   []byte
+	pos   int // 光标在buf中的位置
+	max   int
+	esc   int // 0: 普通字符, 1: 收到ESC, 2: 在CSI/SS3序列中
+	param []byte
+	emit  func(line string, truncated bool)
+}
+
+func newLineBuffer(max int, emit func(string, bool)) *lineBuffer {
+	if max <= 0 {
+		max = defaultMaxCommandLength
+	}
+	return &lineBuffer{max: max, emit: emit}
+}
+
+func (l *lineBuffer) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch l.esc {
+		case 1:
+			l.param = l.param[:0]
+			if b == '[' || b == 'O' {
+				l.esc = 2
+			} else {
+				l.esc = 0
+			}
+			continue
+		case 2:
+			if b >= 0x40 && b <= 0x7e {
+				l.esc = 0
+				l.escape(b)
+			} else if len(l.param) < 8 {
+				l.param = append(l.param, b)
+			}
+			continue
+		}
+
+		switch b {
+		case 0x1b:
+			l.esc = 1
+		case '\r', '\n':
+			if len(l.buf) > 0 {
+				l.emit(string(l.buf), false)
+			}
+			l.reset()
+		case 0x7f, 0x08:
+			if l.pos > 0 {
+				_, size := utf8.DecodeLastRune(l.buf[:l.pos])
+				l.cut(l.pos-size, l.pos)
+			}
+		case 0x04: // Ctrl-D
+			l.deleteForward()
+		case 0x01: // Ctrl-A
+			l.pos = 0
+		case 0x05: // Ctrl-E
+			l.pos = len(l.buf)
+		case 0x02: // Ctrl-B
+			l.left()
+		case 0x06: // Ctrl-F
+			l.right()
+		case 0x0b: // Ctrl-K
+			l.buf = l.buf[:l.pos]
+		case 0x15: // Ctrl-U
+			l.cut(0, l.pos)
+		case 0x17: // Ctrl-W
+			i := l.pos
+			for i > 0 && l.buf[i-1] == ' ' {
+				i--
+			}
+			for i > 0 && l.buf[i-1] != ' ' {
+				i--
+			}
+			l.cut(i, l.pos)
+		case 0x03: // Ctrl-C
+			l.reset()
+		default:
+			if b < 0x20 {
+				continue
+			}
+			l.buf = append(l.buf, 0)
+			copy(l.buf[l.pos+1:], l.buf[l.pos:])
+			l.buf[l.pos] = b
+			l.pos++
+			if len(l.buf) >= l.max {
+				l.emit(string(l.buf)+truncatedMarker, true)
+				l.reset()
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// escape applies a CSI or SS3 sequence ending in final.
+func (l *lineBuffer) escape(final byte) {
+	switch final {
+	case 'D':
+		l.left()
+	case 'C':
+		l.right()
+	case 'H':
+		l.pos = 0
+	case 'F':
+		l.pos = len(l.buf)
+	case '~':
+		switch string(l.param) {
+		case "1", "7":
+			l.pos = 0
+		case "4", "8":
+			l.pos = len(l.buf)
+		case "3":
+			l.deleteForward()
+		}
+	}
+}
+
+func (l *lineBuffer) left() {
+	if l.pos > 0 {
+		_, size := utf8.DecodeLastRune(l.buf[:l.pos])
+		l.pos -= size
+	}
+}
+
+func (l *lineBuffer) right() {
+	if l.pos < len(l.buf) {
+		_, size := utf8.DecodeRune(l.buf[l.pos:])
+		l.pos += size
+	}
+}
+
+func (l *lineBuffer) deleteForward() {
+	if l.pos < len(l.buf) {
+		_, size := utf8.DecodeRune(l.buf[l.pos:])
+		l.cut(l.pos, l.pos+size)
+	}
+}
+
+// cut removes buf[i:j] and leaves the cursor at i.
+func (l *lineBuffer) cut(i, j int) {
+	l.buf = append(l.buf[:i], l.buf[j:]...)
+	l.pos = i
+}
+
+func (l *lineBuffer) reset() {
+	l.buf = l.buf[:0]
+	l.pos = 0
+}
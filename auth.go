@@ -0,0 +1,173 @@
+package webssh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Target is what an authorized request may open. Empty fields keep the
+// value from WebSSHConfig.
+type Target struct {
+	// Identity是通过鉴权的用户，用于日志和命名会话的Owner
+	Identity   string
+	RemoteAddr string
+	User       string
+	Command    string
+	// Env追加到TurnConfig.Env之后，Dir不为空时替换TurnConfig.Dir
+	Env []string
+	Dir string
+	// Charset不为空时替换TurnConfig.Charset
+	Charset string
+}
+
+// Authorizer decides, before the session is created, whether the upgrade
+// request r may open a session and on what.
+type Authorizer interface {
+	Authorize(r *http.Request) (*Target, error)
+}
+
+// AuthorizerFunc adapts a function to Authorizer.
+type AuthorizerFunc func(r *http.Request) (*Target, error)
+
+func (f AuthorizerFunc) Authorize(r *http.Request) (*Target, error) {
+	return f(r)
+}
+
+// JWTAuthorizer accepts HS256 JSON web tokens passed in the token query
+// parameter or an "Authorization: Bearer" header. The claims sub, host,
+// user and cmd fill the Target; exp and nbf are checked.
+type JWTAuthorizer struct {
+	Secret []byte
+	// QueryParam默认为token
+	QueryParam string
+	// Leeway是校验exp和nbf时允许的时钟误差
+	Leeway time.Duration
+}
+
+type jwtClaims struct {
+	Sub  string `json:"sub"`
+	Exp  int64  `json:"exp"`
+	Nbf  int64  `json:"nbf"`
+	Host string `json:"host"`
+	User string `json:"user"`
+	Cmd  string `json:"cmd"`
+}
+
+func (a *JWTAuthorizer) Authorize(r *http.Request) (*Target, error) {
+	param := a.QueryParam
+	if param == "" {
+		param = "token"
+	}
+	token := r.URL.Query().Get(param)
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	return &Target{Identity: claims.Sub, RemoteAddr: claims.Host, User: claims.User, Command: claims.Cmd}, nil
+}
+
+func (a *JWTAuthorizer) verify(token string) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jwt: malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// 只接受HS256，防止alg为none或者换成其他算法绕过校验
+	if header.Alg != "HS256" {
+		return nil, errors.New("jwt: unsupported alg " + header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("jwt: malformed signature")
+	}
+	mac := hmac.New(sha256.New, a.Secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("jwt: bad signature")
+	}
+	claims := new(jwtClaims)
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if claims.Exp != 0 && now.After(time.Unix(claims.Exp, 0).Add(a.Leeway)) {
+		return nil, errors.New("jwt: token expired")
+	}
+	if claims.Nbf != 0 && now.Add(a.Leeway).Before(time.Unix(claims.Nbf, 0)) {
+		return nil, errors.New("jwt: token not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errors.New("jwt: malformed token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("jwt: malformed token")
+	}
+	return nil
+}
+
+// authorize runs the configured Authorizer, if any.
+func (w *WebSSH) authorize(r *http.Request) (*Target, error) {
+	if w.Authorizer == nil {
+		return nil, nil
+	}
+	return w.Authorizer.Authorize(r)
+}
+
+// withTarget returns a copy of w that opens target instead of the
+// configured host and command.
+func (w WebSSH) withTarget(target *Target) WebSSH {
+	if target == nil {
+		return w
+	}
+	if target.Identity != "" {
+		w.logger().Info("authorized", "identity", target.Identity)
+	}
+	conf := *w.WebSSHConfig
+	if target.RemoteAddr != "" {
+		conf.RemoteAddr = target.RemoteAddr
+	}
+	if target.User != "" {
+		conf.User = target.User
+	}
+	if target.Command != "" {
+		conf.Command = target.Command
+	}
+	if len(target.Env) > 0 {
+		conf.Env = append(conf.Env[:len(conf.Env):len(conf.Env)], target.Env...)
+	}
+	if target.Dir != "" {
+		conf.Dir = target.Dir
+	}
+	if target.Charset != "" {
+		conf.Charset = target.Charset
+	}
+	conf.Owner = target.Identity
+	w.WebSSHConfig = &conf
+	// 预先建立的shell连的是默认主机
+	w.pool = nil
+	return w
+}
@@ -0,0 +1,93 @@
+package webssh
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/ssh"
+)
+
+// Backend is the process a Turn is connected to: a shell on a remote ssh
+// server, a local command on a pty, and so on. Output of the process is
+// written to the io.Writer passed to the StartFunc that created it.
+type Backend interface {
+	// Write sends input to the process.
+	io.Writer
+	Resize(rows, cols int) error
+	// Wait blocks until the process has exited and its output is drained.
+	Wait() error
+	Close() error
+}
+
+// StartFunc starts a Backend with a terminal of the given type and size,
+// writing its output to out.
+type StartFunc func(out io.Writer, term string, rows, cols int) (Backend, error)
+
+// 可选接口，Backend支持时才能使用对应的功能
+type signaler interface {
+	Signal(sig ssh.Signal) error
+}
+
+// Suspend和Resume用，Stop返回nil时进程组已经停下
+type stopper interface {
+	Stop() error
+	Continue() error
+}
+
+type ttyNamer interface {
+	TTYName() string
+}
+
+// 本机会话的进程号，见Turn.Stats
+type pider interface {
+	PID() int
+}
+
+// ExitError is returned by Backend.Wait when the process exited with a
+// non-zero status or was killed by a signal. The ssh backend returns
+// *ssh.ExitError instead.
+type ExitError struct {
+	Code   int
+	Signal string
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("process killed by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("process exited with status %d", e.Code)
+}
+
+// NewBackendTurn creates a Turn connected to the backend started by start.
+func NewBackendTurn(wsConn *websocket.Conn, start StartFunc, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	turn := newTurn(wsConn, conf)
+	if err := turn.setCharset(conf.Charset); err != nil {
+		turn.cancel()
+		turn.endSessionSpan(err)
+		return nil, err
+	}
+	turn.Recorder = rec
+	if conf.Banner != "" {
+		turn.showBanner()
+	}
+	rows, cols := turn.initialSize()
+	span := turn.startSpan("webssh.start", attribute.String("webssh.command", conf.Command))
+	backend, err := start(turn, turn.term(), rows, cols)
+	endSpan(span, err)
+	if err != nil {
+		turn.cancel()
+		turn.endSessionSpan(err)
+		return nil, err
+	}
+	turn.backend = backend
+	if n, ok := backend.(ttyNamer); ok {
+		turn.ttyName = n.TTYName()
+	}
+
+	if wsConn != nil {
+		turn.waitInitialSize()
+	}
+	return turn, nil
+}
@@ -0,0 +1,65 @@
+package webssh
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// BannerData is passed to the Banner template.
+type BannerData struct {
+	SessionID string
+	Owner     string
+	// User和Host是登录的用户和目标主机，见TurnConfig.BannerUser
+	User   string
+	Host   string
+	Policy string
+	Time   string
+}
+
+// showBanner writes the Banner before the first output of the session and,
+// with BannerAck, holds the output back until the user presses a key.
+func (t *Turn) showBanner() {
+	tmpl, err := template.New("banner").Parse(t.Banner)
+	if err != nil {
+		t.logger().Error("banner template", "err", err)
+		return
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, BannerData{
+		SessionID: t.ID,
+		Owner:     t.Owner,
+		User:      t.BannerUser,
+		Host:      t.BannerHost,
+		Policy:    t.BannerPolicy,
+		Time:      time.Now().Format("2006-01-02 15:04:05"),
+	})
+	if err != nil {
+		t.logger().Error("banner template", "err", err)
+		return
+	}
+	// 模板里的换行在终端上要回到行首
+	text := strings.ReplaceAll(strings.ReplaceAll(buf.String(), "\r\n", "\n"), "\n", "\r\n")
+	if !strings.HasSuffix(text, "\r\n") {
+		text += "\r\n"
+	}
+	if t.BannerAck {
+		text += "[press any key to continue]\r\n"
+		t.bannerPending.Store(true)
+		t.flow.set(flowBanner, true)
+	}
+	t.writeOutput([]byte(text))
+}
+
+// ackBanner takes the key that acknowledges the banner and lets the output
+// through. It reports whether the input was used for that.
+func (t *Turn) ackBanner() bool {
+	if !t.bannerPending.CompareAndSwap(true, false) {
+		return false
+	}
+	t.logger().Info("banner acknowledged", "event", "banner_ack")
+	t.auditEvent("banner_ack", "")
+	t.flow.set(flowBanner, false)
+	return true
+}
@@ -0,0 +1,131 @@
+// recconv converts recordings between asciicast (the format of webssh),
+// ttyrec and asciicast v1, e.g. to migrate archives or play them with
+// standard players:
+//
+//	recconv -to ttyrec session.cast session.ttyrec
+//	recconv -to asciicast -size 120x40 old.ttyrec old.cast
+//	recconv -to ttyrec -key $(cat rec.key) encrypted.cast - | ttyplay
+//
+// It also renders them for incident reports, as an animated GIF or as a
+// directory of PNG frames for ffmpeg:
+//
+//	recconv -to gif -start 12 -end 40 session.cast clip.gif
+//	recconv -to png -fps 25 session.cast frames/
+//	ffmpeg -framerate 25 -i frames/frame-%05d.png -pix_fmt yuv420p clip.mp4
+//
+// "-" stands for stdin or stdout. -key is the hex AES key of recordings
+// written with RecKeys: webssh.StaticKey.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/widaT/webssh"
+	"github.com/widaT/webssh/render"
+)
+
+func main() {
+	from := flag.String("from", "", "input format: asciicast or ttyrec, detected when empty")
+	to := flag.String("to", "asciicast", "output format: asciicast, ttyrec, gif, or png for a directory of frames")
+	size := flag.String("size", "", "terminal size COLSxROWS of the output, ttyrec has none")
+	key := flag.String("key", "", "hex AES key of an encrypted recording")
+	var opts render.Options
+	flag.IntVar(&opts.FPS, "fps", 10, "frames per second of gif and png")
+	flag.Float64Var(&opts.Speed, "speed", 1, "playback speed of gif and png")
+	flag.DurationVar(&opts.MaxIdle, "max-idle", 2*time.Second, "longest pause kept in gif and png, 0 keeps all")
+	flag.Float64Var(&opts.Start, "start", 0, "seconds into the recording where gif and png start")
+	flag.Float64Var(&opts.End, "end", 0, "seconds into the recording where gif and png end, 0 for the end")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] input output\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	inFormat, err := webssh.ParseRecFormat(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// gif和png不是录像格式，单独处理
+	toImage := *to == "gif" || *to == "png"
+	outFormat, err := webssh.ParseRecFormat(*to)
+	if !toImage && (err != nil || outFormat == "") {
+		log.Fatalf("invalid output format %q", *to)
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = -1
+	}
+
+	in, err := open(flag.Arg(0), *key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	header, events, err := webssh.ReadRecordingAs(in, inFormat)
+	if err != nil {
+		log.Fatalf("read %s err:%s", flag.Arg(0), err)
+	}
+	if *size != "" {
+		if _, err := fmt.Sscanf(*size, "%dx%d", &header.Width, &header.Height); err != nil {
+			log.Fatalf("invalid size %q", *size)
+		}
+	}
+
+	if *to == "png" {
+		n, err := render.PNGFrames(flag.Arg(1), header, events, opts)
+		if err != nil {
+			log.Fatalf("write %s err:%s", flag.Arg(1), err)
+		}
+		log.Printf("wrote %d frames to %s", n, flag.Arg(1))
+		return
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if flag.Arg(1) != "-" {
+		if out, err = os.Create(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch {
+	case toImage:
+		err = render.GIF(out, header, events, opts)
+	case outFormat == webssh.FormatTtyrec:
+		err = webssh.WriteTtyrec(out, header, events)
+	default:
+		err = webssh.WriteAsciicast(out, header, events)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("write %s err:%s", flag.Arg(1), err)
+	}
+}
+
+func open(name, key string) (io.ReadCloser, error) {
+	if key == "" {
+		if name == "-" {
+			return io.NopCloser(os.Stdin), nil
+		}
+		return os.Open(name)
+	}
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key err:%s", err)
+	}
+	// 加密录像通过EncryptedStorage读出来
+	s := &webssh.EncryptedStorage{
+		Storage: &webssh.LocalStorage{Dir: filepath.Dir(name)},
+		Keys:    webssh.StaticKey(k),
+	}
+	return s.Open(filepath.Base(name))
+}
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/widaT/webssh"
 )
 
@@ -24,17 +34,51 @@ func main() {
 		User:       "wida",
 		Password:   "wida",
 		AuthModel:  webssh.PASSWORD,
+		// 第一次连接时记住主机公钥，之后公钥变化会拒绝连接
+		KnownHostsFile:  "./known_hosts",
+		TrustOnFirstUse: true,
 	}
 
 	handle := webssh.NewWebSSH(confing)
+	if err := handle.Sessions.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		log.Fatal(err)
+	}
+	// 清理没有正常释放的会话和进程
+	handle.Sessions.StartReaper(context.Background(), time.Minute, 0)
 
 	r.GET("/ws/:id", handle.ServeConn)
+	r.POST("/ws/:id", handle.ServeConn) //websocket不通时的SSE连接在这里发送输入
+	r.GET("/ws/:id/attach", handle.ServeAttach)
+	r.GET("/ws/:id/x11", handle.ServeX11)
+	r.GET("/mux", handle.ServeMux) //一个连接上开多个终端
+	r.GET("/handoff", handle.ServeHandoff)
+	r.GET("/reattach", handle.ServeReattach)
 	r.GET("/recoder", handle.RecoderList)
+	r.GET("/sessions", handle.SessionList)        //在线会话列表
+	r.DELETE("/sessions/:id", handle.KillSession) //强制结束会话
+	r.GET("/replay/:name", handle.ServeReplay)    //按原始时间回放，支持暂停、变速和跳转
+	r.GET("/replay/:name/markers", handle.RecordingMarkers)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 	r.Static("/static", "./front/dist/")
 	r.Static("/rec", "./rec/") //录像回看目录
 	r.LoadHTMLFiles("./front/dist/index.html")
 	r.GET("/", func(c *gin.Context) {
 		c.HTML(200, "index.html", nil)
 	})
-	r.Run(":8080")
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// 收到退出信号后先让会话里的进程正常退出
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	handle.Shutdown(ctx)
+	srv.Shutdown(ctx)
 }
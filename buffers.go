@@ -0,0 +1,106 @@
+package webssh
+
+import (
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// 和io.Copy默认的缓冲一样大
+	defaultReadBufferSize = 32 * 1024
+	defaultWSReadBuffer   = 1024
+	defaultWSWriteBuffer  = 10 * 1024
+)
+
+// 按大小分开的缓冲池，值是*sync.Pool
+var (
+	bufPools     sync.Map
+	wsWritePools sync.Map
+)
+
+// getBuffer returns a buffer of size bytes from the pool for that size; it
+// goes back with putBuffer.
+func getBuffer(size int) *[]byte {
+	p, ok := bufPools.Load(size)
+	if !ok {
+		p, _ = bufPools.LoadOrStore(size, &sync.Pool{New: func() any {
+			b := make([]byte, size)
+			return &b
+		}})
+	}
+	return p.(*sync.Pool).Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if p, ok := bufPools.Load(len(*b)); ok {
+		p.(*sync.Pool).Put(b)
+	}
+}
+
+// wsWritePool is the websocket write buffer pool for buffers of size bytes;
+// gorilla wants one pool per size. A connection only holds a buffer while
+// it writes a message, so idle terminals hold none.
+func wsWritePool(size int) websocket.BufferPool {
+	p, ok := wsWritePools.Load(size)
+	if !ok {
+		p, _ = wsWritePools.LoadOrStore(size, &sync.Pool{})
+	}
+	return p.(*sync.Pool)
+}
+
+// newUpgrader is the upgrader with the buffer sizes of c.
+func (c *WebSSHConfig) newUpgrader() websocket.Upgrader {
+	u := upgrader
+	if c.WSReadBufferSize > 0 {
+		u.ReadBufferSize = c.WSReadBufferSize
+	}
+	if c.WSWriteBufferSize > 0 {
+		u.WriteBufferSize = c.WSWriteBufferSize
+	}
+	u.WriteBufferPool = wsWritePool(u.WriteBufferSize)
+	// ttyd、Guacamole和noVNC的客户端各自要求自己的子协议，v2的客户端用子协议协商版本
+	u.Subprotocols = []string{ProtocolV2, ProtocolTTY, ProtocolGuacamole, ProtocolBinary}
+	return u
+}
+
+func (c *TurnConfig) readBufferSize() int {
+	if c.ReadBufferSize > 0 {
+		return c.ReadBufferSize
+	}
+	return defaultReadBufferSize
+}
+
+// ReadFrom writes what r returns to the session, see Write, through a
+// pooled buffer of ReadBufferSize bytes. Backends copying their output
+// with io.Copy end up here.
+func (t *Turn) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := getBuffer(t.readBufferSize())
+	defer putBuffer(buf)
+	for {
+		m, rerr := r.Read(*buf)
+		if m > 0 {
+			w, werr := t.Write((*buf)[:m])
+			n += int64(w)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// outputBuffer is a pooled buffer for a backend reading the output it
+// writes to out: of ReadBufferSize if out is a Turn.
+func outputBuffer(out io.Writer) *[]byte {
+	if t, ok := out.(*Turn); ok {
+		return getBuffer(t.readBufferSize())
+	}
+	return getBuffer(defaultReadBufferSize)
+}
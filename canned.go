@@ -0,0 +1,49 @@
+package webssh
+
+import (
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// NewCannedTurn creates a Turn whose output is replayed from a recording
+// instead of coming from a remote shell. Resizes from the viewer are accepted
+// and input is dropped, or echoed back when CannedEcho is set. The turn ends
+// when the recording has been played.
+func NewCannedTurn(wsConn *websocket.Conn, r io.Reader, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	header, events, err := ReadRecording(r)
+	if err != nil {
+		return nil, err
+	}
+
+	turn := newTurn(wsConn, conf)
+	turn.cannedDone = make(chan struct{})
+
+	turn.Recorder = rec
+	turn.setInitialSize(header.Height, header.Width)
+
+	go turn.playCanned(events)
+	return turn, nil
+}
+
+func (t *Turn) playCanned(events []RecEvent) {
+	defer close(t.cannedDone)
+	start := time.Now()
+	for _, e := range events {
+		if e.Type != OutPutType {
+			continue
+		}
+		wait := time.Duration(e.Time*float64(time.Second)) - time.Since(start)
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if _, err := t.Write([]byte(e.Data)); err != nil {
+			return
+		}
+	}
+}
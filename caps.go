@@ -0,0 +1,133 @@
+package webssh
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgHello is sent by the client to announce the capabilities it supports;
+// the server answers with the ones it enabled. Both directions carry
+// {"caps": [...]}. When ResumeGrace is set, or the session is named, the
+// reply also carries the session id to reattach with.
+const MsgHello = wire.MsgHello
+
+const (
+	CapGzip = wire.CapGzip
+	// CapBinary lets the client send BinaryMessage frames whose payload
+	// follows the type byte as is, without base64. TextMessage frames keep
+	// the base64 encoding.
+	CapBinary = wire.CapBinary
+)
+
+// 协商gzip之后每个数据帧第一个字节是标记
+const (
+	frameRaw  = wire.OutputRaw
+	frameGzip = wire.OutputGzip
+)
+
+const defaultCompressThreshold = 512
+
+type helloMsg = wire.Hello
+
+var gzipPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func (t *Turn) negotiate(hello helloMsg) error {
+	var enabled []string
+	for _, c := range hello.Caps {
+		switch c {
+		case CapGzip:
+			// permessage-deflate已经压缩过了
+			if t.Compression && !t.Deflate {
+				enabled = append(enabled, c)
+			}
+		case CapBinary:
+			if !t.Base64Only {
+				enabled = append(enabled, c)
+			}
+		}
+	}
+	reply := helloMsg{Caps: enabled}
+	if t.ResumeGrace > 0 || t.Name != "" {
+		reply.Session = t.ID
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	// 回复和切换帧格式在同一把锁里完成，回复之后的数据帧都是新格式
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	if err := t.writeControlLocked(MsgHello, b); err != nil {
+		return err
+	}
+	for _, c := range enabled {
+		switch c {
+		case CapGzip:
+			t.gzipOn.Store(true)
+		case CapBinary:
+			t.binaryIn.Store(true)
+		}
+	}
+	return nil
+}
+
+// writeTagged writes p with a frame tag, compressed if it is large enough.
+// It returns len(p) on success.
+func (t *Turn) writeTagged(w io.Writer, p []byte) (int, error) {
+	threshold := t.CompressThreshold
+	if threshold <= 0 {
+		threshold = defaultCompressThreshold
+	}
+	if len(p) < threshold {
+		if _, err := w.Write([]byte{frameRaw}); err != nil {
+			return 0, err
+		}
+		return w.Write(p)
+	}
+
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+	buf.WriteByte(frameGzip)
+	zw := gzipPool.Get().(*gzip.Writer)
+	zw.Reset(buf)
+	zw.Write(p)
+	zw.Close()
+	gzipPool.Put(zw)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *TurnConfig) newParser() *wire.Parser {
+	return wire.NewParser(wire.Config{MaxMessageSize: c.MaxMessageSize, FailSafe: c.FailSafe})
+}
+
+// parse parses a client message read as a whole.
+func (t *Turn) parse(msgType int, wsData []byte) (wire.Message, error) {
+	return t.parser.Parse(msgType, wsData, t.binaryIn.Load())
+}
+
+// readMessage reads the next client message from conn. binary tells
+// whether conn negotiated CapBinary: binaryIn for the owner connection,
+// false for attached ones, which cannot negotiate. A message that could not
+// be parsed is dropped with an error for which wire.Malformed is true,
+// other errors are those of conn.
+func (t *Turn) readMessage(conn *websocket.Conn, binary bool) (wire.Message, error) {
+	msgType, r, err := conn.NextReader()
+	if err != nil {
+		return wire.Message{}, err
+	}
+	return t.parser.Read(msgType, r, binary)
+}
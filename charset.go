@@ -0,0 +1,42 @@
+package webssh
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// charsetEncoding looks up a charset by its WHATWG name or label, e.g.
+// gbk, gb18030, big5, euc-jp, shift_jis or euc-kr. UTF-8 needs no
+// transcoding and returns nil.
+func charsetEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown charset %s", name)
+	}
+	return enc, nil
+}
+
+// setCharset makes the turn decode output from charset to UTF-8 before
+// everything else, and encode input to charset right before it is written
+// to the pty, so recordings, audit logs and hooks all see UTF-8.
+func (t *Turn) setCharset(charset string) error {
+	enc, err := charsetEncoding(charset)
+	if err != nil || enc == nil {
+		return err
+	}
+	decoder := func() transform.Transformer { return enc.NewDecoder() }
+	// 解码器自己会留下不完整的字符
+	t.runes = nil
+	t.outTr = newStream(t.outputTransformers(decoder))
+	// 远端字符集里没有的字符换成替代字符，不中断输入
+	t.encIn = &stream{t: encoding.ReplaceUnsupported(enc.NewEncoder())}
+	return nil
+}
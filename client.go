@@ -0,0 +1,265 @@
+package webssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// Role is the part a connection plays in a session.
+type Role int
+
+const (
+	// RoleOwner may type and resize the terminal.
+	RoleOwner Role = iota
+	// RoleViewer only receives output.
+	RoleViewer
+)
+
+func (r Role) String() string {
+	if r == RoleOwner {
+		return "owner"
+	}
+	return "viewer"
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// MsgViewers is sent to the owner whenever a connection attaches to or
+// leaves the session, with {"viewers": [ClientInfo...]}.
+const MsgViewers = 'f'
+
+const defaultClientQueueSize = 256
+
+var ErrTooManyViewers = errors.New("too many viewers")
+
+// ClientInfo describes a connection attached to a session.
+type ClientInfo struct {
+	// ID用于MsgControl中指定把写令牌交给谁
+	ID     string    `json:"id"`
+	Role   Role      `json:"role"`
+	Remote string    `json:"remote"`
+	Since  time.Time `json:"since"`
+}
+
+type viewersMsg struct {
+	Viewers []ClientInfo `json:"viewers"`
+}
+
+type client struct {
+	ClientInfo
+	conn *websocket.Conn
+	out  *outputQueue
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *client) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *client) loopWrite(t *Turn) {
+	co := newCoalescer(t.CoalesceDelay, t.CoalesceSize)
+	var next *frame
+	for {
+		var f frame
+		if next != nil {
+			f, next = *next, nil
+		} else {
+			select {
+			case <-c.done:
+				return
+			case f = <-c.out.ch:
+				c.out.taken(f)
+			}
+		}
+		if !t.transferring() {
+			f, next = co.next(c.out, f)
+		}
+		if !c.write(t, f) {
+			return
+		}
+	}
+}
+
+// write sends f and reports whether the connection is still usable.
+func (c *client) write(t *Turn, f frame) bool {
+	defer f.release()
+	if f.msgType == websocket.CloseMessage {
+		// 会话已经结束，前面排队的输出都写完了
+		c.conn.WriteControl(f.msgType, f.p, time.Now().Add(time.Second))
+		c.close()
+		return false
+	}
+	if err := c.conn.WriteMessage(f.msgType, f.p); err != nil {
+		t.countWSError()
+		c.close()
+		return false
+	}
+	return true
+}
+
+// Attach adds another connection to the session and serves it until the
+// connection or the session is closed. The connection gets the session's
+// output from now on; what it may send depends on role. Messages answered
+// on the connection the session was started with, such as MsgHello and
+// MsgFile, are ignored: the connection keeps the plain framing.
+func (t *Turn) Attach(wsConn *websocket.Conn, role Role) error {
+	return t.attach(wsConn, role, wsConn.RemoteAddr().String(), nil)
+}
+
+// attach registers the connection and serves it. If snapshot is given it is
+// called while output is held back and its result is sent before any new
+// output, so the client sees a gapless stream.
+func (t *Turn) attach(wsConn *websocket.Conn, role Role, remote string, snapshot func() []byte) error {
+	size := t.ClientQueueSize
+	if size <= 0 {
+		size = defaultClientQueueSize
+	}
+	policy := t.ClientOverflowPolicy
+	if policy == OverflowBlock {
+		policy = OverflowDropOldest
+	}
+	c := &client{
+		ClientInfo: ClientInfo{ID: newSessionID(), Role: role, Remote: remote, Since: time.Now()},
+		conn:       wsConn,
+		done:       make(chan struct{}),
+	}
+	c.out = newOutputQueue(size, policy, c.done)
+
+	t.clientsMu.Lock()
+	if t.ctx.Err() != nil {
+		t.clientsMu.Unlock()
+		return errors.New("session closed")
+	}
+	if role == RoleViewer && t.MaxViewers > 0 && t.viewerCount() >= t.MaxViewers {
+		t.clientsMu.Unlock()
+		return ErrTooManyViewers
+	}
+	if snapshot != nil {
+		if p := snapshot(); len(p) > 0 {
+			c.out.Push(p)
+		}
+	}
+	if t.clients == nil {
+		t.clients = make(map[*client]struct{})
+	}
+	t.clients[c] = struct{}{}
+	t.clientsMu.Unlock()
+	t.notifyViewers()
+
+	defer func() {
+		t.clientsMu.Lock()
+		delete(t.clients, c)
+		held := t.writer == c
+		t.clientsMu.Unlock()
+		c.close()
+		if held {
+			t.Revoke()
+		}
+		t.notifyViewers()
+	}()
+
+	go c.loopWrite(t)
+	for {
+		m, err := t.readMessage(wsConn, false)
+		if err != nil && !wire.Malformed(err) {
+			return fmt.Errorf("reading webSocket message err:%s", err)
+		}
+		if err == nil {
+			switch m.Type {
+			case MsgControl:
+				var msg controlMsg
+				if err := json.Unmarshal(m.Payload, &msg); err != nil {
+					if err := t.protocolViolation(c.Role, m.Type, fmt.Errorf("control message err:%s", err)); err != nil {
+						return err
+					}
+					continue
+				}
+				t.handleControl(c, msg)
+				continue
+			case MsgHello, MsgHandoff, MsgFile, MsgForward, MsgSearch, MsgLatency, MsgZmodem, MsgTrzsz:
+				// 回复和协商结果都只对会话的主连接有效
+				continue
+			case MsgData, MsgPaste:
+				if t.isWriter(c) {
+					if err := t.handleWriterInput(t.ctx, m); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+		}
+		if err := t.handleParsed(t.ctx, c.Role, m, err, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// broadcast queues p for every attached connection and keeps it in the
+// scrollback of the session and of pending join requests.
+func (t *Turn) broadcast(p []byte) {
+	t.clientsMu.RLock()
+	defer t.clientsMu.RUnlock()
+	if t.scrollback != nil {
+		t.scrollback.Write(p)
+	}
+	for _, req := range t.joins {
+		if req.buf != nil {
+			req.buf.Write(p)
+		}
+	}
+	for c := range t.clients {
+		if err := c.out.Push(p); err != nil {
+			c.close()
+		}
+	}
+}
+
+func (t *Turn) closeClients() {
+	t.clientsMu.Lock()
+	defer t.clientsMu.Unlock()
+	for c := range t.clients {
+		c.close()
+	}
+}
+
+// Clients returns the connections attached to the session besides the one
+// it was started with.
+func (t *Turn) Clients() []ClientInfo {
+	t.clientsMu.RLock()
+	defer t.clientsMu.RUnlock()
+	infos := make([]ClientInfo, 0, len(t.clients))
+	for c := range t.clients {
+		infos = append(infos, c.ClientInfo)
+	}
+	return infos
+}
+
+// viewerCount must be called with clientsMu held.
+func (t *Turn) viewerCount() int {
+	n := 0
+	for c := range t.clients {
+		if c.Role == RoleViewer {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *Turn) notifyViewers() {
+	if t.ctx.Err() != nil {
+		return
+	}
+	t.writeControl(MsgViewers, viewersMsg{Viewers: t.Clients()})
+}
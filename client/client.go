@@ -0,0 +1,716 @@
+// Package client drives webssh sessions from Go, for programs that run
+// commands through the gateway and for tests of the server. It speaks the
+// native message protocol: it sends input and window sizes, reads the
+// output, answers latency probes and keyboard-interactive prompts,
+// transfers files and reports the other control messages as events.
+//
+//	c, err := client.Dial(ctx, "ws://localhost:8080/ws/1", &client.Options{Rows: 24, Cols: 80})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	go io.Copy(os.Stdout, c)
+//	c.Write([]byte("uname -a\rexit\r"))
+//	status, err := c.Wait()
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// 上传时每个消息携带的字节数，和服务端下载的一样
+const chunkSize = 32 * 1024
+
+var (
+	// ErrClosed is returned by calls on a client whose connection ended.
+	ErrClosed = errors.New("webssh client: connection closed")
+	errBusy   = errors.New("webssh client: a handoff request is already pending")
+)
+
+// Options configures Dial. The zero value works.
+type Options struct {
+	// Header随握手请求发送，比如Authorization
+	Header http.Header
+	// Dialer为空时使用websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	// Rows和Cols是初始终端大小，作为?rows=&cols=放在url里
+	Rows, Cols int
+	// NoGzip和NoBinary时不协商对应的能力，见wire.CapGzip和wire.CapBinary
+	NoGzip   bool
+	NoBinary bool
+	// Output不为空时输出写到这里，否则从Client.Read读；两者都不读的话读循环会阻塞
+	Output io.Writer
+	// OnEvent在读循环里收到控制消息时调用，不能阻塞太久
+	OnEvent func(Event)
+	// Prompt回答keyboard-interactive的问题，为空时问题只作为事件上报
+	Prompt func(instruction string, questions []Question) ([]string, error)
+}
+
+// Event is a control message of the server. Replies to requests of the
+// client, such as file transfers and searches, go to the request instead.
+type Event struct {
+	Type byte
+	Data json.RawMessage
+}
+
+// Decode decodes the data of the event into v, e.g. a wire.ErrorMsg for
+// wire.MsgError.
+func (e Event) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// Question is a keyboard-interactive question.
+type Question = wire.Question
+
+// ExitStatus is how the remote command ended.
+type ExitStatus = wire.ExitStatus
+
+// ServerError is an error the server sent before closing the connection.
+type ServerError struct {
+	wire.ErrorMsg
+}
+
+func (e *ServerError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("webssh: %s: %s", e.Code, e.Message)
+	}
+	return "webssh: " + e.Code
+}
+
+// FileInfo describes a file of the session host.
+type FileInfo = wire.FileInfo
+
+// Handoff is a token another connection redeems to take over the session.
+type Handoff = wire.Handoff
+
+// Client is a connection to a webssh session.
+type Client struct {
+	conn *websocket.Conn
+	opts Options
+
+	wmu    sync.Mutex
+	binary atomic.Bool
+	gzip   atomic.Bool
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	mu       sync.Mutex
+	nextID   int
+	files    map[string]*fileWait
+	searches map[int]chan wire.SearchResult
+	pings    map[int]chan struct{}
+	handoff  chan Handoff
+	session  string
+	exit     *ExitStatus
+	err      error
+
+	done chan struct{}
+}
+
+// Dial opens a session at rawURL, a ws:// or wss:// URL of ServeConn or
+// Handler, and negotiates the capabilities of opts.
+func Dial(ctx context.Context, rawURL string, opts *Options) (*Client, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Rows > 0 && opts.Cols > 0 {
+		q := u.Query()
+		q.Set("rows", strconv.Itoa(opts.Rows))
+		q.Set("cols", strconv.Itoa(opts.Cols))
+		u.RawQuery = q.Encode()
+	}
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.DialContext(ctx, u.String(), opts.Header)
+	if err != nil {
+		return nil, err
+	}
+	c := New(conn, opts)
+	var caps []string
+	if !opts.NoGzip {
+		caps = append(caps, wire.CapGzip)
+	}
+	if !opts.NoBinary {
+		caps = append(caps, wire.CapBinary)
+	}
+	if len(caps) > 0 {
+		if err := c.send(wire.MsgHello, wire.Hello{Caps: caps}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// New runs a client on a connection that is already open. Nothing is
+// negotiated.
+func New(conn *websocket.Conn, opts *Options) *Client {
+	if opts == nil {
+		opts = &Options{}
+	}
+	c := &Client{
+		conn:     conn,
+		opts:     *opts,
+		files:    make(map[string]*fileWait),
+		searches: make(map[int]chan wire.SearchResult),
+		pings:    make(map[int]chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if c.opts.Output == nil {
+		c.pr, c.pw = io.Pipe()
+	}
+	go c.loopRead()
+	return c
+}
+
+// Read reads the output of the session, unless Options.Output is set. It
+// returns io.EOF once the connection ended.
+func (c *Client) Read(p []byte) (int, error) {
+	if c.pr == nil {
+		return 0, errors.New("webssh client: output goes to Options.Output")
+	}
+	return c.pr.Read(p)
+}
+
+// Write sends p as input, as if typed.
+func (c *Client) Write(p []byte) (int, error) {
+	if err := c.sendRaw(wire.MsgData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Paste sends text as a paste, see wire.MsgPaste.
+func (c *Client) Paste(text string) error {
+	return c.sendRaw(wire.MsgPaste, []byte(text))
+}
+
+// Resize changes the size of the terminal.
+func (c *Client) Resize(rows, cols int) error {
+	return c.send(wire.MsgResize, wire.Resize{Rows: rows, Columns: cols})
+}
+
+// PauseOutput asks the server to stop sending output, see wire.MsgFlow.
+func (c *Client) PauseOutput() error {
+	return c.send(wire.MsgFlow, wire.Flow{Pause: true})
+}
+
+// ResumeOutput undoes PauseOutput.
+func (c *Client) ResumeOutput() error {
+	return c.send(wire.MsgFlow, wire.Flow{Pause: false})
+}
+
+// Detach leaves a named session running and ends the connection.
+func (c *Client) Detach() error {
+	return c.send(wire.MsgDetach, struct{}{})
+}
+
+// Marker adds a marker with label to the recording.
+func (c *Client) Marker(label string) error {
+	return c.send(wire.MsgMarker, map[string]string{"label": label})
+}
+
+// SessionID is the id the server gave in its hello reply, to reattach
+// with. It is empty until then, or if the session cannot be reattached.
+func (c *Client) SessionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// Done is closed when the connection ended.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Wait waits for the connection to end and returns how the remote command
+// exited. The error is a *ServerError if the server closed the session
+// with one.
+func (c *Client) Wait() (ExitStatus, error) {
+	<-c.done
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.exit != nil {
+		return *c.exit, nil
+	}
+	if c.err != nil {
+		return ExitStatus{Code: -1}, c.err
+	}
+	return ExitStatus{Code: -1}, ErrClosed
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	c.wmu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.wmu.Unlock()
+	return c.conn.Close()
+}
+
+// send sends a control message with v as json.
+func (c *Client) send(typ byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.sendRaw(typ, b)
+}
+
+// sendRaw sends a message with payload p, as is once the server agreed to
+// binary messages, base64 encoded before.
+func (c *Client) sendRaw(typ byte, p []byte) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.binary.Load() {
+		msg := make([]byte, 1+len(p))
+		msg[0] = typ
+		copy(msg[1:], p)
+		return c.conn.WriteMessage(websocket.BinaryMessage, msg)
+	}
+	msg := make([]byte, 1+base64.StdEncoding.EncodedLen(len(p)))
+	msg[0] = typ
+	base64.StdEncoding.Encode(msg[1:], p)
+	return c.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (c *Client) loopRead() {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		if c.err == nil && c.exit == nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) || ce.Code != websocket.CloseNormalClosure {
+				c.err = err
+			}
+		}
+		c.mu.Unlock()
+		if c.pw != nil {
+			c.pw.Close()
+		}
+		close(c.done)
+		c.conn.Close()
+	}()
+	for {
+		var msgType int
+		var p []byte
+		msgType, p, err = c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType == websocket.BinaryMessage {
+			if err = c.output(p); err != nil {
+				return
+			}
+			continue
+		}
+		if len(p) == 0 {
+			continue
+		}
+		body, derr := base64.StdEncoding.DecodeString(string(p[1:]))
+		if derr != nil {
+			continue
+		}
+		c.control(p[0], body)
+	}
+}
+
+// output writes a data frame to the output.
+func (c *Client) output(p []byte) error {
+	if c.gzip.Load() && len(p) > 0 {
+		tag := p[0]
+		p = p[1:]
+		if tag == wire.OutputGzip {
+			zr, err := gzip.NewReader(bytes.NewReader(p))
+			if err != nil {
+				return err
+			}
+			if p, err = io.ReadAll(zr); err != nil {
+				return err
+			}
+		}
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	w := c.opts.Output
+	if w == nil {
+		w = c.pw
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// control handles a control message of the server.
+func (c *Client) control(typ byte, body []byte) {
+	switch typ {
+	case wire.MsgHello:
+		var hello wire.Hello
+		if json.Unmarshal(body, &hello) == nil {
+			for _, name := range hello.Caps {
+				switch name {
+				case wire.CapGzip:
+					c.gzip.Store(true)
+				case wire.CapBinary:
+					c.binary.Store(true)
+				}
+			}
+			c.mu.Lock()
+			c.session = hello.Session
+			c.mu.Unlock()
+		}
+	case wire.MsgExit:
+		var status ExitStatus
+		if json.Unmarshal(body, &status) == nil {
+			c.mu.Lock()
+			c.exit = &status
+			c.mu.Unlock()
+		}
+	case wire.MsgError:
+		var e wire.ErrorMsg
+		if json.Unmarshal(body, &e) == nil {
+			c.mu.Lock()
+			c.err = &ServerError{e}
+			c.mu.Unlock()
+		}
+	case wire.MsgFile:
+		var reply wire.FileReply
+		if json.Unmarshal(body, &reply) == nil {
+			c.mu.Lock()
+			w := c.files[reply.ID]
+			c.mu.Unlock()
+			if w != nil {
+				// 请求方已经放弃的话丢掉
+				select {
+				case w.ch <- reply:
+				case <-w.stop:
+				}
+				return
+			}
+		}
+	case wire.MsgSearch:
+		var res wire.SearchResult
+		if json.Unmarshal(body, &res) == nil {
+			c.mu.Lock()
+			ch := c.searches[res.ID]
+			delete(c.searches, res.ID)
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- res
+				return
+			}
+		}
+	case wire.MsgLatency:
+		var msg wire.Latency
+		if json.Unmarshal(body, &msg) == nil {
+			if msg.Seq != 0 {
+				// 服务端的探测，原样发回
+				c.sendRaw(wire.MsgLatency, body)
+				return
+			}
+			if msg.Pong {
+				c.mu.Lock()
+				ch := c.pings[msg.ID]
+				delete(c.pings, msg.ID)
+				c.mu.Unlock()
+				if ch != nil {
+					close(ch)
+					return
+				}
+			}
+		}
+	case wire.MsgHandoff:
+		var tok Handoff
+		if json.Unmarshal(body, &tok) == nil {
+			c.mu.Lock()
+			ch := c.handoff
+			c.handoff = nil
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- tok
+				return
+			}
+		}
+	case wire.MsgPrompt:
+		if c.opts.Prompt != nil {
+			var msg wire.Prompt
+			if json.Unmarshal(body, &msg) == nil {
+				go c.answer(msg.Instruction, msg.Questions)
+				return
+			}
+		}
+	}
+	if c.opts.OnEvent != nil {
+		c.opts.OnEvent(Event{Type: typ, Data: body})
+	}
+}
+
+// answer answers keyboard-interactive questions with Options.Prompt. An
+// error leaves them unanswered, the server gives up after a while.
+func (c *Client) answer(instruction string, questions []Question) {
+	answers, err := c.opts.Prompt(instruction, questions)
+	if err != nil {
+		return
+	}
+	c.send(wire.MsgPrompt, wire.PromptReply{Answers: answers})
+}
+
+func (c *Client) id() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return c.nextID
+}
+
+// Ping measures the round trip to the server.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	id := c.id()
+	ch := make(chan struct{})
+	c.mu.Lock()
+	c.pings[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pings, id)
+		c.mu.Unlock()
+	}()
+	start := time.Now()
+	if err := c.send(wire.MsgLatency, wire.Latency{ID: id}); err != nil {
+		return 0, err
+	}
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, ErrClosed
+	}
+}
+
+// Search searches the scrollback and screen of the session, see
+// wire.MsgSearch.
+func (c *Client) Search(ctx context.Context, q wire.SearchQuery) (wire.SearchResult, error) {
+	q.ID = c.id()
+	ch := make(chan wire.SearchResult, 1)
+	c.mu.Lock()
+	c.searches[q.ID] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.searches, q.ID)
+		c.mu.Unlock()
+	}()
+	if err := c.send(wire.MsgSearch, q); err != nil {
+		return wire.SearchResult{}, err
+	}
+	select {
+	case res := <-ch:
+		if res.Error != "" {
+			return res, errors.New(res.Error)
+		}
+		return res, nil
+	case <-ctx.Done():
+		return wire.SearchResult{}, ctx.Err()
+	case <-c.done:
+		return wire.SearchResult{}, ErrClosed
+	}
+}
+
+// RequestHandoff asks for a token that lets another connection take over
+// the session.
+func (c *Client) RequestHandoff(ctx context.Context) (Handoff, error) {
+	ch := make(chan Handoff, 1)
+	c.mu.Lock()
+	if c.handoff != nil {
+		c.mu.Unlock()
+		return Handoff{}, errBusy
+	}
+	c.handoff = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		if c.handoff == ch {
+			c.handoff = nil
+		}
+		c.mu.Unlock()
+	}()
+	if err := c.send(wire.MsgHandoff, struct{}{}); err != nil {
+		return Handoff{}, err
+	}
+	select {
+	case tok := <-ch:
+		return tok, nil
+	case <-ctx.Done():
+		return Handoff{}, ctx.Err()
+	case <-c.done:
+		return Handoff{}, ErrClosed
+	}
+}
+
+// fileWait routes the replies of a file request to it until stop is
+// closed.
+type fileWait struct {
+	ch   chan wire.FileReply
+	stop chan struct{}
+}
+
+func (c *Client) fileRequest() (string, *fileWait, func()) {
+	id := "c" + strconv.Itoa(c.id())
+	w := &fileWait{ch: make(chan wire.FileReply, 4), stop: make(chan struct{})}
+	c.mu.Lock()
+	c.files[id] = w
+	c.mu.Unlock()
+	return id, w, func() {
+		c.mu.Lock()
+		delete(c.files, id)
+		c.mu.Unlock()
+		close(w.stop)
+	}
+}
+
+// FileError is a file operation the server refused or that failed on the
+// session host.
+type FileError struct {
+	Op, Path string
+	Message  string
+	// Code是wire.CodeTransferDenied时被TransferPolicy拒绝
+	Code string
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("webssh %s %s: %s", e.Op, e.Path, e.Message)
+}
+
+func (c *Client) wait(ctx context.Context, w *fileWait, req wire.FileRequest) (wire.FileReply, error) {
+	select {
+	case reply := <-w.ch:
+		if reply.Error != "" {
+			return reply, &FileError{Op: req.Op, Path: req.Path, Message: reply.Error, Code: reply.Code}
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return wire.FileReply{}, ctx.Err()
+	case <-c.done:
+		return wire.FileReply{}, ErrClosed
+	}
+}
+
+// fileOp sends a request answered with one reply.
+func (c *Client) fileOp(ctx context.Context, op, path string) (wire.FileReply, error) {
+	id, w, release := c.fileRequest()
+	defer release()
+	req := wire.FileRequest{ID: id, Op: op, Path: path}
+	if err := c.send(wire.MsgFile, req); err != nil {
+		return wire.FileReply{}, err
+	}
+	return c.wait(ctx, w, req)
+}
+
+// List lists the directory path of the session host. File transfer must
+// be enabled on the server.
+func (c *Client) List(ctx context.Context, path string) ([]FileInfo, error) {
+	reply, err := c.fileOp(ctx, "list", path)
+	return reply.Files, err
+}
+
+// Mkdir creates the directory path on the session host.
+func (c *Client) Mkdir(ctx context.Context, path string) error {
+	_, err := c.fileOp(ctx, "mkdir", path)
+	return err
+}
+
+// Remove removes the file or empty directory path of the session host.
+func (c *Client) Remove(ctx context.Context, path string) error {
+	_, err := c.fileOp(ctx, "remove", path)
+	return err
+}
+
+// Download copies the file path of the session host to w and returns the
+// number of bytes written.
+func (c *Client) Download(ctx context.Context, path string, w io.Writer) (int64, error) {
+	id, fw, release := c.fileRequest()
+	defer release()
+	req := wire.FileRequest{ID: id, Op: "get", Path: path}
+	if err := c.send(wire.MsgFile, req); err != nil {
+		return 0, err
+	}
+	var n int64
+	for {
+		reply, err := c.wait(ctx, fw, req)
+		if err != nil {
+			return n, err
+		}
+		m, err := w.Write(reply.Data)
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+		if reply.EOF {
+			return n, nil
+		}
+	}
+}
+
+// Upload copies r to the file path of the session host, replacing it, and
+// returns the number of bytes sent. A failed upload may leave a partial
+// file behind.
+func (c *Client) Upload(ctx context.Context, path string, r io.Reader) (int64, error) {
+	id, fw, release := c.fileRequest()
+	defer release()
+	var n int64
+	buf := make([]byte, chunkSize)
+	for {
+		m, err := io.ReadFull(r, buf)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			// 服务端没有取消上传的请求，已经传的部分留在那里
+			return n, err
+		}
+		req := wire.FileRequest{ID: id, Op: "put", Path: path, Data: buf[:m], EOF: eof}
+		if err := c.send(wire.MsgFile, req); err != nil {
+			return n, err
+		}
+		n += int64(m)
+		if eof {
+			_, err := c.wait(ctx, fw, req)
+			return n, err
+		}
+		// 中间的块没有回复，有回复就是出错了
+		select {
+		case reply := <-fw.ch:
+			return n, &FileError{Op: req.Op, Path: path, Message: reply.Error, Code: reply.Code}
+		case <-ctx.Done():
+			return n, ctx.Err()
+		default:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package webssh
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/text/transform"
+)
+
+// MsgClipboard carries a clipboardMsg. The server sends it when a program
+// sets the clipboard with OSC 52 (tmux set-clipboard, vim's osc52 copy), or
+// asks to read it, in which case Query is set. The client sends the text of
+// its clipboard, which is handed to the program as the OSC 52 answer.
+const MsgClipboard = 'm'
+
+// OSC 52的内容最多这么长，更长的原样交给终端
+const maxClipboardSize = 1024 * 1024
+
+type clipboardMsg struct {
+	// Selection是OSC 52的选择区，c为剪贴板，p为primary，默认c
+	Selection string `json:"selection,omitempty"`
+	Text      string `json:"text,omitempty"`
+	Query     bool   `json:"query,omitempty"`
+}
+
+// clipboardTransformer takes OSC 52 sequences out of the output and sends
+// them to the client as MsgClipboard.
+func (t *Turn) clipboardTransformer() transform.Transformer {
+	return oscStripper{
+		codes:   []int{52},
+		maxLen:  maxClipboardSize,
+		onMatch: t.clipboardFromOutput,
+	}
+}
+
+// clipboardFromOutput handles the body of an OSC 52 sequence,
+// "52;<selection>;<base64 or ?>".
+func (t *Turn) clipboardFromOutput(body []byte) {
+	parts := bytes.SplitN(body, []byte(";"), 3)
+	if len(parts) != 3 {
+		return
+	}
+	msg := clipboardMsg{Selection: string(parts[1])}
+	if string(parts[2]) == "?" {
+		msg.Query = true
+	} else {
+		text, err := base64.StdEncoding.DecodeString(string(parts[2]))
+		if err != nil {
+			return
+		}
+		msg.Text = string(text)
+	}
+	t.writeControl(MsgClipboard, msg)
+}
+
+// answerClipboard gives the text from the client to the program as the
+// answer to an OSC 52 query.
+func (t *Turn) answerClipboard(msg clipboardMsg) error {
+	if t.backend == nil {
+		return nil
+	}
+	sel := msg.Selection
+	if sel == "" {
+		sel = "c"
+	}
+	answer := fmt.Sprintf("\x1b]52;%s;%s\x1b\\", sel, base64.StdEncoding.EncodeToString([]byte(msg.Text)))
+	return t.writeInput(t.ctx, []byte(answer))
+}
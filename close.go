@@ -0,0 +1,158 @@
+package webssh
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultShutdownTimeout = 5 * time.Second
+
+// Reason describes why the server ended a session.
+type Reason string
+
+const (
+	ReasonIdle        Reason = "idle"
+	ReasonMaxDuration Reason = "max_duration"
+	ReasonAdmin       Reason = "admin"
+	ReasonMaintenance Reason = "maintenance"
+	ReasonShutdown    Reason = "shutdown"
+	ReasonSlowClient  Reason = "slow_client"
+	ReasonTransferred Reason = "transferred"
+	ReasonBackendLost Reason = "backend_lost"
+	// ReasonUnlockFailed是锁屏后解锁失败次数太多
+	ReasonUnlockFailed Reason = "unlock_failed"
+	// ReasonDLP是输出里出现了DLPTerminate规则匹配的内容
+	ReasonDLP Reason = "dlp"
+	// ReasonProtocol是客户端违反协议的次数超过了MaxProtocolViolations
+	ReasonProtocol Reason = "protocol_error"
+)
+
+var defaultDisconnectMessages = map[Reason]string{
+	ReasonIdle:         "Session closed after being idle.",
+	ReasonMaxDuration:  "Session closed after {{.Duration}}: maximum session duration reached.",
+	ReasonAdmin:        "Session terminated by an administrator.",
+	ReasonMaintenance:  "Session closed for server maintenance.",
+	ReasonShutdown:     "Server is shutting down.",
+	ReasonSlowClient:   "Session closed: the connection could not keep up with the output.",
+	ReasonTransferred:  "Session transferred to another connection.",
+	ReasonBackendLost:  "Connection to the remote host was lost.",
+	ReasonUnlockFailed: "Session closed after too many failed unlock attempts.",
+	ReasonDLP:          "Session closed: sensitive data was detected in the output.",
+	ReasonProtocol:     "Session closed: the client sent too many malformed messages.",
+}
+
+// DisconnectData is passed to DisconnectMessages templates.
+type DisconnectData struct {
+	SessionID string
+	Reason    Reason
+	Duration  time.Duration
+}
+
+// CloseWithReason shows the banner configured for reason to the client and
+// then closes the session.
+func (t *Turn) CloseWithReason(reason Reason) error {
+	t.closeReason.CompareAndSwap(nil, reason)
+	t.auditEvent("closed", string(reason))
+	msg := t.disconnectMessage(reason)
+	if msg != "" {
+		t.writeNotice("\r\n" + msg + "\r\n")
+	}
+	if e, ok := reasonCodes[reason]; ok {
+		e.Message = msg
+		t.writeControl(MsgError, e)
+	}
+	t.flush(controlWait)
+	if conn := t.conn(); conn != nil {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(reason)),
+			time.Now().Add(time.Second))
+	}
+	return t.Close()
+}
+
+func (t *Turn) disconnectMessage(reason Reason) string {
+	text, ok := t.DisconnectMessages[reason]
+	if !ok {
+		text = defaultDisconnectMessages[reason]
+	}
+	if text == "" {
+		return ""
+	}
+	tmpl, err := template.New(string(reason)).Parse(text)
+	if err != nil {
+		return text
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, DisconnectData{
+		SessionID: t.ID,
+		Reason:    reason,
+		Duration:  time.Since(t.StartTime).Round(time.Second),
+	})
+	if err != nil {
+		return text
+	}
+	return buf.String()
+}
+
+// CloseAll closes every live session with the given reason, e.g. before
+// maintenance or on server shutdown.
+func (m *SessionManager) CloseAll(reason Reason) {
+	m.mu.RLock()
+	turns := make([]*Turn, 0, len(m.sessions))
+	for _, t := range m.sessions {
+		turns = append(turns, t)
+	}
+	m.mu.RUnlock()
+	for _, t := range turns {
+		t.CloseWithReason(reason)
+	}
+}
+
+// Shutdown asks the process to exit with SIGTERM and waits for it until ctx
+// is done, then closes the session, killing the process if it is still
+// running. Remote servers that do not support the ssh "signal" request only
+// see the session closed.
+func (t *Turn) Shutdown(ctx context.Context) error {
+	if sig, ok := t.backend.(signaler); ok {
+		sig.Signal(ssh.SIGTERM)
+		// 挂起的进程收不到TERM
+		if t.Suspended() {
+			t.Resume()
+		}
+		select {
+		case <-t.waitDone:
+		case <-t.ctx.Done():
+		case <-ctx.Done():
+		}
+	}
+	return t.Close()
+}
+
+// Shutdown shows ReasonShutdown to every live session and shuts them down
+// in parallel, see Turn.Shutdown. It returns once all of them are closed.
+func (m *SessionManager) Shutdown(ctx context.Context) {
+	m.mu.RLock()
+	turns := make([]*Turn, 0, len(m.sessions))
+	for _, t := range m.sessions {
+		turns = append(turns, t)
+	}
+	m.mu.RUnlock()
+	var wg sync.WaitGroup
+	for _, t := range turns {
+		wg.Add(1)
+		go func(t *Turn) {
+			defer wg.Done()
+			if msg := t.disconnectMessage(ReasonShutdown); msg != "" {
+				t.writeNotice("\r\n" + msg + "\r\n")
+			}
+			t.Shutdown(ctx)
+		}(t)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,403 @@
+package webssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 转发过的请求带着来源实例的名字，目标实例不再转发
+const clusterForwardedHeader = "X-Webssh-Forwarded-By"
+
+const defaultClusterTTL = 30 * time.Second
+
+var errNoCluster = errors.New("not in a cluster")
+
+// ClusterStore is the state shared by the instances of a cluster, a key
+// value store whose entries expire, such as Redis or etcd.
+type ClusterStore interface {
+	Put(key string, value []byte, ttl time.Duration) error
+	// Get returns nil if there is no key.
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	// List returns the values of the keys that start with prefix.
+	List(prefix string) ([][]byte, error)
+}
+
+// ClusterNode is an instance of a cluster.
+type ClusterNode struct {
+	Node     string    `json:"node"`
+	Addr     string    `json:"addr"`
+	Sessions int       `json:"sessions"`
+	Time     time.Time `json:"time"`
+}
+
+// ClusterSession is a live session of some instance of the cluster.
+type ClusterSession struct {
+	Result
+	Node     string `json:"node"`
+	NodeAddr string `json:"node_addr"`
+	State    string `json:"state"`
+}
+
+// clusterToken is where a handoff token can be redeemed.
+type clusterToken struct {
+	Session  string `json:"session"`
+	Node     string `json:"node"`
+	NodeAddr string `json:"node_addr"`
+}
+
+// Cluster lets instances behind a load balancer share their sessions. The
+// terminals stay where they were started, but every instance publishes its
+// sessions, recording names and handoff tokens in Store, so that any of
+// them can list the sessions of all, see Sessions, and Handler can forward
+// a reconnect to the instance that has the session. Recordings are shared
+// by putting them in a common RecStorage, e.g. S3Storage.
+type Cluster struct {
+	// Node是这个实例的名字，在集群里唯一；Addr是其他实例转发请求用的地址，如http://10.0.0.5:8080
+	Node  string
+	Addr  string
+	Store ClusterStore
+	// Prefix是所有键的前缀，默认"webssh/"
+	Prefix string
+	// 每TTL/3(默认10秒)刷新一次；实例停止刷新后它的会话在TTL之后从列表里消失
+	TTL    time.Duration
+	Logger Logger
+
+	changed chan struct{}
+	proxies sync.Map
+}
+
+func (c *Cluster) logger() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return DefaultLogger()
+}
+
+func (c *Cluster) key(kind, id string) string {
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = "webssh/"
+	}
+	return prefix + kind + "/" + id
+}
+
+func (c *Cluster) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return defaultClusterTTL
+}
+
+// Start publishes the sessions of m until ctx is done, when they are
+// removed from Store.
+func (c *Cluster) Start(ctx context.Context, m *SessionManager) error {
+	if c.Node == "" || c.Store == nil {
+		return errors.New("cluster needs Node and Store")
+	}
+	if u, err := url.Parse(c.Addr); err != nil || u.Host == "" {
+		return errors.New("cluster Addr must be a URL like http://host:port")
+	}
+	c.changed = make(chan struct{}, 1)
+	m.cluster.Store(c)
+	go c.loop(ctx, m)
+	return nil
+}
+
+// sessionsChanged makes the loop publish the sessions now.
+func (c *Cluster) sessionsChanged() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Cluster) loop(ctx context.Context, m *SessionManager) {
+	ticker := time.NewTicker(c.ttl() / 3)
+	defer ticker.Stop()
+	// 上次发布的会话，结束了的要删掉
+	published := make(map[string]struct{})
+	for {
+		published = c.publish(m, published)
+		select {
+		case <-ctx.Done():
+			m.cluster.CompareAndSwap(c, nil)
+			for id := range published {
+				c.Store.Delete(c.key("session", id))
+			}
+			c.Store.Delete(c.key("node", c.Node))
+			return
+		case <-ticker.C:
+		case <-c.changed:
+		}
+	}
+}
+
+func (c *Cluster) publish(m *SessionManager, published map[string]struct{}) map[string]struct{} {
+	m.mu.RLock()
+	turns := make([]*Turn, 0, len(m.sessions))
+	for _, t := range m.sessions {
+		turns = append(turns, t)
+	}
+	m.mu.RUnlock()
+	ttl := c.ttl()
+	now := make(map[string]struct{}, len(turns))
+	for _, t := range turns {
+		b, _ := json.Marshal(ClusterSession{Result: t.Result(), Node: c.Node, NodeAddr: c.Addr, State: t.state()})
+		if err := c.Store.Put(c.key("session", t.ID), b, ttl); err != nil {
+			c.logger().Warn("cluster publish", "session", t.ID, "err", err)
+			continue
+		}
+		now[t.ID] = struct{}{}
+	}
+	for id := range published {
+		if _, ok := now[id]; !ok {
+			if err := c.Store.Delete(c.key("session", id)); err != nil {
+				// 下次再删，最晚TTL之后过期
+				now[id] = struct{}{}
+			}
+		}
+	}
+	b, _ := json.Marshal(ClusterNode{Node: c.Node, Addr: c.Addr, Sessions: len(turns), Time: time.Now()})
+	if err := c.Store.Put(c.key("node", c.Node), b, ttl); err != nil {
+		c.logger().Warn("cluster heartbeat", "err", err)
+	}
+	return now
+}
+
+// publishToken makes a handoff token for t redeemable through any
+// instance.
+func (c *Cluster) publishToken(tok handoffToken) {
+	b, _ := json.Marshal(clusterToken{Session: tok.turn.ID, Node: c.Node, NodeAddr: c.Addr})
+	if err := c.Store.Put(c.key("handoff", tok.Token), b, time.Until(tok.Expires)); err != nil {
+		c.logger().Warn("cluster publish handoff", "err", err)
+	}
+}
+
+// Nodes returns the live instances, sorted by name.
+func (c *Cluster) Nodes() ([]ClusterNode, error) {
+	values, err := c.Store.List(c.key("node", ""))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]ClusterNode, 0, len(values))
+	for _, v := range values {
+		var n ClusterNode
+		if json.Unmarshal(v, &n) == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+	return nodes, nil
+}
+
+// Sessions returns the live sessions of all instances, oldest first. They
+// are as of the last time their instance published them.
+func (c *Cluster) Sessions() ([]ClusterSession, error) {
+	values, err := c.Store.List(c.key("session", ""))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ClusterSession, 0, len(values))
+	for _, v := range values {
+		var s ClusterSession
+		if json.Unmarshal(v, &s) == nil {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list, nil
+}
+
+// Locate returns the session id of any instance.
+func (c *Cluster) Locate(id string) (ClusterSession, error) {
+	var s ClusterSession
+	b, err := c.Store.Get(c.key("session", id))
+	if err != nil {
+		return s, err
+	}
+	if b == nil {
+		return s, ErrSessionNotFound
+	}
+	return s, json.Unmarshal(b, &s)
+}
+
+// route returns the address of the instance that should serve r, empty if
+// it is this one. Reattaching with ?session=, redeeming a handoff with
+// ?token= and reconnecting to a named session with ?name= go to the
+// instance that has the session.
+func (c *Cluster) route(r *http.Request) string {
+	if r.Header.Get(clusterForwardedHeader) != "" {
+		return ""
+	}
+	q := r.URL.Query()
+	var node, addr string
+	switch {
+	case q.Get("token") != "":
+		b, err := c.Store.Get(c.key("handoff", q.Get("token")))
+		var tok clusterToken
+		if err != nil || b == nil || json.Unmarshal(b, &tok) != nil {
+			return ""
+		}
+		node, addr = tok.Node, tok.NodeAddr
+	case q.Get("session") != "":
+		s, err := c.Locate(q.Get("session"))
+		if err != nil {
+			return ""
+		}
+		node, addr = s.Node, s.NodeAddr
+	case q.Get("name") != "":
+		// 名字只在同一个身份内唯一，这里不知道身份，按任一同名会话转发，
+		// 身份不对的话目标实例会新开一个会话
+		list, err := c.Sessions()
+		if err != nil {
+			return ""
+		}
+		for _, s := range list {
+			if s.Name != q.Get("name") {
+				continue
+			}
+			if s.Node == c.Node {
+				return ""
+			}
+			node, addr = s.Node, s.NodeAddr
+		}
+	}
+	if node == c.Node {
+		return ""
+	}
+	return addr
+}
+
+// proxy returns the reverse proxy to the instance at addr, websockets
+// included.
+func (c *Cluster) proxy(addr string) (http.Handler, error) {
+	if p, ok := c.proxies.Load(addr); ok {
+		return p.(http.Handler), nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(u)
+	director := p.Director
+	p.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set(clusterForwardedHeader, c.Node)
+	}
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		c.logger().Warn("cluster forward", "node", addr, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	c.proxies.Store(addr, p)
+	return p, nil
+}
+
+// forward serves r from the instance that has its session and reports
+// whether it did.
+func (c *Cluster) forward(w http.ResponseWriter, r *http.Request) bool {
+	addr := c.route(r)
+	if addr == "" || strings.EqualFold(addr, c.Addr) {
+		return false
+	}
+	p, err := c.proxy(addr)
+	if err != nil {
+		c.logger().Warn("cluster forward", "node", addr, "err", err)
+		return false
+	}
+	c.logger().Info("cluster forward", "node", addr, "path", r.URL.Path)
+	p.ServeHTTP(w, r)
+	return true
+}
+
+// Handler forwards reconnects to the instance that has the session and
+// serves other requests with next.
+func (c *Cluster) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.forward(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Middleware is Handler for gin routes, e.g. ServeConn, ServeReattach and
+// ServeHandoff.
+func (c *Cluster) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if c.forward(ctx.Writer, ctx.Request) {
+			ctx.Abort()
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// MemoryClusterStore is a ClusterStore in memory, for a single instance
+// and for trying things out.
+type MemoryClusterStore struct {
+	mu sync.Mutex
+	m  map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func NewMemoryClusterStore() *MemoryClusterStore {
+	return &MemoryClusterStore{m: make(map[string]memoryEntry)}
+}
+
+func (s *MemoryClusterStore) Put(key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = memoryEntry{value: append([]byte(nil), value...), expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *MemoryClusterStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(s.m, key)
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+func (s *MemoryClusterStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.m, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemoryClusterStore) List(prefix string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var values [][]byte
+	for k, e := range s.m {
+		if now.After(e.expires) {
+			delete(s.m, k)
+			continue
+		}
+		if strings.HasPrefix(k, prefix) {
+			values = append(values, e.value)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,229 @@
+package webssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SCAN每次最多返回这么多个键，MGET每次最多取这么多个
+const redisBatch = 200
+
+// RedisClusterStore is a ClusterStore in Redis, spoken to over one
+// connection that is opened again after an error.
+type RedisClusterStore struct {
+	// Addr是host:port
+	Addr     string
+	Password string
+	DB       int
+	// Timeout是连接和每个命令的超时，默认5秒
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (s *RedisClusterStore) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (s *RedisClusterStore) dial() error {
+	conn, err := net.DialTimeout("tcp", s.Addr, s.timeout())
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if s.Password != "" {
+		if _, err := s.roundTrip("AUTH", s.Password); err != nil {
+			s.close()
+			return err
+		}
+	}
+	if s.DB != 0 {
+		if _, err := s.roundTrip("SELECT", strconv.Itoa(s.DB)); err != nil {
+			s.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisClusterStore) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// do runs a command, connecting first if needed. A command that failed
+// on the connection is not retried, the connection is opened again for
+// the next one.
+func (s *RedisClusterStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	v, err := s.roundTrip(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		s.close()
+	}
+	return v, err
+}
+
+func (s *RedisClusterStore) roundTrip(args ...string) (interface{}, error) {
+	s.conn.SetDeadline(time.Now().Add(s.timeout()))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(s.r)
+}
+
+// readRedisReply reads one RESP reply: a string, an int64, nil, a
+// redisError or a []interface{} of those.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed length %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		p := make([]byte, n+2)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+		return string(p[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed length %q", line)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			if list[i], err = readRedisReply(r); err != nil {
+				var rerr redisError
+				if !errors.As(err, &rerr) {
+					return nil, err
+				}
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply %q", kind)
+}
+
+func (s *RedisClusterStore) Put(key string, value []byte, ttl time.Duration) error {
+	ms := ttl.Milliseconds()
+	if ms <= 0 {
+		ms = 1
+	}
+	_, err := s.do("SET", key, string(value), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (s *RedisClusterStore) Get(key string) ([]byte, error) {
+	v, err := s.do("GET", key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	str, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply to GET %T", v)
+	}
+	return []byte(str), nil
+}
+
+func (s *RedisClusterStore) Delete(key string) error {
+	_, err := s.do("DEL", key)
+	return err
+}
+
+func (s *RedisClusterStore) List(prefix string) ([][]byte, error) {
+	pattern := redisGlobEscaper.Replace(prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		v, err := s.do("SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(redisBatch))
+		if err != nil {
+			return nil, err
+		}
+		reply, ok := v.([]interface{})
+		if !ok || len(reply) != 2 {
+			return nil, errors.New("redis: unexpected reply to SCAN")
+		}
+		cursor, _ = reply[0].(string)
+		batch, _ := reply[1].([]interface{})
+		for _, k := range batch {
+			if k, ok := k.(string); ok {
+				keys = append(keys, k)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	var values [][]byte
+	for len(keys) > 0 {
+		n := min(len(keys), redisBatch)
+		v, err := s.do(append([]string{"MGET"}, keys[:n]...)...)
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[n:]
+		list, _ := v.([]interface{})
+		for _, item := range list {
+			// 取之前过期的键是nil
+			if str, ok := item.(string); ok {
+				values = append(values, []byte(str))
+			}
+		}
+	}
+	return values, nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
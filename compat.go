@@ -0,0 +1,168 @@
+package webssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol profiles for front ends written for other servers, chosen with
+// ?protocol= or, for ttyd clients, the "tty" websocket subprotocol they
+// ask for. See also ProtocolGuacamole and ProtocolV2.
+//
+// ProtocolAttach is for the xterm.js AttachAddon: every message from the
+// browser is input as it is, except a text message {"cols":N,"rows":M}
+// which resizes the terminal, and the output comes as binary messages
+// with nothing else in between.
+//
+// ProtocolTTY is the protocol of ttyd: messages from the browser start
+// with '0' for input, '1' for a resize {"columns","rows"}, '2' and '3' to
+// pause and resume the output, and the first one may be the JSON
+// {"AuthToken","columns","rows"}, whose token is ignored since the
+// connection has already been authorized. The output starts with '0', a
+// new window title is sent as '1' followed by the title.
+//
+// Control messages of the native protocol have no counterpart in either
+// profile and are dropped, so is the error message before the connection
+// is closed; the close code and reason are kept.
+const (
+	ProtocolAttach = "attach"
+	ProtocolTTY    = "tty"
+)
+
+// ttyd的消息类型
+const (
+	ttyInput  = '0'
+	ttyResize = '1'
+	ttyPause  = '2'
+	ttyResume = '3'
+
+	ttyOutput = '0'
+	ttyTitle  = '1'
+)
+
+// compatConn translates between a browser speaking one of the profiles and
+// the native protocol.
+type compatConn struct {
+	ws  *websocket.Conn
+	tty bool
+	// ttyd的第一条消息可能是认证和大小
+	first bool
+}
+
+// withProtocol returns wsConn as a MessageConn speaking the native
+// protocol, wsConn itself unless r asks for another profile.
+func withProtocol(r *http.Request, wsConn *websocket.Conn) MessageConn {
+	p := r.URL.Query().Get("protocol")
+	if sub := wsConn.Subprotocol(); sub != "" {
+		p = sub
+	}
+	switch p {
+	case ProtocolV2, "v2":
+		return &v2Conn{ws: wsConn}
+	case ProtocolGuacamole:
+		return newGuacConn(wsConn)
+	case ProtocolAttach:
+		return &compatConn{ws: wsConn}
+	case ProtocolTTY:
+		return &compatConn{ws: wsConn, tty: true, first: true}
+	}
+	return wsConn
+}
+
+func (c *compatConn) ReadMessage() (int, []byte, error) {
+	for {
+		msgType, p, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(p) == 0 {
+			continue
+		}
+		var msg []byte
+		if c.tty {
+			msg = c.fromTTY(p)
+		} else {
+			msg = fromAttach(msgType, p)
+		}
+		if msg != nil {
+			return websocket.TextMessage, msg, nil
+		}
+	}
+}
+
+func fromAttach(msgType int, p []byte) []byte {
+	if msgType == websocket.TextMessage && p[0] == '{' {
+		var size struct {
+			Cols int `json:"cols"`
+			Rows int `json:"rows"`
+		}
+		dec := json.NewDecoder(bytes.NewReader(p))
+		dec.DisallowUnknownFields()
+		// 粘贴进来的json不算
+		if dec.Decode(&size) == nil && size.Cols > 0 && size.Rows > 0 && !dec.More() {
+			b, _ := json.Marshal(Resize{Columns: size.Cols, Rows: size.Rows})
+			return controlFrame(MsgResize, b)
+		}
+	}
+	return controlFrame(MsgData, p)
+}
+
+func (c *compatConn) fromTTY(p []byte) []byte {
+	first := c.first
+	c.first = false
+	switch p[0] {
+	case ttyInput:
+		return controlFrame(MsgData, p[1:])
+	case ttyResize:
+		// {"columns","rows"}和Resize的字段一致
+		return controlFrame(MsgResize, p[1:])
+	case ttyPause, ttyResume:
+		b, _ := json.Marshal(flowMsg{Pause: p[0] == ttyPause})
+		return controlFrame(MsgFlow, b)
+	case '{':
+		if first {
+			var size Resize
+			if json.Unmarshal(p, &size) == nil && size.Columns > 0 && size.Rows > 0 {
+				b, _ := json.Marshal(size)
+				return controlFrame(MsgResize, b)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *compatConn) WriteMessage(msgType int, p []byte) error {
+	if msgType == websocket.BinaryMessage {
+		if c.tty {
+			return c.ws.WriteMessage(websocket.BinaryMessage, append([]byte{ttyOutput}, p...))
+		}
+		return c.ws.WriteMessage(websocket.BinaryMessage, p)
+	}
+	if !c.tty || len(p) == 0 || p[0] != MsgTermState {
+		return nil
+	}
+	var state termState
+	if json.Unmarshal(decode(p[1:]), &state) != nil || state.Title == "" {
+		return nil
+	}
+	return c.ws.WriteMessage(websocket.BinaryMessage, append([]byte{ttyTitle}, state.Title...))
+}
+
+func (c *compatConn) Close() error {
+	return c.ws.Close()
+}
+
+// CloseWithCode passes the close code and reason of the session on, see
+// MessageConn.
+func (c *compatConn) CloseWithCode(code int, reason string) error {
+	if code == websocket.CloseAbnormalClosure {
+		return c.ws.Close()
+	}
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	return c.ws.Close()
+}
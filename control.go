@@ -0,0 +1,67 @@
+package webssh
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// 控制消息和flush等待输出队列空位的最长时间
+const controlWait = time.Second
+
+// 服务端发给客户端的控制消息。数据仍然是BinaryMessage，控制消息是
+// TextMessage，格式和客户端消息一致：一个字节的类型加base64编码的json
+const (
+	MsgEcho        = '7'
+	MsgJoinRequest = '8'
+	// MsgExit在远端命令结束时发给所有连接，code为-1表示远端没有给出退出码，
+	// 之后用正常的close帧(1000)关闭连接，reason是"exit 1"或"signal KILL"
+	MsgExit = wire.MsgExit
+)
+
+// writeControl queues a control message to the owner connection behind the
+// output written so far.
+func (t *Turn) writeControl(msgType byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.out.pushWait(frame{msgType: websocket.TextMessage, p: controlFrame(msgType, b)}, controlWait)
+}
+
+// writeControlLocked sends an already encoded control message right away,
+// ahead of queued output. wsMu must be held.
+func (t *Turn) writeControlLocked(msgType byte, body []byte) error {
+	if t.WsConn == nil {
+		return nil
+	}
+	return t.WsConn.WriteMessage(websocket.TextMessage, controlFrame(msgType, body))
+}
+
+func controlFrame(msgType byte, body []byte) []byte {
+	return append([]byte{msgType}, encode(body)...)
+}
+
+// writeNotice queues a message for the user that is not part of the
+// session's output, so it is neither recorded nor sent to other clients.
+func (t *Turn) writeNotice(msg string) error {
+	return t.out.pushWait(frame{msgType: websocket.BinaryMessage, p: []byte(msg)}, controlWait)
+}
+
+// flush waits until everything queued so far has been written, at most
+// timeout.
+func (t *Turn) flush(timeout time.Duration) {
+	marker := frame{flushed: make(chan struct{})}
+	if t.out.pushWait(marker, timeout) != nil {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-marker.flushed:
+	case <-t.ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,218 @@
+package webssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// RecFormat is a format of recordings for ConvertRecording.
+type RecFormat string
+
+const (
+	// FormatAsciicast是Recorder写的asciicast v2，读取时也支持v1
+	FormatAsciicast RecFormat = "asciicast"
+	// FormatTtyrec是ttyrec/ttyplay的格式，只有输出，没有窗口大小
+	FormatTtyrec RecFormat = "ttyrec"
+)
+
+// ttyrec的一帧最多这么大，和ReadRecording的单行上限一致
+const maxTtyrecFrame = 16 * 1024 * 1024
+
+// DetectRecFormat guesses the format of a recording from its first bytes:
+// asciicast starts with a JSON object, anything else is taken for ttyrec.
+func DetectRecFormat(head []byte) RecFormat {
+	if b := bytes.TrimLeft(head, " \t\r\n"); len(b) > 0 && b[0] == '{' {
+		return FormatAsciicast
+	}
+	return FormatTtyrec
+}
+
+// ConvertRecording reads a recording in format from from r and writes it to
+// w in format to. An empty from is detected with DetectRecFormat. Events
+// that the target cannot hold are dropped: ttyrec keeps the output and
+// turns resizes into the xterm resize sequence, which ttyplay passes on to
+// the terminal.
+func ConvertRecording(w io.Writer, to RecFormat, r io.Reader, from RecFormat) error {
+	header, events, err := ReadRecordingAs(r, from)
+	if err != nil {
+		return err
+	}
+	switch to {
+	case FormatAsciicast:
+		return WriteAsciicast(w, header, events)
+	case FormatTtyrec:
+		return WriteTtyrec(w, header, events)
+	}
+	return fmt.Errorf("unknown recording format %q", to)
+}
+
+// ReadRecordingAs reads a recording in format, detected when empty.
+// Recordings without a size, such as ttyrec, get 80x24.
+func ReadRecordingAs(r io.Reader, format RecFormat) (*RecHeader, []RecEvent, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(64)
+	if bytes.HasPrefix(head, []byte(encMagic)) {
+		return nil, nil, errors.New("recording is encrypted, read it through EncryptedStorage")
+	}
+	if format == "" {
+		format = DetectRecFormat(head)
+	}
+	switch format {
+	case FormatAsciicast:
+		return readAsciicast(br)
+	case FormatTtyrec:
+		return ReadTtyrec(br)
+	}
+	return nil, nil, fmt.Errorf("unknown recording format %q", format)
+}
+
+// readAsciicast reads asciicast v2, or v1 with all events in one document.
+func readAsciicast(r io.Reader) (*RecHeader, []RecEvent, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var v1 struct {
+		Version int                  `json:"version"`
+		Stdout  [][2]json.RawMessage `json:"stdout"`
+	}
+	// v2的header后面还有事件，整体解析会失败
+	if json.Unmarshal(b, &v1) != nil || v1.Version != 1 {
+		return ReadRecording(bytes.NewReader(b))
+	}
+	header := defaultRecHeader()
+	if err := json.Unmarshal(b, header); err != nil {
+		return nil, nil, fmt.Errorf("parse recording header err:%s", err)
+	}
+	header.Version = 2
+	events := make([]RecEvent, 0, len(v1.Stdout))
+	var now float64
+	for _, frame := range v1.Stdout {
+		// v1里是距上一帧的间隔
+		var delay float64
+		var data string
+		if json.Unmarshal(frame[0], &delay) != nil || json.Unmarshal(frame[1], &data) != nil {
+			return nil, nil, errors.New("parse recording event err:bad asciicast v1 frame")
+		}
+		now += delay
+		events = append(events, RecEvent{Time: now, Type: OutPutType, Data: data})
+	}
+	return header, events, nil
+}
+
+// WriteAsciicast writes header and events as asciicast v2, the format of
+// Recorder.
+func WriteAsciicast(w io.Writer, header *RecHeader, events []RecEvent) error {
+	bw := bufio.NewWriter(w)
+	h := *header
+	h.Version = 2
+	b, err := json.Marshal(&h)
+	if err != nil {
+		return err
+	}
+	bw.Write(append(b, '\n'))
+	var line []byte
+	for _, e := range events {
+		line = append(appendEvent(line[:0], e.Time, e.Type, []byte(e.Data)), '\n')
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadTtyrec reads a ttyrec recording: frames of seconds, microseconds and
+// length as little endian 32 bit numbers, followed by the output. The
+// second of the first frame becomes the timestamp of the header and times
+// count from it. A frame holding nothing but an xterm resize sequence is
+// read as a resize.
+func ReadTtyrec(r io.Reader) (*RecHeader, []RecEvent, error) {
+	header := defaultRecHeader()
+	header.Width, header.Height = 80, 24
+	var events []RecEvent
+	var start int64
+	var head [12]byte
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, fmt.Errorf("ttyrec frame err:%s", err)
+		}
+		sec, usec := binary.LittleEndian.Uint32(head[0:]), binary.LittleEndian.Uint32(head[4:])
+		n := binary.LittleEndian.Uint32(head[8:])
+		if n > maxTtyrecFrame {
+			return nil, nil, fmt.Errorf("ttyrec frame of %d bytes too large", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, fmt.Errorf("ttyrec frame err:%s", err)
+		}
+		if events == nil {
+			start = int64(sec)
+			header.Timestamp = start
+		}
+		// 按微秒取整，免得出现0.020164012908935547这样的时间
+		us := max((int64(sec)-start)*1e6+int64(usec), 0)
+		e := RecEvent{Time: float64(us) / 1e6, Type: OutPutType, Data: string(data)}
+		// WriteTtyrec写的窗口大小变化还原回来
+		var rows, cols int
+		if n, _ := fmt.Sscanf(e.Data, "\x1b[8;%d;%dt", &rows, &cols); n == 2 && e.Data == fmt.Sprintf("\x1b[8;%d;%dt", rows, cols) {
+			e.Type, e.Data = ResizeType, fmt.Sprintf("%dx%d", cols, rows)
+		}
+		events = append(events, e)
+	}
+	if events == nil {
+		return nil, nil, errors.New("empty recording")
+	}
+	return header, events, nil
+}
+
+// WriteTtyrec writes the output events as ttyrec frames timed from the
+// timestamp of header. A resize becomes the xterm sequence that resizes
+// the terminal, other events are dropped.
+func WriteTtyrec(w io.Writer, header *RecHeader, events []RecEvent) error {
+	bw := bufio.NewWriter(w)
+	var head [12]byte
+	for _, e := range events {
+		data := e.Data
+		switch e.Type {
+		case OutPutType:
+		case ResizeType:
+			rows, cols, ok := e.Size()
+			if !ok {
+				continue
+			}
+			data = fmt.Sprintf("\x1b[8;%d;%dt", rows, cols)
+		default:
+			continue
+		}
+		us := int64(math.Round(e.Time * 1e6))
+		binary.LittleEndian.PutUint32(head[0:], uint32(header.Timestamp+us/1e6))
+		binary.LittleEndian.PutUint32(head[4:], uint32(us%1e6))
+		binary.LittleEndian.PutUint32(head[8:], uint32(len(data)))
+		bw.Write(head[:])
+		if _, err := io.WriteString(bw, data); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ParseRecFormat parses the name of a format, as given on a command line.
+func ParseRecFormat(s string) (RecFormat, error) {
+	switch f := RecFormat(strings.ToLower(s)); f {
+	case "", FormatAsciicast, FormatTtyrec:
+		return f, nil
+	case "cast":
+		return FormatAsciicast, nil
+	}
+	return "", fmt.Errorf("unknown recording format %q", s)
+}
@@ -0,0 +1,214 @@
+package webssh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 向凭据服务取凭据最多等这么久
+const credentialTimeout = 10 * time.Second
+
+// Credentials are what a CredentialProvider hands out for one target. Empty
+// fields keep the value from the configuration.
+type Credentials struct {
+	User     string `json:"username"`
+	Password string `json:"password"`
+	// PrivateKey是PEM格式的私钥，Certificate是authorized_keys格式的OpenSSH证书
+	PrivateKey  string `json:"private_key"`
+	Passphrase  string `json:"passphrase"`
+	Certificate string `json:"certificate"`
+}
+
+// CredentialProvider looks up the credentials for user on host, an
+// address like 10.0.0.1:22, each time a connection is made, so secrets
+// stay in the vault and rotated ones are picked up.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, host, user string) (*Credentials, error)
+}
+
+// CredentialProviderFunc adapts a function to CredentialProvider.
+type CredentialProviderFunc func(ctx context.Context, host, user string) (*Credentials, error)
+
+func (f CredentialProviderFunc) Credentials(ctx context.Context, host, user string) (*Credentials, error) {
+	return f(ctx, host, user)
+}
+
+// apply puts c into conf. Unless conf.AuthModels is set, the methods are
+// chosen from what c holds: the certificate or the key first, then the
+// password.
+func (c *Credentials) apply(conf *SSHClientConfig) {
+	if c.User != "" {
+		conf.User = c.User
+	}
+	if c.Password != "" {
+		conf.Password = c.Password
+	}
+	if c.PrivateKey != "" {
+		conf.Key = []byte(c.PrivateKey)
+		conf.Passphrase = c.Passphrase
+	}
+	if c.Certificate != "" {
+		conf.Cert = []byte(c.Certificate)
+	}
+	if len(conf.AuthModels) > 0 {
+		return
+	}
+	var models []AuthModel
+	switch {
+	case c.PrivateKey != "" && c.Certificate != "":
+		models = append(models, CERTIFICATE)
+	case c.PrivateKey != "":
+		models = append(models, PUBLICKEY)
+	}
+	if c.Password != "" {
+		models = append(models, PASSWORD, KEYBOARD_INTERACTIVE)
+	}
+	conf.AuthModels = models
+}
+
+// EnvCredentials reads credentials from environment variables named
+// Prefix (default WEBSSH_) followed by USER, PASSWORD, PRIVATE_KEY,
+// PASSPHRASE and CERTIFICATE. A variable with the host in between, e.g.
+// WEBSSH_10_0_0_1_22_PASSWORD, takes precedence.
+type EnvCredentials struct {
+	Prefix string
+}
+
+func (e *EnvCredentials) Credentials(ctx context.Context, host, user string) (*Credentials, error) {
+	prefix := e.Prefix
+	if prefix == "" {
+		prefix = "WEBSSH_"
+	}
+	hostPrefix := prefix + strings.ToUpper(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, host)) + "_"
+	get := func(name string) string {
+		if v, ok := os.LookupEnv(hostPrefix + name); ok {
+			return v
+		}
+		return os.Getenv(prefix + name)
+	}
+	return &Credentials{
+		User:        get("USER"),
+		Password:    get("PASSWORD"),
+		PrivateKey:  get("PRIVATE_KEY"),
+		Passphrase:  get("PASSPHRASE"),
+		Certificate: get("CERTIFICATE"),
+	}, nil
+}
+
+// FileCredentials reads a JSON file mapping "user@host", "host" or "*" to
+// Credentials, tried in that order. The file is read on every connection,
+// so changes apply without a restart. It should be readable by the server
+// only.
+type FileCredentials struct {
+	Path string
+}
+
+func (f *FileCredentials) Credentials(ctx context.Context, host, user string) (*Credentials, error) {
+	b, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("read credentials err:%s", err)
+	}
+	var all map[string]*Credentials
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, fmt.Errorf("parse credentials %s err:%s", f.Path, err)
+	}
+	for _, key := range []string{user + "@" + host, host, "*"} {
+		if c := all[key]; c != nil {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no credentials for %s@%s", user, host)
+}
+
+// VaultCredentials reads credentials from a HashiCorp Vault KV version 2
+// secret, whose fields are named like the json tags of Credentials.
+type VaultCredentials struct {
+	// Addr和Token为空时取VAULT_ADDR和VAULT_TOKEN
+	Addr  string
+	Token string
+	// Namespace用于Vault企业版
+	Namespace string
+	// Mount是KV引擎挂载的路径，默认secret
+	Mount string
+	// Path是secret的路径，{host}和{user}会被替换，默认webssh/{host}
+	Path string
+	// Client为空时使用http.DefaultClient
+	Client *http.Client
+}
+
+func (v *VaultCredentials) Credentials(ctx context.Context, host, user string) (*Credentials, error) {
+	addr, token := v.Addr, v.Token
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	mount, path := v.Mount, v.Path
+	if mount == "" {
+		mount = "secret"
+	}
+	if path == "" {
+		path = "webssh/{host}"
+	}
+	path = strings.NewReplacer("{host}", host, "{user}", user).Replace(path)
+	url := strings.TrimRight(addr, "/") + "/v1/" + strings.Trim(mount, "/") + "/data/" + strings.TrimLeft(path, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault err:%s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault %s: %s", path, res.Status)
+	}
+	var secret struct {
+		Data struct {
+			Data *Credentials `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("vault %s err:%s", path, err)
+	}
+	if secret.Data.Data == nil {
+		return nil, fmt.Errorf("vault %s has no data", path)
+	}
+	return secret.Data.Data, nil
+}
+
+// credentials fills config from the CredentialProvider, if any.
+func (w *WebSSH) credentials(config *SSHClientConfig) error {
+	if w.Credentials == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialTimeout)
+	defer cancel()
+	c, err := w.Credentials.Credentials(ctx, config.HostAddr, config.User)
+	if err != nil {
+		return fmt.Errorf("credentials for %s err:%s", config.HostAddr, err)
+	}
+	c.apply(config)
+	return nil
+}
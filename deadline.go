@@ -0,0 +1,88 @@
+package webssh
+
+import (
+	"fmt"
+	"time"
+)
+
+// 会话到期前默认提前这么久提醒
+const defaultDeadlineWarning = 5 * time.Minute
+
+// deadline returns when the session must end, or the zero time.
+func (t *Turn) deadline() time.Time {
+	t.deadlineMu.Lock()
+	defer t.deadlineMu.Unlock()
+	d := t.Deadline
+	if t.deadlineSet {
+		d = t.deadlineAt
+	}
+	if t.MaxDuration > 0 {
+		if max := t.StartTime.Add(t.MaxDuration); d.IsZero() || max.Before(d) {
+			d = max
+		}
+	}
+	return d
+}
+
+// SetDeadline schedules the end of the session at d, replacing
+// TurnConfig.Deadline; MaxDuration still applies. The zero time cancels a
+// scheduled end.
+func (t *Turn) SetDeadline(d time.Time) {
+	t.deadlineMu.Lock()
+	t.deadlineAt = d
+	t.deadlineSet = true
+	t.deadlineMu.Unlock()
+	t.deadlineOnce.Do(func() { go t.loopDeadline() })
+	t.rescheduleDeadline()
+}
+
+// rescheduleDeadline makes loopDeadline pick up a new deadline.
+func (t *Turn) rescheduleDeadline() {
+	select {
+	case t.deadlineChanged <- struct{}{}:
+	default:
+	}
+}
+
+// loopDeadline warns the user DeadlineWarning before the deadline and then
+// closes the session with ReasonMaxDuration.
+func (t *Turn) loopDeadline() {
+	warned := false
+	for {
+		deadline := t.deadline()
+		warning := t.DeadlineWarning
+		if warning <= 0 {
+			warning = defaultDeadlineWarning
+		}
+		var timer *time.Timer
+		var wake <-chan time.Time
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				t.CloseWithReason(ReasonMaxDuration)
+				return
+			}
+			next := left
+			if !warned && left > warning {
+				next = left - warning
+			} else if !warned {
+				t.writeNotice(fmt.Sprintf("\r\nThis session will be closed in %s: maximum session duration.\r\n", left.Round(time.Second)))
+				warned = true
+			}
+			timer = time.NewTimer(next)
+			wake = timer.C
+		}
+		select {
+		case <-t.ctx.Done():
+		case <-t.deadlineChanged:
+			warned = false
+		case <-wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package webssh
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// upgrade upgrades r to a websocket, offering permessage-deflate when
+// Deflate is set.
+func (w WebSSH) upgrade(rw http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	u := w.newUpgrader()
+	u.EnableCompression = w.Deflate
+	wsConn, err := u.Upgrade(rw, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	w.TurnConfig.setDeflateLevel(wsConn)
+	return wsConn, nil
+}
+
+func (c *TurnConfig) setDeflateLevel(wsConn *websocket.Conn) {
+	if !c.Deflate || c.DeflateLevel == 0 {
+		return
+	}
+	if err := wsConn.SetCompressionLevel(c.DeflateLevel); err != nil {
+		c.logger().Warn("set deflate level", "level", c.DeflateLevel, "err", err)
+	}
+}
+
+// enableDeflate turns compression on for a data frame of n bytes if it is
+// worth it; keystroke echoes are not. wsMu must be held.
+func (t *Turn) enableDeflate(n int) {
+	if t.Deflate {
+		t.WsConn.EnableWriteCompression(n >= t.DeflateThreshold)
+	}
+}
@@ -0,0 +1,140 @@
+package webssh
+
+import (
+	"regexp"
+	"time"
+)
+
+// DLPAction is what happens when a DLPRule matches the output.
+type DLPAction int
+
+const (
+	// DLPAlert只报告，输出和录像都不变
+	DLPAlert DLPAction = iota
+	// DLPRedact在录像里把匹配的内容替换成*，终端上照常显示
+	DLPRedact
+	// DLPTerminate丢弃这段输出并以ReasonDLP结束会话
+	DLPTerminate
+)
+
+func (a DLPAction) String() string {
+	switch a {
+	case DLPRedact:
+		return "redact"
+	case DLPTerminate:
+		return "terminate"
+	}
+	return "alert"
+}
+
+// DLPRule looks for sensitive data in the output of a session. Validate,
+// if set, is called with each match to weed out false positives, e.g. a
+// Luhn check for card numbers.
+type DLPRule struct {
+	Name     string
+	Pattern  *regexp.Regexp
+	Action   DLPAction
+	Validate func(match []byte) bool
+}
+
+// DLPMatch reports a DLPRule matching the output. It does not carry the
+// matched data, so it can be logged safely.
+type DLPMatch struct {
+	Time   time.Time `json:"time"`
+	Rule   string    `json:"rule"`
+	Action string    `json:"action"`
+}
+
+// 匹配可能跨越两段输出，保留上一段结尾这么多字节一起检查
+const dlpTailSize = 256
+
+// DefaultDLPRules returns rules for card numbers, AWS access keys and
+// private keys, all with action.
+func DefaultDLPRules(action DLPAction) []DLPRule {
+	return []DLPRule{
+		{Name: "credit_card", Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), Action: action, Validate: luhn},
+		{Name: "aws_access_key", Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), Action: action},
+		{Name: "aws_secret_key", Pattern: regexp.MustCompile(`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}`), Action: action},
+		{Name: "private_key", Pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY-----`), Action: action},
+	}
+}
+
+// luhn reports whether the digits in b pass the Luhn checksum.
+func luhn(b []byte) bool {
+	sum, n := 0, 0
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// scanDLP matches the DLP rules against p, together with the end of the
+// previous output. It returns what to record instead of p, and whether the
+// session is being terminated and p must not be sent.
+func (t *Turn) scanDLP(p []byte) ([]byte, bool) {
+	if len(t.DLP) == 0 {
+		return p, false
+	}
+	t.dlpMu.Lock()
+	defer t.dlpMu.Unlock()
+	buf := append(t.dlpTail, p...)
+	off := len(t.dlpTail)
+	rec, copied := p, false
+	terminate := false
+	for _, rule := range t.DLP {
+		for _, m := range rule.Pattern.FindAllIndex(buf, -1) {
+			// 完全在上一段里的已经报告过
+			if m[1] <= off {
+				continue
+			}
+			if rule.Validate != nil && !rule.Validate(buf[m[0]:m[1]]) {
+				continue
+			}
+			t.dlpMatch(DLPMatch{Rule: rule.Name, Action: rule.Action.String()})
+			switch rule.Action {
+			case DLPRedact:
+				if !copied {
+					rec, copied = append([]byte(nil), p...), true
+				}
+				start := m[0] - off
+				if start < 0 {
+					start = 0
+				}
+				for i := start; i < m[1]-off; i++ {
+					rec[i] = '*'
+				}
+			case DLPTerminate:
+				terminate = true
+			}
+		}
+	}
+	if len(buf) > dlpTailSize {
+		buf = buf[len(buf)-dlpTailSize:]
+	}
+	t.dlpTail = append(t.dlpTail[:0], buf...)
+	if terminate && t.dlpStop.CompareAndSwap(false, true) {
+		go t.CloseWithReason(ReasonDLP)
+	}
+	return rec, t.dlpStop.Load()
+}
+
+// dlpMatch reports m to OnDLP and the AuditLogger.
+func (t *Turn) dlpMatch(m DLPMatch) {
+	m.Time = time.Now()
+	t.logger().Warn("dlp rule matched", "event", "dlp", "rule", m.Rule, "action", m.Action)
+	t.auditEvent("dlp", m.Rule+" "+m.Action)
+	if t.OnDLP != nil {
+		t.OnDLP(t, m)
+	}
+}
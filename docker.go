@@ -0,0 +1,248 @@
+package webssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	defaultDockerHost       = "unix:///var/run/docker.sock"
+	defaultDockerAPIVersion = "v1.41"
+)
+
+// DockerExecConfig describes a command to run in a container through the
+// Docker Engine API, like docker exec -it.
+type DockerExecConfig struct {
+	// Host默认取DOCKER_HOST，再默认unix:///var/run/docker.sock，
+	// 也可以是tcp://host:2375
+	Host       string
+	APIVersion string
+
+	ContainerID string
+	// Cmd默认为/bin/sh
+	Cmd        []string
+	User       string
+	WorkingDir string
+	Env        []string
+}
+
+type dockerBackend struct {
+	api  *dockerAPI
+	id   string
+	conn net.Conn
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+type dockerAPI struct {
+	network string
+	addr    string
+	version string
+	client  *http.Client
+}
+
+func newDockerAPI(dconf *DockerExecConfig) (*dockerAPI, error) {
+	host := dconf.Host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = defaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	api := &dockerAPI{version: dconf.APIVersion}
+	if api.version == "" {
+		api.version = defaultDockerAPIVersion
+	}
+	switch u.Scheme {
+	case "unix":
+		api.network, api.addr = "unix", u.Path
+	case "tcp", "http":
+		api.network, api.addr = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("unsupported docker host %s", host)
+	}
+	api.client = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, api.network, api.addr)
+		},
+	}}
+	return api, nil
+}
+
+func (api *dockerAPI) url(path string) string {
+	return "http://docker/" + api.version + path
+}
+
+// post sends v as json and decodes the response into out, if not nil.
+func (api *dockerAPI) post(path string, v, out interface{}) error {
+	var body io.Reader
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	resp, err := api.client.Post(api.url(path), "application/json", body)
+	if err != nil {
+		return err
+	}
+	return dockerResponse(resp, out)
+}
+
+func (api *dockerAPI) get(path string, out interface{}) error {
+	resp, err := api.client.Get(api.url(path))
+	if err != nil {
+		return err
+	}
+	return dockerResponse(resp, out)
+}
+
+func dockerResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&msg)
+		return fmt.Errorf("docker api: %s %s", resp.Status, msg.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// StartDocker returns a StartFunc that creates an exec instance with a tty
+// in the container and attaches to it.
+func StartDocker(dconf *DockerExecConfig) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		api, err := newDockerAPI(dconf)
+		if err != nil {
+			return nil, err
+		}
+		cmd := dconf.Cmd
+		if len(cmd) == 0 {
+			cmd = []string{"/bin/sh"}
+		}
+		var created struct {
+			ID string `json:"Id"`
+		}
+		err = api.post("/containers/"+url.PathEscape(dconf.ContainerID)+"/exec", map[string]interface{}{
+			"AttachStdin":  true,
+			"AttachStdout": true,
+			"AttachStderr": true,
+			"Tty":          true,
+			"Cmd":          cmd,
+			"User":         dconf.User,
+			"WorkingDir":   dconf.WorkingDir,
+			"Env":          append([]string{"TERM=" + term}, dconf.Env...),
+			"ConsoleSize":  []int{rows, cols},
+		}, &created)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, r, err := api.hijack("/exec/"+created.ID+"/start", map[string]interface{}{"Detach": false, "Tty": true})
+		if err != nil {
+			return nil, err
+		}
+		b := &dockerBackend{api: api, id: created.ID, conn: conn, done: make(chan struct{})}
+		go func() {
+			defer close(b.done)
+			// tty模式下输出没有多路复用的头，直接转发
+			io.Copy(out, r)
+		}()
+		b.Resize(rows, cols)
+		return b, nil
+	}
+}
+
+// hijack starts an exec and returns the raw connection carrying its
+// stdin and output.
+func (api *dockerAPI) hijack(path string, v interface{}) (net.Conn, io.Reader, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.Dial(api.network, api.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, api.url(path), bytes.NewReader(body))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		err := dockerResponse(resp, nil)
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, br, nil
+}
+
+func (b *dockerBackend) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn.Write(p)
+}
+
+func (b *dockerBackend) Resize(rows, cols int) error {
+	return b.api.post(fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", b.id, rows, cols), nil, nil)
+}
+
+func (b *dockerBackend) Wait() error {
+	<-b.done
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err := b.api.get("/exec/"+b.id+"/json", &inspect); err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return &ExitError{Code: inspect.ExitCode}
+	}
+	return nil
+}
+
+func (b *dockerBackend) Close() error {
+	return b.conn.Close()
+}
+
+// NewDockerTurn starts a shell in a running container.
+func NewDockerTurn(wsConn *websocket.Conn, dconf *DockerExecConfig, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	if dconf.ContainerID == "" {
+		return nil, fmt.Errorf("docker exec: no container")
+	}
+	return NewBackendTurn(wsConn, StartDocker(dconf), rec, conf)
+}
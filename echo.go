@@ -0,0 +1,94 @@
+package webssh
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// 远端的termios取不到，根据输出里的密码提示推断回显是否关闭，
+// 用户回车后恢复
+var passwordPrompt = regexp.MustCompile(`(?i)(password|passphrase|passcode|verification code)[^\n]*:\s*$`)
+
+type echoState struct {
+	Echo bool `json:"echo"`
+}
+
+// trackEchoOutput is called with every chunk of output.
+func (t *Turn) trackEchoOutput(p []byte) {
+	if !t.ReportEcho {
+		return
+	}
+	if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+		p = p[i+1:]
+	}
+	if passwordPrompt.Match(p) {
+		t.setEcho(false)
+	}
+}
+
+// trackEchoInput is called with every chunk of client input.
+func (t *Turn) trackEchoInput(p []byte) {
+	if !t.ReportEcho {
+		return
+	}
+	if bytes.ContainsAny(p, "\r\n\x03") {
+		t.setEcho(true)
+	}
+}
+
+func (t *Turn) setEcho(on bool) {
+	t.echoMu.Lock()
+	defer t.echoMu.Unlock()
+	if t.echoOff == !on {
+		return
+	}
+	t.echoOff = !on
+	t.writeControl(MsgEcho, echoState{Echo: on})
+}
+
+// Echo reports whether the remote application is believed to echo input.
+func (t *Turn) Echo() bool {
+	t.echoMu.Lock()
+	defer t.echoMu.Unlock()
+	return !t.echoOff
+}
+
+// trackSecretOutput notes that a password prompt showed up, so the next
+// line typed is a secret.
+func (t *Turn) trackSecretOutput(p []byte) {
+	if !t.MaskSecrets && t.CommandPolicy == nil && t.Policies == nil && !t.DetectPrivilege {
+		return
+	}
+	if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+		p = p[i+1:]
+	}
+	if passwordPrompt.Match(p) {
+		t.secret.Store(true)
+	}
+}
+
+// maskSecret returns p as it may be stored: while a secret is being typed,
+// every printable byte up to Enter is replaced with '*'.
+func (t *Turn) maskSecret(p []byte) []byte {
+	if !t.secret.Load() {
+		return p
+	}
+	if !t.MaskSecrets {
+		if bytes.ContainsAny(p, "\r\n\x03") {
+			t.secret.Store(false)
+		}
+		return p
+	}
+	masked := make([]byte, len(p))
+	copy(masked, p)
+	for i, b := range masked {
+		if b == '\r' || b == '\n' || b == 0x03 {
+			t.secret.Store(false)
+			break
+		}
+		if b >= 0x20 && b != 0x7f {
+			masked[i] = '*'
+		}
+	}
+	return masked
+}
@@ -0,0 +1,301 @@
+package webssh
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 加密录像的文件头：magic、key id长度和key id、nonce前缀
+const encMagic = "WSENC1"
+
+const (
+	// 每块明文最多这么长，Recorder每次写入通常远小于这个
+	encChunkSize   = 64 * 1024
+	encPrefixSize  = 7
+	encMaxKeyIDLen = 1024
+)
+
+var ErrRecordingTruncated = errors.New("encrypted recording is truncated")
+
+// RecordingKeys supplies the AES keys of encrypted recordings, 16, 24 or 32
+// bytes long. NewKey returns the key for a new recording and an id that is
+// stored in its header, e.g. the data key wrapped by a KMS; Key returns the
+// key again from that id.
+type RecordingKeys interface {
+	NewKey(name string) (key, id []byte, err error)
+	Key(name string, id []byte) ([]byte, error)
+}
+
+// StaticKey encrypts every recording with key. The id stored with the
+// recordings is a fingerprint of the key, so Key fails with a clear error
+// instead of garbage when the key has changed.
+func StaticKey(key []byte) RecordingKeys {
+	sum := sha256.Sum256(key)
+	return &staticKey{key: key, id: sum[:8]}
+}
+
+type staticKey struct {
+	key, id []byte
+}
+
+func (k *staticKey) NewKey(string) ([]byte, []byte, error) {
+	return k.key, k.id, nil
+}
+
+func (k *staticKey) Key(name string, id []byte) ([]byte, error) {
+	if string(id) != string(k.id) {
+		return nil, fmt.Errorf("recording %s was encrypted with another key", name)
+	}
+	return k.key, nil
+}
+
+// EncryptedStorage encrypts what is written to Storage with AES-GCM and
+// decrypts it again on Open, so replay, markers and transcripts work as
+// before. Each Write is sealed as a chunk of its own, numbered in its
+// nonce, and a last, empty chunk marks the end: reordered, dropped or
+// changed chunks and a cut off end are all detected on reading. A
+// recording that was never closed, e.g. when the server crashed, reads up
+// to where it ends and then fails with ErrRecordingTruncated.
+type EncryptedStorage struct {
+	Storage RecorderStorage
+	Keys    RecordingKeys
+}
+
+func (s *EncryptedStorage) Create(name string) (io.WriteCloser, error) {
+	key, id, err := s.Keys.NewKey(name)
+	if err != nil {
+		return nil, fmt.Errorf("recording key err:%s", err)
+	}
+	if len(id) > encMaxKeyIDLen {
+		return nil, errors.New("recording key id too long")
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(encMagic)+2+len(id)+encPrefixSize)
+	header = append(header, encMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(id)))
+	header = append(header, id...)
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+
+	w, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &encWriter{w: w, aead: aead, header: header, prefix: prefix}, nil
+}
+
+func (s *EncryptedStorage) Open(name string) (io.ReadCloser, error) {
+	r, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &encReader{r: bufio.NewReader(r), c: r, keys: s.Keys, name: name}, nil
+}
+
+func (s *EncryptedStorage) List() ([]string, error) {
+	return s.Storage.List()
+}
+
+// Stat passes on to Storage, if it is a PrunableStorage.
+func (s *EncryptedStorage) Stat(name string) (RecordingInfo, error) {
+	ps, ok := s.Storage.(PrunableStorage)
+	if !ok {
+		return RecordingInfo{}, errNotPrunable
+	}
+	return ps.Stat(name)
+}
+
+// Remove passes on to Storage, if it is a PrunableStorage.
+func (s *EncryptedStorage) Remove(name string) error {
+	ps, ok := s.Storage.(PrunableStorage)
+	if !ok {
+		return errNotPrunable
+	}
+	return ps.Remove(name)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("recording key err:%s", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encNonce is the nonce prefix, the chunk number and whether it is the last
+// chunk.
+func encNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, n)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+type encWriter struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	closed bool
+}
+
+func (e *encWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > encChunkSize {
+			chunk = chunk[:encChunkSize]
+		}
+		if err := e.seal(chunk, false); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func (e *encWriter) seal(p []byte, last bool) error {
+	if e.n == ^uint32(0) {
+		return errors.New("encrypted recording too long")
+	}
+	// 文件头作为附加数据，换了key id或nonce前缀就解不开
+	ct := e.aead.Seal(nil, encNonce(e.prefix, e.n, last), p, e.header)
+	e.n++
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(ct)), uint32(len(ct)))
+	_, err := e.w.Write(append(buf, ct...))
+	return err
+}
+
+func (e *encWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	err := e.seal(nil, true)
+	if cerr := e.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type encReader struct {
+	r    *bufio.Reader
+	c    io.Closer
+	keys RecordingKeys
+	name string
+
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	buf    []byte
+	// 读到最后一块之后，后面可能还有追加写入的另一段
+	done bool
+}
+
+func (e *encReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.aead == nil || e.done {
+			if _, err := e.r.Peek(1); err == io.EOF && e.done {
+				return 0, io.EOF
+			}
+			if err := e.readHeader(); err != nil {
+				return 0, err
+			}
+		}
+		if err := e.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+func (e *encReader) readHeader() error {
+	head := make([]byte, len(encMagic)+2)
+	if _, err := io.ReadFull(e.r, head); err != nil {
+		return fmt.Errorf("encrypted recording header err:%s", err)
+	}
+	if string(head[:len(encMagic)]) != encMagic {
+		return errors.New("not an encrypted recording")
+	}
+	idLen := int(binary.BigEndian.Uint16(head[len(encMagic):]))
+	if idLen > encMaxKeyIDLen {
+		return errors.New("recording key id too long")
+	}
+	rest := make([]byte, idLen+encPrefixSize)
+	if _, err := io.ReadFull(e.r, rest); err != nil {
+		return fmt.Errorf("encrypted recording header err:%s", err)
+	}
+	key, err := e.keys.Key(e.name, rest[:idLen])
+	if err != nil {
+		return fmt.Errorf("recording key err:%s", err)
+	}
+	if e.aead, err = newGCM(key); err != nil {
+		return err
+	}
+	e.header = append(head, rest...)
+	e.prefix = rest[idLen:]
+	e.n = 0
+	e.done = false
+	return nil
+}
+
+func (e *encReader) readChunk() error {
+	var size [4]byte
+	if _, err := io.ReadFull(e.r, size[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrRecordingTruncated
+		}
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > encChunkSize+uint32(e.aead.Overhead()) {
+		return errors.New("encrypted recording chunk too large")
+	}
+	ct := make([]byte, n)
+	if _, err := io.ReadFull(e.r, ct); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrRecordingTruncated
+		}
+		return err
+	}
+	p, err := e.aead.Open(nil, encNonce(e.prefix, e.n, false), ct, e.header)
+	if err != nil {
+		p, err = e.aead.Open(nil, encNonce(e.prefix, e.n, true), ct, e.header)
+		if err != nil {
+			return fmt.Errorf("encrypted recording chunk %d has been tampered with", e.n)
+		}
+		e.done = true
+	}
+	e.n++
+	e.buf = p
+	return nil
+}
+
+func (e *encReader) Close() error {
+	return e.c.Close()
+}
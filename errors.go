@@ -0,0 +1,106 @@
+package webssh
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgError is the last message before the server closes a connection on
+// purpose. It carries an ErrorMsg so the client can tell the user why.
+const MsgError = wire.MsgError
+
+// Error codes sent in ErrorMsg.
+const (
+	CodeAuthFailed      = wire.CodeAuthFailed
+	CodeUnauthorized    = wire.CodeUnauthorized
+	CodeHostUnreachable = wire.CodeHostUnreachable
+	CodeHostKey         = wire.CodeHostKey
+	CodeSessionExpired  = wire.CodeSessionExpired
+	CodeIdle            = wire.CodeIdle
+	CodeTerminated      = wire.CodeTerminated
+	CodeShutdown        = wire.CodeShutdown
+	CodeSlowClient      = wire.CodeSlowClient
+	CodeTransferred     = wire.CodeTransferred
+	CodeBackendLost     = wire.CodeBackendLost
+	CodeQuotaExceeded   = wire.CodeQuotaExceeded
+	CodeNotFound        = wire.CodeNotFound
+	CodeInUse           = wire.CodeInUse
+	CodeInternal        = wire.CodeInternal
+	CodeProtocolError   = wire.CodeProtocolError
+	// CodeTransferDenied不关闭连接，只出现在文件传输的回复里
+	CodeTransferDenied = wire.CodeTransferDenied
+)
+
+// ErrorMsg tells the client why its connection is closed. Retryable is set
+// when connecting again may succeed without the user changing anything.
+type ErrorMsg = wire.ErrorMsg
+
+// reasonCodes maps the reasons the server closes sessions to error codes.
+var reasonCodes = map[Reason]ErrorMsg{
+	ReasonIdle:         {Code: CodeIdle},
+	ReasonMaxDuration:  {Code: CodeSessionExpired},
+	ReasonAdmin:        {Code: CodeTerminated},
+	ReasonMaintenance:  {Code: CodeShutdown, Retryable: true},
+	ReasonShutdown:     {Code: CodeShutdown, Retryable: true},
+	ReasonSlowClient:   {Code: CodeSlowClient, Retryable: true},
+	ReasonTransferred:  {Code: CodeTransferred},
+	ReasonBackendLost:  {Code: CodeBackendLost, Retryable: true},
+	ReasonUnlockFailed: {Code: CodeUnauthorized},
+	ReasonDLP:          {Code: CodeTerminated},
+	ReasonProtocol:     {Code: CodeProtocolError},
+}
+
+// errorFor classifies err, as returned while opening a session.
+func errorFor(err error) ErrorMsg {
+	msg := ErrorMsg{Code: CodeInternal, Message: err.Error()}
+	var quota *QuotaError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &quota):
+		msg.Code = CodeQuotaExceeded
+	case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrSessionLocked):
+		msg.Code = CodeUnauthorized
+	case errors.Is(err, ErrSessionNotFound):
+		msg.Code = CodeNotFound
+	case errors.Is(err, errNotDetached):
+		msg.Code = CodeInUse
+	case errors.Is(err, ErrMirrorDown):
+		// 审计镜像恢复后就能连上
+		msg.Retryable = true
+	case HostKeyWarning(err) != "":
+		msg.Code = CodeHostKey
+	case isAuthError(err):
+		msg.Code = CodeAuthFailed
+	case errors.As(err, &netErr):
+		// 连不上、超时、被拒绝
+		msg.Code = CodeHostUnreachable
+		msg.Retryable = true
+	}
+	return msg
+}
+
+// closeWithError sends msg as MsgError and a close frame with its code.
+func closeWithError(wsConn *websocket.Conn, msg ErrorMsg) {
+	b, _ := json.Marshal(msg)
+	wsConn.WriteMessage(websocket.TextMessage, controlFrame(MsgError, b))
+	wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(closeCode(msg), msg.Code),
+		time.Now().Add(time.Second))
+}
+
+func closeCode(msg ErrorMsg) int {
+	switch msg.Code {
+	case CodeUnauthorized, CodeAuthFailed, CodeQuotaExceeded, CodeHostKey:
+		return websocket.ClosePolicyViolation
+	case CodeShutdown:
+		return websocket.CloseGoingAway
+	case CodeInternal, CodeHostUnreachable, CodeBackendLost:
+		return websocket.CloseInternalServerErr
+	}
+	return websocket.CloseNormalClosure
+}
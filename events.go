@@ -0,0 +1,152 @@
+package webssh
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 订阅者的通道默认能缓冲这么多事件
+const defaultEventBuffer = 64
+
+// Event is published on an EventBus. The concrete types are
+// SessionStartedEvent, ResizedEvent, ReconnectedEvent, ExitedEvent and
+// RecordingRotatedEvent.
+type Event interface {
+	// SessionID is empty for events that belong to no session.
+	SessionID() string
+	EventTime() time.Time
+}
+
+// EventHeader is embedded in every Event.
+type EventHeader struct {
+	Session string    `json:"session,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func (h EventHeader) SessionID() string    { return h.Session }
+func (h EventHeader) EventTime() time.Time { return h.Time }
+
+// SessionStartedEvent is published once the session is registered and its
+// hooks have run.
+type SessionStartedEvent struct {
+	EventHeader
+	Owner  string `json:"owner,omitempty"`
+	Remote string `json:"remote,omitempty"`
+	// User和Host是ssh会话登录的用户和主机
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+}
+
+// ResizedEvent is published when the pty size changed.
+type ResizedEvent struct {
+	EventHeader
+	Rows int `json:"rows"`
+	Cols int `json:"cols"`
+}
+
+// ReconnectedEvent is published when the ssh connection of a session was
+// established again, see TurnConfig.Reconnect.
+type ReconnectedEvent struct {
+	EventHeader
+	Attempt int `json:"attempt"`
+}
+
+// ExitedEvent is published once when the session is closed. Code is -1 and
+// Signal empty if the remote command did not exit; Reason is set if the
+// server closed the session.
+type ExitedEvent struct {
+	EventHeader
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+	Reason Reason `json:"reason,omitempty"`
+}
+
+// RecordingRotatedEvent is published when LocalStorage removed old recordings
+// to stay within MaxFiles.
+type RecordingRotatedEvent struct {
+	EventHeader
+	Removed []string `json:"removed"`
+}
+
+// EventBus delivers events to every subscriber. Publishing never blocks:
+// an event is dropped for a subscriber whose buffer is full, and counted
+// in Dropped.
+type EventBus struct {
+	mu      sync.RWMutex
+	subs    map[chan Event]struct{}
+	Dropped atomic.Int64
+}
+
+// NewEventBus returns an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// buffering up to size (default 64). cancel unsubscribes and closes the
+// channel.
+func (b *EventBus) Subscribe(size int) (events <-chan Event, cancel func()) {
+	if size <= 0 {
+		size = defaultEventBuffer
+	}
+	ch := make(chan Event, size)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// SubscribeFunc calls fn with every event, in order, on a goroutine of its
+// own so a slow fn does not hold up the sessions. cancel stops it.
+func (b *EventBus) SubscribeFunc(fn func(Event)) (cancel func()) {
+	ch, cancel := b.Subscribe(0)
+	go func() {
+		for e := range ch {
+			fn(e)
+		}
+	}()
+	return cancel
+}
+
+// Publish sends e to every subscriber. It may be called on a nil bus.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			b.Dropped.Add(1)
+		}
+	}
+}
+
+// header returns the EventHeader of an event of the session happening now.
+func (t *Turn) header() EventHeader {
+	return EventHeader{Session: t.ID, Time: time.Now()}
+}
+
+// publishExited publishes ExitedEvent, only the first time it is called.
+func (t *Turn) publishExited() {
+	if t.Events == nil {
+		return
+	}
+	t.exitedOnce.Do(func() {
+		e := ExitedEvent{EventHeader: t.header(), Code: int(t.exitCode.Load())}
+		e.Signal, _ = t.exitSignal.Load().(string)
+		e.Reason, _ = t.closeReason.Load().(Reason)
+		t.Events.Publish(e)
+	})
+}
@@ -0,0 +1,332 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/sftp"
+	"github.com/widaT/webssh/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// MsgFile carries file operations in both directions, see fileReq and
+// fileReply. Requests and replies are matched by id.
+const MsgFile = wire.MsgFile
+
+// 下载时每个消息携带的最大字节数
+const fileChunkSize = 32 * 1024
+
+var errNoFileTransfer = errors.New("file transfer not enabled")
+
+// fileReq is sent by the client. Op is one of list, get, put, mkdir and
+// remove. An upload is a series of put requests with the same id, the last
+// one with eof set.
+type fileReq = wire.FileRequest
+
+// fileReply answers a fileReq. A download is answered with a series of
+// replies carrying data, the last one with eof set.
+type fileReply = wire.FileReply
+
+type fileInfo = wire.FileInfo
+
+// fileSystem is the part of the session host's file system exposed to the
+// client.
+type fileSystem interface {
+	ReadDir(path string) ([]os.FileInfo, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Open(path string) (io.ReadCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	Mkdir(path string) error
+	Remove(path string) error
+	// RealPath是path解析了所有符号链接之后的绝对路径
+	RealPath(path string) (string, error)
+	Close() error
+}
+
+type sftpFS struct {
+	*sftp.Client
+}
+
+func (fs sftpFS) Open(path string) (io.ReadCloser, error) {
+	return fs.Client.Open(path)
+}
+
+func (fs sftpFS) Create(path string) (io.WriteCloser, error) {
+	return fs.Client.Create(path)
+}
+
+func openSFTP(client *ssh.Client) func() (fileSystem, error) {
+	return func() (fileSystem, error) {
+		c, err := sftp.NewClient(client)
+		if err != nil {
+			return nil, fmt.Errorf("start sftp subsystem err:%s", err)
+		}
+		return sftpFS{c}, nil
+	}
+}
+
+type localFS struct{}
+
+func openLocalFS() (fileSystem, error) {
+	return localFS{}, nil
+}
+
+func (localFS) ReadDir(path string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (localFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localFS) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (localFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localFS) Create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+func (localFS) Mkdir(path string) error {
+	return os.Mkdir(path, 0755)
+}
+
+func (localFS) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localFS) RealPath(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(real)
+}
+
+func (localFS) Close() error {
+	return nil
+}
+
+// openFileSystem opens the file system of the session on first use.
+func (t *Turn) openFileSystem() (fileSystem, error) {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	if !t.FileTransfer || t.openFiles == nil {
+		return nil, errNoFileTransfer
+	}
+	if t.files == nil {
+		fs, err := t.openFiles()
+		if err != nil {
+			return nil, err
+		}
+		t.files = fs
+	}
+	return t.files, nil
+}
+
+// upload is a file being uploaded.
+type upload struct {
+	w    io.WriteCloser
+	path string
+	n    int64
+}
+
+// checkFileReq checks req against the TransferPolicy. An upload is only
+// checked on its first chunk.
+func (t *Turn) checkFileReq(fs fileSystem, req fileReq) error {
+	p := t.TransferPolicy
+	if p == nil {
+		return nil
+	}
+	switch req.Op {
+	case "list":
+		return p.allowPath(fs, req.Path, false)
+	case "get":
+		if err := p.allowDirection(true); err != nil {
+			return err
+		}
+		return p.allowPath(fs, req.Path, true)
+	case "put":
+		t.filesMu.Lock()
+		_, started := t.uploads[req.ID]
+		t.filesMu.Unlock()
+		if started {
+			return nil
+		}
+		if err := p.allowDirection(false); err != nil {
+			return err
+		}
+		return p.allowPath(fs, req.Path, true)
+	case "mkdir", "remove":
+		if err := p.allowDirection(false); err != nil {
+			return err
+		}
+		return p.allowPath(fs, req.Path, false)
+	}
+	return nil
+}
+
+func (t *Turn) handleFile(req fileReq) {
+	fs, err := t.openFileSystem()
+	if err == nil {
+		if err = t.checkFileReq(fs, req); err != nil {
+			t.denyTransfer(err)
+		}
+	}
+	if err != nil {
+		t.writeControl(MsgFile, fileReply{ID: req.ID, Error: err.Error(), Code: transferCode(err)})
+		return
+	}
+	reply := fileReply{ID: req.ID}
+	switch req.Op {
+	case "list":
+		var infos []os.FileInfo
+		if infos, err = fs.ReadDir(req.Path); err == nil {
+			for _, info := range infos {
+				reply.Files = append(reply.Files, fileInfo{
+					Name:    info.Name(),
+					Size:    info.Size(),
+					Mode:    info.Mode().String(),
+					ModTime: info.ModTime(),
+					IsDir:   info.IsDir(),
+				})
+			}
+		}
+	case "get":
+		// 下载可能很大，不阻塞读循环
+		go t.sendFile(fs, req)
+		return
+	case "put":
+		if err = t.receiveFile(fs, req); err == nil && !req.EOF {
+			return
+		}
+	case "mkdir":
+		err = fs.Mkdir(req.Path)
+	case "remove":
+		err = fs.Remove(req.Path)
+	default:
+		err = fmt.Errorf("unknown file op %q", req.Op)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		reply.Code = transferCode(err)
+	}
+	t.writeControl(MsgFile, reply)
+}
+
+func (t *Turn) sendFile(fs fileSystem, req fileReq) {
+	if t.TransferPolicy != nil {
+		info, err := fs.Stat(req.Path)
+		if err == nil {
+			if err = t.TransferPolicy.allowSize(info.Size()); err != nil {
+				t.denyTransfer(err)
+			}
+		}
+		if err != nil {
+			t.writeControl(MsgFile, fileReply{ID: req.ID, Error: err.Error(), Code: transferCode(err)})
+			return
+		}
+	}
+	f, err := fs.Open(req.Path)
+	if err != nil {
+		t.writeControl(MsgFile, fileReply{ID: req.ID, Error: err.Error()})
+		return
+	}
+	var sent int64
+	defer f.Close()
+	buf := make([]byte, fileChunkSize)
+	for t.ctx.Err() == nil {
+		n, err := io.ReadFull(f, buf)
+		reply := fileReply{ID: req.ID, Data: buf[:n]}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			reply.EOF = true
+		} else if err != nil {
+			reply = fileReply{ID: req.ID, Error: err.Error()}
+		}
+		// 文件在传输过程中可能变大，按实际发出的字节再检查一次
+		sent += int64(n)
+		perr := t.TransferPolicy.allowSize(sent)
+		if perr == nil {
+			perr = t.countTransfer(true, n)
+		}
+		if perr != nil {
+			t.denyTransfer(perr)
+			reply = fileReply{ID: req.ID, Error: perr.Error(), Code: CodeTransferDenied}
+		}
+		if werr := t.writeControl(MsgFile, reply); werr != nil || reply.EOF || reply.Error != "" {
+			return
+		}
+	}
+}
+
+// receiveFile writes one chunk of an upload, creating the file on the
+// first chunk and closing it on the last. An upload going over the
+// TransferPolicy limits is aborted and the partial file removed.
+func (t *Turn) receiveFile(fs fileSystem, req fileReq) error {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	u, ok := t.uploads[req.ID]
+	if !ok {
+		w, err := fs.Create(req.Path)
+		if err != nil {
+			return err
+		}
+		if t.uploads == nil {
+			t.uploads = make(map[string]*upload)
+		}
+		u = &upload{w: w, path: req.Path}
+		t.uploads[req.ID] = u
+	}
+	u.n += int64(len(req.Data))
+	err := t.TransferPolicy.allowSize(u.n)
+	if err == nil {
+		err = t.countTransfer(false, len(req.Data))
+	}
+	if err != nil {
+		t.denyTransfer(err)
+		delete(t.uploads, req.ID)
+		u.w.Close()
+		fs.Remove(u.path)
+		return err
+	}
+	_, err = u.w.Write(req.Data)
+	if err != nil || req.EOF {
+		delete(t.uploads, req.ID)
+		if cerr := u.w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeFiles aborts unfinished uploads and closes the file system.
+func (t *Turn) closeFiles() {
+	t.filesMu.Lock()
+	defer t.filesMu.Unlock()
+	for id, u := range t.uploads {
+		u.w.Close()
+		delete(t.uploads, id)
+	}
+	if t.files != nil {
+		t.files.Close()
+		t.files = nil
+	}
+}
@@ -0,0 +1,94 @@
+package webssh
+
+import (
+	"context"
+	"sync"
+
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgFlow lets the owner pause and resume the output with {"pause": true}
+// and {"pause": false}. While paused the terminal output is not read, so
+// the remote program blocks once the pty buffer is full; nothing is lost.
+const MsgFlow = wire.MsgFlow
+
+type flowMsg = wire.Flow
+
+// 输出暂停的原因
+const (
+	flowPaused = 1 << iota
+	flowHighWatermark
+	flowLocked
+	flowBanner
+)
+
+// flowGate blocks output while any reason to hold it back is set.
+type flowGate struct {
+	mu      sync.Mutex
+	reasons int
+	open    chan struct{}
+}
+
+func newFlowGate() *flowGate {
+	g := &flowGate{open: make(chan struct{})}
+	close(g.open)
+	return g
+}
+
+func (g *flowGate) set(reason int, on bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	held := g.reasons != 0
+	if on {
+		g.reasons |= reason
+	} else {
+		g.reasons &^= reason
+	}
+	switch {
+	case !held && g.reasons != 0:
+		g.open = make(chan struct{})
+	case held && g.reasons == 0:
+		close(g.open)
+	}
+}
+
+func (g *flowGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	open := g.open
+	g.mu.Unlock()
+	select {
+	case <-open:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PauseOutput stops reading the terminal output until ResumeOutput is
+// called.
+func (t *Turn) PauseOutput() {
+	t.flow.set(flowPaused, true)
+}
+
+// ResumeOutput undoes PauseOutput.
+func (t *Turn) ResumeOutput() {
+	t.flow.set(flowPaused, false)
+}
+
+// queuedChanged applies the watermarks after the bytes waiting in the
+// owner's output queue changed to n.
+func (t *Turn) queuedChanged(n int64) {
+	if t.HighWatermark <= 0 || t.OverflowPolicy != OverflowBlock {
+		return
+	}
+	low := t.LowWatermark
+	if low <= 0 || low > t.HighWatermark {
+		low = t.HighWatermark / 2
+	}
+	switch {
+	case n >= int64(t.HighWatermark):
+		t.flow.set(flowHighWatermark, true)
+	case n <= int64(low):
+		t.flow.set(flowHighWatermark, false)
+	}
+}
@@ -0,0 +1,190 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// MsgForward carries port forward requests from the owner and their
+// replies, see forwardReq and forwardReply. Requests and replies are
+// matched by id.
+const MsgForward = 'j'
+
+// ForwardRemote连接Target的超时
+const forwardDialTimeout = 10 * time.Second
+
+var (
+	errNoPortForward   = errors.New("port forwarding not enabled")
+	ErrForwardNotFound = errors.New("forward not found")
+)
+
+// ForwardType is ForwardLocal (ssh -L) or ForwardRemote (ssh -R).
+type ForwardType string
+
+const (
+	// ForwardLocal在webssh服务端监听，连接经ssh转到远端可达的Target
+	ForwardLocal ForwardType = "local"
+	// ForwardRemote在ssh服务器上监听，连接转到webssh服务端可达的Target
+	ForwardRemote ForwardType = "remote"
+)
+
+// Forward is a port forward tied to the lifetime of a Turn.
+type Forward struct {
+	ID     string      `json:"id"`
+	Type   ForwardType `json:"type"`
+	Listen string      `json:"listen"` // 实际监听的地址
+	Target string      `json:"target"`
+
+	ln   net.Listener
+	dial func(addr string) (net.Conn, error)
+}
+
+// forwardReq is sent by the owner. Op is one of open, close and list;
+// close takes the id of the forward in Forward.
+type forwardReq struct {
+	ID      string      `json:"id"`
+	Op      string      `json:"op"`
+	Forward string      `json:"forward,omitempty"`
+	Type    ForwardType `json:"type,omitempty"`
+	Listen  string      `json:"listen,omitempty"`
+	Target  string      `json:"target,omitempty"`
+}
+
+type forwardReply struct {
+	ID       string     `json:"id"`
+	Error    string     `json:"error,omitempty"`
+	Forward  *Forward   `json:"forward,omitempty"`
+	Forwards []*Forward `json:"forwards,omitempty"`
+}
+
+// OpenForward starts a port forward of the given type from listen to
+// target. It is closed with CloseForward or together with the Turn.
+func (t *Turn) OpenForward(typ ForwardType, listen, target string) (*Forward, error) {
+	// 重连后换成新的连接，见switchClient
+	t.fwdMu.Lock()
+	client := t.fwdClient
+	t.fwdMu.Unlock()
+	if !t.PortForward || client == nil {
+		return nil, errNoPortForward
+	}
+	f := &Forward{Type: typ, Target: target}
+	var err error
+	switch typ {
+	case ForwardLocal:
+		f.ln, err = net.Listen("tcp", listen)
+		f.dial = func(addr string) (net.Conn, error) { return client.Dial("tcp", addr) }
+	case ForwardRemote:
+		f.ln, err = client.Listen("tcp", listen)
+		f.dial = func(addr string) (net.Conn, error) { return net.DialTimeout("tcp", addr, forwardDialTimeout) }
+	default:
+		return nil, fmt.Errorf("unknown forward type %q", typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listen %s err:%s", listen, err)
+	}
+	f.Listen = f.ln.Addr().String()
+
+	t.fwdMu.Lock()
+	if t.ctx.Err() != nil {
+		t.fwdMu.Unlock()
+		f.ln.Close()
+		return nil, errors.New("session closed")
+	}
+	t.fwdSeq++
+	f.ID = strconv.Itoa(t.fwdSeq)
+	if t.forwards == nil {
+		t.forwards = make(map[string]*Forward)
+	}
+	t.forwards[f.ID] = f
+	t.fwdMu.Unlock()
+
+	go f.serve()
+	return f, nil
+}
+
+// Forwards returns the open port forwards of the session.
+func (t *Turn) Forwards() []*Forward {
+	t.fwdMu.Lock()
+	defer t.fwdMu.Unlock()
+	list := make([]*Forward, 0, len(t.forwards))
+	for _, f := range t.forwards {
+		list = append(list, f)
+	}
+	return list
+}
+
+// CloseForward stops accepting connections on the forward with the given
+// id. Connections already forwarded are left to finish.
+func (t *Turn) CloseForward(id string) error {
+	t.fwdMu.Lock()
+	f, ok := t.forwards[id]
+	delete(t.forwards, id)
+	t.fwdMu.Unlock()
+	if !ok {
+		return ErrForwardNotFound
+	}
+	return f.ln.Close()
+}
+
+// closeForwards is called when the Turn closes.
+func (t *Turn) closeForwards() {
+	t.fwdMu.Lock()
+	defer t.fwdMu.Unlock()
+	for id, f := range t.forwards {
+		f.ln.Close()
+		delete(t.forwards, id)
+	}
+}
+
+func (f *Forward) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.pipe(conn)
+	}
+}
+
+func (f *Forward) pipe(conn net.Conn) {
+	defer conn.Close()
+	remote, err := f.dial(f.Target)
+	if err != nil {
+		DefaultLogger().Warn("forward", "listen", f.Listen, "target", f.Target, "err", err)
+		return
+	}
+	defer remote.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (t *Turn) handleForward(req forwardReq) {
+	reply := forwardReply{ID: req.ID}
+	var err error
+	switch req.Op {
+	case "open":
+		reply.Forward, err = t.OpenForward(req.Type, req.Listen, req.Target)
+	case "close":
+		err = t.CloseForward(req.Forward)
+	case "list":
+		reply.Forwards = t.Forwards()
+	default:
+		err = fmt.Errorf("unknown forward op %q", req.Op)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	t.writeControl(MsgForward, reply)
+}
@@ -0,0 +1,349 @@
+package webssh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolGuacamole speaks the instruction format of Apache Guacamole
+// (LENGTH.VALUE,...;) with the WebSocketTunnel of guacamole-common-js or a
+// gateway, chosen with ?protocol=guacamole or the "guacamole" subprotocol.
+//
+// The server opens an output pipe named STDOUT and sends the output as
+// its blobs, the window title as name, and disconnect, after error unless
+// the session ended normally, when it is closed. The client types with
+// key instructions, may send raw input as blobs of a pipe named STDIN,
+// and resizes with size, in pixels of a guacCellWidth by guacCellHeight
+// cell. A select/connect handshake is answered with args and ready.
+const ProtocolGuacamole = "guacamole"
+
+const (
+	// 输出管道的流编号
+	guacStdout = "1"
+	// guacamole-common-js默认15秒收不到数据就断开
+	guacNop = 5 * time.Second
+	// 每个blob最多带这么多字节，指令长度不能超过8192个字符
+	guacBlobSize = 4096
+	// 没有字体，按这个字符大小把像素换算成行列
+	guacCellWidth  = 8
+	guacCellHeight = 16
+	// 还没读完的指令最多攒这么多
+	maxGuacBuffer = 64 << 10
+)
+
+// Guacamole的状态码
+const (
+	guacServerError  = 0x0200
+	guacUnauthorized = 0x0301
+)
+
+var errGuacSyntax = errors.New("invalid guacamole instruction")
+
+type guacConn struct {
+	ws *websocket.Conn
+	id string
+	// 没读完的半条指令和读出来还没处理的
+	buf     []byte
+	pending [][]string
+	// 客户端打开的STDIN管道
+	stdin map[string]bool
+	ctrl  bool
+
+	mu     sync.Mutex
+	opened bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newGuacConn(ws *websocket.Conn) *guacConn {
+	g := &guacConn{ws: ws, id: newSessionID(), stdin: map[string]bool{}, done: make(chan struct{})}
+	// WebSocketTunnel先等一条操作码为空的指令，参数是隧道的uuid
+	g.write(guacInstruction("", g.id))
+	go g.keepalive()
+	return g
+}
+
+func (g *guacConn) keepalive() {
+	ticker := time.NewTicker(guacNop)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			if g.write(guacInstruction("nop")) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (g *guacConn) ReadMessage() (int, []byte, error) {
+	for {
+		for len(g.pending) > 0 {
+			ins := g.pending[0]
+			g.pending = g.pending[1:]
+			if msg := g.handle(ins); msg != nil {
+				return websocket.TextMessage, msg, nil
+			}
+		}
+		_, p, err := g.ws.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		g.buf = append(g.buf, p...)
+		for {
+			ins, rest, err := parseGuac(g.buf)
+			if err != nil {
+				return 0, nil, err
+			}
+			if ins == nil {
+				break
+			}
+			g.pending = append(g.pending, ins)
+			g.buf = rest
+		}
+		if len(g.buf) > maxGuacBuffer {
+			return 0, nil, errors.New("guacamole instruction too long")
+		}
+		g.buf = append([]byte(nil), g.buf...)
+	}
+}
+
+// handle answers one instruction of the client and returns the message of
+// the native protocol it stands for, if any.
+func (g *guacConn) handle(ins []string) []byte {
+	op, args := ins[0], ins[1:]
+	switch op {
+	case "":
+		// 隧道的ping原样送回
+		if len(args) > 0 && args[0] == "ping" {
+			g.write(guacInstruction("", args...))
+		}
+	case "select":
+		g.write(guacInstruction("args", "VERSION_1_5_0"))
+	case "connect":
+		g.write(guacInstruction("ready", "$"+g.id))
+	case "size":
+		if len(args) < 2 {
+			return nil
+		}
+		width, _ := strconv.Atoi(args[0])
+		height, _ := strconv.Atoi(args[1])
+		if width <= 0 || height <= 0 {
+			return nil
+		}
+		b, _ := json.Marshal(Resize{Columns: max(width/guacCellWidth, 1), Rows: max(height/guacCellHeight, 1)})
+		return controlFrame(MsgResize, b)
+	case "key":
+		if len(args) < 2 {
+			return nil
+		}
+		keysym, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil
+		}
+		pressed := args[1] == "1"
+		if keysym == 0xffe3 || keysym == 0xffe4 {
+			g.ctrl = pressed
+			return nil
+		}
+		if p := keysymInput(keysym, g.ctrl); pressed && p != nil {
+			return controlFrame(MsgData, p)
+		}
+	case "pipe":
+		if len(args) >= 3 && args[2] == "STDIN" {
+			g.stdin[args[0]] = true
+			g.write(guacInstruction("ack", args[0], "OK", "0"))
+		}
+	case "blob":
+		if len(args) < 2 || !g.stdin[args[0]] {
+			return nil
+		}
+		p, err := base64.StdEncoding.DecodeString(args[1])
+		g.write(guacInstruction("ack", args[0], "OK", "0"))
+		if err == nil && len(p) > 0 {
+			return controlFrame(MsgData, p)
+		}
+	case "end":
+		if len(args) >= 1 {
+			delete(g.stdin, args[0])
+		}
+	case "disconnect":
+		g.ws.Close()
+	}
+	return nil
+}
+
+// keysymInput is what the terminal gets for an X11 keysym, nil for keys
+// that send nothing.
+func keysymInput(keysym int, ctrl bool) []byte {
+	switch keysym {
+	case 0xff08:
+		return []byte{0x7f}
+	case 0xff09:
+		return []byte{'\t'}
+	case 0xff0d, 0xff8d:
+		return []byte{'\r'}
+	case 0xff1b:
+		return []byte{0x1b}
+	case 0xff50:
+		return []byte("\x1b[H")
+	case 0xff51:
+		return []byte("\x1b[D")
+	case 0xff52:
+		return []byte("\x1b[A")
+	case 0xff53:
+		return []byte("\x1b[C")
+	case 0xff54:
+		return []byte("\x1b[B")
+	case 0xff55:
+		return []byte("\x1b[5~")
+	case 0xff56:
+		return []byte("\x1b[6~")
+	case 0xff57:
+		return []byte("\x1b[F")
+	case 0xff63:
+		return []byte("\x1b[2~")
+	case 0xffff:
+		return []byte("\x1b[3~")
+	}
+	var r rune
+	switch {
+	case keysym >= 0x20 && keysym <= 0xff:
+		r = rune(keysym)
+	case keysym >= 0x1000100 && keysym <= 0x110ffff:
+		// Unicode字符的keysym
+		r = rune(keysym - 0x1000000)
+	default:
+		return nil
+	}
+	if ctrl {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return []byte{byte(r-'a') + 1}
+		case r >= '@' && r <= '_':
+			return []byte{byte(r - '@')}
+		}
+	}
+	return utf8.AppendRune(nil, r)
+}
+
+func (g *guacConn) WriteMessage(msgType int, p []byte) error {
+	if msgType == websocket.BinaryMessage {
+		g.mu.Lock()
+		opened := g.opened
+		g.opened = true
+		g.mu.Unlock()
+		if !opened {
+			if err := g.write(guacInstruction("pipe", guacStdout, "text/plain", "STDOUT")); err != nil {
+				return err
+			}
+		}
+		for len(p) > 0 {
+			n := min(len(p), guacBlobSize)
+			if err := g.write(guacInstruction("blob", guacStdout, base64.StdEncoding.EncodeToString(p[:n]))); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+		return nil
+	}
+	if len(p) == 0 || p[0] != MsgTermState {
+		return nil
+	}
+	var state termState
+	if json.Unmarshal(decode(p[1:]), &state) != nil || state.Title == "" {
+		return nil
+	}
+	return g.write(guacInstruction("name", state.Title))
+}
+
+func (g *guacConn) write(p []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ws.WriteMessage(websocket.TextMessage, p)
+}
+
+func (g *guacConn) Close() error {
+	g.once.Do(func() { close(g.done) })
+	return g.ws.Close()
+}
+
+// CloseWithCode reports an abnormal end as a Guacamole error before
+// disconnecting, see MessageConn.
+func (g *guacConn) CloseWithCode(code int, reason string) error {
+	switch code {
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway:
+	case websocket.ClosePolicyViolation:
+		g.write(guacInstruction("error", reason, strconv.Itoa(guacUnauthorized)))
+	default:
+		g.write(guacInstruction("error", reason, strconv.Itoa(guacServerError)))
+	}
+	g.write(guacInstruction("disconnect"))
+	g.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return g.Close()
+}
+
+// guacInstruction encodes op and args; the lengths count characters, not
+// bytes.
+func guacInstruction(op string, args ...string) []byte {
+	var b []byte
+	for i, s := range append([]string{op}, args...) {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendInt(b, int64(utf8.RuneCountInString(s)), 10)
+		b = append(append(b, '.'), s...)
+	}
+	return append(b, ';')
+}
+
+// parseGuac reads the first instruction in b and returns it with what
+// follows, or nil if b does not hold a whole instruction yet.
+func parseGuac(b []byte) ([]string, []byte, error) {
+	var ins []string
+	i := 0
+	for {
+		j := i
+		for j < len(b) && b[j] >= '0' && b[j] <= '9' {
+			j++
+		}
+		if j == len(b) {
+			return nil, b, nil
+		}
+		if j == i || b[j] != '.' || j-i > 5 {
+			return nil, nil, errGuacSyntax
+		}
+		n, _ := strconv.Atoi(string(b[i:j]))
+		// 长度是字符数，按UTF-8逐个数过去
+		k := j + 1
+		for ; n > 0; n-- {
+			if !utf8.FullRune(b[k:]) {
+				return nil, b, nil
+			}
+			_, size := utf8.DecodeRune(b[k:])
+			k += size
+		}
+		if k >= len(b) {
+			return nil, b, nil
+		}
+		ins = append(ins, string(b[j+1:k]))
+		switch b[k] {
+		case ',':
+			i = k + 1
+		case ';':
+			return ins, b[k+1:], nil
+		default:
+			return nil, nil, errGuacSyntax
+		}
+	}
+}
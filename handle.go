@@ -3,106 +3,407 @@ package webssh
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+	"golang.org/x/crypto/ssh"
 )
 
 type WebSSHConfig struct {
-	Record     bool
-	RecPath    string
+	Record  bool
+	RecPath string
+	// RecDirPerm是自动创建录像目录时使用的权限，默认0755
+	RecDirPerm os.FileMode
+	// RecDigest开启后在录像旁边写一个.sha256哈希链，用VerifyRecordingFile校验
+	RecDigest bool
+	// RecStorage为空时录像保存在本机的RecPath目录
+	RecStorage RecorderStorage
+	// RecIdleLimit大于0时录像里的空闲时间最多记这么长，见Recorder.IdleLimit
+	RecIdleLimit time.Duration
+	// RecTranscript开启后在录像旁边同时写一份去掉控制序列的纯文本(.txt)，方便全文检索
+	RecTranscript bool
+	// RecKeys不为空时录像(连同哈希链和纯文本)用AES-GCM加密保存，见EncryptedStorage
+	RecKeys RecordingKeys
+	// RecSigner不为空时每RecSignEvery行(默认64)和录像结束时签名，写到.sig，用VerifyStoredRecording校验
+	RecSigner    RecordingSigner
+	RecSignEvery int
+	// RecRetention不为空时StartPruner按它定期删除旧录像，见RetentionPolicy
+	RecRetention *RetentionPolicy
+	// Cluster不为空时StartCluster把会话发布到集群，见Cluster
+	Cluster *Cluster
+
 	RemoteAddr string
 	User       string
 	Password   string
 	AuthModel  AuthModel
 	PkPath     string
+	// 以下字段见SSHClientConfig
+	AuthModels   []AuthModel
+	Passphrase   string
+	AgentSocket  string
+	CertPath     string
+	GSSAPI       GSSAPIClientFunc
+	GSSAPITarget string
+	// RelayPrompts开启后KEYBOARD_INTERACTIVE的问题(如二次验证码)通过MsgPrompt
+	// 转给浏览器回答，否则都用Password回答
+	RelayPrompts bool
+	// 主机公钥校验，见SSHClientConfig
+	HostKeyCallback       ssh.HostKeyCallback
+	KnownHostsFile        string
+	TrustOnFirstUse       bool
+	InsecureIgnoreHostKey bool
+	// SessionEndWebhook不为空时，会话结束后把Result推送到该地址
+	SessionEndWebhook *Webhook
+	// Utmp开启后会话会写入本机的utmp/wtmp，who和last可以看到
+	Utmp bool
+	// Jumps是连接RemoteAddr时经过的跳板机，见SSHClientConfig
+	Jumps []*SSHClientConfig
+	// Proxy是连接远端用的socks5://或http://代理
+	Proxy string
+	// 连接远端失败时的重试次数和初始间隔
+	DialRetries int
+	DialBackoff time.Duration
+	// ShareConns开启后连同一主机、用户和凭据的会话共用一条ssh连接，各开一个channel（类似OpenSSH的ControlMaster）。
+	// 每条连接最多ShareConnsMax个会话(默认10，和sshd的MaxSessions一致)，最后一个会话结束后再保留ShareConnsIdle(默认1分钟)
+	ShareConns     bool
+	ShareConnsMax  int
+	ShareConnsIdle time.Duration
+	// PoolSize大于0时预先建立这么多个shell，新连接直接使用；设置了ReconnectVia时不预先建立。
+	// 退出前调用Shutdown关闭空闲的shell
+	PoolSize int
+	// Local为true时在本机的pty上启动shell，不连接RemoteAddr
+	Local bool
+	// Telnet为true时用telnet连接RemoteAddr，给没有ssh的老设备用
+	Telnet bool
+	// Serial不为空时连接本机的串口，不连接RemoteAddr
+	Serial *SerialConfig
+	// Credentials不为空时每次连接远端前从中取用户、密码和私钥，比如从Vault，配置里就不用写密码
+	Credentials CredentialProvider
+	// Authorizer不为空时，建立会话之前校验升级请求，并可以指定连接的主机、用户和命令
+	Authorizer Authorizer
+	// WSReadBufferSize和WSWriteBufferSize是websocket的读写缓冲，默认1KB和10KB；
+	// 写缓冲只在写消息时从池里取，空闲的连接不占用
+	WSReadBufferSize  int
+	WSWriteBufferSize int
+	// MaxMuxChannels是ServeMux一个连接上最多同时打开的终端数，默认16
+	MaxMuxChannels int
+	// Profiles不为空时客户端可以用?profile=<name>按名字连接配置好的主机，见Profile
+	Profiles *Profiles
+	TurnConfig
 }
 
 type WebSSH struct {
 	*WebSSHConfig
+	Sessions *SessionManager
+
+	pool *PTYPool
+	// 开启ShareConns时共用的ssh连接
+	conns *connShare
 }
 
 func NewWebSSH(conf *WebSSHConfig) *WebSSH {
-	return &WebSSH{
+	w := &WebSSH{
 		WebSSHConfig: conf,
+		Sessions:     NewSessionManager(),
+	}
+	// tmux/screen会话按会话ID命名，没法预先启动
+	if conf.PoolSize > 0 && !conf.Local && !conf.Telnet && conf.Serial == nil && conf.ReconnectVia == "" {
+		w.pool = NewPTYPool(conf.PoolSize, func() (*ssh.Client, error) {
+			return w.dial(nil, nil)
+		}, &conf.TurnConfig)
+		if conf.Context != nil {
+			context.AfterFunc(conf.Context, w.pool.Close)
+		}
+	}
+	if conf.ShareConns {
+		w.conns = newConnShare(conf.ShareConnsMax, conf.ShareConnsIdle)
+	}
+	return w
+}
+
+// Shutdown closes the idle shells of the pool, see PoolSize, and shuts
+// the live sessions down, see SessionManager.Shutdown.
+func (w *WebSSH) Shutdown(ctx context.Context) {
+	if w.pool != nil {
+		w.pool.Close()
 	}
+	w.Sessions.Shutdown(ctx)
 }
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024 * 10,
+	ReadBufferSize:  defaultWSReadBuffer,
+	WriteBufferSize: defaultWSWriteBuffer,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
 }
 
+// ServeConn runs a session on a websocket, or on an event stream with the
+// input in POSTs where websockets are blocked, see sseConn.
 func (w WebSSH) ServeConn(c *gin.Context) {
-	wsConn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if c.Request.Method == http.MethodPost {
+		// 连接id就是凭证，升级时已经校验过了
+		if status, err := postEventInput(c.Request); err != nil {
+			c.AbortWithStatusJSON(status, gin.H{"ok": false, "msg": err.Error()})
+		} else {
+			c.Status(status)
+		}
+		return
+	}
+	target, err := w.authorize(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	if isEventStream(c.Request) {
+		err := serveEventStream(c.Writer, c.Request, func(wsConn *websocket.Conn) {
+			w.withTarget(target).serveNamed(wsConn, c.Request, c.ClientIP())
+		})
+		if err != nil {
+			c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		}
+		return
+	}
+	wsConn, err := w.upgrade(c.Writer, c.Request)
 	if err != nil {
 		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
 		return
 	}
 	defer wsConn.Close()
-	var config *SSHClientConfig
-	switch w.AuthModel {
+	bridgeMessages(withProtocol(c.Request, wsConn), func(wsConn *websocket.Conn) {
+		w.withTarget(target).serveNamed(wsConn, c.Request, c.ClientIP())
+	})
+}
 
-	case PASSWORD:
-		config = SSHClientConfigPassword(
-			w.RemoteAddr,
-			w.User,
-			w.Password,
-		)
-	case PUBLICKEY:
-		config = SSHClientConfigPulicKey(
-			w.RemoteAddr,
-			w.User,
-			w.PkPath,
-		)
+// serveRequest authorizes r and runs its session on wsConn, which has
+// already been upgraded.
+func (w WebSSH) serveRequest(wsConn *websocket.Conn, r *http.Request, clientIP string) {
+	target, err := w.authorize(r)
+	if err != nil {
+		closeWithError(wsConn, errorFor(err))
+		return
 	}
+	w.withTarget(target).serveNamed(wsConn, r, clientIP)
+}
 
-	client, err := NewSSHClient(config)
-	if err != nil {
-		wsConn.WriteControl(websocket.CloseMessage,
-			[]byte(err.Error()), time.Now().Add(time.Second))
+// serveNamed reattaches to the session named in the query or starts a new
+// one.
+func (w WebSSH) serveNamed(wsConn *websocket.Conn, r *http.Request, clientIP string) {
+	if name := r.URL.Query().Get("name"); name != "" {
+		// 同名会话还在就接回去
+		if turn := w.Sessions.Find(w.Owner, name); turn != nil {
+			if err := turn.Reattach(wsConn); err != nil {
+				closeWithError(wsConn, errorFor(err))
+				return
+			}
+			<-turn.Done()
+			return
+		}
+		conf := *w.WebSSHConfig
+		conf.Name = name
+		w.WebSSHConfig = &conf
+	}
+	w.serve(wsConn, r, clientIP)
+}
+
+// serve runs a new session on an upgraded connection until it ends.
+func (w WebSSH) serve(wsConn *websocket.Conn, r *http.Request, clientIP string) {
+	var err error
+	var profile *Profile
+	if name := r.URL.Query().Get("profile"); name != "" {
+		if w, profile, err = w.withProfile(name); err != nil {
+			closeWithError(wsConn, errorFor(err))
+			return
+		}
+	}
+	if profile != nil && profile.Passthrough {
+		addr, err := profile.tunnelAddr(r.URL.Query().Get("port"))
+		if err == nil && w.Policies != nil {
+			err = w.Policies.CheckTarget(addr)
+		}
+		if err != nil {
+			w.logger().Warn("tunnel not allowed", "remote", clientIP, "profile", profile.Name, "err", err)
+			closeWithError(wsConn, errorFor(err))
+			return
+		}
+		w.serveTunnel(wsConn, addr, clientIP)
 		return
 	}
-	defer client.Close()
+	if w.Policies != nil && !w.Local && w.Serial == nil {
+		if err := w.Policies.CheckTarget(w.RemoteAddr); err != nil {
+			w.logger().Warn("target not allowed", "remote", clientIP, "target", w.RemoteAddr)
+			closeWithError(wsConn, errorFor(err))
+			return
+		}
+	}
+	turnConfig := w.TurnConfig
+	if turnConfig.TraceContext == nil {
+		turnConfig.TraceContext = TraceContextFromRequest(r)
+	}
+	if turnConfig.SessionID == "" {
+		turnConfig.SessionID = turnConfig.NewID()
+	}
+	// 直接链接可以在url里带上初始大小：/ws/1?cols=120&rows=40
+	if rows, cols, ok := querySize(r.URL.Query()); ok {
+		turnConfig.Rows, turnConfig.Cols = rows, cols
+	}
+	// 远端是GBK等旧字符集时可以带上?charset=gbk
+	if charset := r.URL.Query().Get("charset"); charset != "" {
+		turnConfig.Charset = charset
+	}
+	// 锁屏后默认由Authorizer重新认证
+	if turnConfig.LockAfter > 0 && turnConfig.Unlock == nil && w.Authorizer != nil {
+		turnConfig.Unlock = UnlockWithAuthorizer(w.Authorizer)
+	}
+	if turnConfig.Banner != "" && turnConfig.BannerUser == "" && turnConfig.BannerHost == "" {
+		turnConfig.BannerUser, turnConfig.BannerHost = w.User, w.RemoteAddr
+	}
+	// 否则等客户端的第一条消息，是resize的话按这个大小启动shell
+	var first chan firstMessage
+	parser := turnConfig.newParser()
+	if turnConfig.Rows <= 0 || turnConfig.Cols <= 0 {
+		first = readFirst(wsConn, parser)
+		if rows, cols, ok := waitFirstSize(first, initialSizeWait); ok {
+			turnConfig.Rows, turnConfig.Cols = rows, cols
+			first = nil
+		}
+	}
 
 	var recorder *Recorder
+	var recordingPath string
 	if w.Record {
-		// mask := syscall.Umask(0)
-		// defer syscall.Umask(mask)
-		os.MkdirAll(w.RecPath, os.ModePerm)
-
 		safeRemoteAddr := strings.ReplaceAll(w.RemoteAddr, ":", "_")
-		fileName := filepath.Join(w.RecPath, fmt.Sprintf("%s_%s_%s.cast", safeRemoteAddr, w.User, time.Now().Format("20060102_150405")))
+		name := fmt.Sprintf("%s_%s_%s.cast", safeRemoteAddr, w.User, time.Now().Format("20060102_150405"))
+		recordingPath = name
+		if w.RecStorage == nil {
+			recordingPath = filepath.Join(w.RecPath, name)
+		}
+		// 在recorder.Close之后才释放，空闲很久的会话的录像也不会被清理掉
+		defer w.Sessions.openRecording(name)()
+		recorder, err = NewStorageRecorder(w.storage(), name, w.RecDigest)
+		if err != nil {
+			// 录像失败时不建立会话
+			w.logger().Error("create recording", "session", turnConfig.SessionID, "err", err)
+			closeWithError(wsConn, errorFor(err))
+			return
+		}
+		defer recorder.Close()
+		if w.RecSigner != nil {
+			sw, err := w.storage().Create(name + signatureSuffix)
+			if err != nil {
+				// 审计要求签名，签不了就不建立会话
+				w.logger().Error("create recording signature", "session", turnConfig.SessionID, "err", err)
+				closeWithError(wsConn, errorFor(&RecordingError{Path: name + signatureSuffix, Err: err}))
+				return
+			}
+			recorder.Sign(sw, w.RecSigner, w.RecSignEvery)
+		}
+		if w.RecTranscript {
+			if tw, err := w.storage().Create(name + transcriptSuffix); err != nil {
+				w.logger().Warn("create transcript", "session", turnConfig.SessionID, "err", err)
+			} else {
+				recorder.Transcript = NewTranscriber(tw)
+			}
+		}
+		recorder.Title = fmt.Sprintf("%s@%s", w.User, w.RemoteAddr)
+		recorder.IdleLimit = w.RecIdleLimit
+		w.logger().Info("recording", "session", turnConfig.SessionID, "path", recordingPath)
+	}
 
-		f, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	var client *ssh.Client
+	// 回答认证问题时收到的其他消息，会话建立后按顺序处理
+	var held []firstMessage
+	if w.pool == nil && !w.Local && !w.Telnet && w.Serial == nil {
+		var challenge ssh.KeyboardInteractiveChallenge
+		relay := &promptRelay{ws: wsConn, parser: parser, first: first}
+		if w.RelayPrompts {
+			challenge = relay.challenge
+		}
+		var release func()
+		client, release, err = w.connect(func(attempt, retries int, err error) {
+			wsConn.WriteMessage(websocket.BinaryMessage, []byte(RetryNotice(attempt, retries, err)))
+		}, challenge)
+		first, held = relay.first, relay.held
 		if err != nil {
-			fmt.Println(err.Error())
-			c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+			if warning := HostKeyWarning(err); warning != "" {
+				wsConn.WriteMessage(websocket.BinaryMessage, []byte(warning))
+			}
+			closeWithError(wsConn, errorFor(err))
+			return
 		}
-		fmt.Println(fileName)
-		defer f.Close()
-		recorder = NewRecorder(f)
+		defer release()
 	}
 
-	turn, err := NewTurn(wsConn, client, recorder)
+	var turn *Turn
+	if w.pool != nil {
+		turn, err = w.pool.Get(wsConn, recorder, &turnConfig)
+	} else if w.Local {
+		turn, err = NewLocalTurn(wsConn, recorder, &turnConfig)
+	} else if w.Serial != nil {
+		turn, err = NewSerialTurn(wsConn, w.Serial, recorder, &turnConfig)
+	} else if w.Telnet {
+		turn, err = NewTelnetTurn(wsConn, &TelnetConfig{Addr: w.RemoteAddr}, recorder, &turnConfig)
+	} else if w.Reconnect > 0 {
+		// 重连时不再转发认证问题，LoopRead已经在读这个websocket
+		turn, err = NewReconnectingTurn(wsConn, client, func() (*ssh.Client, func(), error) {
+			return w.connect(nil, nil)
+		}, recorder, &turnConfig)
+	} else {
+		turn, err = NewTurn(wsConn, client, recorder, &turnConfig)
+	}
 	if err != nil {
-		wsConn.WriteControl(websocket.CloseMessage,
-			[]byte(err.Error()), time.Now().Add(time.Second))
+		closeWithError(wsConn, errorFor(err))
 		return
 	}
 	defer turn.Close()
+	turn.upgradeReq = r
+	turn.clientIP = clientIP
+	turn.recording = recordingPath
+	if err := w.Sessions.Admit(turn); err != nil {
+		closeWithError(wsConn, errorFor(err))
+		return
+	}
+	defer w.Sessions.Remove(turn)
+	if err := turn.startHooks(); err != nil {
+		closeWithError(wsConn, errorFor(err))
+		return
+	}
+	w.Events.Publish(SessionStartedEvent{
+		EventHeader: turn.header(),
+		Owner:       turn.Owner,
+		Remote:      clientIP,
+		User:        w.User,
+		Host:        w.RemoteAddr,
+	})
+	if w.Utmp {
+		if err := turn.UtmpLogin(w.User, clientIP); err != nil {
+			turn.logger().Warn("utmp login", "err", err)
+		} else {
+			defer turn.UtmpLogout()
+		}
+	}
+	if w.SessionEndWebhook != nil {
+		defer func() {
+			r := turn.Result()
+			r.User = w.User
+			r.RemoteAddr = w.RemoteAddr
+			r.RecordingPath = recordingPath
+			w.SessionEndWebhook.Send(r)
+		}()
+	}
 
 	logBuff := bufPool.Get().(*bytes.Buffer)
 	logBuff.Reset()
@@ -113,37 +414,383 @@ func (w WebSSH) ServeConn(c *gin.Context) {
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
+		// 第一条消息不是resize或者等超时了，先处理它再进入读循环
+		if first != nil {
+			held = append(held, <-first)
+		}
+		for _, msg := range held {
+			if msg.err != nil && !wire.Malformed(msg.err) {
+				turn.logger().Warn("read first message", "err", msg.err)
+				return
+			}
+			var err error
+			if msg.err != nil {
+				// 太长的消息已经丢掉了
+				err = turn.protocolViolation(RoleOwner, 0, msg.err)
+			} else {
+				err = turn.handleMessage(ctx, RoleOwner, msg.msgType, msg.p, logBuff)
+			}
+			if err != nil {
+				turn.logger().Warn("handle message", "err", err)
+				return
+			}
+		}
 		err := turn.LoopRead(logBuff, ctx)
 		if err != nil {
-			log.Printf("%#v", err)
+			turn.logger().Info("read loop ended", "err", err)
 		}
 	}()
 	go func() {
 		defer wg.Done()
 		err := turn.SessionWait()
 		if err != nil {
-			log.Printf("%#v", err)
+			turn.logger().Info("session ended", "err", err)
 		}
 		cancel()
+		// 关闭连接，让LoopRead从ReadMessage返回
+		turn.Close()
 	}()
 	wg.Wait()
 }
 
-func (w WebSSH) RecoderList(c *gin.Context) {
-	files, err := ioutil.ReadDir(w.RecPath)
+type firstMessage struct {
+	msgType int
+	p       []byte
+	err     error
+}
+
+// readFirst reads the first message from wsConn in the background. Nothing
+// else may read from wsConn until it has been received.
+func readFirst(wsConn *websocket.Conn, parser *wire.Parser) chan firstMessage {
+	ch := make(chan firstMessage, 1)
+	go func() {
+		ch <- readFrame(wsConn, parser)
+	}()
+	return ch
+}
+
+// readFrame reads a whole message from wsConn, within the size limit of
+// parser, before the session that parses it exists.
+func readFrame(wsConn *websocket.Conn, parser *wire.Parser) firstMessage {
+	msgType, r, err := wsConn.NextReader()
+	if err != nil {
+		return firstMessage{err: err}
+	}
+	p, err := parser.ReadFrame(msgType, r)
+	if errors.Is(err, wire.ErrEmpty) {
+		p, err = []byte{0}, nil
+	}
+	return firstMessage{msgType: msgType, p: p, err: err}
+}
+
+// waitFirstSize waits at most timeout for the first message and returns the
+// size it carries if it is a resize. Otherwise the message stays in the
+// channel.
+func waitFirstSize(first chan firstMessage, timeout time.Duration) (int, int, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-first:
+		if msg.err == nil && msg.p[0] == MsgResize {
+			var args Resize
+			if json.Unmarshal(decode(msg.p[1:]), &args) == nil && args.Rows > 0 && args.Columns > 0 {
+				return args.Rows, args.Columns, true
+			}
+		}
+		// 放回去，由读循环处理
+		first <- msg
+		return 0, 0, false
+	case <-timer.C:
+		return 0, 0, false
+	}
+}
+
+func querySize(q url.Values) (int, int, bool) {
+	rows, err := strconv.Atoi(q.Get("rows"))
+	if err != nil || rows <= 0 {
+		return 0, 0, false
+	}
+	cols, err := strconv.Atoi(q.Get("cols"))
+	if err != nil || cols <= 0 {
+		return 0, 0, false
+	}
+	return rows, cols, true
+}
+
+func (w *WebSSH) dial(onRetry func(attempt, retries int, err error), challenge ssh.KeyboardInteractiveChallenge) (*ssh.Client, error) {
+	config, err := w.clientConfig(onRetry, challenge)
+	if err != nil {
+		return nil, err
+	}
+	return NewSSHClient(config)
+}
+
+// clientConfig is the SSHClientConfig for RemoteAddr, with the credentials
+// filled in.
+func (w *WebSSH) clientConfig(onRetry func(attempt, retries int, err error), challenge ssh.KeyboardInteractiveChallenge) (*SSHClientConfig, error) {
+	var config *SSHClientConfig
+	switch w.AuthModel {
+
+	case PASSWORD:
+		config = SSHClientConfigPassword(
+			w.RemoteAddr,
+			w.User,
+			w.Password,
+		)
+	case PUBLICKEY:
+		config = SSHClientConfigPulicKey(
+			w.RemoteAddr,
+			w.User,
+			w.PkPath,
+		)
+	}
+	if config == nil {
+		config = &SSHClientConfig{
+			Timeout:   time.Second * 5,
+			AuthModel: w.AuthModel,
+			HostAddr:  w.RemoteAddr,
+			User:      w.User,
+			Password:  w.Password,
+			KeyPath:   w.PkPath,
+		}
+	}
+	config.AuthModels = w.AuthModels
+	config.Passphrase = w.Passphrase
+	config.AgentSocket = w.AgentSocket
+	config.CertPath = w.CertPath
+	config.GSSAPI = w.GSSAPI
+	config.GSSAPITarget = w.GSSAPITarget
+	config.HostKeyCallback = w.HostKeyCallback
+	config.KnownHostsFile = w.KnownHostsFile
+	config.TrustOnFirstUse = w.TrustOnFirstUse
+	config.InsecureIgnoreHostKey = w.InsecureIgnoreHostKey
+	config.Jumps = w.Jumps
+	config.Proxy = w.Proxy
+	config.Retries = w.DialRetries
+	config.RetryBackoff = w.DialBackoff
+	config.OnRetry = onRetry
+	if err := w.credentials(config); err != nil {
+		return nil, err
+	}
+	if challenge != nil {
+		relayPrompts(config, challenge)
+	}
+	return config, nil
+}
+
+// ServeAttach joins the connection to the live session named by the id
+// parameter. The owner of the session, as given by the Authorizer, joins
+// as owner; anybody else joins as a viewer once the owner approved, see
+// JoinApproval, whether or not the session asks for approval.
+func (w WebSSH) ServeAttach(c *gin.Context) {
+	target, err := w.authorize(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	turn := w.Sessions.Get(c.Param("id"))
+	if turn == nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": "session not found"})
+		return
+	}
+	role := RoleViewer
+	// 没有Authorizer时没有身份，谁都只能旁观
+	if target != nil && target.Identity != "" && target.Identity == turn.Owner && c.Query("role") != "viewer" {
+		role = RoleOwner
+	}
+	wsConn, err := w.upgrade(c.Writer, c.Request)
 	if err != nil {
 		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
 		return
 	}
-	var filesName []string
-	for _, f := range files {
-		if f.IsDir() {
-			continue
+	defer wsConn.Close()
+	if err := turn.requestJoin(wsConn, role, c.ClientIP(), role != RoleOwner); err != nil {
+		if errors.Is(err, ErrSessionLocked) {
+			closeWithError(wsConn, errorFor(err))
 		}
+		turn.logger().Warn("join", "remote", c.ClientIP(), "err", err)
+	}
+}
 
-		if strings.HasSuffix(f.Name(), ".cast") {
-			filesName = append(filesName, f.Name())
-		}
+// ServeHandoff moves the session named by the token query parameter, see
+// MsgHandoff, to this connection.
+func (w WebSSH) ServeHandoff(c *gin.Context) {
+	turn, ok := w.Sessions.TakeHandoff(c.Query("token"))
+	if !ok {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": "invalid or expired token"})
+		return
+	}
+	wsConn, err := w.upgrade(c.Writer, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	turn.Rebind(wsConn)
+	<-turn.Done()
+}
+
+// ServeReattach attaches this connection to the session named by the
+// session query parameter after its connection dropped, see ResumeGrace.
+// Only the identity that owns the session may take it back.
+func (w WebSSH) ServeReattach(c *gin.Context) {
+	target, err := w.authorize(c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	turn := w.Sessions.Get(c.Query("session"))
+	if turn == nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": ErrSessionNotFound.Error()})
+		return
+	}
+	var identity string
+	if target != nil {
+		identity = target.Identity
+	}
+	if identity != turn.Owner {
+		turn.logger().Warn("reattach refused", "remote", c.ClientIP(), "identity", identity)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": ErrUnauthorized.Error()})
+		return
+	}
+	wsConn, err := w.upgrade(c.Writer, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	if err := turn.Reattach(wsConn); err != nil {
+		closeWithError(wsConn, errorFor(err))
+		wsConn.Close()
+		return
+	}
+	<-turn.Done()
+}
+
+// ServeReplay plays the recording named by the name parameter, which must
+// be one of the files listed by RecoderList, with its original timing. See
+// Player for the control messages the client may send.
+func (w WebSSH) ServeReplay(c *gin.Context) {
+	name := filepath.Base(c.Param("name"))
+	f, err := w.OpenRecording(name)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	defer f.Close()
+	wsConn, err := w.upgrade(c.Writer, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	defer wsConn.Close()
+	player, err := NewPlayer(wsConn, f)
+	if err != nil {
+		closeWithError(wsConn, errorFor(err))
+		return
+	}
+	// idle参数（秒）把回放时的停顿压缩到最多这么长
+	if idle, err := strconv.ParseFloat(c.Query("idle"), 64); err == nil {
+		player.CapIdle(time.Duration(idle * float64(time.Second)))
+	}
+	if err := player.Play(c.Request.Context()); err != nil {
+		w.logger().Warn("replay", "recording", name, "err", err)
+		return
+	}
+	wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+func (w WebSSH) RecoderList(c *gin.Context) {
+	filesName, err := w.Recordings()
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
 	}
 	c.JSON(200, filesName)
 }
+
+// SessionList lists the live sessions.
+func (w WebSSH) SessionList(c *gin.Context) {
+	if c.Query("cluster") != "" {
+		list, err := w.ClusterSessions()
+		if err != nil {
+			c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+			return
+		}
+		c.JSON(200, list)
+		return
+	}
+	c.JSON(200, w.Sessions.List())
+}
+
+// KillSession closes the session named by the id parameter.
+func (w WebSSH) KillSession(c *gin.Context) {
+	if err := w.Sessions.Kill(c.Param("id")); err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"ok": true})
+}
+
+// OpenRecording opens the recording name, which must be one of the files
+// listed by Recordings.
+func (w WebSSH) OpenRecording(name string) (io.ReadCloser, error) {
+	name = filepath.Base(name)
+	if !strings.HasSuffix(name, ".cast") {
+		return nil, errors.New("not a recording")
+	}
+	return w.storage().Open(name)
+}
+
+// VerifyRecording checks the signatures of the recording name, see
+// VerifySignatures.
+func (w WebSSH) VerifyRecording(name string, v RecordingVerifier) (*VerifyResult, error) {
+	return VerifyStoredRecording(w.storage(), filepath.Base(name), v)
+}
+
+// StartPruner applies RecRetention to the recordings every interval
+// (default an hour) until ctx is done.
+func (w *WebSSH) StartPruner(ctx context.Context, interval time.Duration) {
+	if w.RecRetention == nil {
+		return
+	}
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	p := *w.RecRetention
+	if p.InUse == nil {
+		p.InUse = w.Sessions.RecordingOpen
+	}
+	p.Start(ctx, w.storage(), interval)
+}
+
+// StartCluster publishes the sessions to Cluster until ctx is done.
+func (w *WebSSH) StartCluster(ctx context.Context) error {
+	if w.Cluster == nil {
+		return errNoCluster
+	}
+	return w.Cluster.Start(ctx, w.Sessions)
+}
+
+// ClusterSessions returns the live sessions of every instance of Cluster.
+func (w WebSSH) ClusterSessions() ([]ClusterSession, error) {
+	if w.Cluster == nil {
+		return nil, errNoCluster
+	}
+	return w.Cluster.Sessions()
+}
+
+// Recordings returns the names of the recordings, oldest first.
+func (w WebSSH) Recordings() ([]string, error) {
+	return w.storage().List()
+}
+
+func (w *WebSSH) storage() RecorderStorage {
+	var s RecorderStorage = &LocalStorage{Dir: w.RecPath, DirPerm: w.RecDirPerm, Events: w.Events}
+	if w.RecStorage != nil {
+		s = w.RecStorage
+	}
+	if w.RecKeys != nil {
+		s = &EncryptedStorage{Storage: s, Keys: w.RecKeys}
+	}
+	return s
+}
@@ -0,0 +1,101 @@
+package webssh
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgHandoff asks the server for a token that lets another connection take
+// over the session. The server answers with {"token": ..., "expires": ...}.
+const MsgHandoff = wire.MsgHandoff
+
+const defaultHandoffTTL = 30 * time.Second
+
+type handoffToken struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	turn    *Turn
+}
+
+// NewHandoffToken returns a single-use token for taking over t.
+func (m *SessionManager) NewHandoffToken(t *Turn, ttl time.Duration) handoffToken {
+	if ttl <= 0 {
+		ttl = defaultHandoffTTL
+	}
+	tok := handoffToken{
+		Token:   newSessionID(),
+		Expires: time.Now().Add(ttl),
+		turn:    t,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handoffs == nil {
+		m.handoffs = make(map[string]handoffToken)
+	}
+	now := time.Now()
+	for k, v := range m.handoffs {
+		if now.After(v.Expires) {
+			delete(m.handoffs, k)
+		}
+	}
+	m.handoffs[tok.Token] = tok
+	if c := m.cluster.Load(); c != nil {
+		go c.publishToken(tok)
+	}
+	return tok
+}
+
+// TakeHandoff redeems a token. Each token works once and only before it
+// expires.
+func (m *SessionManager) TakeHandoff(token string) (*Turn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tok, ok := m.handoffs[token]
+	if !ok {
+		return nil, false
+	}
+	delete(m.handoffs, token)
+	if c := m.cluster.Load(); c != nil {
+		go c.Store.Delete(c.key("handoff", token))
+	}
+	if time.Now().After(tok.Expires) || tok.turn.ctx.Err() != nil {
+		return nil, false
+	}
+	return tok.turn, true
+}
+
+// Rebind moves the session to wsConn. The previous connection is told the
+// session was transferred and closed; LoopRead continues on wsConn.
+func (t *Turn) Rebind(wsConn *websocket.Conn) {
+	t.wsMu.Lock()
+	old := t.WsConn
+	if old != nil {
+		if msg := t.disconnectMessage(ReasonTransferred); msg != "" {
+			t.writeDataLocked([]byte("\r\n" + msg + "\r\n"))
+		}
+		old.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, string(ReasonTransferred)),
+			time.Now().Add(time.Second))
+	}
+	t.WsConn = wsConn
+	// 新连接还没有协商过
+	t.gzipOn.Store(false)
+	t.binaryIn.Store(false)
+	t.wsMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Done is closed when the session ends.
+func (t *Turn) Done() <-chan struct{} {
+	return t.ctx.Done()
+}
+
+func (t *Turn) conn() *websocket.Conn {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	return t.WsConn
+}
@@ -0,0 +1,90 @@
+package webssh
+
+// Hook lets embedders observe and change what passes through a session,
+// e.g. for auditing, metrics or filtering. Hooks in TurnConfig.Hooks are
+// composed as middleware: the first one sees the data first and decides
+// whether and what to pass to next. Returning an error from OnInput or
+// OnOutput ends the session; to drop data return nil without calling next.
+// Embed NopHook to implement only some of the methods.
+type Hook interface {
+	// OnSessionStart is called once the session is registered; an error
+	// closes it before any input is read.
+	OnSessionStart(t *Turn) error
+	// OnInput sees what the user typed after InputTransformers, before
+	// CommandPolicy and auditing.
+	OnInput(t *Turn, p []byte, next func([]byte) error) error
+	// OnOutput sees the output of the shell after OutputTransformers, before
+	// it is recorded and sent. zmodem and trzsz transfers bypass it.
+	OnOutput(t *Turn, p []byte, next func([]byte) error) error
+	// OnResize sees the size after MaxRows, MaxCols and ResizeTransform.
+	OnResize(t *Turn, rows, cols int, next func(rows, cols int) error) error
+	// OnClose is called once when the session is closed. reason is empty
+	// unless the server ended it with CloseWithReason.
+	OnClose(t *Turn, reason Reason)
+}
+
+// NopHook passes everything on unchanged.
+type NopHook struct{}
+
+func (NopHook) OnSessionStart(*Turn) error { return nil }
+
+func (NopHook) OnInput(_ *Turn, p []byte, next func([]byte) error) error { return next(p) }
+
+func (NopHook) OnOutput(_ *Turn, p []byte, next func([]byte) error) error { return next(p) }
+
+func (NopHook) OnResize(_ *Turn, rows, cols int, next func(rows, cols int) error) error {
+	return next(rows, cols)
+}
+
+func (NopHook) OnClose(*Turn, Reason) {}
+
+// startHooks runs OnSessionStart of every hook, stopping at the first error.
+func (t *Turn) startHooks() error {
+	for _, h := range t.Hooks {
+		if err := h.OnSessionStart(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookInput passes p through OnInput of every hook and then to last.
+func (t *Turn) hookInput(p []byte, last func([]byte) error) error {
+	next := last
+	for i := len(t.Hooks) - 1; i >= 0; i-- {
+		h, n := t.Hooks[i], next
+		next = func(p []byte) error { return h.OnInput(t, p, n) }
+	}
+	return next(p)
+}
+
+// hookOutput passes p through OnOutput of every hook and then to last.
+func (t *Turn) hookOutput(p []byte, last func([]byte) error) error {
+	next := last
+	for i := len(t.Hooks) - 1; i >= 0; i-- {
+		h, n := t.Hooks[i], next
+		next = func(p []byte) error { return h.OnOutput(t, p, n) }
+	}
+	return next(p)
+}
+
+// hookResize passes the size through OnResize of every hook and then to
+// last.
+func (t *Turn) hookResize(rows, cols int, last func(rows, cols int) error) error {
+	next := last
+	for i := len(t.Hooks) - 1; i >= 0; i-- {
+		h, n := t.Hooks[i], next
+		next = func(rows, cols int) error { return h.OnResize(t, rows, cols, n) }
+	}
+	return next(rows, cols)
+}
+
+// closeHooks runs OnClose of every hook, only the first time it is called.
+func (t *Turn) closeHooks() {
+	t.hooksClosed.Do(func() {
+		reason, _ := t.closeReason.Load().(Reason)
+		for _, h := range t.Hooks {
+			h.OnClose(t, reason)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var tofuMu sync.Mutex
+
+// hostKeyCallback builds the host key check for conf. Unless told otherwise
+// keys are checked against ~/.ssh/known_hosts.
+func hostKeyCallback(conf *SSHClientConfig) (ssh.HostKeyCallback, error) {
+	if conf.HostKeyCallback != nil {
+		return conf.HostKeyCallback, nil
+	}
+	if conf.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := conf.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if conf.TrustOnFirstUse {
+		return tofuCallback(file), nil
+	}
+	return knownhosts.New(file)
+}
+
+// tofuCallback accepts and remembers the key of a host seen for the first
+// time and rejects any later change of it.
+func tofuCallback(file string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		tofuMu.Lock()
+		defer tofuMu.Unlock()
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+				return err
+			}
+			if err := os.WriteFile(file, nil, 0o600); err != nil {
+				return err
+			}
+		}
+		check, err := knownhosts.New(file)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}
+}
+
+// HostKeyWarning returns a message for the user if err is a host key
+// mismatch, or "".
+func HostKeyWarning(err error) string {
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return ""
+	}
+	if len(keyErr.Want) == 0 {
+		return "WARNING: host key is unknown, refusing to connect.\r\n"
+	}
+	return "WARNING: REMOTE HOST IDENTIFICATION HAS CHANGED! " +
+		"Someone could be eavesdropping on you, refusing to connect.\r\n"
+}
@@ -0,0 +1,140 @@
+package webssh
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// HandlerOptions configures Handler.
+type HandlerOptions struct {
+	*WebSSHConfig
+	// Sessions不为空时会话登记在这里，否则用新建的SessionManager
+	Sessions *SessionManager
+
+	// AllowedOrigins为空时只接受和请求Host相同的Origin(或没有Origin)，
+	// "*"接受所有来源。"https://*.example.com"匹配子域名，不带scheme时匹配任意scheme
+	AllowedOrigins []string
+	// OriginPolicy见OriginStrict，默认OriginSameHost
+	OriginPolicy OriginPolicy
+	// IPPolicy不为空时按ClientIP给出的地址限制连接，见NewIPPolicy。
+	// 被IPPolicy或Origin拒绝的请求以403返回，并作为rejected事件交给AuditLogger
+	IPPolicy *IPPolicy
+	// Subprotocols是服务端支持的websocket子协议，按客户端给出的顺序选第一个支持的
+	Subprotocols []string
+	// Authorize在升级之前调用，返回错误时以403拒绝连接
+	Authorize func(r *http.Request) error
+	// ClientIP从请求中取出客户端地址，默认取RemoteAddr
+	ClientIP func(r *http.Request) string
+}
+
+type handler struct {
+	ws       *WebSSH
+	opts     HandlerOptions
+	upgrader websocket.Upgrader
+}
+
+// Handler returns an http.Handler that upgrades each request to a
+// websocket and runs a session on it, so it can be mounted on any mux
+// without gin.
+func Handler(opts HandlerOptions) http.Handler {
+	ws := NewWebSSH(opts.WebSSHConfig)
+	if opts.Sessions != nil {
+		ws.Sessions = opts.Sessions
+	}
+	h := &handler{ws: ws, opts: opts}
+	h.upgrader = opts.WebSSHConfig.newUpgrader()
+	// ttyd、Guacamole和noVNC的客户端各自要求自己的子协议，v2的客户端用子协议协商版本
+	h.upgrader.Subprotocols = append(append([]string(nil), opts.Subprotocols...), ProtocolV2, ProtocolTTY, ProtocolGuacamole, ProtocolBinary)
+	h.upgrader.CheckOrigin = h.checkOrigin
+	// 级别在升级之后设置
+	h.upgrader.EnableCompression = opts.WebSSHConfig.Deflate
+	return h
+}
+
+func (h *handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if h.opts.IPPolicy != nil {
+		if err := h.opts.IPPolicy.Check(h.clientIP(r)); err != nil {
+			h.rejectUpgrade(rw, r, "rejected", err)
+			return
+		}
+	}
+	if r.Method == http.MethodPost {
+		if status, err := postEventInput(r); err != nil {
+			http.Error(rw, err.Error(), status)
+		} else {
+			rw.WriteHeader(status)
+		}
+		return
+	}
+	if h.opts.Authorize != nil {
+		if err := h.opts.Authorize(r); err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	target, err := h.ws.authorize(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusForbidden)
+		return
+	}
+	// 在升级之前检查，被拒绝的来源也能记入审计日志
+	if !h.checkOrigin(r) {
+		h.rejectUpgrade(rw, r, "rejected", fmt.Errorf("origin %q not allowed", r.Header.Get("Origin")))
+		return
+	}
+	if isEventStream(r) {
+		err := serveEventStream(rw, r, func(wsConn *websocket.Conn) {
+			h.ws.withTarget(target).serve(wsConn, r, h.clientIP(r))
+		})
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// 升级失败时Upgrader已经写好了错误响应
+	wsConn, err := h.upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		return
+	}
+	defer wsConn.Close()
+	h.opts.WebSSHConfig.setDeflateLevel(wsConn)
+	bridgeMessages(withProtocol(r, wsConn), func(wsConn *websocket.Conn) {
+		h.ws.withTarget(target).serve(wsConn, r, h.clientIP(r))
+	})
+}
+
+func (h *handler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	switch {
+	case h.opts.OriginPolicy == OriginAny:
+		return true
+	case origin == "":
+		return h.opts.OriginPolicy != OriginStrict
+	}
+	if len(h.opts.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, o := range h.opts.AllowedOrigins {
+		if o == "*" && h.opts.OriginPolicy != OriginStrict || matchOrigin(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) clientIP(r *http.Request) string {
+	if h.opts.ClientIP != nil {
+		return h.opts.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,117 @@
+package webssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// HashChain writes one hex encoded hash per recording line, where each hash
+// covers the line and the hash before it. Changing, dropping or reordering
+// any line breaks the chain from that line on.
+type HashChain struct {
+	w    io.Writer
+	prev [sha256.Size]byte
+}
+
+func NewHashChain(w io.Writer) *HashChain {
+	return &HashChain{w: w}
+}
+
+func (c *HashChain) next(line []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(c.prev[:])
+	h.Write(line)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	c.prev = sum
+	return sum
+}
+
+// Add hashes line, which must not include the line terminator.
+func (c *HashChain) Add(line []byte) error {
+	sum := c.next(line)
+	_, err := fmt.Fprintf(c.w, "%s\n", hex.EncodeToString(sum[:]))
+	return err
+}
+
+// OpenDigest starts writing a hash chain of the recording to path. It must
+// be called before anything is recorded.
+func (rec *Recorder) OpenDigest(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return &RecordingError{Path: path, Err: err}
+	}
+	rec.digest = NewHashChain(f)
+	return nil
+}
+
+// VerifyResult is the outcome of VerifyRecording. Line numbers start at 1;
+// line 1 is the header.
+type VerifyResult struct {
+	OK            bool
+	Lines         int
+	FirstMismatch int
+	Reason        string
+}
+
+// VerifyRecording checks a recording against the digest written by its
+// HashChain and reports the first line that does not match.
+func VerifyRecording(recording, digest io.Reader) (*VerifyResult, error) {
+	lines := bufio.NewScanner(recording)
+	lines.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	sums := bufio.NewScanner(digest)
+	chain := NewHashChain(io.Discard)
+
+	res := &VerifyResult{}
+	for lines.Scan() {
+		res.Lines++
+		if !sums.Scan() {
+			return res.fail("recording has more lines than the digest"), sums.Err()
+		}
+		want, err := hex.DecodeString(sums.Text())
+		if err != nil {
+			return res.fail("malformed digest"), nil
+		}
+		got := chain.next(bytes.TrimSuffix(lines.Bytes(), []byte("\r")))
+		if !bytes.Equal(got[:], want) {
+			return res.fail("line does not match its hash"), nil
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	if sums.Scan() {
+		res.Lines++
+		return res.fail("recording is shorter than the digest"), nil
+	}
+	res.OK = true
+	return res, sums.Err()
+}
+
+func (res *VerifyResult) fail(reason string) *VerifyResult {
+	res.FirstMismatch = res.Lines
+	res.Reason = reason
+	return res
+}
+
+// VerifyRecordingFile verifies the recording at path against path+".sha256".
+func VerifyRecordingFile(path string) (*VerifyResult, error) {
+	rec, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Close()
+	digest, err := os.Open(path + digestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer digest.Close()
+	return VerifyRecording(rec, digest)
+}
+
+const digestSuffix = ".sha256"
@@ -0,0 +1,173 @@
+package webssh
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 客户端消息：owner对加入请求的答复
+const MsgJoinReply = '9'
+
+// JoinScrollback selects what an approved join request receives before the
+// live output.
+type JoinScrollback int
+
+const (
+	// JoinScrollbackFromRequest sends the output produced while the request
+	// was waiting for approval.
+	JoinScrollbackFromRequest JoinScrollback = iota
+	// JoinScrollbackFromStart sends the session scrollback, see
+	// ScrollbackSize.
+	JoinScrollbackFromStart
+)
+
+const (
+	defaultJoinTimeout    = time.Minute
+	defaultScrollbackSize = 64 * 1024
+)
+
+var (
+	ErrJoinDenied = errors.New("join request denied")
+	// ErrSessionLocked is returned when joining a session whose screen is
+	// locked, see MsgLock.
+	ErrSessionLocked = errors.New("session is locked")
+)
+
+type joinRequest struct {
+	id       string
+	role     Role
+	buf      *ringBuffer
+	decision chan bool
+}
+
+type joinNotice struct {
+	ID     string `json:"id"`
+	Role   string `json:"role"`
+	Remote string `json:"remote"`
+}
+
+type joinReply struct {
+	ID      string `json:"id"`
+	Approve bool   `json:"approve"`
+}
+
+// RequestJoin attaches wsConn to the session, first asking the owner for
+// approval when JoinApproval is set. The request is denied if the owner
+// does not answer within JoinTimeout, disconnects or the session ends
+// meanwhile, and at once while the session is detached.
+func (t *Turn) RequestJoin(wsConn *websocket.Conn, role Role, remote string) error {
+	return t.requestJoin(wsConn, role, remote, t.JoinApproval)
+}
+
+// requestJoin is RequestJoin, asking the owner if approval is set. Nobody
+// joins a locked session, the scrollback would show what the lock hides.
+func (t *Turn) requestJoin(wsConn *websocket.Conn, role Role, remote string, approval bool) error {
+	if t.Locked() {
+		return ErrSessionLocked
+	}
+	if !approval {
+		return t.attach(wsConn, role, remote, t.scrollbackSnapshot)
+	}
+	if role == RoleViewer && t.MaxViewers > 0 {
+		t.clientsMu.RLock()
+		full := t.viewerCount() >= t.MaxViewers
+		t.clientsMu.RUnlock()
+		if full {
+			return ErrTooManyViewers
+		}
+	}
+
+	req := &joinRequest{
+		id:       newSessionID(),
+		role:     role,
+		decision: make(chan bool, 1),
+	}
+	if t.JoinScrollback == JoinScrollbackFromRequest {
+		size := t.ScrollbackSize
+		if size <= 0 {
+			size = defaultScrollbackSize
+		}
+		req.buf = newRingBuffer(size)
+	}
+
+	t.clientsMu.Lock()
+	if t.joins == nil {
+		t.joins = make(map[string]*joinRequest)
+	}
+	t.joins[req.id] = req
+	t.clientsMu.Unlock()
+	defer func() {
+		t.clientsMu.Lock()
+		delete(t.joins, req.id)
+		t.clientsMu.Unlock()
+	}()
+
+	// 登记之后再检查，和detachLocked里的denyJoins不会错过
+	if t.Detached() {
+		t.denyJoins()
+	} else if err := t.writeControl(MsgJoinRequest, joinNotice{ID: req.id, Role: role.String(), Remote: remote}); err != nil {
+		return err
+	}
+
+	timeout := t.JoinTimeout
+	if timeout <= 0 {
+		timeout = defaultJoinTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var approved bool
+	select {
+	case approved = <-req.decision:
+	case <-timer.C:
+	case <-t.ctx.Done():
+	}
+	if !approved {
+		wsConn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ErrJoinDenied.Error()),
+			time.Now().Add(time.Second))
+		return ErrJoinDenied
+	}
+	// 等待期间可能被锁上
+	if t.Locked() {
+		return ErrSessionLocked
+	}
+
+	if req.buf != nil {
+		return t.attach(wsConn, role, remote, req.buf.Bytes)
+	}
+	return t.attach(wsConn, role, remote, t.scrollbackSnapshot)
+}
+
+func (t *Turn) answerJoin(id string, approve bool) {
+	t.clientsMu.RLock()
+	req, ok := t.joins[id]
+	t.clientsMu.RUnlock()
+	if !ok {
+		return
+	}
+	select {
+	case req.decision <- approve:
+	default:
+	}
+}
+
+// denyJoins denies every pending join request.
+func (t *Turn) denyJoins() {
+	t.clientsMu.RLock()
+	defer t.clientsMu.RUnlock()
+	for _, req := range t.joins {
+		select {
+		case req.decision <- false:
+		default:
+		}
+	}
+}
+
+func (t *Turn) scrollbackSnapshot() []byte {
+	if t.scrollback == nil {
+		return nil
+	}
+	return t.scrollback.Bytes()
+}
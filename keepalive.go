@@ -0,0 +1,165 @@
+package webssh
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHKeepAliveMax = 3
+	// 空闲超时之前多久提醒用户
+	defaultIdleWarning = time.Minute
+	pingWriteWait      = 10 * time.Second
+)
+
+// loopSSHKeepAlive sends keepalive requests on the ssh connection, like
+// OpenSSH's ServerAliveInterval, and ends the session after
+// SSHKeepAliveMax unanswered ones.
+func (t *Turn) loopSSHKeepAlive(client *ssh.Client) {
+	max := t.SSHKeepAliveMax
+	if max <= 0 {
+		max = defaultSSHKeepAliveMax
+	}
+	ticker := time.NewTicker(t.SSHKeepAlive)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if t.reconn != nil {
+			// 重连期间不用检查
+			if client = t.reconn.conn(); client == nil {
+				missed = 0
+				continue
+			}
+		}
+		if sshPing(client, t.SSHKeepAlive) {
+			missed = 0
+			continue
+		}
+		missed++
+		if missed >= max {
+			if t.reconn != nil {
+				// 断开这条连接，会话会重连
+				t.reconn.drop(client)
+				missed = 0
+				continue
+			}
+			t.CloseWithReason(ReasonBackendLost)
+			return
+		}
+	}
+}
+
+// sshPing reports whether the server answered a keepalive request within
+// timeout.
+func sshPing(client *ssh.Client, timeout time.Duration) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+// loopPing sends a websocket ping every PingInterval. Together with
+// watchPong it makes LoopRead fail on a connection that stopped answering.
+func (t *Turn) loopPing() {
+	ticker := time.NewTicker(t.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// WriteControl可以和其他写操作并发调用
+		if conn := t.conn(); conn != nil {
+			conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingWriteWait))
+		}
+	}
+}
+
+// watchPong sets a read deadline on conn that is extended by every pong and
+// every message read.
+func (t *Turn) watchPong(conn *websocket.Conn) {
+	wait := 2 * t.PingInterval
+	conn.SetReadDeadline(time.Now().Add(wait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wait))
+	})
+}
+
+// loopIdle closes the session with ReasonIdle when no input arrived for
+// IdleTimeout, warning the user IdleWarning before. With Policies the
+// timeout may change, or be turned off, while it runs.
+func (t *Turn) loopIdle() {
+	var timeout, warning time.Duration
+	// 超时改变之前的空闲时间不算，重新加载后不会立刻关闭会话
+	var changed time.Time
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	warned := false
+	for {
+		if d := t.idleTimeout(); d != timeout {
+			timeout, changed = d, time.Now()
+			warning = t.IdleWarning
+			if warning <= 0 || warning >= timeout {
+				warning = defaultIdleWarning
+				if warning >= timeout {
+					warning = timeout / 2
+				}
+			}
+			check := min(warning/2, 10*time.Second)
+			if check <= 0 {
+				check = 10 * time.Second
+			}
+			ticker.Reset(check)
+		}
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if timeout <= 0 {
+			continue
+		}
+		if t.conn() == nil {
+			// 池中还没有绑定连接的Turn不算空闲
+			t.touch()
+			continue
+		}
+		idle := min(time.Since(time.Unix(0, t.lastInput.Load())), time.Since(changed))
+		switch {
+		case idle >= timeout:
+			t.CloseWithReason(ReasonIdle)
+			return
+		case idle >= timeout-warning:
+			if !warned {
+				left := (timeout - idle).Round(time.Second)
+				t.writeNotice(fmt.Sprintf("\r\nSession idle, it will be closed in %s unless there is input.\r\n", left))
+				warned = true
+			}
+		default:
+			warned = false
+		}
+	}
+}
+
+// touch records user activity for the idle timeout.
+func (t *Turn) touch() {
+	t.lastInput.Store(time.Now().UnixNano())
+}
@@ -0,0 +1,250 @@
+package webssh
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// kubectl exec使用的websocket子协议，每个消息第一个字节是通道号
+const kubeProtocol = "v4.channel.k8s.io"
+
+const (
+	kubeStdin = iota
+	kubeStdout
+	kubeStderr
+	kubeError
+	kubeResize
+)
+
+const (
+	kubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// KubeExecConfig describes a container to exec into through the Kubernetes
+// API server, like kubectl exec -it.
+type KubeExecConfig struct {
+	// Host是API server地址，如https://10.0.0.1:6443
+	Host   string
+	Token  string
+	CAData []byte
+	// TLSConfig不为空时优先于CAData
+	TLSConfig *tls.Config
+
+	Namespace string
+	Pod       string
+	// Container为空时使用pod里唯一的容器
+	Container string
+	// Command默认为/bin/sh
+	Command []string
+}
+
+// KubeInCluster returns a KubeExecConfig for the API server of the cluster
+// this process runs in, authenticated as its service account.
+func KubeInCluster(namespace, pod, container string) (*KubeExecConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a kubernetes cluster")
+	}
+	token, err := os.ReadFile(kubeTokenFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &KubeExecConfig{
+		Host:      "https://" + host + ":" + port,
+		Token:     strings.TrimSpace(string(token)),
+		CAData:    ca,
+		Namespace: namespace,
+		Pod:       pod,
+		Container: container,
+	}, nil
+}
+
+type kubeBackend struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+	done chan struct{}
+	// 错误通道上收到的状态，没有收到时是读连接的错误
+	err       error
+	gotStatus bool
+}
+
+// StartKube returns a StartFunc that execs kconf.Command in the container
+// with a tty.
+func StartKube(kconf *KubeExecConfig) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		u, err := kconf.execURL()
+		if err != nil {
+			return nil, err
+		}
+		tlsConf := kconf.TLSConfig
+		if tlsConf == nil && len(kconf.CAData) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(kconf.CAData) {
+				return nil, errors.New("kube exec: invalid CAData")
+			}
+			tlsConf = &tls.Config{RootCAs: pool}
+		}
+		dialer := websocket.Dialer{
+			Subprotocols:    []string{kubeProtocol},
+			TLSClientConfig: tlsConf,
+		}
+		header := http.Header{}
+		if kconf.Token != "" {
+			header.Set("Authorization", "Bearer "+kconf.Token)
+		}
+		conn, resp, err := dialer.Dial(u, header)
+		if err != nil {
+			if resp != nil {
+				body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+				return nil, fmt.Errorf("kube exec %s: %s %s", kconf.Pod, resp.Status, body)
+			}
+			return nil, fmt.Errorf("kube exec %s err:%s", kconf.Pod, err)
+		}
+
+		b := &kubeBackend{conn: conn, done: make(chan struct{})}
+		if err := b.Resize(rows, cols); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		go b.loopRead(out)
+		return b, nil
+	}
+}
+
+func (kconf *KubeExecConfig) execURL() (string, error) {
+	u, err := url.Parse(kconf.Host)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/exec", url.PathEscape(kconf.Namespace), url.PathEscape(kconf.Pod))
+	q := url.Values{}
+	command := kconf.Command
+	if len(command) == 0 {
+		command = []string{"/bin/sh"}
+	}
+	for _, c := range command {
+		q.Add("command", c)
+	}
+	if kconf.Container != "" {
+		q.Set("container", kconf.Container)
+	}
+	q.Set("stdin", "true")
+	q.Set("stdout", "true")
+	q.Set("tty", "true")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (b *kubeBackend) loopRead(out io.Writer) {
+	defer close(b.done)
+	for {
+		_, p, err := b.conn.ReadMessage()
+		if err != nil {
+			if !b.gotStatus && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				b.err = err
+			}
+			return
+		}
+		if len(p) == 0 {
+			continue
+		}
+		switch p[0] {
+		case kubeStdout, kubeStderr:
+			out.Write(p[1:])
+		case kubeError:
+			b.err = kubeStatusError(p[1:])
+			b.gotStatus = true
+		}
+	}
+}
+
+// kubeStatus is the part of metav1.Status sent on the error channel.
+type kubeStatus struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Details struct {
+		Causes []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"causes"`
+	} `json:"details"`
+}
+
+func kubeStatusError(p []byte) error {
+	var s kubeStatus
+	if err := json.Unmarshal(p, &s); err != nil {
+		return fmt.Errorf("kube exec: %s", p)
+	}
+	if s.Status == "Success" {
+		return nil
+	}
+	if s.Reason == "NonZeroExitCode" {
+		for _, c := range s.Details.Causes {
+			if c.Reason == "ExitCode" {
+				if code, err := strconv.Atoi(c.Message); err == nil {
+					return &ExitError{Code: code}
+				}
+			}
+		}
+	}
+	return fmt.Errorf("kube exec: %s", s.Message)
+}
+
+func (b *kubeBackend) write(channel byte, p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, p...))
+}
+
+func (b *kubeBackend) Write(p []byte) (int, error) {
+	if err := b.write(kubeStdin, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *kubeBackend) Resize(rows, cols int) error {
+	size, _ := json.Marshal(struct {
+		Width  int
+		Height int
+	}{cols, rows})
+	return b.write(kubeResize, size)
+}
+
+func (b *kubeBackend) Wait() error {
+	<-b.done
+	return b.err
+}
+
+func (b *kubeBackend) Close() error {
+	return b.conn.Close()
+}
+
+// NewKubeTurn starts a shell in a Kubernetes container.
+func NewKubeTurn(wsConn *websocket.Conn, kconf *KubeExecConfig, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	return NewBackendTurn(wsConn, StartKube(kconf), rec, conf)
+}
@@ -0,0 +1,159 @@
+package webssh
+
+import (
+	"sync"
+	"time"
+
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgLatency measures the round trip to the owner. Every LatencyInterval
+// the server sends {"seq"} and the client sends the same message back as
+// soon as it reads it; the time in between, including output still queued
+// before the probe, is one sample. With ReportLatency the server then
+// sends {"rtt","stats"} in milliseconds. A client may also send {"id"}
+// without seq to measure on its own: the server answers {"id","pong":true}
+// at once.
+const MsgLatency = wire.MsgLatency
+
+const (
+	// 统计最近这么多次的往返时间
+	latencyWindow = 32
+	// 最多等这么多个探测的回复，更早的作废
+	maxPendingProbes = 8
+)
+
+type latencyMsg = wire.Latency
+
+// LatencyStats are the round trips of the last probes, in milliseconds.
+// Jitter is the mean difference between consecutive samples.
+type LatencyStats = wire.LatencyStats
+
+// latency keeps the pending probes and the last samples of a session.
+type latency struct {
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]time.Time
+	samples [latencyWindow]time.Duration
+	n       int
+	last    time.Time
+	lost    int64
+}
+
+func newLatency() *latency {
+	return &latency{pending: make(map[uint64]time.Time)}
+}
+
+// probe returns the seq of a new probe sent now.
+func (l *latency) probe(now time.Time) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.pending[l.seq] = now
+	if len(l.pending) > maxPendingProbes {
+		for seq := range l.pending {
+			if seq <= l.seq-maxPendingProbes {
+				delete(l.pending, seq)
+				l.lost++
+			}
+		}
+	}
+	return l.seq
+}
+
+// answer records the reply to probe seq and reports whether there was one.
+func (l *latency) answer(seq uint64, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sent, ok := l.pending[seq]
+	if !ok {
+		return 0, false
+	}
+	delete(l.pending, seq)
+	rtt := now.Sub(sent)
+	l.samples[l.n%latencyWindow] = rtt
+	l.n++
+	l.last = now
+	return rtt, true
+}
+
+func (l *latency) stats() *LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n == 0 {
+		return nil
+	}
+	count := min(l.n, latencyWindow)
+	s := &LatencyStats{Samples: count, Lost: l.lost, Time: l.last}
+	var sum, jitter time.Duration
+	lo, hi := time.Duration(1<<63-1), time.Duration(0)
+	// 从最旧的样本开始
+	for i := 0; i < count; i++ {
+		d := l.samples[(l.n-count+i)%latencyWindow]
+		sum += d
+		lo, hi = min(lo, d), max(hi, d)
+		if i > 0 {
+			diff := d - l.samples[(l.n-count+i-1)%latencyWindow]
+			jitter += max(diff, -diff)
+		}
+	}
+	s.Last = ms(l.samples[(l.n-1)%latencyWindow])
+	s.Min, s.Max = ms(lo), ms(hi)
+	s.Avg = ms(sum / time.Duration(count))
+	if count > 1 {
+		s.Jitter = ms(jitter / time.Duration(count-1))
+	}
+	return s
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Latency returns the round trips measured so far, nil before the first
+// one or without LatencyInterval.
+func (t *Turn) Latency() *LatencyStats {
+	if t.latency == nil {
+		return nil
+	}
+	return t.latency.stats()
+}
+
+// loopLatency sends a MsgLatency probe every LatencyInterval.
+func (t *Turn) loopLatency() {
+	ticker := time.NewTicker(t.LatencyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// 断线时不探测
+		if t.conn() == nil {
+			continue
+		}
+		t.writeControl(MsgLatency, latencyMsg{Seq: t.latency.probe(time.Now())})
+	}
+}
+
+// handleLatency answers a MsgLatency of the owner.
+func (t *Turn) handleLatency(msg latencyMsg) {
+	if msg.Seq == 0 {
+		t.writeControl(MsgLatency, latencyMsg{ID: msg.ID, Pong: true})
+		return
+	}
+	if t.latency == nil {
+		return
+	}
+	rtt, ok := t.latency.answer(msg.Seq, time.Now())
+	if !ok {
+		return
+	}
+	if t.SlowRTT > 0 && rtt > t.SlowRTT {
+		t.logger().Warn("slow round trip", "rtt", rtt)
+	}
+	if t.ReportLatency {
+		t.writeControl(MsgLatency, latencyMsg{RTT: ms(rtt), Stats: t.latency.stats()})
+	}
+}
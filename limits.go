@@ -0,0 +1,41 @@
+package webssh
+
+import "time"
+
+// 默认在这个cgroup下为每个会话创建子cgroup
+const defaultCgroupParent = "/sys/fs/cgroup/webssh"
+
+// cpu.max的周期
+const cgroupCPUPeriod = 100 * time.Millisecond
+
+// ResourceLimits bounds what the process tree of a local session may use,
+// so one user's shell can't starve the host. On linux every session gets a
+// cgroup v2 of its own under CgroupParent; when that is not possible the
+// limits are set with setrlimit on the shell before it runs, which its
+// children inherit but which holds for each process on its own; a CPU
+// limit then fails the session. Other platforms refuse to start a session
+// with limits.
+type ResourceLimits struct {
+	// CPU是可以使用的CPU核数，0.5表示半个核，0不限制
+	CPU float64
+	// Memory是内存的字节数，0不限制；回退到setrlimit时限制的是每个进程的地址空间
+	Memory int64
+	// Procs是进程数，0不限制；回退到setrlimit时是RLIMIT_NPROC，按用户计数
+	Procs int
+	// CgroupParent是会话cgroup的父目录，默认/sys/fs/cgroup/webssh，需要已经开启
+	// cpu、memory和pids控制器(cgroup.subtree_control)并且可写
+	CgroupParent string
+	// NoCgroup为true时直接使用setrlimit
+	NoCgroup bool
+}
+
+func (l *ResourceLimits) empty() bool {
+	return l == nil || l.CPU <= 0 && l.Memory <= 0 && l.Procs <= 0
+}
+
+func (l *ResourceLimits) cgroupParent() string {
+	if l.CgroupParent != "" {
+		return l.CgroupParent
+	}
+	return defaultCgroupParent
+}
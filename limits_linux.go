@@ -0,0 +1,166 @@
+//go:build linux
+
+package webssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var cgroupSeq atomic.Int64
+
+// sessionCgroup is the cgroup v2 a local session runs in.
+type sessionCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newSessionCgroup creates a cgroup with the limits l under its parent.
+func newSessionCgroup(l *ResourceLimits) (*sessionCgroup, error) {
+	dir := filepath.Join(l.cgroupParent(), fmt.Sprintf("session-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	cg := &sessionCgroup{dir: dir}
+	var files []string
+	if l.CPU > 0 {
+		period := cgroupCPUPeriod.Microseconds()
+		files = append(files, "cpu.max", fmt.Sprintf("%d %d", int64(l.CPU*float64(period)), period))
+	}
+	if l.Memory > 0 {
+		files = append(files, "memory.max", strconv.FormatInt(l.Memory, 10))
+	}
+	if l.Procs > 0 {
+		files = append(files, "pids.max", strconv.Itoa(l.Procs))
+	}
+	for i := 0; i < len(files); i += 2 {
+		if err := os.WriteFile(filepath.Join(dir, files[i]), []byte(files[i+1]), 0); err != nil {
+			os.Remove(dir)
+			return nil, fmt.Errorf("%s err:%s", files[i], err)
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+// remove kills what is left in the cgroup and removes it.
+func (cg *sessionCgroup) remove() {
+	cg.fd.Close()
+	// cgroup.kill需要5.14以上的内核，更早的内核上进程已经由killSession结束
+	os.WriteFile(filepath.Join(cg.dir, "cgroup.kill"), []byte("1"), 0)
+	for i := 0; i < 10; i++ {
+		err := os.Remove(cg.dir)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		// 进程退出后cgroup还要过一会儿才变空
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// applyLimits makes cmd start in a cgroup with the limits l. When there is
+// none it returns a function setting them with setrlimit on the started
+// process instead, see startLimited.
+func applyLimits(cmd *exec.Cmd, l *ResourceLimits, logger Logger) (cg *sessionCgroup, started func(pid int) error, err error) {
+	if l.empty() {
+		return nil, nil, nil
+	}
+	if !l.NoCgroup {
+		cg, err := newSessionCgroup(l)
+		if err == nil {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cg.fd.Fd())
+			return cg, nil, nil
+		}
+		logger.Warn("cgroup unavailable, using setrlimit", "parent", l.cgroupParent(), "err", err)
+	}
+	// 只限制内存和进程数的话用户会以为CPU也限制住了
+	if l.CPU > 0 {
+		return nil, nil, fmt.Errorf("cpu limit needs a cgroup")
+	}
+	return nil, func(pid int) error { return setRlimits(pid, l) }, nil
+}
+
+// setRlimits sets the limits l on the process pid.
+func setRlimits(pid int, l *ResourceLimits) error {
+	var errs []string
+	if l.Memory > 0 {
+		lim := unix.Rlimit{Cur: uint64(l.Memory), Max: uint64(l.Memory)}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &lim, nil); err != nil {
+			errs = append(errs, "RLIMIT_AS "+err.Error())
+		}
+	}
+	if l.Procs > 0 {
+		lim := unix.Rlimit{Cur: uint64(l.Procs), Max: uint64(l.Procs)}
+		if err := unix.Prlimit(pid, unix.RLIMIT_NPROC, &lim, nil); err != nil {
+			errs = append(errs, "RLIMIT_NPROC "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("setrlimit err:%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// rlimitGate is the script cmd runs in when its limits are set with
+// setrlimit: it waits on an inherited pipe until they are, then execs the
+// command with its arguments, so neither it nor anything it forks ever
+// runs without them.
+const rlimitGate = `read -r ok <&%[1]d || exit 126; exec %[1]d<&-; exec "$0" "$@"`
+
+// startLimited starts cmd with the limits l, see ResourceLimits.
+func startLimited(cmd *exec.Cmd, l *ResourceLimits, logger Logger) (*sessionCgroup, error) {
+	cg, started, err := applyLimits(cmd, l, logger)
+	if err != nil {
+		return nil, err
+	}
+	var gate *os.File
+	if started != nil {
+		// setrlimit只能在启动之后设置，先让/bin/sh(chroot里也要有)停在管道上等着
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		defer w.Close()
+		fd := 3 + len(cmd.ExtraFiles)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		cmd.Args = append([]string{"sh", "-c", fmt.Sprintf(rlimitGate, fd), cmd.Path}, cmd.Args[1:]...)
+		cmd.Path = "/bin/sh"
+		gate = w
+	}
+	if err := cmd.Start(); err != nil {
+		if cg != nil {
+			cg.remove()
+		}
+		return nil, err
+	}
+	if started != nil {
+		if err := started(cmd.Process.Pid); err != nil {
+			// 没有限制住就不让它运行
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			return nil, err
+		}
+		if _, err := gate.Write([]byte("\n")); err != nil {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			return nil, err
+		}
+	}
+	return cg, nil
+}
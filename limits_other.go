@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package webssh
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type sessionCgroup struct{}
+
+func (cg *sessionCgroup) remove() {}
+
+// startLimited starts cmd; limits are only supported on linux.
+func startLimited(cmd *exec.Cmd, l *ResourceLimits, logger Logger) (*sessionCgroup, error) {
+	if !l.empty() {
+		return nil, errors.New("resource limits are only supported on linux")
+	}
+	return nil, cmd.Start()
+}
@@ -0,0 +1,22 @@
+package webssh
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+// NewLocalTurn starts TurnConfig.Command, or the user's shell, on a pty on
+// this machine instead of on a remote ssh server.
+func NewLocalTurn(wsConn *websocket.Conn, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	if conf == nil {
+		conf = &TurnConfig{}
+	}
+	turn, err := NewBackendTurn(wsConn, StartLocalShell(conf.shellOptions()), rec, conf)
+	if err != nil {
+		return nil, err
+	}
+	// 文件传输以daemon的身份读写，会绕过Sandbox
+	if conf.Sandbox == nil {
+		turn.openFiles = openLocalFS
+	}
+	return turn, nil
+}
@@ -0,0 +1,218 @@
+//go:build !windows
+
+package webssh
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+// 进程退出后等待pty中剩余输出的时间，后台进程一直占着pty时不会无限等
+const drainTimeout = time.Second
+
+var localSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// 默认先发SIGHUP，等这么久还没退出再SIGKILL
+const defaultKillGrace = 3 * time.Second
+
+type localBackend struct {
+	cmd  *exec.Cmd
+	ptmx *os.File
+	tty  string
+	done chan struct{}
+
+	killSignal syscall.Signal
+	killGrace  time.Duration
+	waited     chan struct{} // cmd.Wait已经返回
+	closeOnce  sync.Once
+	// 设置了Limits并且使用cgroup时会话所在的cgroup
+	cgroup *sessionCgroup
+}
+
+// StartLocal returns a StartFunc that runs command with sh -c on a new pty,
+// or $SHELL if command is empty.
+func StartLocal(command string) StartFunc {
+	return StartLocalShell(ShellOptions{Command: command})
+}
+
+// StartLocalShell is StartLocal with environment variables, a working
+// directory and a login shell.
+func StartLocalShell(opts ShellOptions) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		cmd := localCommand(opts)
+		cmd.Dir = opts.Dir
+
+		ptmx, tty, err := pty.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer tty.Close()
+		if err := pty.Setsize(ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}); err != nil {
+			ptmx.Close()
+			return nil, err
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+		// 新会话并把pty作为控制终端，信号发给整个进程组
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		userEnv, err := applySandbox(cmd, opts.Sandbox, tty)
+		if err != nil {
+			ptmx.Close()
+			return nil, err
+		}
+		env := os.Environ()
+		if opts.Sandbox != nil {
+			// daemon的环境变量里可能有密钥
+			env = []string{sandboxPath}
+		}
+		cmd.Env = append(append(append(env, "TERM="+term), userEnv...), opts.Env...)
+		cg, err := startLimited(cmd, opts.Limits, opts.log())
+		if err != nil {
+			ptmx.Close()
+			return nil, err
+		}
+
+		b := &localBackend{cmd: cmd, ptmx: ptmx, tty: tty.Name(), done: make(chan struct{}), waited: make(chan struct{}), cgroup: cg}
+		b.killSignal = syscall.SIGHUP
+		if s, ok := localSignals[opts.KillSignal]; ok {
+			b.killSignal = s
+		}
+		b.killGrace = opts.KillGrace
+		if b.killGrace <= 0 {
+			b.killGrace = defaultKillGrace
+		}
+		go func() {
+			defer close(b.done)
+			io.Copy(out, ptmx)
+		}()
+		return b, nil
+	}
+}
+
+func localCommand(opts ShellOptions) *exec.Cmd {
+	shell := opts.Shell
+	// 沙箱里daemon的$SHELL可能不存在，也不该由daemon的环境决定
+	if shell == "" && opts.Sandbox == nil {
+		shell = os.Getenv("SHELL")
+	}
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	switch {
+	case opts.Command != "" && opts.Login:
+		return exec.Command(shell, "-lc", opts.Command)
+	case opts.Command != "":
+		return exec.Command("/bin/sh", "-c", opts.Command)
+	case opts.Login:
+		return exec.Command(shell, "-l")
+	}
+	return exec.Command(shell)
+}
+
+func (b *localBackend) Write(p []byte) (int, error) {
+	return b.ptmx.Write(p)
+}
+
+func (b *localBackend) Resize(rows, cols int) error {
+	return pty.Setsize(b.ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+}
+
+func (b *localBackend) Wait() error {
+	err := b.cmd.Wait()
+	close(b.waited)
+	select {
+	case <-b.done:
+	case <-time.After(drainTimeout):
+	}
+	var e *exec.ExitError
+	if !errors.As(err, &e) {
+		return err
+	}
+	status, ok := e.Sys().(syscall.WaitStatus)
+	if !ok {
+		return err
+	}
+	if status.Signaled() {
+		return &ExitError{Code: -1, Signal: signalName(status.Signal())}
+	}
+	return &ExitError{Code: status.ExitStatus()}
+}
+
+// Close sends KillSignal to the process group, so the shell can save its
+// history, and kills what is left of the session KillGrace later, or as
+// soon as the shell has exited. It does not wait for that.
+func (b *localBackend) Close() error {
+	b.closeOnce.Do(func() {
+		pid := b.cmd.Process.Pid
+		syscall.Kill(-pid, b.killSignal)
+		go func() {
+			timer := time.NewTimer(b.killGrace)
+			select {
+			case <-b.waited:
+			case <-timer.C:
+			}
+			timer.Stop()
+			// shell退出后留下的后台任务和子进程一起结束
+			killSession(pid)
+			if b.cgroup != nil {
+				b.cgroup.remove()
+			}
+			b.ptmx.Close()
+		}()
+	})
+	return nil
+}
+
+func (b *localBackend) Signal(sig ssh.Signal) error {
+	s, ok := localSignals[sig]
+	if !ok {
+		return errors.New("unsupported signal " + string(sig))
+	}
+	return syscall.Kill(-b.cmd.Process.Pid, s)
+}
+
+func (b *localBackend) Stop() error {
+	return syscall.Kill(-b.cmd.Process.Pid, syscall.SIGSTOP)
+}
+
+func (b *localBackend) Continue() error {
+	return syscall.Kill(-b.cmd.Process.Pid, syscall.SIGCONT)
+}
+
+func (b *localBackend) PID() int {
+	return b.cmd.Process.Pid
+}
+
+func (b *localBackend) TTYName() string {
+	return b.tty
+}
+
+func signalName(s syscall.Signal) string {
+	for name, sig := range localSignals {
+		if sig == s {
+			return string(name)
+		}
+	}
+	return s.String()
+}
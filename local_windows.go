@@ -0,0 +1,285 @@
+//go:build windows
+
+package webssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// 进程退出后等待ConPTY中剩余输出的时间
+const drainTimeout = time.Second
+
+// ConPTY的创建标志，见CreatePseudoConsole
+const pseudoConsoleResizeQuirk = 0x2
+
+type localBackend struct {
+	hpc       windows.Handle
+	in        *os.File
+	out       *os.File
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	process windows.Handle
+	pid     int
+	exited  bool // 退出后process已经关闭
+}
+
+// StartLocal returns a StartFunc that runs command, or an interactive
+// shell if command is empty, on a ConPTY pseudo console.
+func StartLocal(command string) StartFunc {
+	return StartLocalShell(ShellOptions{Command: command})
+}
+
+// StartLocalShell is StartLocal with environment variables, a working
+// directory and a choice of shell, see windowsShell. Login has no meaning
+// on windows.
+func StartLocalShell(opts ShellOptions) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		if !opts.Limits.empty() {
+			return nil, errors.New("resource limits are only supported on linux")
+		}
+		if opts.Sandbox != nil {
+			return nil, errors.New("sandbox is not supported on windows")
+		}
+		var inR, inW, outR, outW windows.Handle
+		if err := windows.CreatePipe(&inR, &inW, nil, 0); err != nil {
+			return nil, fmt.Errorf("create pipe err:%s", err)
+		}
+		if err := windows.CreatePipe(&outR, &outW, nil, 0); err != nil {
+			windows.CloseHandle(inR)
+			windows.CloseHandle(inW)
+			return nil, fmt.Errorf("create pipe err:%s", err)
+		}
+		// 关闭pseudo console之后这两端由它持有
+		defer windows.CloseHandle(inR)
+		defer windows.CloseHandle(outW)
+
+		var flags uint32
+		if opts.ResizeQuirk {
+			flags |= pseudoConsoleResizeQuirk
+		}
+		var hpc windows.Handle
+		if err := windows.CreatePseudoConsole(consoleSize(rows, cols), inR, outW, flags, &hpc); err != nil {
+			windows.CloseHandle(inW)
+			windows.CloseHandle(outR)
+			return nil, fmt.Errorf("create pseudo console err:%s", err)
+		}
+		b := &localBackend{
+			hpc:  hpc,
+			in:   os.NewFile(uintptr(inW), "conpty-in"),
+			out:  os.NewFile(uintptr(outR), "conpty-out"),
+			done: make(chan struct{}),
+		}
+		process, err := startConsoleProcess(hpc, opts)
+		if err != nil {
+			windows.ClosePseudoConsole(hpc)
+			b.in.Close()
+			b.out.Close()
+			return nil, err
+		}
+		b.process = process
+		if pid, err := windows.GetProcessId(process); err == nil {
+			b.pid = int(pid)
+		}
+		go func() {
+			defer close(b.done)
+			io.Copy(out, b.out)
+		}()
+		return b, nil
+	}
+}
+
+func startConsoleProcess(hpc windows.Handle, opts ShellOptions) (windows.Handle, error) {
+	attrs, err := windows.NewProcThreadAttributeList(1)
+	if err != nil {
+		return 0, err
+	}
+	defer attrs.Delete()
+	// 这个属性的值就是HPCON本身，不是指向它的指针
+	value := *(*unsafe.Pointer)(unsafe.Pointer(&hpc))
+	if err := attrs.Update(windows.PROC_THREAD_ATTRIBUTE_PSEUDOCONSOLE, value, unsafe.Sizeof(hpc)); err != nil {
+		return 0, err
+	}
+	si := new(windows.StartupInfoEx)
+	si.Cb = uint32(unsafe.Sizeof(*si))
+	// 不继承本进程的标准输入输出，全部走pseudo console
+	si.Flags = windows.STARTF_USESTDHANDLES
+	si.ProcThreadAttributeList = attrs.List()
+
+	cmdline, err := windows.UTF16PtrFromString(windowsCommandLine(opts))
+	if err != nil {
+		return 0, err
+	}
+	var dir *uint16
+	if opts.Dir != "" {
+		if dir, err = windows.UTF16PtrFromString(opts.Dir); err != nil {
+			return 0, err
+		}
+	}
+	env := environmentBlock(append(os.Environ(), opts.Env...))
+	var pi windows.ProcessInformation
+	err = windows.CreateProcess(nil, cmdline, nil, nil, false,
+		windows.EXTENDED_STARTUPINFO_PRESENT|windows.CREATE_UNICODE_ENVIRONMENT,
+		env, dir, &si.StartupInfo, &pi)
+	if err != nil {
+		return 0, fmt.Errorf("start %s err:%s", windowsShell(opts.Shell), err)
+	}
+	windows.CloseHandle(pi.Thread)
+	return pi.Process, nil
+}
+
+// windowsShell picks the shell for name: pwsh, powershell, cmd or a path.
+// An empty name prefers PowerShell 7, then Windows PowerShell, then
+// %COMSPEC%. Windows Terminal (wt) is a terminal emulator, not a shell, and
+// cannot run behind a pseudo console.
+func windowsShell(name string) string {
+	switch strings.ToLower(name) {
+	case "":
+		for _, s := range []string{"pwsh.exe", "powershell.exe"} {
+			if p, err := exec.LookPath(s); err == nil {
+				return p
+			}
+		}
+		return comspec()
+	case "pwsh", "powershell":
+		if p, err := exec.LookPath(name + ".exe"); err == nil {
+			return p
+		}
+		return name + ".exe"
+	case "cmd":
+		return comspec()
+	}
+	return name
+}
+
+func comspec() string {
+	if c := os.Getenv("COMSPEC"); c != "" {
+		return c
+	}
+	return "cmd.exe"
+}
+
+func windowsCommandLine(opts ShellOptions) string {
+	shell := windowsShell(opts.Shell)
+	line := windows.EscapeArg(shell)
+	isCmd := strings.EqualFold(filepath.Base(shell), "cmd.exe") || strings.EqualFold(shell, "cmd")
+	switch {
+	case isCmd && opts.Command != "":
+		// cmd自己解析/c后面的整行
+		line += " /c " + opts.Command
+	case opts.Command != "":
+		line += " -NoLogo -Command " + windows.EscapeArg(opts.Command)
+	case !isCmd:
+		line += " -NoLogo"
+	}
+	return line
+}
+
+// environmentBlock encodes env for CreateProcess: NUL separated UTF-16
+// strings ending with an empty one.
+func environmentBlock(env []string) *uint16 {
+	// 后面的同名变量覆盖前面的，windows的变量名不区分大小写
+	seen := make(map[string]int)
+	var list []string
+	for _, kv := range env {
+		k, _, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		key := strings.ToUpper(k)
+		if i, ok := seen[key]; ok {
+			list[i] = kv
+			continue
+		}
+		seen[key] = len(list)
+		list = append(list, kv)
+	}
+	var block []uint16
+	for _, kv := range list {
+		block = append(block, utf16.Encode([]rune(kv))...)
+		block = append(block, 0)
+	}
+	block = append(block, 0)
+	return &block[0]
+}
+
+func consoleSize(rows, cols int) windows.Coord {
+	if rows <= 0 {
+		rows = 24
+	}
+	if cols <= 0 {
+		cols = 80
+	}
+	return windows.Coord{X: int16(cols), Y: int16(rows)}
+}
+
+// Write passes input to the console. Pasted text often ends lines with LF,
+// which cmd and PowerShell do not take as Enter, so LF and CRLF become CR.
+func (b *localBackend) Write(p []byte) (int, error) {
+	q := p
+	if bytes.IndexByte(p, '\n') >= 0 {
+		q = bytes.ReplaceAll(bytes.ReplaceAll(p, []byte("\r\n"), []byte("\r")), []byte("\n"), []byte("\r"))
+	}
+	if _, err := b.in.Write(q); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *localBackend) Resize(rows, cols int) error {
+	return windows.ResizePseudoConsole(b.hpc, consoleSize(rows, cols))
+}
+
+func (b *localBackend) Wait() error {
+	windows.WaitForSingleObject(b.process, windows.INFINITE)
+	var code uint32
+	err := windows.GetExitCodeProcess(b.process, &code)
+	b.mu.Lock()
+	b.exited = true
+	windows.CloseHandle(b.process)
+	b.mu.Unlock()
+	// 进程退出后ConPTY不会自己关闭输出，关掉它才能读到EOF
+	b.closeConsole()
+	select {
+	case <-b.done:
+	case <-time.After(drainTimeout):
+	}
+	if err != nil {
+		return err
+	}
+	return &ExitError{Code: int(code)}
+}
+
+func (b *localBackend) PID() int {
+	return b.pid
+}
+
+func (b *localBackend) Close() error {
+	b.mu.Lock()
+	if !b.exited {
+		windows.TerminateProcess(b.process, 1)
+	}
+	b.mu.Unlock()
+	b.closeConsole()
+	return b.in.Close()
+}
+
+func (b *localBackend) closeConsole() {
+	b.closeOnce.Do(func() {
+		windows.ClosePseudoConsole(b.hpc)
+	})
+}
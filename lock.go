@@ -0,0 +1,163 @@
+package webssh
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// MsgLock locks the screen of a session that had no input for LockAfter,
+// or when the owner sends {"lock": true}. While locked the output is held
+// back as with MsgFlow, nothing is lost, and every message but MsgLock and
+// MsgResize is dropped. The server sends {"locked": true, "reason": ...};
+// the client should hide the terminal and ask the user to authenticate
+// again, then send {"token": ...} or {"user": ..., "password": ...}. A
+// wrong credential is answered with {"locked": true, "error": ...}, a good
+// one with {"locked": false} and the output resumes. After LockAttempts
+// failures the session is closed with ReasonUnlockFailed.
+const MsgLock = 'r'
+
+// 默认连续解锁失败这么多次后结束会话
+const defaultLockAttempts = 5
+
+var errNoUnlock = errors.New("unlock is not configured")
+
+type lockMsg struct {
+	Locked bool   `json:"locked"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type lockReq struct {
+	Lock     bool   `json:"lock,omitempty"`
+	Token    string `json:"token,omitempty"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// UnlockWithAuthorizer returns an Unlock that runs a on the unlock request
+// and accepts it if the identity matches the owner of the session. The
+// request carries only the credential of the client and the path of the
+// original upgrade request, so the token the session was opened with does
+// not unlock it again.
+func UnlockWithAuthorizer(a Authorizer) func(t *Turn, r *http.Request) error {
+	return func(t *Turn, r *http.Request) error {
+		target, err := a.Authorize(r)
+		if err != nil {
+			return err
+		}
+		if target == nil || target.Identity != t.Owner {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+}
+
+// Locked reports whether the screen of the session is locked.
+func (t *Turn) Locked() bool {
+	return t.locked.Load()
+}
+
+// Lock locks the screen, see MsgLock. reason is passed on to the client,
+// e.g. "idle".
+func (t *Turn) Lock(reason string) {
+	if !t.locked.CompareAndSwap(false, true) {
+		return
+	}
+	t.flow.set(flowLocked, true)
+	// 锁屏期间只有owner解锁后才能再输入
+	t.Revoke()
+	t.unlockFailures.Store(0)
+	t.logger().Info("session locked", "event", "locked", "reason", reason)
+	t.auditEvent("locked", reason)
+	t.writeControl(MsgLock, lockMsg{Locked: true, Reason: reason})
+}
+
+func (t *Turn) unlock() {
+	if !t.locked.CompareAndSwap(true, false) {
+		return
+	}
+	t.touch()
+	t.logger().Info("session unlocked", "event", "unlocked")
+	t.auditEvent("unlocked", "")
+	t.writeControl(MsgLock, lockMsg{Locked: false})
+	t.flow.set(flowLocked, false)
+}
+
+// handleLock locks the screen or checks an unlock attempt of the owner.
+func (t *Turn) handleLock(req lockReq) {
+	if req.Lock {
+		t.Lock("user")
+		return
+	}
+	if !t.Locked() {
+		return
+	}
+	err := errNoUnlock
+	if t.Unlock != nil {
+		err = t.Unlock(t, t.unlockRequest(req))
+	}
+	if err == nil {
+		t.unlock()
+		return
+	}
+	n := t.unlockFailures.Add(1)
+	t.logger().Warn("unlock failed", "event", "unlock_failed", "failures", n, "err", err)
+	t.auditEvent("unlock_failed", err.Error())
+	limit := t.LockAttempts
+	if limit <= 0 {
+		limit = defaultLockAttempts
+	}
+	if int(n) >= limit {
+		go t.CloseWithReason(ReasonUnlockFailed)
+		return
+	}
+	t.writeControl(MsgLock, lockMsg{Locked: true, Error: err.Error()})
+}
+
+// unlockRequest is a request for the path the session was opened on, from
+// the same address, with the credential of req as its Authorization.
+func (t *Turn) unlockRequest(req lockReq) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	if o := t.upgradeReq; o != nil {
+		r.URL.Path, r.Host, r.RemoteAddr = o.URL.Path, o.Host, o.RemoteAddr
+	}
+	switch {
+	case req.Token != "":
+		r.Header.Set("Authorization", "Bearer "+req.Token)
+	case req.User != "":
+		r.SetBasicAuth(req.User, req.Password)
+	}
+	return r
+}
+
+// loopLock locks the screen after LockAfter without input.
+func (t *Turn) loopLock() {
+	check := t.LockAfter / 4
+	if check > 10*time.Second {
+		check = 10 * time.Second
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if t.conn() == nil {
+			// 池中还没有绑定连接的Turn不算空闲
+			t.touch()
+			continue
+		}
+		if !t.Locked() && time.Since(time.Unix(0, t.lastInput.Load())) >= t.LockAfter {
+			t.Lock("idle")
+		}
+	}
+}
+
+// lockedDrops reports whether a message of type typ is dropped because the
+// screen is locked.
+func (t *Turn) lockedDrops(typ byte) bool {
+	return t.Locked() && typ != MsgLock && typ != MsgResize && typ != MsgLatency
+}
@@ -0,0 +1,128 @@
+package webssh
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger receives what webssh logs. args are alternating keys and values,
+// as with log/slog, so a *slog.Logger can be used as it is; ZapLogger
+// adapts zap. Messages about a session carry its "session" id and, when
+// known, the "remote" address of the client.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+var defaultLogger atomic.Pointer[Logger]
+
+// SetLogger sets the Logger used when TurnConfig.Logger is not set and
+// for messages that belong to no session. nil goes back to the standard
+// library log.
+func SetLogger(l Logger) {
+	if l == nil {
+		defaultLogger.Store(nil)
+		return
+	}
+	defaultLogger.Store(&l)
+}
+
+// DefaultLogger returns the Logger set with SetLogger.
+func DefaultLogger() Logger {
+	if l := defaultLogger.Load(); l != nil {
+		return *l
+	}
+	return stdLogger{}
+}
+
+// stdLogger writes to the standard library log as
+// "LEVEL msg key=value ...". Debug messages are dropped.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...interface{}) {}
+
+func (stdLogger) Info(msg string, args ...interface{}) {
+	stdLog("INFO", msg, args)
+}
+
+func (stdLogger) Warn(msg string, args ...interface{}) {
+	stdLog("WARN", msg, args)
+}
+
+func (stdLogger) Error(msg string, args ...interface{}) {
+	stdLog("ERROR", msg, args)
+}
+
+func stdLog(level, msg string, args []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " %v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	log.Print(b.String())
+}
+
+// withFields is a Logger adding fields to every message.
+type withFields struct {
+	l      Logger
+	fields []interface{}
+}
+
+func (w withFields) args(args []interface{}) []interface{} {
+	return append(w.fields[:len(w.fields):len(w.fields)], args...)
+}
+
+func (w withFields) Debug(msg string, args ...interface{}) { w.l.Debug(msg, w.args(args)...) }
+func (w withFields) Info(msg string, args ...interface{})  { w.l.Info(msg, w.args(args)...) }
+func (w withFields) Warn(msg string, args ...interface{})  { w.l.Warn(msg, w.args(args)...) }
+func (w withFields) Error(msg string, args ...interface{}) { w.l.Error(msg, w.args(args)...) }
+
+// logger is TurnConfig.Logger, or DefaultLogger.
+func (c *TurnConfig) logger() Logger {
+	if c != nil && c.Logger != nil {
+		return c.Logger
+	}
+	return DefaultLogger()
+}
+
+// logger returns the Logger of the session, with its id and client address.
+func (t *Turn) logger() Logger {
+	fields := []interface{}{"session", t.ID}
+	if t.clientIP != "" {
+		fields = append(fields, "remote", t.clientIP)
+	}
+	return withFields{l: t.TurnConfig.logger(), fields: fields}
+}
+
+// SugaredLogger is the part of *zap.SugaredLogger that ZapLogger needs.
+type SugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// ZapLogger returns a Logger writing to a zap logger, e.g.
+// ZapLogger(zap.L().Sugar()), without webssh depending on zap.
+func ZapLogger(s SugaredLogger) Logger {
+	return zapLogger{s}
+}
+
+type zapLogger struct {
+	s SugaredLogger
+}
+
+func (z zapLogger) Debug(msg string, args ...interface{}) { z.s.Debugw(msg, args...) }
+func (z zapLogger) Info(msg string, args ...interface{})  { z.s.Infow(msg, args...) }
+func (z zapLogger) Warn(msg string, args ...interface{})  { z.s.Warnw(msg, args...) }
+func (z zapLogger) Error(msg string, args ...interface{}) { z.s.Errorw(msg, args...) }
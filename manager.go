@@ -0,0 +1,222 @@
+package webssh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Metrics is a point-in-time view of all sessions seen by a SessionManager,
+// including those that have already ended.
+type Metrics struct {
+	Time           time.Time
+	ActiveSessions int
+	BytesIn        int64
+	BytesOut       int64
+	SessionSeconds float64
+}
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionEventType is the kind of a SessionEvent.
+type SessionEventType string
+
+const (
+	SessionStarted SessionEventType = "started"
+	SessionEnded   SessionEventType = "ended"
+	SessionKilled  SessionEventType = "killed"
+)
+
+// SessionEvent reports a change in the life of a session.
+type SessionEvent struct {
+	Type    SessionEventType
+	Session Result
+}
+
+type SessionManager struct {
+	// OnEvent不为空时在会话开始、结束和被Kill时调用，需要在添加会话之前设置
+	OnEvent func(SessionEvent)
+	// Quotas不为空时Admit按身份限制会话数和输出带宽，身份由Identify给出，
+	// 默认是Turn.Owner
+	Quotas   func(identity string) Quota
+	Identify func(t *Turn) string
+
+	mu       sync.RWMutex
+	sessions map[string]*Turn
+	handoffs map[string]handoffToken
+
+	// 已结束会话的累计值
+	bytesIn        int64
+	bytesOut       int64
+	sessionSeconds float64
+
+	// 见RegisterMetrics，没有注册时duration为空
+	duration  prometheus.Histogram
+	ptyErrors atomic.Int64
+	wsErrors  atomic.Int64
+
+	// 所有会话共用的输出限速，见SetOutputRate
+	outLim    atomic.Pointer[rate.Limiter]
+	identLims map[string]*identityLimit
+
+	// 已经移除但进程可能还没退出的会话，见Reap
+	orphans map[*Turn]struct{}
+	// 见Cluster.Start
+	cluster atomic.Pointer[Cluster]
+	reaped  struct {
+		Exited, Unregistered, Killed atomic.Int64
+	}
+
+	// 正在写的录像，RetentionPolicy不删除，见RecordingOpen
+	recordings map[string]int
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*Turn),
+	}
+}
+
+func (m *SessionManager) Add(t *Turn) {
+	m.mu.Lock()
+	m.sessions[t.ID] = t
+	t.manager = m
+	t.shared.Store(m)
+	m.mu.Unlock()
+	if c := m.cluster.Load(); c != nil {
+		c.sessionsChanged()
+	}
+	m.emit(SessionStarted, t)
+}
+
+func (m *SessionManager) Remove(t *Turn) {
+	m.mu.Lock()
+	if _, ok := m.sessions[t.ID]; !ok {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.sessions, t.ID)
+	m.releaseIdentity(t)
+	m.trackOrphan(t)
+	m.bytesIn += t.bytesIn.Load()
+	m.bytesOut += t.bytesOut.Load()
+	m.sessionSeconds += time.Since(t.StartTime).Seconds()
+	m.observeEnded(time.Since(t.StartTime))
+	m.mu.Unlock()
+	if c := m.cluster.Load(); c != nil {
+		c.sessionsChanged()
+	}
+	m.emit(SessionEnded, t)
+}
+
+// openRecording marks the recording name as being written until release
+// is called.
+func (m *SessionManager) openRecording(name string) (release func()) {
+	m.mu.Lock()
+	if m.recordings == nil {
+		m.recordings = make(map[string]int)
+	}
+	m.recordings[name]++
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		if m.recordings[name]--; m.recordings[name] <= 0 {
+			delete(m.recordings, name)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// RecordingOpen reports whether a live session is still writing the
+// recording name, see RetentionPolicy.InUse.
+func (m *SessionManager) RecordingOpen(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.recordings[name] > 0
+}
+
+// SetOutputRate limits the output of all sessions together to bytesPerSec,
+// on top of the OutputRate of each session. burst defaults to bytesPerSec;
+// 0 removes the limit. It may be called at any time.
+func (m *SessionManager) SetOutputRate(bytesPerSec, burst int) {
+	m.outLim.Store(newByteLimiter(bytesPerSec, burst))
+}
+
+// List returns what is known about every live session, oldest first.
+func (m *SessionManager) List() []Result {
+	m.mu.RLock()
+	list := make([]Result, 0, len(m.sessions))
+	for _, t := range m.sessions {
+		list = append(list, t.Result())
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartTime.Before(list[j].StartTime)
+	})
+	return list
+}
+
+// Kill closes the session with ReasonAdmin.
+func (m *SessionManager) Kill(id string) error {
+	t := m.Get(id)
+	if t == nil {
+		return ErrSessionNotFound
+	}
+	m.emit(SessionKilled, t)
+	return t.CloseWithReason(ReasonAdmin)
+}
+
+func (m *SessionManager) emit(typ SessionEventType, t *Turn) {
+	if m.OnEvent != nil {
+		m.OnEvent(SessionEvent{Type: typ, Session: t.Result()})
+	}
+}
+
+func (m *SessionManager) Get(id string) *Turn {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sessions[id]
+}
+
+// Snapshot returns the cumulative metrics. Sessions are moved from the live
+// set into the totals under the same lock, so a session is never counted
+// twice or missed while it is being removed.
+func (m *SessionManager) Snapshot() Metrics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := time.Now()
+	metrics := Metrics{
+		Time:           now,
+		ActiveSessions: len(m.sessions),
+		BytesIn:        m.bytesIn,
+		BytesOut:       m.bytesOut,
+		SessionSeconds: m.sessionSeconds,
+	}
+	for _, t := range m.sessions {
+		metrics.BytesIn += t.bytesIn.Load()
+		metrics.BytesOut += t.bytesOut.Load()
+		metrics.SessionSeconds += now.Sub(t.StartTime).Seconds()
+	}
+	return metrics
+}
+
+// NewID returns a session ID from IDGenerator, or a random one.
+func (c *TurnConfig) NewID() string {
+	if c.IDGenerator != nil {
+		return c.IDGenerator()
+	}
+	return newSessionID()
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,82 @@
+package webssh
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgMarker is sent by the owner with {"label"} to mark the current point
+// of the recording, e.g. "deploy started". A Player sends it once before
+// playing, with {"markers":[{"time","label"}]}, and the client may seek to
+// any of them.
+const MsgMarker = wire.MsgMarker
+
+// 标记名最长这么多字节
+const maxMarkerLabel = 256
+
+// Marker is a named point in a recording.
+type Marker struct {
+	Time  float64 `json:"time"`
+	Label string  `json:"label"`
+}
+
+type markerMsg struct {
+	Label   string   `json:"label,omitempty"`
+	Markers []Marker `json:"markers,omitempty"`
+}
+
+// Markers returns the markers among events.
+func Markers(events []RecEvent) []Marker {
+	markers := []Marker{}
+	for _, e := range events {
+		if e.Type == MarkerType {
+			markers = append(markers, Marker{Time: e.Time, Label: e.Data})
+		}
+	}
+	return markers
+}
+
+// Markers returns the markers of the recording being played.
+func (p *Player) Markers() []Marker {
+	return Markers(p.events)
+}
+
+func (p *Player) writeMarkers() error {
+	markers := p.Markers()
+	if len(markers) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(markerMsg{Markers: markers})
+	return p.WsConn.WriteMessage(websocket.TextMessage, controlFrame(MsgMarker, b))
+}
+
+func (t *Turn) handleMarker(msg markerMsg) {
+	label := msg.Label
+	if len(label) > maxMarkerLabel {
+		label = label[:maxMarkerLabel]
+	}
+	if label != "" {
+		t.Mark(label)
+	}
+}
+
+// RecordingMarkers lists the markers of the recording named by the name
+// parameter.
+func (w WebSSH) RecordingMarkers(c *gin.Context) {
+	f, err := w.OpenRecording(c.Param("name"))
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	defer f.Close()
+	_, events, err := ReadRecording(f)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, Markers(events))
+}
@@ -0,0 +1,107 @@
+package webssh
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	descActiveSessions = prometheus.NewDesc("webssh_active_sessions",
+		"Number of live sessions.", nil, nil)
+	descBytesIn = prometheus.NewDesc("webssh_bytes_in_total",
+		"Bytes of input written to the terminal, all sessions.", nil, nil)
+	descBytesOut = prometheus.NewDesc("webssh_bytes_out_total",
+		"Bytes of output sent to clients, all sessions.", nil, nil)
+	descSessionBytesIn = prometheus.NewDesc("webssh_session_bytes_in",
+		"Bytes of input written to the terminal by a live session.", []string{"session"}, nil)
+	descSessionBytesOut = prometheus.NewDesc("webssh_session_bytes_out",
+		"Bytes of output sent to clients by a live session.", []string{"session"}, nil)
+	descPtyErrors = prometheus.NewDesc("webssh_pty_read_errors_total",
+		"Sessions whose terminal ended with an error rather than an exit status.", nil, nil)
+	descWSErrors = prometheus.NewDesc("webssh_websocket_write_errors_total",
+		"Failed websocket writes.", nil, nil)
+	descReaped = prometheus.NewDesc("webssh_reaped_sessions_total",
+		"Sessions the reaper had to clean up, by what was left behind.", []string{"kind"}, nil)
+)
+
+// sessionCollector exports the metrics of a SessionManager.
+type sessionCollector struct {
+	m *SessionManager
+}
+
+// RegisterMetrics registers the manager's metrics with reg: active
+// sessions, bytes in and out in total and per live session, a histogram of
+// session durations, terminal read errors, websocket write errors and the
+// sessions cleaned up by Reap.
+func (m *SessionManager) RegisterMetrics(reg prometheus.Registerer) error {
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "webssh_session_duration_seconds",
+		Help:    "Duration of ended sessions.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	})
+	if err := reg.Register(duration); err != nil {
+		return err
+	}
+	if err := reg.Register(sessionCollector{m}); err != nil {
+		reg.Unregister(duration)
+		return err
+	}
+	m.mu.Lock()
+	m.duration = duration
+	m.mu.Unlock()
+	return nil
+}
+
+func (c sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descActiveSessions
+	ch <- descBytesIn
+	ch <- descBytesOut
+	ch <- descSessionBytesIn
+	ch <- descSessionBytesOut
+	ch <- descPtyErrors
+	ch <- descWSErrors
+	ch <- descReaped
+}
+
+func (c sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.m
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	bytesIn, bytesOut := m.bytesIn, m.bytesOut
+	for id, t := range m.sessions {
+		in, out := t.bytesIn.Load(), t.bytesOut.Load()
+		bytesIn += in
+		bytesOut += out
+		ch <- prometheus.MustNewConstMetric(descSessionBytesIn, prometheus.GaugeValue, float64(in), id)
+		ch <- prometheus.MustNewConstMetric(descSessionBytesOut, prometheus.GaugeValue, float64(out), id)
+	}
+	ch <- prometheus.MustNewConstMetric(descActiveSessions, prometheus.GaugeValue, float64(len(m.sessions)))
+	ch <- prometheus.MustNewConstMetric(descBytesIn, prometheus.CounterValue, float64(bytesIn))
+	ch <- prometheus.MustNewConstMetric(descBytesOut, prometheus.CounterValue, float64(bytesOut))
+	ch <- prometheus.MustNewConstMetric(descPtyErrors, prometheus.CounterValue, float64(m.ptyErrors.Load()))
+	ch <- prometheus.MustNewConstMetric(descWSErrors, prometheus.CounterValue, float64(m.wsErrors.Load()))
+	reaped := m.ReapStats()
+	ch <- prometheus.MustNewConstMetric(descReaped, prometheus.CounterValue, float64(reaped.Exited), "exited")
+	ch <- prometheus.MustNewConstMetric(descReaped, prometheus.CounterValue, float64(reaped.Unregistered), "unregistered")
+	ch <- prometheus.MustNewConstMetric(descReaped, prometheus.CounterValue, float64(reaped.Killed), "killed")
+}
+
+// observeEnded must be called with m.mu held.
+func (m *SessionManager) observeEnded(d time.Duration) {
+	if m.duration != nil {
+		m.duration.Observe(d.Seconds())
+	}
+}
+
+func (t *Turn) countPtyError() {
+	if t.manager != nil {
+		t.manager.ptyErrors.Add(1)
+	}
+}
+
+func (t *Turn) countWSError() {
+	if t.manager != nil {
+		t.manager.wsErrors.Add(1)
+	}
+}
@@ -0,0 +1,295 @@
+package webssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Types of MirrorEvent besides those of recordings.
+const (
+	MirrorStart = "start"
+	MirrorEnd   = "end"
+)
+
+// ErrMirrorDown is returned by Mirror.OnSessionStart when FailClosed is set
+// and the sink has been failing.
+var ErrMirrorDown = errors.New("session mirror unavailable")
+
+// MirrorEvent is one piece of a session as it happens. Type is "o", "i" or
+// "r" with Data as in recordings, MirrorStart with the TERM of the session
+// (its size follows as "r"), or MirrorEnd with the close reason. Seq counts
+// the events of a session from 1, so a sink can spot gaps after events
+// were dropped.
+type MirrorEvent struct {
+	Session string    `json:"session"`
+	Owner   string    `json:"owner,omitempty"`
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Data    string    `json:"data,omitempty"`
+}
+
+// MirrorSink takes batches of events to an external system, e.g. Kafka or
+// a gRPC stream. Send is called from one goroutine at a time; an error
+// makes Mirror retry the batch.
+type MirrorSink interface {
+	Send(ctx context.Context, events []MirrorEvent) error
+}
+
+// MirrorSinkFunc adapts a function to MirrorSink.
+type MirrorSinkFunc func(ctx context.Context, events []MirrorEvent) error
+
+func (f MirrorSinkFunc) Send(ctx context.Context, events []MirrorEvent) error {
+	return f(ctx, events)
+}
+
+// Mirror is a Hook that forwards the I/O of every session to Sink within
+// FlushInterval, so a SOC can watch privileged sessions live instead of
+// reading the recording afterwards. Sessions never wait for the sink: when
+// the queue is full events are dropped and counted in Dropped. Put it last
+// in TurnConfig.Hooks to see what the user sees.
+type Mirror struct {
+	NopHook
+	Sink MirrorSink
+	// Input开启后也转发用户输入，可能包含密码
+	Input bool
+	// FlushInterval是最长攒批的时间，默认200毫秒；MaxBatch是每批最多几个事件，默认256
+	FlushInterval time.Duration
+	MaxBatch      int
+	// QueueSize是等待发送的事件数上限，默认4096，满了就丢弃
+	QueueSize int
+	// 一批发送失败后重试的次数，间隔从1秒开始翻倍
+	Retries int
+	Timeout time.Duration
+	// FailClosed开启后sink不可用时拒绝新会话，已有的会话不受影响
+	FailClosed bool
+
+	Dropped atomic.Int64
+
+	once  sync.Once
+	queue chan MirrorEvent
+	seqs  sync.Map // *Turn -> *atomic.Uint64
+	down  atomic.Bool
+	// 最近一次报告丢弃的时间，避免刷屏
+	lastDropLog atomic.Int64
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        chan struct{}
+}
+
+func (m *Mirror) start() {
+	m.once.Do(func() {
+		if m.FlushInterval <= 0 {
+			m.FlushInterval = 200 * time.Millisecond
+		}
+		if m.MaxBatch <= 0 {
+			m.MaxBatch = 256
+		}
+		if m.QueueSize <= 0 {
+			m.QueueSize = 4096
+		}
+		if m.Timeout <= 0 {
+			m.Timeout = 5 * time.Second
+		}
+		m.queue = make(chan MirrorEvent, m.QueueSize)
+		m.stop = make(chan struct{})
+		m.done = make(chan struct{})
+		go m.run()
+	})
+}
+
+func (m *Mirror) OnSessionStart(t *Turn) error {
+	m.start()
+	if m.FailClosed && m.down.Load() {
+		return ErrMirrorDown
+	}
+	m.seqs.Store(t, new(atomic.Uint64))
+	m.push(t, MirrorStart, t.term())
+	// 第一次resize在OnSessionStart之前，不经过OnResize
+	rows, cols := int(t.rows.Load()), int(t.cols.Load())
+	if rows <= 0 || cols <= 0 {
+		rows, cols = t.initialSize()
+	}
+	m.push(t, string(ResizeType), fmt.Sprintf("%dx%d", cols, rows))
+	return nil
+}
+
+func (m *Mirror) OnInput(t *Turn, p []byte, next func([]byte) error) error {
+	if m.Input {
+		m.push(t, string(InputType), string(p))
+	}
+	return next(p)
+}
+
+func (m *Mirror) OnOutput(t *Turn, p []byte, next func([]byte) error) error {
+	m.push(t, string(OutPutType), string(p))
+	return next(p)
+}
+
+func (m *Mirror) OnResize(t *Turn, rows, cols int, next func(rows, cols int) error) error {
+	m.push(t, string(ResizeType), fmt.Sprintf("%dx%d", cols, rows))
+	return next(rows, cols)
+}
+
+func (m *Mirror) OnClose(t *Turn, reason Reason) {
+	m.push(t, MirrorEnd, string(reason))
+	m.seqs.Delete(t)
+}
+
+// push queues an event of t without blocking.
+func (m *Mirror) push(t *Turn, typ, data string) {
+	v, ok := m.seqs.Load(t)
+	if !ok {
+		// OnSessionStart没有调用过，或者会话已经结束
+		return
+	}
+	e := MirrorEvent{Session: t.ID, Owner: t.Owner, Seq: v.(*atomic.Uint64).Add(1), Time: time.Now(), Type: typ, Data: data}
+	select {
+	case m.queue <- e:
+	default:
+		m.Dropped.Add(1)
+		now := time.Now().UnixNano()
+		if last := m.lastDropLog.Load(); now-last > int64(10*time.Second) && m.lastDropLog.CompareAndSwap(last, now) {
+			DefaultLogger().Warn("session mirror queue full", "dropped", m.Dropped.Load())
+		}
+	}
+}
+
+func (m *Mirror) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]MirrorEvent, 0, m.MaxBatch)
+	flush := func() {
+		if len(batch) > 0 {
+			m.send(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case e := <-m.queue:
+			batch = append(batch, e)
+			if len(batch) >= m.MaxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-m.stop:
+			// 把剩下的发完
+			for {
+				select {
+				case e := <-m.queue:
+					batch = append(batch, e)
+					if len(batch) >= m.MaxBatch {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (m *Mirror) send(batch []MirrorEvent) {
+	backoff := time.Second
+	retries := m.Retries
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), m.Timeout)
+		err := m.Sink.Send(ctx, batch)
+		cancel()
+		if err == nil {
+			m.down.Store(false)
+			return
+		}
+		if i >= retries {
+			m.down.Store(true)
+			m.Dropped.Add(int64(len(batch)))
+			DefaultLogger().Error("session mirror", "dropped", len(batch), "err", err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-m.stop:
+			// 关闭时不再等
+			retries = i + 1
+		}
+		backoff *= 2
+	}
+}
+
+// Close sends what is queued and stops the Mirror. Sessions must have
+// ended before.
+func (m *Mirror) Close() error {
+	m.start()
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+	return nil
+}
+
+// WebhookSink posts each batch to URL as newline delimited JSON, one
+// MirrorEvent per line, e.g. to a SIEM collector or a Kafka HTTP bridge.
+type WebhookSink struct {
+	URL    string
+	Header http.Header
+	Client *http.Client
+}
+
+func (s *WebhookSink) Send(ctx context.Context, events []MirrorEvent) error {
+	var body bytes.Buffer
+	if err := writeMirrorEvents(&body, events); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, &body)
+	if err != nil {
+		return err
+	}
+	for k, v := range s.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// WriterSink writes the events to W as newline delimited JSON, e.g. to a
+// pipe read by a log shipper.
+type WriterSink struct {
+	W io.Writer
+}
+
+func (s *WriterSink) Send(_ context.Context, events []MirrorEvent) error {
+	return writeMirrorEvents(s.W, events)
+}
+
+func writeMirrorEvents(w io.Writer, events []MirrorEvent) error {
+	enc := json.NewEncoder(w)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
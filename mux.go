@@ -0,0 +1,327 @@
+package webssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// 一个连接上默认最多开这么多个终端
+const defaultMuxChannels = 16
+
+// muxCtl is a message on channel 0 of a multiplexed connection. The client
+// sends {"op":"open","ch":1,"query":"rows=40&cols=120"} and
+// {"op":"close","ch":1}, the server answers {"op":"opened","ch":1,
+// "session":...} with the ID of the new session, {"op":"closed","ch":1,...}
+// when a channel has ended, with the close code and reason of its session,
+// and {"op":"error","ch":1,"reason":...} when it could not be opened.
+//
+// {"op":"broadcast","chs":[1,2,3]} puts channels in the broadcast set:
+// input sent to one of them goes to all of them, e.g. to run the same
+// command on many servers. An empty chs clears the set.
+type muxCtl struct {
+	Op      string `json:"op"`
+	Ch      int    `json:"ch"`
+	Chs     []int  `json:"chs,omitempty"`
+	Query   string `json:"query,omitempty"`
+	Session string `json:"session,omitempty"`
+	Code    int    `json:"code,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type muxConn struct {
+	w        WebSSH
+	r        *http.Request
+	clientIP string
+	conn     *websocket.Conn
+
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	channels map[int]*websocket.Conn
+	// broadcast里的通道共享输入
+	broadcast map[int]bool
+	wg        sync.WaitGroup
+}
+
+// ServeMux runs several independent sessions over one websocket, e.g. for
+// a dashboard with many terminals. Every message starts with the decimal
+// channel id and '|', followed by a message of the usual protocol with the
+// same frame type; channel 0 carries muxCtl. Each channel is authorized
+// and served like a connection to ServeConn with the query of its open
+// message added to the one of the upgrade request.
+func (w WebSSH) ServeMux(c *gin.Context) {
+	// 这里只校验一次，打开每个终端时再按各自的参数校验
+	if _, err := w.authorize(c.Request); err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	wsConn, err := w.upgrade(c.Writer, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	defer wsConn.Close()
+	m := &muxConn{w: w, r: c.Request, clientIP: c.ClientIP(), conn: wsConn, channels: map[int]*websocket.Conn{}}
+	if err := m.loop(); err != nil {
+		w.logger().Info("mux connection ended", "remote", c.ClientIP(), "err", err)
+	}
+	m.closeAll()
+	m.wg.Wait()
+}
+
+func (m *muxConn) loop() error {
+	for {
+		msgType, p, err := m.conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("reading mux message err:%s", err)
+		}
+		ch, body, err := splitChannel(p)
+		if err != nil {
+			return err
+		}
+		if ch == 0 {
+			var ctl muxCtl
+			if err := json.Unmarshal(body, &ctl); err != nil {
+				return fmt.Errorf("mux control message err:%s", err)
+			}
+			m.control(ctl)
+			continue
+		}
+		for _, conn := range m.targets(ch, body) {
+			if err := conn.WriteMessage(msgType, body); err != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// targets returns the channels a message sent to ch goes to: every channel
+// of the broadcast set for input to one of them, otherwise ch itself.
+func (m *muxConn) targets(ch int, body []byte) []*websocket.Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	input := len(body) > 0 && (body[0] == MsgData || body[0] == MsgPaste)
+	if !input || !m.broadcast[ch] {
+		// 已经结束的终端，客户端可能还没收到closed
+		if conn := m.channels[ch]; conn != nil {
+			return []*websocket.Conn{conn}
+		}
+		return nil
+	}
+	conns := make([]*websocket.Conn, 0, len(m.broadcast))
+	for c := range m.broadcast {
+		if conn := m.channels[c]; conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+func (m *muxConn) control(ctl muxCtl) {
+	switch ctl.Op {
+	case "open":
+		if err := m.open(ctl.Ch, ctl.Query); err != nil {
+			m.writeCtl(muxCtl{Op: "error", Ch: ctl.Ch, Reason: err.Error()})
+		}
+	case "broadcast":
+		m.mu.Lock()
+		m.broadcast = map[int]bool{}
+		for _, ch := range ctl.Chs {
+			m.broadcast[ch] = true
+		}
+		m.mu.Unlock()
+	case "close":
+		m.mu.Lock()
+		conn := m.channels[ctl.Ch]
+		m.mu.Unlock()
+		if conn != nil {
+			// 和浏览器关闭连接一样结束会话
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+		}
+	}
+}
+
+func (m *muxConn) open(ch int, query string) error {
+	max := m.w.MaxMuxChannels
+	if max <= 0 {
+		max = defaultMuxChannels
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case ch <= 0:
+		return errors.New("invalid channel")
+	case m.channels[ch] != nil:
+		return errors.New("channel in use")
+	case len(m.channels) >= max:
+		return errors.New("too many channels")
+	}
+	r, err := channelRequest(m.r, query)
+	if err != nil {
+		return err
+	}
+	server, client, err := pipeConns()
+	if err != nil {
+		return err
+	}
+	// 先定好ID，客户端据此区分各个会话的输出
+	w := m.w
+	conf := *w.WebSSHConfig
+	conf.SessionID = conf.NewID()
+	w.WebSSHConfig = &conf
+	m.channels[ch] = client
+	// 在会话的输出之前告诉客户端
+	m.writeCtl(muxCtl{Op: "opened", Ch: ch, Session: conf.SessionID})
+	m.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		defer server.Close()
+		w.serveRequest(server, r, m.clientIP)
+	}()
+	go func() {
+		defer m.wg.Done()
+		m.relay(ch, client)
+	}()
+	return nil
+}
+
+// relay copies what the session on ch sends to the shared connection until
+// the session closes it.
+func (m *muxConn) relay(ch int, conn *websocket.Conn) {
+	prefix := []byte(strconv.Itoa(ch) + "|")
+	closed := muxCtl{Op: "closed", Ch: ch, Code: websocket.CloseAbnormalClosure}
+	for {
+		msgType, p, err := conn.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				closed.Code, closed.Reason = ce.Code, ce.Text
+			}
+			break
+		}
+		if err := m.write(msgType, append(prefix, p...)); err != nil {
+			break
+		}
+	}
+	conn.Close()
+	m.mu.Lock()
+	delete(m.channels, ch)
+	delete(m.broadcast, ch)
+	m.mu.Unlock()
+	m.writeCtl(closed)
+}
+
+func (m *muxConn) write(msgType int, p []byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return m.conn.WriteMessage(msgType, p)
+}
+
+func (m *muxConn) writeCtl(ctl muxCtl) {
+	b, _ := json.Marshal(ctl)
+	m.write(websocket.TextMessage, append([]byte("0|"), b...))
+}
+
+func (m *muxConn) closeAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.channels {
+		conn.Close()
+	}
+}
+
+func splitChannel(p []byte) (int, []byte, error) {
+	i := bytes.IndexByte(p, '|')
+	if i <= 0 || i > 5 {
+		return 0, nil, errors.New("mux message without channel")
+	}
+	ch, err := strconv.Atoi(string(p[:i]))
+	if err != nil || ch < 0 {
+		return 0, nil, fmt.Errorf("invalid mux channel %q", p[:i])
+	}
+	return ch, p[i+1:], nil
+}
+
+// channelRequest is the upgrade request r with query added, as if the
+// channel had connected by itself.
+func channelRequest(r *http.Request, query string) (*http.Request, error) {
+	extra, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel query err:%s", err)
+	}
+	q := r.URL.Query()
+	for k, v := range extra {
+		q[k] = v
+	}
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = q.Encode()
+	return r, nil
+}
+
+// pipeConns returns both ends of a websocket connection over net.Pipe, for
+// a session that does not have a connection of its own.
+func pipeConns() (server, client *websocket.Conn, err error) {
+	c1, c2 := net.Pipe()
+	type upgraded struct {
+		conn *websocket.Conn
+		err  error
+	}
+	ch := make(chan upgraded, 1)
+	go func() {
+		br := bufio.NewReader(c2)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			c2.Close()
+			ch <- upgraded{err: err}
+			return
+		}
+		rw := &pipeResponse{conn: c2, brw: bufio.NewReadWriter(br, bufio.NewWriter(c2)), header: http.Header{}}
+		conn, err := upgrader.Upgrade(rw, req, nil)
+		ch <- upgraded{conn: conn, err: err}
+	}()
+	dialer := websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) { return c1, nil },
+	}
+	client, _, err = dialer.Dial("ws://mux/", nil)
+	res := <-ch
+	if err != nil || res.err != nil {
+		c1.Close()
+		c2.Close()
+		if err == nil {
+			err = res.err
+		}
+		return nil, nil, fmt.Errorf("mux channel err:%s", err)
+	}
+	return res.conn, client, nil
+}
+
+// pipeResponse lets the upgrader take over one end of a net.Pipe.
+type pipeResponse struct {
+	conn   net.Conn
+	brw    *bufio.ReadWriter
+	header http.Header
+}
+
+func (p *pipeResponse) Header() http.Header { return p.header }
+
+func (p *pipeResponse) Write(b []byte) (int, error) { return p.conn.Write(b) }
+
+func (p *pipeResponse) WriteHeader(int) {}
+
+func (p *pipeResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return p.conn, p.brw, nil
+}
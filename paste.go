@@ -0,0 +1,173 @@
+package webssh
+
+import (
+	"bytes"
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgPaste carries pasted text, framed like MsgData. It is wrapped in
+// bracketed paste markers when the application asked for them, and written
+// in PasteChunkSize pieces PasteDelay apart.
+const MsgPaste = wire.MsgPaste
+
+const (
+	defaultPasteChunkSize = 1024
+	defaultPasteDelay     = 10 * time.Millisecond
+)
+
+var (
+	bracketedOn  = []byte("\x1b[?2004h")
+	bracketedOff = []byte("\x1b[?2004l")
+	pasteStart   = []byte("\x1b[200~")
+	pasteEnd     = []byte("\x1b[201~")
+)
+
+// trackPasteOutput notes whether the application has bracketed paste mode
+// on. It is called with every chunk of output.
+func (t *Turn) trackPasteOutput(p []byte) {
+	// 开关序列可能被拆在两次输出里
+	head := p
+	if len(head) > len(bracketedOn)-1 {
+		head = head[:len(bracketedOn)-1]
+	}
+	var joined [32]byte
+	t.updateBracketed(append(append(joined[:0], t.pasteTail...), head...))
+	t.updateBracketed(p)
+	if len(p) >= len(bracketedOn)-1 {
+		t.pasteTail = append(t.pasteTail[:0], p[len(p)-len(bracketedOn)+1:]...)
+	} else {
+		t.pasteTail = append(t.pasteTail, p...)
+		if n := len(t.pasteTail) - len(bracketedOn) + 1; n > 0 {
+			t.pasteTail = t.pasteTail[n:]
+		}
+	}
+}
+
+func (t *Turn) updateBracketed(p []byte) {
+	on, off := bytes.LastIndex(p, bracketedOn), bytes.LastIndex(p, bracketedOff)
+	if on > off {
+		t.bracketed.Store(true)
+	} else if off > on {
+		t.bracketed.Store(false)
+	}
+}
+
+// pasteItem is input waiting in the paste queue.
+type pasteItem struct {
+	ctx   context.Context
+	body  []byte
+	paste bool
+}
+
+// 排队等待写入的消息数，满了之后读循环才会等
+const pasteQueueLen = 16
+
+// handlePaste queues pasted text to be written like typed input, in chunks
+// so a large paste does not overflow the input buffer of the pty. The
+// chunks are written PasteDelay apart by loopPaste, so the read loop goes
+// on meanwhile, reading pongs and keeping its read deadline.
+func (t *Turn) handlePaste(ctx context.Context, body []byte, logBuff *bytes.Buffer) error {
+	// 内容里的结束标记会让程序提前结束粘贴，把后面的内容当命令执行；
+	// 客户端自己加过的标记也去掉
+	body = bytes.ReplaceAll(bytes.ReplaceAll(body, pasteStart, nil), pasteEnd, nil)
+	t.queueInput(ctx, body, true)
+	return nil
+}
+
+// handleTyped writes typed input, after the pastes still being written.
+func (t *Turn) handleTyped(ctx context.Context, body []byte, logBuff *bytes.Buffer) error {
+	if t.pasting.Load() > 0 {
+		t.queueInput(ctx, append([]byte(nil), body...), false)
+		return nil
+	}
+	return t.handleInput(ctx, body, logBuff)
+}
+
+// queueInput hands body to loopPaste, starting it on first use. It waits
+// while the queue is full.
+func (t *Turn) queueInput(ctx context.Context, body []byte, paste bool) {
+	t.pasteOnce.Do(func() {
+		t.pasteQ = make(chan pasteItem, pasteQueueLen)
+		go t.loopPaste()
+	})
+	t.pasting.Add(1)
+	select {
+	case t.pasteQ <- pasteItem{ctx: ctx, body: body, paste: paste}:
+	case <-ctx.Done():
+		t.pasting.Add(-1)
+	case <-t.ctx.Done():
+		t.pasting.Add(-1)
+	}
+}
+
+// loopPaste writes the queued input in order until the session ends.
+func (t *Turn) loopPaste() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case item := <-t.pasteQ:
+			var err error
+			if item.ctx.Err() != nil {
+				// 放进队列的读循环已经结束
+			} else if item.paste {
+				err = t.writePaste(item.ctx, item.body)
+			} else {
+				err = t.handleInput(item.ctx, item.body, nil)
+			}
+			t.pasting.Add(-1)
+			if err != nil {
+				t.logger().Warn("write paste", "err", err)
+			}
+		}
+	}
+}
+
+// writePaste writes body in PasteChunkSize chunks PasteDelay apart,
+// wrapped in bracketed paste markers when the application asked for them.
+func (t *Turn) writePaste(ctx context.Context, body []byte) error {
+	if t.bracketed.Load() {
+		body = append(append(append([]byte(nil), pasteStart...), body...), pasteEnd...)
+	}
+	size := t.PasteChunkSize
+	if size <= 0 {
+		size = defaultPasteChunkSize
+	}
+	delay := t.PasteDelay
+	if delay <= 0 {
+		delay = defaultPasteDelay
+	}
+	for len(body) > 0 {
+		n := len(body)
+		if n > size {
+			n = size
+			// 不拆开一个字符
+			for n > 1 && !utf8.RuneStart(body[n]) {
+				n--
+			}
+		}
+		// 读循环的logBuff可能已经还回池里，这里不写它
+		if err := t.handleInput(ctx, body[:n], nil); err != nil {
+			return err
+		}
+		body = body[n:]
+		if len(body) == 0 {
+			break
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-t.ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+	return nil
+}
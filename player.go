@@ -0,0 +1,260 @@
+package webssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 回放控制消息，和MsgData/MsgResize共用一套类型
+const (
+	MsgPause  = '3'
+	MsgResume = '4'
+	MsgSpeed  = '5'
+	MsgSeek   = '6'
+)
+
+const (
+	minPlaySpeed = 0.5
+	maxPlaySpeed = 5
+)
+
+type playCtrl struct {
+	Type  byte    `json:"-"`
+	Speed float64 `json:"speed"`
+	Time  float64 `json:"time"`
+}
+
+// Player streams an asciicast recording to a websocket with its original
+// timing. The client may pause, resume, change speed and seek.
+type Player struct {
+	Header *RecHeader
+	WsConn *websocket.Conn
+
+	events []RecEvent
+}
+
+func NewPlayer(wsConn *websocket.Conn, r io.Reader) (*Player, error) {
+	header, events, err := ReadRecording(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Player{Header: header, WsConn: wsConn, events: events}, nil
+}
+
+// ReadRecording reads an asciicast v2 recording.
+func ReadRecording(r io.Reader) (*RecHeader, []RecEvent, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("empty recording")
+	}
+	header := new(RecHeader)
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return nil, nil, fmt.Errorf("parse recording header err:%s", err)
+	}
+
+	var events []RecEvent
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var e RecEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, nil, fmt.Errorf("parse recording event err:%s", err)
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return header, events, nil
+}
+
+// CapIdle shortens every pause between events to at most limit, so long
+// idle stretches replay quickly. Recordings made with an idle limit are
+// capped already.
+func (p *Player) CapIdle(limit time.Duration) {
+	max := limit.Seconds()
+	if max <= 0 {
+		return
+	}
+	var skipped, last float64
+	for i := range p.events {
+		t := p.events[i].Time - skipped
+		if t-last > max {
+			skipped += t - last - max
+			t = last + max
+		}
+		p.events[i].Time = t
+		last = t
+	}
+}
+
+// Duration returns the time of the last event in the recording.
+func (p *Player) Duration() float64 {
+	if len(p.events) == 0 {
+		return 0
+	}
+	return p.events[len(p.events)-1].Time
+}
+
+func (p *Player) Play(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ctrl := make(chan playCtrl)
+	errc := make(chan error, 1)
+	go p.loopRead(ctx, ctrl, errc)
+	if err := p.writeMarkers(); err != nil {
+		return err
+	}
+
+	var (
+		clock  float64
+		anchor = time.Now()
+		speed  = 1.0
+		paused bool
+		i      int
+	)
+	now := func() float64 {
+		if paused {
+			return clock
+		}
+		return clock + time.Since(anchor).Seconds()*speed
+	}
+
+	for i < len(p.events) {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !paused {
+			wait := (p.events[i].Time - now()) / speed
+			if wait <= 0 {
+				if err := p.writeEvent(p.events[i]); err != nil {
+					return err
+				}
+				i++
+				continue
+			}
+			timer = time.NewTimer(time.Duration(wait * float64(time.Second)))
+			timeout = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			stopTimer(timer)
+			return ctx.Err()
+		case err := <-errc:
+			stopTimer(timer)
+			return err
+		case <-timeout:
+		case c := <-ctrl:
+			stopTimer(timer)
+			clock, anchor = now(), time.Now()
+			switch c.Type {
+			case MsgPause:
+				paused = true
+			case MsgResume:
+				paused = false
+			case MsgSpeed:
+				speed = clampSpeed(c.Speed)
+			case MsgSeek:
+				var err error
+				if i, err = p.seek(c.Time); err != nil {
+					return err
+				}
+				clock = c.Time
+			}
+		}
+	}
+	return nil
+}
+
+// seek redraws the screen as of time t and returns the index of the next
+// event to play.
+func (p *Player) seek(t float64) (int, error) {
+	buf := bufPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufPool.Put(buf)
+
+	buf.WriteString("\x1bc")
+	i := 0
+	for ; i < len(p.events) && p.events[i].Time < t; i++ {
+		if p.events[i].Type == OutPutType {
+			buf.WriteString(p.events[i].Data)
+		}
+	}
+	return i, p.WsConn.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+}
+
+func (p *Player) writeEvent(e RecEvent) error {
+	switch e.Type {
+	case OutPutType:
+		return p.WsConn.WriteMessage(websocket.BinaryMessage, []byte(e.Data))
+	case ResizeType:
+		// 录制时窗口大小变了，回放的终端跟着变
+		rows, cols, ok := e.Size()
+		if !ok {
+			return nil
+		}
+		b, _ := json.Marshal(Resize{Columns: cols, Rows: rows})
+		return p.WsConn.WriteMessage(websocket.TextMessage, controlFrame(MsgResize, b))
+	}
+	return nil
+}
+
+func (p *Player) loopRead(ctx context.Context, ctrl chan<- playCtrl, errc chan<- error) {
+	for {
+		_, wsData, err := p.WsConn.ReadMessage()
+		if err != nil {
+			errc <- fmt.Errorf("reading webSocket message err:%s", err)
+			return
+		}
+		if len(wsData) == 0 {
+			continue
+		}
+		c := playCtrl{Type: wsData[0]}
+		switch c.Type {
+		case MsgSpeed, MsgSeek:
+			if err := json.Unmarshal(decode(wsData[1:]), &c); err != nil {
+				errc <- fmt.Errorf("player control message err:%s", err)
+				return
+			}
+		case MsgPause, MsgResume:
+		default:
+			continue
+		}
+		select {
+		case ctrl <- c:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func clampSpeed(speed float64) float64 {
+	if speed < minPlaySpeed {
+		return minPlaySpeed
+	}
+	if speed > maxPlaySpeed {
+		return maxPlaySpeed
+	}
+	return speed
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
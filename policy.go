@@ -0,0 +1,110 @@
+package webssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// CommandPolicy decides whether a command line typed by the user may run.
+type CommandPolicy interface {
+	// Check returns an error, shown to the user, to block line.
+	Check(sessionID, line string) error
+}
+
+// CommandRules is a CommandPolicy made of regular expressions matched
+// against the whole line. A line matching any of Deny is blocked; if Allow
+// is not empty, a line must also match one of Allow.
+type CommandRules struct {
+	Allow []*regexp.Regexp
+	Deny  []*regexp.Regexp
+}
+
+// NewCommandRules compiles the given patterns into CommandRules.
+func NewCommandRules(allow, deny []string) (*CommandRules, error) {
+	r := &CommandRules{}
+	for _, s := range allow {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("allow rule %q err:%s", s, err)
+		}
+		r.Allow = append(r.Allow, re)
+	}
+	for _, s := range deny {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("deny rule %q err:%s", s, err)
+		}
+		r.Deny = append(r.Deny, re)
+	}
+	return r, nil
+}
+
+func (r *CommandRules) Check(sessionID, line string) error {
+	for _, re := range r.Deny {
+		if re.MatchString(line) {
+			return fmt.Errorf("command denied by rule %s", re)
+		}
+	}
+	if len(r.Allow) == 0 {
+		return nil
+	}
+	for _, re := range r.Allow {
+		if re.MatchString(line) {
+			return nil
+		}
+	}
+	return errors.New("command not allowed")
+}
+
+// 拦截命令时代替回车发给shell的按键：移到行尾再清空整行
+var clearLine = []byte{0x05, 0x15}
+
+var errCommandTooLong = errors.New("command too long to check")
+
+// 在密码提示后输入的行被拦截时，日志里用它代替行的内容
+const maskedCommand = "[secret]"
+
+// applyPolicy checks every line completed in p against CommandPolicy and
+// replaces the Enter of a blocked line with keys that clear it, so the
+// shell never runs it. This relies on the remote line editor honouring
+// Ctrl-E and Ctrl-U, as bash, zsh and most readline programs do. A line
+// typed at what looks like a password prompt is checked too, since the
+// prompt comes from output the user controls, but its text is kept out of
+// the log.
+func (t *Turn) applyPolicy(p []byte) []byte {
+	var out []byte
+	secret := t.secret.Load()
+	for len(p) > 0 {
+		i := bytes.IndexAny(p, "\r\n")
+		if i < 0 {
+			t.cmdLine.Write(p)
+			out = append(out, p...)
+			break
+		}
+		t.cmdLine.Write(p[:i])
+		line := string(t.cmdLine.buf)
+		err := t.cmdTooLong
+		t.cmdLine.reset()
+		t.cmdTooLong = nil
+		if err == nil && line != "" {
+			err = t.checkCommand(line)
+		}
+		logged := line
+		if secret {
+			logged = maskedCommand
+		}
+		secret = false
+		out = append(out, p[:i]...)
+		if err != nil {
+			t.logger().Warn("blocked command", "event", "command_blocked", "command", logged, "err", err)
+			t.writeNotice(fmt.Sprintf("\r\n[blocked: %s]\r\n", err))
+			out = append(out, clearLine...)
+		} else {
+			out = append(out, p[i])
+		}
+		p = p[i+1:]
+	}
+	return out
+}
@@ -2,7 +2,14 @@ package webssh
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
 )
 
 var bufPool = sync.Pool{
@@ -10,3 +17,263 @@ var bufPool = sync.Pool{
 		return new(bytes.Buffer)
 	},
 }
+
+// 池中shell在绑定websocket之前产生的输出最多缓存这么多
+const maxPendingOutput = 64 * 1024
+
+var errPoolClosed = errors.New("pty pool closed")
+
+// PTYPool keeps a number of shells started and ready so new connections do
+// not wait for the ssh handshake and shell startup. All shells in a pool are
+// started with the command, environment and terminal type of the same
+// TurnConfig; use one pool per command profile. The Turn around a shell is
+// only made when a connection takes it, with the TurnConfig of that
+// connection, so its id, name, charset, banner, trace context and size are
+// its own.
+type PTYPool struct {
+	size int
+	dial func() (*ssh.Client, error)
+	conf *TurnConfig
+
+	ready  chan *pooledShell
+	refill chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// pooledShell is a shell started on its own connection, waiting for a Turn.
+type pooledShell struct {
+	client  *ssh.Client
+	backend *sshBackend
+	out     *pendingWriter
+}
+
+// pendingWriter keeps the output of a shell until it is attached to a
+// Turn, then passes it on.
+type pendingWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (p *pendingWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.w != nil {
+		return p.w.Write(b)
+	}
+	if room := maxPendingOutput - p.buf.Len(); room > 0 {
+		p.buf.Write(b[:min(len(b), room)])
+	}
+	return len(b), nil
+}
+
+// attach writes the output kept so far to w and sends the rest there.
+func (p *pendingWriter) attach(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.buf.Len() > 0 {
+		if _, err := w.Write(p.buf.Bytes()); err != nil {
+			return err
+		}
+		p.buf = bytes.Buffer{}
+	}
+	p.w = w
+	return nil
+}
+
+func NewPTYPool(size int, dial func() (*ssh.Client, error), conf *TurnConfig) *PTYPool {
+	p := &PTYPool{
+		size:   size,
+		dial:   dial,
+		conf:   conf,
+		ready:  make(chan *pooledShell, size),
+		refill: make(chan struct{}, 1),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	go p.loopFill()
+	return p
+}
+
+// Get starts a Turn with conf on a ready shell bound to wsConn, or on a new
+// connection if the pool is empty.
+func (p *PTYPool) Get(wsConn *websocket.Conn, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	if p.ctx.Err() != nil {
+		return nil, errPoolClosed
+	}
+	defer p.wakeFiller()
+	for {
+		select {
+		case s := <-p.ready:
+			if !s.alive() {
+				s.close()
+				continue
+			}
+			return s.turn(wsConn, rec, conf)
+		default:
+			client, err := p.dial()
+			if err != nil {
+				return nil, err
+			}
+			turn, err := NewTurn(wsConn, client, rec, conf)
+			if err != nil {
+				client.Close()
+				return nil, err
+			}
+			turn.sshClient = client
+			return turn, nil
+		}
+	}
+}
+
+// Close stops refilling and closes the idle shells.
+func (p *PTYPool) Close() {
+	p.cancel()
+	for {
+		select {
+		case s := <-p.ready:
+			s.close()
+		default:
+			return
+		}
+	}
+}
+
+// spawn starts a shell for the pool.
+func (p *PTYPool) spawn() (*pooledShell, error) {
+	client, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	term := p.conf.Term
+	if term == "" {
+		term = defaultTerm
+	}
+	rows, cols := defaultRows, defaultCols
+	if p.conf.Rows > 0 && p.conf.Cols > 0 {
+		rows, cols = p.conf.Rows, p.conf.Cols
+	}
+	out := &pendingWriter{}
+	b, err := StartSSHShell(client, p.conf.shellOptions())(out, term, rows, cols)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &pooledShell{client: client, backend: b.(*sshBackend), out: out}, nil
+}
+
+// turn makes the Turn of a connection around the shell, which is closed if
+// that fails.
+func (s *pooledShell) turn(wsConn *websocket.Conn, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	start := func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		if err := s.backend.Resize(rows, cols); err != nil {
+			return nil, err
+		}
+		// 等待期间的输出先发出去，也是录像的开头
+		if err := s.out.attach(out); err != nil {
+			return nil, err
+		}
+		return s.backend, nil
+	}
+	turn, err := NewBackendTurn(wsConn, start, rec, conf)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	turn.Session = s.backend.sess
+	turn.StdinPipe = s.backend.stdin
+	turn.openFiles = openSFTP(s.client)
+	turn.fwdClient = s.client
+	turn.sshClient = s.client
+	if conf.SSHKeepAlive > 0 {
+		go turn.loopSSHKeepAlive(s.client)
+	}
+	return turn, nil
+}
+
+// alive reports whether the shell is still usable.
+func (s *pooledShell) alive() bool {
+	_, err := s.backend.sess.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+func (s *pooledShell) close() {
+	s.backend.Close()
+	s.client.Close()
+}
+
+func (p *PTYPool) wakeFiller() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *PTYPool) loopFill() {
+	for {
+		for len(p.ready) < p.size {
+			s, err := p.spawn()
+			if err != nil {
+				p.conf.logger().Error("pty pool", "err", err)
+				break
+			}
+			select {
+			case p.ready <- s:
+				if p.ctx.Err() != nil {
+					// 和Close同时发生时这个shell可能没被关掉
+					p.Close()
+					return
+				}
+			case <-p.ctx.Done():
+				s.close()
+				return
+			}
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.refill:
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// Bind attaches a Turn started without a websocket to wsConn. Output it
+// produced so far is sent first and becomes the start of the recording.
+func (t *Turn) Bind(wsConn *websocket.Conn, rec *Recorder) error {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	t.WsConn = wsConn
+	t.StartTime = time.Now()
+	t.Recorder = rec
+	// MaxDuration从绑定时开始算
+	t.rescheduleDeadline()
+	t.waitInitialSize()
+	if t.pending == nil || t.pending.Len() == 0 {
+		return nil
+	}
+	p := t.pending.Bytes()
+	t.pending = nil
+	if t.Recorder != nil {
+		t.Recorder.Lock()
+		t.Recorder.WriteData(OutPutType, string(p))
+		t.Recorder.Unlock()
+	}
+	t.bytesOut.Add(int64(len(p)))
+	return wsConn.WriteMessage(websocket.BinaryMessage, p)
+}
+
+// bufferPending keeps output of a Turn that is not bound to a websocket yet.
+func (t *Turn) bufferPending(p []byte) (int, error) {
+	if t.pending == nil {
+		t.pending = new(bytes.Buffer)
+	}
+	if room := maxPendingOutput - t.pending.Len(); room > 0 {
+		if len(p) > room {
+			t.pending.Write(p[:room])
+		} else {
+			t.pending.Write(p)
+		}
+	}
+	return len(p), nil
+}
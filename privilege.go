@@ -0,0 +1,131 @@
+package webssh
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// 提升权限的命令，sudo -i、su -、doas等
+var privilegeCommand = regexp.MustCompile(`^\s*(?:sudo|sudoedit|su|doas|pkexec|run0)(?:\s|$)`)
+
+// 去掉提示符里的颜色和标题等控制序列
+var ansiSequence = regexp.MustCompile(`\x1b(?:\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[()][0-9A-Za-z])`)
+
+// 以#结尾的是root的提示符，$、%、>是普通用户的
+var (
+	rootPrompt = regexp.MustCompile(`^[^\s#$%>][^#$%>]{0,200}#\s?$|^#\s?$`)
+	userPrompt = regexp.MustCompile(`^[^\s#$%>][^#$%>]{0,200}[$%>]\s?$`)
+)
+
+// PrivilegeEvent reports a command that raises privileges, or the prompt
+// changing between a user and a root one.
+type PrivilegeEvent struct {
+	Time time.Time `json:"time"`
+	// Kind是command(输入了sudo、su等命令)、escalated(出现了root的提示符)或dropped(回到普通用户的提示符)
+	Kind    string `json:"kind"`
+	Command string `json:"command,omitempty"`
+	Prompt  string `json:"prompt,omitempty"`
+}
+
+func (e PrivilegeEvent) String() string {
+	switch e.Kind {
+	case "command":
+		return "privilege command: " + e.Command
+	case "escalated":
+		return "root prompt: " + e.Prompt
+	}
+	return "user prompt: " + e.Prompt
+}
+
+// privilege is the state of DetectPrivilege.
+type privilege struct {
+	lines *lineBuffer
+	// root是上一次看到的提示符是不是root的，known为false时还没看到过提示符
+	root  bool
+	known bool
+	tail  []byte
+}
+
+func (t *Turn) newPrivilege() *privilege {
+	p := &privilege{}
+	p.lines = newLineBuffer(t.MaxCommandLength, func(line string, truncated bool) {
+		if privilegeCommand.MatchString(line) {
+			t.privilegeEvent(PrivilegeEvent{Kind: "command", Command: strings.TrimSpace(line)})
+		}
+	})
+	return p
+}
+
+// trackPrivilegeInput looks for privilege commands in what the user types.
+// Input typed at a password prompt is skipped.
+func (t *Turn) trackPrivilegeInput(p []byte, secret bool) {
+	if t.priv == nil {
+		return
+	}
+	t.privMu.Lock()
+	defer t.privMu.Unlock()
+	if secret {
+		t.priv.lines.reset()
+		return
+	}
+	t.priv.lines.Write(p)
+}
+
+// trackPrivilegeOutput looks at the last line of the output for a shell
+// prompt and reports when it changes between a user and a root one.
+func (t *Turn) trackPrivilegeOutput(p []byte) {
+	if t.priv == nil {
+		return
+	}
+	t.privMu.Lock()
+	defer t.privMu.Unlock()
+	pv := t.priv
+	if i := bytes.LastIndexAny(p, "\r\n"); i >= 0 {
+		pv.tail = pv.tail[:0]
+		p = p[i+1:]
+	}
+	// 提示符可能被拆成几段输出，只保留最后一行的一部分
+	pv.tail = append(pv.tail, p...)
+	if len(pv.tail) > 512 {
+		pv.tail = append(pv.tail[:0], pv.tail[len(pv.tail)-512:]...)
+	}
+	line := ansiSequence.ReplaceAll(pv.tail, nil)
+	var root bool
+	switch {
+	case rootPrompt.Match(line):
+		root = true
+	case userPrompt.Match(line):
+	default:
+		return
+	}
+	if pv.known && pv.root == root {
+		return
+	}
+	first := !pv.known
+	pv.root, pv.known = root, true
+	// 会话一开始就是普通用户不算事件，一开始就是root要记下来
+	if first && !root {
+		return
+	}
+	kind := "escalated"
+	if !root {
+		kind = "dropped"
+	}
+	t.privilegeEvent(PrivilegeEvent{Kind: kind, Prompt: strings.TrimSpace(string(line))})
+}
+
+// privilegeEvent reports e to OnPrivilege and the AuditLogger, and marks
+// it in the recording if PrivilegeMarkers is set.
+func (t *Turn) privilegeEvent(e PrivilegeEvent) {
+	e.Time = time.Now()
+	t.logger().Info("privilege change", "event", "privilege", "kind", e.Kind, "command", e.Command, "prompt", e.Prompt)
+	t.auditEvent("privilege", e.String())
+	if t.PrivilegeMarkers {
+		t.Mark(e.String())
+	}
+	if t.OnPrivilege != nil {
+		t.OnPrivilege(t, e)
+	}
+}
@@ -0,0 +1,154 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var errNoProfiles = fmt.Errorf("%w: no profiles configured", ErrUnauthorized)
+
+// Profile is a named target. The client asks for a session with
+// ?profile=<name> and the host, credentials and command stay on the
+// server.
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// RemoteAddr是host:port
+	RemoteAddr string `json:"-"`
+	User       string `json:"-"`
+	// 认证方式和凭据，见WebSSHConfig里的同名字段；Credentials不为空时从中取
+	AuthModel   AuthModel          `json:"-"`
+	AuthModels  []AuthModel        `json:"-"`
+	Password    string             `json:"-"`
+	PkPath      string             `json:"-"`
+	Passphrase  string             `json:"-"`
+	CertPath    string             `json:"-"`
+	Credentials CredentialProvider `json:"-"`
+	// Command、Env和Dir替换WebSSHConfig里的默认命令、环境变量和工作目录
+	Command string   `json:"-"`
+	Env     []string `json:"-"`
+	Dir     string   `json:"-"`
+	// Record不为空时替换WebSSHConfig.Record
+	Record *bool `json:"-"`
+	// Identities不为空时只有其中的身份(Authorizer给出的Identity)可以使用
+	Identities []string `json:"-"`
+
+	// Passthrough为true时不开shell，把websocket直接接到RemoteAddr的TCP端口，
+	// 给noVNC、RDP网关等用，见ProtocolBinary
+	Passthrough bool `json:"passthrough,omitempty"`
+	// PassthroughPorts是客户端可以用?port=选择的其他端口，主机不变
+	PassthroughPorts []int `json:"-"`
+}
+
+// allows reports whether identity may use the profile.
+func (p *Profile) allows(identity string) bool {
+	if len(p.Identities) == 0 {
+		return true
+	}
+	for _, id := range p.Identities {
+		if id == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// Profiles is the inventory of named targets, see WebSSHConfig.Profiles.
+// It may be changed while the server runs.
+type Profiles struct {
+	mu sync.RWMutex
+	m  map[string]*Profile
+}
+
+func NewProfiles(profiles ...*Profile) (*Profiles, error) {
+	ps := &Profiles{m: make(map[string]*Profile)}
+	for _, p := range profiles {
+		if err := ps.Register(p); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// Register adds p, or replaces the profile with its name.
+func (ps *Profiles) Register(p *Profile) error {
+	if p.Name == "" {
+		return errors.New("profile without name")
+	}
+	if p.RemoteAddr == "" {
+		return fmt.Errorf("profile %s without RemoteAddr", p.Name)
+	}
+	ps.mu.Lock()
+	ps.m[p.Name] = p
+	ps.mu.Unlock()
+	return nil
+}
+
+// Remove removes the profile name. Sessions already opened with it go on.
+func (ps *Profiles) Remove(name string) {
+	ps.mu.Lock()
+	delete(ps.m, name)
+	ps.mu.Unlock()
+}
+
+// Get returns the profile name, nil if there is none.
+func (ps *Profiles) Get(name string) *Profile {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.m[name]
+}
+
+// List returns the profiles identity may use, sorted by name. An empty
+// identity gets all of them.
+func (ps *Profiles) List(identity string) []*Profile {
+	ps.mu.RLock()
+	list := make([]*Profile, 0, len(ps.m))
+	for _, p := range ps.m {
+		if identity == "" || p.allows(identity) {
+			list = append(list, p)
+		}
+	}
+	ps.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// withProfile returns a copy of w that opens the profile name for its
+// Owner, and the profile.
+func (w WebSSH) withProfile(name string) (WebSSH, *Profile, error) {
+	if w.Profiles == nil {
+		return w, nil, errNoProfiles
+	}
+	p := w.Profiles.Get(name)
+	if p == nil {
+		return w, nil, fmt.Errorf("%w: unknown profile %s", ErrUnauthorized, name)
+	}
+	if !p.allows(w.Owner) {
+		return w, nil, fmt.Errorf("%w: profile %s not allowed", ErrUnauthorized, name)
+	}
+	conf := *w.WebSSHConfig
+	conf.RemoteAddr, conf.User = p.RemoteAddr, p.User
+	conf.AuthModel, conf.AuthModels = p.AuthModel, p.AuthModels
+	conf.Password, conf.PkPath, conf.Passphrase, conf.CertPath = p.Password, p.PkPath, p.Passphrase, p.CertPath
+	conf.Credentials = p.Credentials
+	if p.Command != "" {
+		conf.Command = p.Command
+	}
+	if len(p.Env) > 0 {
+		conf.Env = append(conf.Env[:len(conf.Env):len(conf.Env)], p.Env...)
+	}
+	if p.Dir != "" {
+		conf.Dir = p.Dir
+	}
+	if p.Record != nil {
+		conf.Record = *p.Record
+	}
+	// 按配置连接的是别的主机，不是本机、串口或预先建立的shell
+	conf.Local, conf.Telnet, conf.Serial = false, false, nil
+	w.WebSSHConfig = &conf
+	w.pool = nil
+	w.logger().Info("profile", "profile", name, "identity", w.Owner)
+	return w, p, nil
+}
@@ -0,0 +1,162 @@
+package webssh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// MsgPrompt relays keyboard-interactive questions from the ssh server, such
+// as a one-time code, while the connection is being set up. The server
+// sends {"instruction": ..., "questions": [{"prompt": ..., "echo": ...}]}
+// and the client answers {"answers": [...]}, one per question.
+const MsgPrompt = wire.MsgPrompt
+
+// 等待用户回答的最长时间
+const promptTimeout = 2 * time.Minute
+
+type promptQuestion = wire.Question
+
+type promptMsg = wire.Prompt
+
+type promptReply = wire.PromptReply
+
+// promptRelay asks the browser on the other end of ws. Messages that arrive
+// meanwhile and are not answers are kept in held, in order, to be handled
+// once the session exists.
+type promptRelay struct {
+	ws     *websocket.Conn
+	parser *wire.Parser
+	// first是还没有取走的第一条消息，见readFirst
+	first chan firstMessage
+	held  []firstMessage
+}
+
+func (p *promptRelay) challenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 0 {
+		return nil, nil
+	}
+	msg := promptMsg{Instruction: instruction}
+	for i, q := range questions {
+		msg.Questions = append(msg.Questions, promptQuestion{Prompt: q, Echo: echos[i]})
+	}
+	b, _ := json.Marshal(msg)
+	if err := p.ws.WriteMessage(websocket.TextMessage, controlFrame(MsgPrompt, b)); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(promptTimeout)
+	for {
+		m, err := p.next(deadline)
+		if wire.Malformed(err) {
+			p.held = append(p.held, m)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("keyboard-interactive err:%s", err)
+		}
+		if m.p[0] != MsgPrompt {
+			p.held = append(p.held, m)
+			continue
+		}
+		var reply promptReply
+		body, err := base64.StdEncoding.DecodeString(string(m.p[1:]))
+		if err != nil || json.Unmarshal(body, &reply) != nil {
+			return nil, errors.New("keyboard-interactive: malformed answer")
+		}
+		if len(reply.Answers) != len(questions) {
+			return nil, errors.New("keyboard-interactive: wrong number of answers")
+		}
+		return reply.Answers, nil
+	}
+}
+
+func (p *promptRelay) next(deadline time.Time) (firstMessage, error) {
+	if p.first != nil {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case m := <-p.first:
+			p.first = nil
+			return m, m.err
+		case <-timer.C:
+			return firstMessage{}, errors.New("timeout")
+		}
+	}
+	p.ws.SetReadDeadline(deadline)
+	defer p.ws.SetReadDeadline(time.Time{})
+	m := readFrame(p.ws, p.parser)
+	return m, m.err
+}
+
+// relayPrompts makes conf, and its jump hosts that have no challenge of
+// their own, relay keyboard-interactive questions with challenge. The
+// target host always gets the method, since hosts enforcing two factors
+// often offer nothing else after the password.
+func relayPrompts(conf *SSHClientConfig, challenge ssh.KeyboardInteractiveChallenge) {
+	conf.KeyboardInteractive = withPassword(conf.Password, challenge)
+	models := conf.AuthModels
+	if len(models) == 0 {
+		models = []AuthModel{conf.AuthModel}
+	}
+	hasKI := false
+	for _, m := range models {
+		hasKI = hasKI || m == KEYBOARD_INTERACTIVE
+	}
+	if !hasKI {
+		conf.AuthModels = append(models[:len(models):len(models)], KEYBOARD_INTERACTIVE)
+	}
+	jumps := make([]*SSHClientConfig, len(conf.Jumps))
+	for i, j := range conf.Jumps {
+		if j.KeyboardInteractive == nil {
+			jump := *j
+			jump.KeyboardInteractive = withPassword(j.Password, challenge)
+			j = &jump
+		}
+		jumps[i] = j
+	}
+	conf.Jumps = jumps
+}
+
+// withPassword answers questions that ask for the password with password,
+// the first time only in case it is wrong, and relays the others, so that
+// the browser is only asked for the second factor.
+func withPassword(password string, relay ssh.KeyboardInteractiveChallenge) ssh.KeyboardInteractiveChallenge {
+	used := false
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if password == "" || used {
+			return relay(user, instruction, questions, echos)
+		}
+		answers := make([]string, len(questions))
+		var rest []string
+		var restEchos []bool
+		var restIdx []int
+		for i, q := range questions {
+			if !echos[i] && strings.Contains(strings.ToLower(q), "password") {
+				answers[i] = password
+				used = true
+				continue
+			}
+			rest = append(rest, q)
+			restEchos = append(restEchos, echos[i])
+			restIdx = append(restIdx, i)
+		}
+		if len(rest) == 0 {
+			return answers, nil
+		}
+		got, err := relay(user, instruction, rest, restEchos)
+		if err != nil {
+			return nil, err
+		}
+		for i, a := range got {
+			answers[restIdx[i]] = a
+		}
+		return answers, nil
+	}
+}
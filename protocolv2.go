@@ -0,0 +1,185 @@
+package webssh
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolV2 is version 2 of the message protocol, chosen with the
+// "webssh.v2" subprotocol or ?protocol=v2. Clients that ask for neither
+// keep the native protocol, with its type byte and base64 payload.
+//
+// Binary messages carry the terminal data as is in both directions. Text
+// messages are JSON envelopes {"v":2,"type":...,"data":{...}}, where data
+// is what the native control message of that type carries. The types are
+// named in v2Types, e.g. resize with {"cols","rows"}, paste with {"text"},
+// error, exit and the file transfers transfer.file, transfer.zmodem and
+// transfer.trzsz. A ping is answered right away with a pong carrying the
+// same data. Envelopes of a newer version or an unknown type are dropped.
+const ProtocolV2 = "webssh.v2"
+
+// ProtocolVersion is the newest version of the message protocol.
+const ProtocolVersion = 2
+
+var v2Types = map[byte]string{
+	MsgResize:      "resize",
+	MsgEcho:        "echo",
+	MsgJoinRequest: "join_request",
+	MsgJoinReply:   "join_reply",
+	MsgHello:       "hello",
+	MsgHandoff:     "handoff",
+	MsgExit:        "exit",
+	MsgFile:        "transfer.file",
+	MsgZmodem:      "transfer.zmodem",
+	MsgTrzsz:       "transfer.trzsz",
+	MsgViewers:     "viewers",
+	MsgControl:     "control",
+	MsgFlow:        "flow",
+	MsgPrompt:      "prompt",
+	MsgForward:     "forward",
+	MsgDetach:      "detach",
+	MsgError:       "error",
+	MsgClipboard:   "clipboard",
+	MsgPaste:       "paste",
+	MsgTermState:   "term_state",
+	MsgMarker:      "marker",
+	MsgLock:        "lock",
+	MsgSearch:      "search",
+	MsgLatency:     "latency",
+}
+
+// v2Msgs is v2Types the other way round.
+var v2Msgs = func() map[string]byte {
+	m := make(map[string]byte, len(v2Types))
+	for b, name := range v2Types {
+		m[name] = b
+	}
+	return m
+}()
+
+type v2Envelope struct {
+	V    int             `json:"v"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type v2Resize struct {
+	Cols int `json:"cols"`
+	Rows int `json:"rows"`
+}
+
+type v2Paste struct {
+	Text string `json:"text"`
+}
+
+// v2Conn translates between a client speaking ProtocolV2 and the native
+// protocol.
+type v2Conn struct {
+	ws *websocket.Conn
+	// pong在读的goroutine里发，和输出的写要互斥
+	mu sync.Mutex
+}
+
+func (c *v2Conn) ReadMessage() (int, []byte, error) {
+	for {
+		msgType, p, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if msgType == websocket.BinaryMessage {
+			if len(p) > 0 {
+				return websocket.TextMessage, controlFrame(MsgData, p), nil
+			}
+			continue
+		}
+		if msg := c.fromEnvelope(p); msg != nil {
+			return websocket.TextMessage, msg, nil
+		}
+	}
+}
+
+// fromEnvelope returns the native message for an envelope, or nil if
+// there is none.
+func (c *v2Conn) fromEnvelope(p []byte) []byte {
+	var env v2Envelope
+	if json.Unmarshal(p, &env) != nil || env.V > ProtocolVersion {
+		return nil
+	}
+	switch env.Type {
+	case "ping":
+		c.writeEnvelope("pong", env.Data)
+		return nil
+	case "resize":
+		var size v2Resize
+		if json.Unmarshal(env.Data, &size) != nil {
+			return nil
+		}
+		b, _ := json.Marshal(Resize{Columns: size.Cols, Rows: size.Rows})
+		return controlFrame(MsgResize, b)
+	case "paste":
+		var paste v2Paste
+		if json.Unmarshal(env.Data, &paste) != nil {
+			return nil
+		}
+		return controlFrame(MsgPaste, []byte(paste.Text))
+	}
+	b, ok := v2Msgs[env.Type]
+	if !ok {
+		return nil
+	}
+	data := []byte(env.Data)
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	return controlFrame(b, data)
+}
+
+func (c *v2Conn) WriteMessage(msgType int, p []byte) error {
+	if msgType == websocket.BinaryMessage {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.ws.WriteMessage(websocket.BinaryMessage, p)
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	name, ok := v2Types[p[0]]
+	if !ok {
+		return nil
+	}
+	data := decode(p[1:])
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(data))
+	}
+	return c.writeEnvelope(name, data)
+}
+
+func (c *v2Conn) writeEnvelope(name string, data json.RawMessage) error {
+	b, err := json.Marshal(v2Envelope{V: ProtocolVersion, Type: name, Data: data})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+func (c *v2Conn) Close() error {
+	return c.ws.Close()
+}
+
+// CloseWithCode passes the close code and reason of the session on, see
+// MessageConn.
+func (c *v2Conn) CloseWithCode(code int, reason string) error {
+	if code == websocket.CloseAbnormalClosure {
+		return c.ws.Close()
+	}
+	c.mu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	c.mu.Unlock()
+	return c.ws.Close()
+}
@@ -0,0 +1,93 @@
+package webssh
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialProxy connects to addr through the proxy at rawURL, which is either
+// socks5://[user:pass@]host:port or http://[user:pass@]host:port (CONNECT).
+func dialProxy(rawURL, addr string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy %s err:%s", rawURL, err)
+	}
+	forward := &net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := d.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy %s err:%s", u.Host, err)
+		}
+		return conn, nil
+	case "http":
+		return dialConnect(forward, u, addr, timeout)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func dialConnect(forward *net.Dialer, u *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := forward.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy %s err:%s", u.Host, err)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s err:%s", u.Host, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s err:%s", u.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy %s: %s", u.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn keeps what the proxy sent after its response, e.g. the
+// ssh server version line.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
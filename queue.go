@@ -0,0 +1,248 @@
+package webssh
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy decides what happens to output for a client whose queue is
+// full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for the client, which in turn stops reading from
+	// the pty. Nothing is lost.
+	OverflowBlock OverflowPolicy = iota
+	OverflowDropOldest
+	OverflowDropNewest
+	OverflowDisconnect
+)
+
+const (
+	minPooledFrame      = 512
+	maxPooledFrame      = 64 * 1024
+	defaultCoalesceSize = 32 * 1024
+)
+
+var (
+	ErrSlowClient  = errors.New("client too slow to keep up with output")
+	errQueueClosed = errors.New("output queue closed")
+	errQueueFull   = errors.New("output queue full")
+)
+
+// frame is one websocket message waiting to be written. A frame with
+// flushed set carries no message; the writer closes flushed when it gets
+// there.
+type frame struct {
+	msgType int
+	p       []byte
+	flushed chan struct{}
+	// buf是Push时从池里取的缓冲，p就在里面，写出或丢弃后用release放回
+	buf *[]byte
+}
+
+func (f frame) release() {
+	if f.buf != nil {
+		putBuffer(f.buf)
+	}
+}
+
+type outputQueue struct {
+	ch      chan frame
+	policy  OverflowPolicy
+	done    <-chan struct{}
+	dropped atomic.Int64
+	// evict收到OverflowDropOldest挤出的非数据帧，为空时直接丢弃
+	evict func(frame)
+	// queued是队列里数据帧的字节数，变化时调用onQueued
+	queued   atomic.Int64
+	onQueued func(int64)
+}
+
+func newOutputQueue(size int, policy OverflowPolicy, done <-chan struct{}) *outputQueue {
+	return &outputQueue{
+		ch:     make(chan frame, size),
+		policy: policy,
+		done:   done,
+	}
+}
+
+// Push queues a copy of p as a data frame according to the queue's policy.
+func (q *outputQueue) Push(p []byte) error {
+	b := frame{msgType: websocket.BinaryMessage}
+	if size := frameBufferSize(len(p)); size > 0 {
+		b.buf = getBuffer(size)
+		b.p = (*b.buf)[:len(p)]
+	} else {
+		b.p = make([]byte, len(p))
+	}
+	copy(b.p, p)
+
+	// 先计数再入队，避免写协程先取走时计数变成负数
+	q.account(len(b.p))
+	switch q.policy {
+	case OverflowDropNewest:
+		select {
+		case q.ch <- b:
+		default:
+			q.account(-len(b.p))
+			q.dropped.Add(1)
+			b.release()
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case q.ch <- b:
+				return nil
+			default:
+			}
+			select {
+			case f := <-q.ch:
+				if f.msgType == websocket.BinaryMessage {
+					q.taken(f)
+					q.dropped.Add(1)
+					f.release()
+				} else if q.evict != nil {
+					q.evict(f)
+				}
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		select {
+		case q.ch <- b:
+		default:
+			q.account(-len(b.p))
+			b.release()
+			return ErrSlowClient
+		}
+	default:
+		select {
+		case q.ch <- b:
+		case <-q.done:
+			q.account(-len(b.p))
+			b.release()
+			return errQueueClosed
+		}
+	}
+	return nil
+}
+
+// coalescer merges data frames that follow each other within delay into
+// one message of at most size bytes, see TurnConfig.CoalesceDelay.
+type coalescer struct {
+	delay time.Duration
+	size  int
+	timer *time.Timer
+}
+
+func newCoalescer(delay time.Duration, size int) *coalescer {
+	if delay <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultCoalesceSize
+	}
+	if size > maxPooledFrame {
+		size = maxPooledFrame
+	}
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	return &coalescer{delay: delay, size: size, timer: timer}
+}
+
+// next returns f with the data frames queued in q after it appended, and
+// the frame that ended the batch, to be handled next. The wait for more
+// output never exceeds delay after f.
+func (c *coalescer) next(q *outputQueue, f frame) (merged frame, after *frame) {
+	if c == nil || f.msgType != websocket.BinaryMessage || f.flushed != nil || len(f.p) >= c.size {
+		return f, nil
+	}
+	c.timer.Reset(c.delay)
+	fired := false
+	defer func() {
+		if !fired && !c.timer.Stop() {
+			<-c.timer.C
+		}
+	}()
+	for len(f.p) < c.size {
+		select {
+		case g := <-q.ch:
+			q.taken(g)
+			if g.msgType != websocket.BinaryMessage || g.flushed != nil || len(f.p)+len(g.p) > c.size {
+				return f, &g
+			}
+			f = f.join(g, c.size)
+			g.release()
+		case <-c.timer.C:
+			fired = true
+			return f, nil
+		case <-q.done:
+			return f, nil
+		}
+	}
+	return f, nil
+}
+
+// join appends g to f, moving f into a pooled buffer of size bytes first.
+func (f frame) join(g frame, size int) frame {
+	if f.buf == nil || cap(*f.buf) < len(f.p)+len(g.p) {
+		buf := getBuffer(frameBufferSize(size))
+		p := append((*buf)[:0], f.p...)
+		f.release()
+		f.buf, f.p = buf, p
+	}
+	f.p = append(f.p, g.p...)
+	return f
+}
+
+// frameBufferSize is the pooled buffer size for a frame of n bytes, a
+// power of two so few pools are needed, or 0 for frames too large to keep
+// around.
+func frameBufferSize(n int) int {
+	if n > maxPooledFrame {
+		return 0
+	}
+	size := minPooledFrame
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
+
+// taken must be called for every frame received from ch.
+func (q *outputQueue) taken(f frame) {
+	if f.msgType == websocket.BinaryMessage {
+		q.account(-len(f.p))
+	}
+}
+
+func (q *outputQueue) account(n int) {
+	queued := q.queued.Add(int64(n))
+	if q.onQueued != nil {
+		q.onQueued(queued)
+	}
+}
+
+// pushWait queues f regardless of the policy, waiting at most timeout for
+// room. Control frames and flush markers are never dropped.
+func (q *outputQueue) pushWait(f frame, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case q.ch <- f:
+		return nil
+	case <-q.done:
+		return errQueueClosed
+	case <-timer.C:
+		return errQueueFull
+	}
+}
+
+// Dropped returns the number of frames discarded so far.
+func (q *outputQueue) Dropped() int64 {
+	return q.dropped.Load()
+}
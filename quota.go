@@ -0,0 +1,103 @@
+package webssh
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+// Quota limits what one identity may use, see SessionManager.Quotas. Zero
+// fields are not limited.
+type Quota struct {
+	MaxSessions int
+	// MaxOutputRate是这个身份所有会话加起来每秒的输出字节数
+	MaxOutputRate int
+}
+
+// QuotaError is returned by Admit when an identity is over its quota. It is
+// sent to the client as json, {"code":"quota_exceeded",...}.
+type QuotaError struct {
+	Identity string `json:"identity"`
+	Limit    string `json:"limit"`
+	Max      int    `json:"max"`
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s has reached %d %s", e.Identity, e.Max, e.Limit)
+}
+
+func (e *QuotaError) MarshalJSON() ([]byte, error) {
+	type quotaError QuotaError
+	return json.Marshal(struct {
+		Code string `json:"code"`
+		*quotaError
+	}{"quota_exceeded", (*quotaError)(e)})
+}
+
+// identityLimit is the output limiter shared by the sessions of one
+// identity.
+type identityLimit struct {
+	lim  *rate.Limiter
+	refs int
+}
+
+func (m *SessionManager) identity(t *Turn) string {
+	if m.Identify != nil {
+		return m.Identify(t)
+	}
+	return t.Owner
+}
+
+// Admit adds t like Add, unless its identity already uses all the sessions
+// its quota allows, in which case it returns a *QuotaError.
+func (m *SessionManager) Admit(t *Turn) error {
+	if m.Quotas == nil {
+		m.Add(t)
+		return nil
+	}
+	id := m.identity(t)
+	quota := m.Quotas(id)
+	m.mu.Lock()
+	if quota.MaxSessions > 0 {
+		n := 0
+		for _, s := range m.sessions {
+			if s.identity == id {
+				n++
+			}
+		}
+		if n >= quota.MaxSessions {
+			m.mu.Unlock()
+			return &QuotaError{Identity: id, Limit: "sessions", Max: quota.MaxSessions}
+		}
+	}
+	t.identity = id
+	if quota.MaxOutputRate > 0 {
+		if m.identLims == nil {
+			m.identLims = make(map[string]*identityLimit)
+		}
+		l := m.identLims[id]
+		if l == nil {
+			l = &identityLimit{lim: newByteLimiter(quota.MaxOutputRate, 0)}
+			m.identLims[id] = l
+		}
+		l.refs++
+		t.identLim.Store(l.lim)
+	}
+	m.mu.Unlock()
+	m.Add(t)
+	return nil
+}
+
+// releaseIdentity drops the reference of t to its identity limiter. m.mu
+// must be held.
+func (m *SessionManager) releaseIdentity(t *Turn) {
+	if t.identLim.Load() == nil {
+		return
+	}
+	if l := m.identLims[t.identity]; l != nil {
+		if l.refs--; l.refs <= 0 {
+			delete(m.identLims, t.identity)
+		}
+	}
+}
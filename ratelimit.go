@@ -0,0 +1,55 @@
+package webssh
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// newByteLimiter returns a token bucket allowing bytesPerSec with bursts of
+// up to burst bytes, or nil when bytesPerSec is not positive.
+func newByteLimiter(bytesPerSec, burst int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// waitBytes blocks until n bytes may pass the limiter. n may be larger than
+// the burst, in which case it is taken in burst sized steps.
+func waitBytes(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		k := n
+		if k > l.Burst() {
+			k = l.Burst()
+		}
+		if err := l.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// throttleInput applies an input limiter to n bytes or messages. It reports
+// false when the input must be dropped; without InputDrop it waits instead.
+func (t *Turn) throttleInput(ctx context.Context, l *rate.Limiter, n int) bool {
+	if l == nil {
+		return true
+	}
+	if !t.InputDrop {
+		return waitBytes(ctx, l, n) == nil
+	}
+	if n > l.Burst() || !l.AllowN(time.Now(), n) {
+		if !t.inDropping.Swap(true) {
+			t.logger().Warn("input over limit, dropping")
+		}
+		return false
+	}
+	t.inDropping.Store(false)
+	return true
+}
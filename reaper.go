@@ -0,0 +1,132 @@
+package webssh
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 默认给正常清理留的时间
+const defaultReapGrace = 30 * time.Second
+
+// ReapStats counts the sessions the reaper had to clean up.
+type ReapStats struct {
+	// Exited是命令已经退出但是会话没有关闭的
+	Exited int64
+	// Unregistered是已经关闭但是还登记在SessionManager里的
+	Unregistered int64
+	// Killed是会话关闭后进程还在运行、被强制结束的
+	Killed int64
+}
+
+// StartReaper runs Reap every interval until ctx is done.
+func (m *SessionManager) StartReaper(ctx context.Context, interval, grace time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.Reap(grace)
+			}
+		}
+	}()
+}
+
+// Reap cleans up sessions that were not released on their own: sessions
+// whose command exited more than grace (plus ExitHold) ago but are still
+// open are closed, closed sessions still registered are removed, and
+// processes still running grace after their session was closed are killed.
+// grace defaults to 30 seconds.
+func (m *SessionManager) Reap(grace time.Duration) {
+	if grace <= 0 {
+		grace = defaultReapGrace
+	}
+	now := time.Now()
+	m.mu.RLock()
+	turns := make([]*Turn, 0, len(m.sessions)+len(m.orphans))
+	for _, t := range m.sessions {
+		turns = append(turns, t)
+	}
+	for t := range m.orphans {
+		turns = append(turns, t)
+	}
+	m.mu.RUnlock()
+	for _, t := range turns {
+		closed := t.ctx.Err() != nil
+		if exit := t.exitTime.Load(); !closed && exit > 0 && now.Sub(time.Unix(0, exit)) > grace+t.ExitHold {
+			t.logger().Warn("reaper: session exited but was not closed")
+			m.reaped.Exited.Add(1)
+			t.Close()
+			continue
+		}
+		if !closed || now.Sub(time.Unix(0, t.closeTime.Load())) <= grace {
+			continue
+		}
+		if m.Get(t.ID) == t {
+			t.logger().Warn("reaper: session closed but still registered")
+			m.reaped.Unregistered.Add(1)
+			m.Remove(t)
+		}
+		if t.backend == nil {
+			m.dropOrphan(t)
+			continue
+		}
+		select {
+		case <-t.waitDone:
+			m.dropOrphan(t)
+		default:
+			t.logger().Warn("reaper: session closed but its process is still running")
+			m.reaped.Killed.Add(1)
+			t.forceKill()
+			m.dropOrphan(t)
+		}
+	}
+}
+
+// ReapStats returns what the reaper has cleaned up so far.
+func (m *SessionManager) ReapStats() ReapStats {
+	return ReapStats{
+		Exited:       m.reaped.Exited.Load(),
+		Unregistered: m.reaped.Unregistered.Load(),
+		Killed:       m.reaped.Killed.Load(),
+	}
+}
+
+// trackOrphan keeps t for the reaper if its process may outlive the
+// session. m.mu must be held.
+func (m *SessionManager) trackOrphan(t *Turn) {
+	if t.backend == nil {
+		return
+	}
+	select {
+	case <-t.waitDone:
+		return
+	default:
+	}
+	if m.orphans == nil {
+		m.orphans = make(map[*Turn]struct{})
+	}
+	m.orphans[t] = struct{}{}
+}
+
+func (m *SessionManager) dropOrphan(t *Turn) {
+	m.mu.Lock()
+	delete(m.orphans, t)
+	m.mu.Unlock()
+}
+
+// forceKill kills the process of a closed session again, with SIGKILL if
+// the backend can send signals.
+func (t *Turn) forceKill() {
+	if sig, ok := t.backend.(signaler); ok {
+		sig.Signal(ssh.SIGKILL)
+	}
+	t.backend.Close()
+	if t.sshClient != nil {
+		t.sshClient.Close()
+	}
+}
@@ -0,0 +1,281 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultReconnectBackoff = time.Second
+	maxReconnectBackoff     = 30 * time.Second
+	// 连接断开时会话的Wait可能比连接先返回，最多等这么久再判断是不是断线
+	lostWait = time.Second
+)
+
+// Redial opens a new connection for a session whose ssh connection was
+// lost. release closes it again, or gives it back when it is shared.
+type Redial func() (client *ssh.Client, release func(), err error)
+
+// reconnBackend is an ssh session that is started again on a new
+// connection when the old one drops, see TurnConfig.Reconnect. Input while
+// it is reconnecting is dropped.
+type reconnBackend struct {
+	t      *Turn
+	opts   ShellOptions
+	redial Redial
+	out    io.Writer
+	term   string
+
+	mu     sync.Mutex
+	cur    *sshBackend
+	client *ssh.Client
+	// 第一条连接由调用者释放，之后重连的由这里释放
+	release      func()
+	lost         chan struct{}
+	rows, cols   int
+	reconnecting bool
+	closed       bool
+}
+
+func newReconnBackend(client *ssh.Client, redial Redial, opts ShellOptions) *reconnBackend {
+	b := &reconnBackend{opts: opts, redial: redial}
+	b.use(client, nil)
+	return b
+}
+
+// use makes client the current connection; b.mu must be held or b not yet
+// shared.
+func (b *reconnBackend) use(client *ssh.Client, release func()) {
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+	}()
+	b.client, b.release, b.lost = client, release, lost
+}
+
+func (b *reconnBackend) start(out io.Writer, term string, rows, cols int) (Backend, error) {
+	be, err := StartSSHShell(b.client, b.opts)(out, term, rows, cols)
+	if err != nil {
+		return nil, err
+	}
+	b.cur = be.(*sshBackend)
+	b.out, b.term, b.rows, b.cols = out, term, rows, cols
+	return b, nil
+}
+
+func (b *reconnBackend) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	cur, lost, reconnecting := b.cur, b.lost, b.reconnecting
+	b.mu.Unlock()
+	if reconnecting {
+		return len(p), nil
+	}
+	n, err := cur.Write(p)
+	if err != nil && isLost(lost, lostWait) {
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (b *reconnBackend) Resize(rows, cols int) error {
+	b.mu.Lock()
+	b.rows, b.cols = rows, cols
+	cur, reconnecting := b.cur, b.reconnecting
+	b.mu.Unlock()
+	if reconnecting {
+		// 重连后用新的大小
+		return nil
+	}
+	return cur.Resize(rows, cols)
+}
+
+func (b *reconnBackend) Signal(sig ssh.Signal) error {
+	b.mu.Lock()
+	cur := b.cur
+	b.mu.Unlock()
+	return cur.Signal(sig)
+}
+
+func (b *reconnBackend) Wait() error {
+	for {
+		b.mu.Lock()
+		cur, lost := b.cur, b.lost
+		b.mu.Unlock()
+		err := cur.Wait()
+		if !b.dropped(err, lost) {
+			return err
+		}
+		if rerr := b.reconnect(); rerr != nil {
+			if b.t.ctx.Err() == nil {
+				b.t.writeNotice(fmt.Sprintf("\r\n[reconnect failed: %s]\r\n", rerr))
+				b.t.closeReason.CompareAndSwap(nil, ReasonBackendLost)
+			}
+			return err
+		}
+	}
+}
+
+// dropped reports whether the session ended with err because its
+// connection was lost rather than because it exited.
+func (b *reconnBackend) dropped(err error, lost chan struct{}) bool {
+	var exit *ssh.ExitError
+	if err == nil || errors.As(err, &exit) {
+		return false
+	}
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	return !closed && isLost(lost, lostWait)
+}
+
+func isLost(lost chan struct{}, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-lost:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (b *reconnBackend) reconnect() error {
+	t := b.t
+	b.mu.Lock()
+	b.reconnecting = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.reconnecting = false
+		b.mu.Unlock()
+	}()
+	t.auditEvent("backend_lost", "")
+	t.logger().Warn("lost ssh connection", "event", "backend_lost")
+
+	backoff := t.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = defaultReconnectBackoff
+	}
+	var err error
+	for attempt := 1; attempt <= t.Reconnect; attempt++ {
+		t.writeNotice(fmt.Sprintf("\r\n[connection lost, reconnecting %d/%d in %s]\r\n", attempt, t.Reconnect, backoff))
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return t.ctx.Err()
+		}
+		if backoff *= 2; backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+		if err = b.reattach(); err == nil {
+			t.writeNotice("[reconnected]\r\n")
+			t.auditEvent("reconnected", "")
+			t.logger().Info("reconnected", "event", "reconnected", "attempt", attempt)
+			t.Events.Publish(ReconnectedEvent{EventHeader: t.header(), Attempt: attempt})
+			return nil
+		}
+		t.logger().Warn("reconnect", "attempt", attempt, "retries", t.Reconnect, "err", err)
+	}
+	return err
+}
+
+// reattach dials a new connection and starts the session on it again.
+func (b *reconnBackend) reattach() error {
+	client, release, err := b.redial()
+	if err != nil {
+		return err
+	}
+	opts := b.opts
+	if opts.x11 != nil {
+		if chans := client.HandleChannelOpen("x11"); chans != nil {
+			go opts.x11.accept(chans)
+		} else {
+			opts.x11 = nil
+		}
+	}
+	if opts.forwardAgent {
+		if err := forwardAgent(client, b.t.TurnConfig); err != nil {
+			b.t.logger().Warn("agent forwarding", "err", err)
+			opts.forwardAgent = false
+		}
+	}
+	b.mu.Lock()
+	rows, cols := b.rows, b.cols
+	b.mu.Unlock()
+	be, err := StartSSHShell(client, opts)(b.out, b.term, rows, cols)
+	if err != nil {
+		release()
+		return err
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		be.Close()
+		release()
+		return errors.New("session closed")
+	}
+	old := b.release
+	b.cur = be.(*sshBackend)
+	b.use(client, release)
+	b.mu.Unlock()
+	if old != nil {
+		old()
+	}
+	b.t.switchClient(client)
+	return nil
+}
+
+// conn is the current connection, nil while reconnecting.
+func (b *reconnBackend) conn() *ssh.Client {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.reconnecting {
+		return nil
+	}
+	return b.client
+}
+
+// drop closes client if it is still the current connection, so the session
+// reconnects.
+func (b *reconnBackend) drop(client *ssh.Client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.client == client {
+		client.Close()
+	}
+}
+
+func (b *reconnBackend) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	cur, release := b.cur, b.release
+	b.release = nil
+	b.mu.Unlock()
+	err := cur.Close()
+	if release != nil {
+		release()
+	}
+	return err
+}
+
+// switchClient moves file transfer and port forwarding to client. The
+// forwards open on the old connection are gone with it.
+func (t *Turn) switchClient(client *ssh.Client) {
+	t.closeFiles()
+	t.filesMu.Lock()
+	t.openFiles = openSFTP(client)
+	t.filesMu.Unlock()
+	t.closeForwards()
+	t.fwdMu.Lock()
+	t.fwdClient = client
+	t.fwdMu.Unlock()
+}
@@ -2,24 +2,75 @@ package webssh
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
 type RecType string
 
+const maxRecLineBuffer = 256 * 1024
+
 const (
 	InputType  RecType = "i"
 	OutPutType RecType = "o"
+	ResizeType RecType = "r"
+	// MarkerType是asciicast的标记，回放时可以跳到这里
+	MarkerType RecType = "m"
 )
 
+// RecEvent is one event of a recording: Time is in seconds since the start,
+// Data is the output or input for "o" and "i" events, "COLSxROWS" for "r"
+// and the label for "m". Together with the header's size the events are
+// enough to rebuild the terminal screen at any point.
+type RecEvent struct {
+	Time float64
+	Type RecType
+	Data string
+}
+
+// Size parses the size of a resize event.
+func (e RecEvent) Size() (rows, cols int, ok bool) {
+	if e.Type != ResizeType {
+		return 0, 0, false
+	}
+	if _, err := fmt.Sscanf(e.Data, "%dx%d", &cols, &rows); err != nil {
+		return 0, 0, false
+	}
+	return rows, cols, true
+}
+
+func (e RecEvent) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+func (e *RecEvent) UnmarshalJSON(b []byte) error {
+	var raw [3]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	e.Time, _ = raw[0].(float64)
+	typ, _ := raw[1].(string)
+	e.Type = RecType(typ)
+	e.Data, _ = raw[2].(string)
+	return nil
+}
+
+// RecHeader is the header line of an asciicast v2 recording, which
+// asciinema-player can play directly.
 type RecHeader struct {
-	Version   int   `json:"version"`
-	Width     int   `json:"width"`
-	Height    int   `json:"height"`
-	Timestamp int64 `json:"timestamp"`
-	Env       struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Command   string `json:"command,omitempty"`
+	Title     string `json:"title,omitempty"`
+	// IdleTimeLimit是录制时压缩空闲时间用的上限，单位秒
+	IdleTimeLimit float64 `json:"idle_time_limit,omitempty"`
+	Env           struct {
 		Shell string `json:"SHELL"`
 		Term  string `json:"TERM"`
 	} `json:"env"`
@@ -36,7 +87,82 @@ func defaultRecHeader() *RecHeader {
 type Recorder struct {
 	StartTime time.Time
 	Writer    io.Writer
+	Term      string
+	// Title和Command写入header，可以为空
+	Title   string
+	Command string
+	// IdleLimit大于0时，两个事件之间超过IdleLimit的空闲时间不计入录像，
+	// 长时间停顿的会话回放时不用干等
+	IdleLimit time.Duration
+	// Transcript不为空时输出同时写成纯文本，见Transcriber
+	Transcript *Transcriber
 	sync.Mutex
+
+	// 已经压缩掉的空闲时间，和上一个事件的时间
+	skipped time.Duration
+	last    time.Duration
+
+	// 写header之前的事件先缓存，header写完后一起落盘
+	started  bool
+	buffered [][]byte
+
+	digest *HashChain
+	signer *segmentSigner
+	// 编码事件用的缓冲，每个事件复用
+	line []byte
+}
+
+// RecordingError reports that a recording could not be started.
+type RecordingError struct {
+	Path string
+	Err  error
+}
+
+func (e *RecordingError) Error() string {
+	return fmt.Sprintf("recording %s err:%s", e.Path, e.Err)
+}
+
+func (e *RecordingError) Unwrap() error {
+	return e.Err
+}
+
+// OpenRecorder creates the file at path, and any missing parent directories
+// with dirPerm (0755 if zero), and returns a Recorder writing to it.
+func OpenRecorder(path string, dirPerm os.FileMode) (*Recorder, error) {
+	if dirPerm == 0 {
+		dirPerm = 0o755
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return nil, &RecordingError{Path: path, Err: err}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, &RecordingError{Path: path, Err: err}
+	}
+	return NewRecorder(f), nil
+}
+
+// Close signs the end of the recording, if it is signed, and closes the
+// underlying writer, the digest and signature files and the transcript, if
+// they are io.Closers.
+func (rec *Recorder) Close() error {
+	if rec.signer != nil {
+		if err := rec.signer.close(); err != nil {
+			DefaultLogger().Error("sign recording", "err", err)
+		}
+	}
+	if rec.Transcript != nil {
+		rec.Transcript.Close()
+	}
+	if rec.digest != nil {
+		if c, ok := rec.digest.w.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	if c, ok := rec.Writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 func NewRecorder(writer io.Writer) *Recorder {
@@ -51,17 +177,93 @@ func (rec *Recorder) WriteHeader(height, width int) {
 	header.Timestamp = rec.StartTime.Unix()
 	header.Height = height
 	header.Width = width
+	if rec.Term != "" {
+		header.Env.Term = rec.Term
+	}
+	header.Title = rec.Title
+	header.Command = rec.Command
+	header.IdleTimeLimit = rec.IdleLimit.Seconds()
 	b, _ := json.Marshal(header)
-	rec.Writer.Write(b)
-	rec.Writer.Write([]byte("\r\n"))
+	rec.writeLine(b)
+	rec.started = true
+	for _, line := range rec.buffered {
+		rec.writeLine(line)
+	}
+	rec.buffered = nil
+}
+
+// WriteEvent adds e to the recording, timed now; e.Time is ignored. Like
+// the other Write methods it must be called with rec locked.
+func (rec *Recorder) WriteEvent(e RecEvent) {
+	rec.WriteBytes(e.Type, []byte(e.Data))
 }
 
 func (rec *Recorder) WriteData(rectype RecType, data string) {
-	recData := make([]interface{}, 3)
-	recData[0] = float64(time.Since(rec.StartTime).Microseconds()) / float64(1000000)
-	recData[1] = rectype
-	recData[2] = data
-	b, _ := json.Marshal(recData)
-	rec.Writer.Write(b)
-	rec.Writer.Write([]byte("\r\n"))
+	rec.WriteBytes(rectype, []byte(data))
+}
+
+// WriteBytes is WriteData without converting data to a string; data is not
+// kept after the call.
+func (rec *Recorder) WriteBytes(rectype RecType, data []byte) {
+	seconds := rec.elapsed().Seconds()
+	if rectype == OutPutType && rec.Transcript != nil {
+		rec.Transcript.Write(data)
+	}
+	// 留出换行的位置，writeLine追加时不用再分配
+	rec.line = append(appendEvent(rec.line[:0], seconds, rectype, data), '\n')
+	line := rec.line[:len(rec.line)-1]
+	if !rec.started {
+		rec.buffered = append(rec.buffered, append([]byte(nil), line...))
+		return
+	}
+	rec.writeLine(line)
+	// 一次很大的输出之后不一直占着大缓冲
+	if cap(rec.line) > maxRecLineBuffer {
+		rec.line = nil
+	}
+}
+
+// WriteMarker adds a marker, e.g. where a command was run.
+func (rec *Recorder) WriteMarker(label string) {
+	rec.WriteEvent(RecEvent{Type: MarkerType, Data: label})
+}
+
+// elapsed returns the time of a new event, with idle gaps capped at
+// IdleLimit.
+func (rec *Recorder) elapsed() time.Duration {
+	d := time.Since(rec.StartTime) - rec.skipped
+	if rec.IdleLimit > 0 && d-rec.last > rec.IdleLimit {
+		rec.skipped += d - rec.last - rec.IdleLimit
+		d = rec.last + rec.IdleLimit
+	}
+	rec.last = d
+	return d.Truncate(time.Microsecond)
+}
+
+// writeLine writes one line of newline-delimited json, as asciicast v2
+// requires.
+func (rec *Recorder) writeLine(b []byte) {
+	rec.Writer.Write(append(b, '\n'))
+	if rec.digest != nil {
+		rec.digest.Add(b)
+	}
+	if rec.signer != nil {
+		if err := rec.signer.add(b); err != nil {
+			DefaultLogger().Error("sign recording", "err", err)
+		}
+	}
+}
+
+func (rec *Recorder) WriteResize(height, width int) {
+	rec.WriteEvent(RecEvent{Type: ResizeType, Data: fmt.Sprintf("%dx%d", width, height)})
+}
+
+// Mark adds a marker with label to the recording of the session, if any.
+func (t *Turn) Mark(label string) {
+	if t.Recorder == nil {
+		return
+	}
+	t.Recorder.Lock()
+	t.Recorder.WriteMarker(label)
+	t.Recorder.Unlock()
 }
@@ -0,0 +1,289 @@
+package webssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Duration is a time.Duration written as "15m" in json.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration %s is not a string", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rates are the input and output limits of TurnConfig, 0 is no limit.
+type Rates struct {
+	OutputRate    int `json:"output_rate,omitempty"`
+	OutputBurst   int `json:"output_burst,omitempty"`
+	InputRate     int `json:"input_rate,omitempty"`
+	InputBurst    int `json:"input_burst,omitempty"`
+	InputMsgRate  int `json:"input_msg_rate,omitempty"`
+	InputMsgBurst int `json:"input_msg_burst,omitempty"`
+}
+
+// Policies are the settings a PolicyStore can change while the server
+// runs. Settings left out keep what TurnConfig says.
+type Policies struct {
+	// 命令规则，和CommandPolicy同时生效，见NewCommandRules
+	CommandAllow []string `json:"command_allow,omitempty"`
+	CommandDeny  []string `json:"command_deny,omitempty"`
+	// Rates不为空时替换TurnConfig里的限速，正在运行的会话也立即生效
+	Rates *Rates `json:"rates,omitempty"`
+	// IdleTimeout不为空时替换TurnConfig.IdleTimeout，"0s"表示不限
+	IdleTimeout *Duration `json:"idle_timeout,omitempty"`
+	// AllowedTargets是新会话可以连接的主机，"host"、"host:port"或"*.example.com"，为空不限制
+	AllowedTargets []string `json:"allowed_targets,omitempty"`
+}
+
+// compiledPolicies are Policies ready for use.
+type compiledPolicies struct {
+	Policies
+	rules *CommandRules
+}
+
+// PolicyStore holds the current Policies and swaps them atomically. Set it
+// as TurnConfig.Policies: command rules apply to the next line typed, rate
+// limits and the idle timeout to running sessions at once, and allowed
+// targets to sessions opened from then on.
+type PolicyStore struct {
+	cur atomic.Pointer[compiledPolicies]
+
+	mu    sync.Mutex
+	turns map[*Turn]struct{}
+	// Logger为空时使用DefaultLogger
+	Logger Logger
+}
+
+// NewPolicyStore returns a PolicyStore holding p.
+func NewPolicyStore(p Policies) (*PolicyStore, error) {
+	s := &PolicyStore{turns: make(map[*Turn]struct{})}
+	if err := s.Store(p); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadPolicyFile reads Policies from a json file.
+func LoadPolicyFile(path string) (Policies, error) {
+	var p Policies
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, fmt.Errorf("policy file %s err:%s", path, err)
+	}
+	return p, nil
+}
+
+func (s *PolicyStore) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return DefaultLogger()
+}
+
+// Load returns the current Policies.
+func (s *PolicyStore) Load() Policies {
+	return s.cur.Load().Policies
+}
+
+// Store checks p and makes it the current Policies. On error the current
+// ones stay.
+func (s *PolicyStore) Store(p Policies) error {
+	c := &compiledPolicies{Policies: p}
+	if len(p.CommandAllow) > 0 || len(p.CommandDeny) > 0 {
+		rules, err := NewCommandRules(p.CommandAllow, p.CommandDeny)
+		if err != nil {
+			return err
+		}
+		c.rules = rules
+	}
+	for _, t := range p.AllowedTargets {
+		if t == "" {
+			return errors.New("empty allowed target")
+		}
+	}
+	if p.IdleTimeout != nil && *p.IdleTimeout < 0 {
+		return errors.New("negative idle timeout")
+	}
+	s.cur.Store(c)
+	s.mu.Lock()
+	turns := make([]*Turn, 0, len(s.turns))
+	for t := range s.turns {
+		turns = append(turns, t)
+	}
+	s.mu.Unlock()
+	for _, t := range turns {
+		t.applyRates(c.Rates)
+	}
+	return nil
+}
+
+// WatchFile loads path every interval (default 10 seconds) and stores it
+// when its modification time changed, until ctx is done. A file that does
+// not parse is logged and the current Policies stay.
+func (s *PolicyStore) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	go func() {
+		var mod time.Time
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if fi, err := os.Stat(path); err != nil {
+				s.logger().Error("policy file", "path", path, "err", err)
+			} else if !fi.ModTime().Equal(mod) {
+				mod = fi.ModTime()
+				p, err := LoadPolicyFile(path)
+				if err == nil {
+					err = s.Store(p)
+				}
+				if err != nil {
+					s.logger().Error("reload policies", "path", path, "err", err)
+				} else {
+					s.logger().Info("policies reloaded", "path", path)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check makes the store a CommandPolicy of its command rules.
+func (s *PolicyStore) Check(sessionID, line string) error {
+	if c := s.cur.Load(); c.rules != nil {
+		return c.rules.Check(sessionID, line)
+	}
+	return nil
+}
+
+// CheckTarget returns an error if AllowedTargets does not contain addr,
+// "host" or "host:port".
+func (s *PolicyStore) CheckTarget(addr string) error {
+	allowed := s.cur.Load().AllowedTargets
+	if len(allowed) == 0 {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	for _, a := range allowed {
+		switch {
+		case strings.EqualFold(a, addr), strings.EqualFold(a, host):
+			return nil
+		case strings.HasPrefix(a, "*.") && len(host) > len(a)-1 && strings.EqualFold(host[len(host)-len(a)+1:], a[1:]):
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: target %s not allowed", ErrUnauthorized, addr)
+}
+
+// idleTimeout returns IdleTimeout, or the stored one.
+func (s *PolicyStore) idleTimeout(d time.Duration) time.Duration {
+	if c := s.cur.Load(); c.IdleTimeout != nil {
+		return time.Duration(*c.IdleTimeout)
+	}
+	return d
+}
+
+// add registers t to get changed rate limits until it is closed.
+func (s *PolicyStore) add(t *Turn) {
+	s.mu.Lock()
+	s.turns[t] = struct{}{}
+	s.mu.Unlock()
+	context.AfterFunc(t.ctx, func() {
+		s.mu.Lock()
+		delete(s.turns, t)
+		s.mu.Unlock()
+	})
+	t.applyRates(s.cur.Load().Rates)
+}
+
+// 不限速时的突发大小，waitBytes按它分段
+const unlimitedBurst = math.MaxInt32
+
+// newReloadableLimiter is newByteLimiter for limits a PolicyStore may
+// change: it is never nil, and lets everything through at rate 0.
+func newReloadableLimiter(bytesPerSec, burst int) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, unlimitedBurst)
+	setLimit(l, bytesPerSec, burst)
+	return l
+}
+
+func setLimit(l *rate.Limiter, bytesPerSec, burst int) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		l.SetBurst(unlimitedBurst)
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	l.SetLimit(rate.Limit(bytesPerSec))
+	l.SetBurst(burst)
+}
+
+// applyRates sets the limiters of the session to r, or back to TurnConfig
+// if r is nil.
+func (t *Turn) applyRates(r *Rates) {
+	if r == nil {
+		r = &Rates{t.OutputRate, t.OutputBurst, t.InputRate, t.InputBurst, t.InputMsgRate, t.InputMsgBurst}
+	}
+	setLimit(t.outLim, r.OutputRate, r.OutputBurst)
+	setLimit(t.inLim, r.InputRate, r.InputBurst)
+	setLimit(t.msgLim, r.InputMsgRate, r.InputMsgBurst)
+}
+
+// idleTimeout is IdleTimeout, or the one of Policies.
+func (t *Turn) idleTimeout() time.Duration {
+	if t.Policies != nil {
+		return t.Policies.idleTimeout(t.IdleTimeout)
+	}
+	return t.IdleTimeout
+}
+
+// checkCommand applies CommandPolicy and the command rules of Policies to
+// line.
+func (t *Turn) checkCommand(line string) error {
+	if t.CommandPolicy != nil {
+		if err := t.CommandPolicy.Check(t.ID, line); err != nil {
+			return err
+		}
+	}
+	if t.Policies != nil {
+		return t.Policies.Check(t.ID, line)
+	}
+	return nil
+}
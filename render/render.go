@@ -0,0 +1,334 @@
+// Package render replays recordings through a terminal emulator and draws
+// the screen, for short clips in incident reports: GIF writes an animated
+// GIF, PNGFrames numbered PNGs at a constant frame rate for an MP4:
+//
+//	ffmpeg -framerate 10 -i frame-%05d.png -pix_fmt yuv420p clip.mp4
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hinshun/vt10x"
+	"github.com/widaT/webssh"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Options configures a rendering. The zero value renders the whole
+// recording at 10 frames a second.
+type Options struct {
+	// FPS是每秒最多几帧，默认10
+	FPS int
+	// Speed是回放倍速，默认1
+	Speed float64
+	// MaxIdle是每一帧最多停留多久，长时间的停顿不用干等，默认2秒，小于0不限
+	MaxIdle time.Duration
+	// Start和End是截取的片段，单位秒，End为0表示到结尾
+	Start, End float64
+	// Face是字体，默认basicfont.Face7x13，只有ASCII；中文等需要换成等宽的CJK字体
+	Face font.Face
+	// CellWidth和CellHeight是每个字符的像素大小，默认取Face的大小
+	CellWidth, CellHeight int
+}
+
+// 最后一帧停留的时间
+const lastFrameHold = time.Second
+
+// 和vt10x的Glyph.Mode一致
+const (
+	attrReverse = 1 << iota
+	attrUnderline
+	attrBold
+)
+
+// xterm的256色，默认前景色是7，背景色是0
+var palette = xtermPalette()
+
+func (o *Options) defaults() {
+	if o.FPS <= 0 {
+		o.FPS = 10
+	}
+	if o.Speed <= 0 {
+		o.Speed = 1
+	}
+	if o.MaxIdle == 0 {
+		o.MaxIdle = 2 * time.Second
+	}
+	if o.Face == nil {
+		o.Face = basicfont.Face7x13
+	}
+	m := o.Face.Metrics()
+	if o.CellHeight <= 0 {
+		o.CellHeight = m.Height.Ceil()
+	}
+	if o.CellWidth <= 0 {
+		adv, ok := o.Face.GlyphAdvance('M')
+		if !ok {
+			adv = m.Height / 2
+		}
+		o.CellWidth = adv.Ceil()
+	}
+}
+
+// Frames replays events on a terminal of the size in header and calls fn
+// with every screen that differs from the one before and how long it is
+// shown. Screens are at most 1/FPS apart; img is reused after fn returns.
+func Frames(header *webssh.RecHeader, events []webssh.RecEvent, opts Options, fn func(img *image.Paletted, d time.Duration) error) error {
+	opts.defaults()
+	cols, rows := header.Width, header.Height
+	if cols <= 0 || rows <= 0 {
+		cols, rows = 80, 24
+	}
+	// 画布要装得下录像里最大的窗口
+	maxCols, maxRows := cols, rows
+	for _, e := range events {
+		if r, c, ok := e.Size(); ok {
+			maxCols, maxRows = max(maxCols, c), max(maxRows, r)
+		}
+	}
+	s := &screen{
+		vt:   vt10x.New(vt10x.WithSize(cols, rows)),
+		opts: &opts,
+		img:  image.NewPaletted(image.Rect(0, 0, maxCols*opts.CellWidth, maxRows*opts.CellHeight), palette),
+	}
+	interval := 1 / float64(opts.FPS)
+	// shown是正在显示的一帧的开始时间，changed是屏幕最后一次变化的时间
+	var shown, changed float64
+	started, dirty := false, false
+	emit := func(at float64) error {
+		d := time.Duration((at - shown) / opts.Speed * float64(time.Second))
+		if opts.MaxIdle > 0 && d > opts.MaxIdle {
+			d = opts.MaxIdle
+		}
+		shown = at
+		return fn(s.img, d)
+	}
+	for _, e := range events {
+		if opts.End > 0 && e.Time > opts.End {
+			break
+		}
+		if !started && e.Time >= opts.Start {
+			// 片段开始之前的输出只用来还原屏幕
+			started = true
+			s.draw()
+			shown, changed, dirty = opts.Start, opts.Start, false
+		}
+		if started && dirty && e.Time >= shown+interval {
+			if err := emit(math.Max(changed, shown+interval)); err != nil {
+				return err
+			}
+			s.draw()
+			dirty = false
+		}
+		switch e.Type {
+		case webssh.OutPutType:
+			s.write(e.Data)
+		case webssh.ResizeType:
+			r, c, ok := e.Size()
+			if !ok {
+				continue
+			}
+			s.vt.Resize(c, r)
+		default:
+			continue
+		}
+		changed, dirty = e.Time, true
+	}
+	if !started {
+		return fmt.Errorf("recording ends before %gs", opts.Start)
+	}
+	if dirty {
+		if err := emit(math.Max(changed, shown+interval)); err != nil {
+			return err
+		}
+		s.draw()
+	}
+	return fn(s.img, lastFrameHold)
+}
+
+// GIF writes the recording as an animated GIF to w. Each frame only holds
+// the part of the screen that changed.
+func GIF(w io.Writer, header *webssh.RecHeader, events []webssh.RecEvent, opts Options) error {
+	anim := &gif.GIF{}
+	var prev *image.Paletted
+	err := Frames(header, events, opts, func(img *image.Paletted, d time.Duration) error {
+		if prev == nil {
+			prev = clone(img)
+			anim.Config = image.Config{ColorModel: palette, Width: img.Rect.Dx(), Height: img.Rect.Dy()}
+			anim.Image = append(anim.Image, clone(img))
+		} else {
+			r := changedRect(prev, img)
+			if r.Empty() {
+				// 没有变化，把时间加到上一帧
+				anim.Delay[len(anim.Delay)-1] += gifDelay(d)
+				return nil
+			}
+			anim.Image = append(anim.Image, clone(img.SubImage(r).(*image.Paletted)))
+			draw.Draw(prev, r, img, r.Min, draw.Src)
+		}
+		anim.Delay = append(anim.Delay, gifDelay(d))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// PNGFrames writes the recording to dir as frame-00001.png and so on, one
+// file per 1/FPS, and returns how many it wrote.
+func PNGFrames(dir string, header *webssh.RecHeader, events []webssh.RecEvent, opts Options) (int, error) {
+	opts.defaults()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	n := 0
+	// 帧率固定，按停留时间重复写同一帧，误差累积到下一帧
+	var owed float64
+	var buf bytes.Buffer
+	err := Frames(header, events, opts, func(img *image.Paletted, d time.Duration) error {
+		buf.Reset()
+		if err := png.Encode(&buf, img); err != nil {
+			return err
+		}
+		owed += d.Seconds() * float64(opts.FPS)
+		for count := max(int(math.Round(owed)), 1); count > 0; count-- {
+			n++
+			owed--
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("frame-%05d.png", n)), buf.Bytes(), 0o644); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func gifDelay(d time.Duration) int {
+	// 单位是10毫秒，浏览器会把小于2的当成10
+	return max(int((d+5*time.Millisecond)/(10*time.Millisecond)), 2)
+}
+
+func clone(img *image.Paletted) *image.Paletted {
+	c := image.NewPaletted(img.Rect, img.Palette)
+	draw.Draw(c, c.Rect, img, img.Rect.Min, draw.Src)
+	return c
+}
+
+// changedRect is the smallest rectangle holding every pixel that differs
+// between a and b, which have the same bounds.
+func changedRect(a, b *image.Paletted) image.Rectangle {
+	var r image.Rectangle
+	w := a.Rect.Dx()
+	for y := 0; y < a.Rect.Dy(); y++ {
+		ra, rb := a.Pix[y*a.Stride:y*a.Stride+w], b.Pix[y*b.Stride:y*b.Stride+w]
+		if bytes.Equal(ra, rb) {
+			continue
+		}
+		x0, x1 := 0, w
+		for ra[x0] == rb[x0] {
+			x0++
+		}
+		for ra[x1-1] == rb[x1-1] {
+			x1--
+		}
+		r = r.Union(image.Rect(x0, y, x1, y+1))
+	}
+	return r.Add(a.Rect.Min)
+}
+
+type screen struct {
+	vt   vt10x.Terminal
+	opts *Options
+	img  *image.Paletted
+	// 上次写入时被截断的半个UTF-8字符
+	tail []byte
+}
+
+func (s *screen) write(data string) {
+	p := append(s.tail, data...)
+	n, _ := s.vt.Write(p)
+	s.tail = append(s.tail[:0], p[n:]...)
+}
+
+// draw paints the screen of vt onto img.
+func (s *screen) draw() {
+	s.vt.Lock()
+	defer s.vt.Unlock()
+	cw, ch := s.opts.CellWidth, s.opts.CellHeight
+	draw.Draw(s.img, s.img.Rect, image.NewUniform(palette[0]), image.Point{}, draw.Src)
+	cols, rows := s.vt.Size()
+	cur := s.vt.Cursor()
+	showCursor := s.vt.CursorVisible()
+	d := &font.Drawer{Dst: s.img, Face: s.opts.Face}
+	ascent := s.opts.Face.Metrics().Ascent.Ceil()
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols; x++ {
+			g := s.vt.Cell(x, y)
+			fg, bg := colorIndex(g.FG, 7), colorIndex(g.BG, 0)
+			if g.Mode&attrBold != 0 && fg < 8 {
+				fg += 8
+			}
+			if g.Mode&attrReverse != 0 != (showCursor && x == cur.X && y == cur.Y) {
+				fg, bg = bg, fg
+			}
+			cell := image.Rect(x*cw, y*ch, (x+1)*cw, (y+1)*ch)
+			if bg != 0 {
+				draw.Draw(s.img, cell, image.NewUniform(palette[bg]), image.Point{}, draw.Src)
+			}
+			if g.Char != ' ' && g.Char != 0 && g.Char != utf8.RuneError {
+				d.Src = image.NewUniform(palette[fg])
+				d.Dot = fixed.P(cell.Min.X, cell.Min.Y+ascent)
+				d.DrawString(string(g.Char))
+			}
+			if g.Mode&attrUnderline != 0 {
+				line := image.Rect(cell.Min.X, cell.Max.Y-1, cell.Max.X, cell.Max.Y)
+				draw.Draw(s.img, line, image.NewUniform(palette[fg]), image.Point{}, draw.Src)
+			}
+		}
+	}
+}
+
+// colorIndex maps a vt10x color to the palette, def for the default color.
+func colorIndex(c vt10x.Color, def uint8) uint8 {
+	switch {
+	case c < 256:
+		return uint8(c)
+	case c >= vt10x.DefaultFG:
+		return def
+	}
+	// 24位色取最接近的
+	return uint8(palette.Index(color.RGBA{uint8(c >> 16), uint8(c >> 8), uint8(c), 0xff}))
+}
+
+func xtermPalette() color.Palette {
+	p := make(color.Palette, 0, 256)
+	for _, c := range [16][3]uint8{
+		{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0}, {0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+		{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0}, {92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+	} {
+		p = append(p, color.RGBA{c[0], c[1], c[2], 0xff})
+	}
+	levels := [6]uint8{0, 95, 135, 175, 215, 255}
+	for i := 0; i < 216; i++ {
+		p = append(p, color.RGBA{levels[i/36], levels[i/6%6], levels[i%6], 0xff})
+	}
+	for i := 0; i < 24; i++ {
+		v := uint8(8 + i*10)
+		p = append(p, color.RGBA{v, v, v, 0xff})
+	}
+	return p
+}
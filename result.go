@@ -0,0 +1,182 @@
+package webssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+	"golang.org/x/crypto/ssh"
+)
+
+// Result summarizes a finished session.
+type Result struct {
+	SessionID     string        `json:"session_id"`
+	Name          string        `json:"name,omitempty"`
+	Owner         string        `json:"owner,omitempty"`
+	Detached      bool          `json:"detached,omitempty"`
+	User          string        `json:"user,omitempty"`
+	RemoteAddr    string        `json:"remote_addr,omitempty"`
+	StartTime     time.Time     `json:"start_time"`
+	EndTime       time.Time     `json:"end_time"`
+	Duration      time.Duration `json:"duration"`
+	ExitCode      int           `json:"exit_code"`
+	ExitSignal    string        `json:"exit_signal,omitempty"`
+	BytesIn       int64         `json:"bytes_in"`
+	BytesOut      int64         `json:"bytes_out"`
+	RecordingPath string        `json:"recording_path,omitempty"`
+	Term          string        `json:"term"`
+	InitialRows   int           `json:"initial_rows"`
+	InitialCols   int           `json:"initial_cols"`
+	Title         string        `json:"title,omitempty"`
+	Cwd           string        `json:"cwd,omitempty"`
+}
+
+// Result returns what is known about the session so far. ExitCode is -1
+// until the remote command has exited with a status.
+func (t *Turn) Result() Result {
+	now := time.Now()
+	return Result{
+		SessionID:   t.ID,
+		Name:        t.Name,
+		Owner:       t.Owner,
+		Detached:    t.Detached(),
+		StartTime:   t.StartTime,
+		EndTime:     now,
+		Duration:    now.Sub(t.StartTime),
+		ExitCode:    int(t.exitCode.Load()),
+		ExitSignal:  t.signal(),
+		BytesIn:     t.bytesIn.Load(),
+		BytesOut:    t.bytesOut.Load(),
+		Term:        t.term(),
+		InitialRows: int(t.initRows.Load()),
+		InitialCols: int(t.initCols.Load()),
+		Title:       t.Title(),
+		Cwd:         t.Cwd(),
+
+		RecordingPath: t.recording,
+	}
+}
+
+type exitStatus = wire.ExitStatus
+
+func (t *Turn) exitStatus() exitStatus {
+	return exitStatus{Code: int(t.exitCode.Load()), Signal: t.signal()}
+}
+
+// exitReason is the close reason sent with the close frame after the exit.
+func exitReason(s exitStatus) string {
+	if s.Signal != "" {
+		return "signal " + s.Signal
+	}
+	return fmt.Sprintf("exit %d", s.Code)
+}
+
+// writeExit sends the exit status to the owner and every attached client.
+func (t *Turn) writeExit() {
+	status := t.exitStatus()
+	b, _ := json.Marshal(status)
+	t.out.pushWait(frame{msgType: websocket.TextMessage, p: controlFrame(MsgExit, b)}, controlWait)
+	t.clientsMu.RLock()
+	defer t.clientsMu.RUnlock()
+	for c := range t.clients {
+		c.out.pushWait(frame{msgType: websocket.TextMessage, p: controlFrame(MsgExit, b)}, controlWait)
+	}
+}
+
+// closeExited ends every connection with a normal close frame carrying
+// the exit status, once what is queued has been written.
+func (t *Turn) closeExited() {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, exitReason(t.exitStatus()))
+	t.clientsMu.RLock()
+	for c := range t.clients {
+		c.out.pushWait(frame{msgType: websocket.CloseMessage, p: msg}, controlWait)
+	}
+	t.clientsMu.RUnlock()
+	if conn := t.conn(); conn != nil {
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	}
+}
+
+func (t *Turn) signal() string {
+	s, _ := t.exitSignal.Load().(string)
+	return s
+}
+
+// exitCode maps the error returned by Backend.Wait to an exit code, or -1
+// when the backend did not report one.
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *ssh.ExitError:
+		return e.ExitStatus()
+	case *ExitError:
+		if e.Signal != "" {
+			return -1
+		}
+		return e.Code
+	}
+	return -1
+}
+
+func exitSignal(err error) string {
+	switch e := err.(type) {
+	case *ssh.ExitError:
+		return e.Signal()
+	case *ExitError:
+		return e.Signal
+	}
+	return ""
+}
+
+type Webhook struct {
+	URL     string
+	Timeout time.Duration
+	Retries int
+}
+
+// Send posts r as JSON in the background, retrying with backoff on network
+// errors and non-2xx responses.
+func (h *Webhook) Send(r Result) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		DefaultLogger().Error("session end webhook", "session", r.SessionID, "err", err)
+		return
+	}
+	go func() {
+		timeout := h.Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		client := &http.Client{Timeout: timeout}
+		backoff := time.Second
+		for i := 0; ; i++ {
+			err := h.post(client, body)
+			if err == nil {
+				return
+			}
+			if i >= h.Retries {
+				DefaultLogger().Error("session end webhook", "session", r.SessionID, "err", err)
+				return
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+func (h *Webhook) post(client *http.Client, body []byte) error {
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package webssh
+
+import (
+	"io"
+	"testing"
+)
+
+func TestResultExitSignal(t *testing.T) {
+	turn := newTurn(nil, &TurnConfig{})
+	defer turn.cancel()
+	b, err := StartLocal("kill -TERM $$")(io.Discard, "xterm", 24, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn.backend = b
+	turn.SessionWait()
+	r := turn.Result()
+	if r.ExitSignal != "TERM" || r.ExitCode != -1 {
+		t.Fatalf("exit code %d, signal %q", r.ExitCode, r.ExitSignal)
+	}
+}
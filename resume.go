@@ -0,0 +1,160 @@
+package webssh
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// 断线期间默认保留的输出
+const defaultResumeBuffer = 64 * 1024
+
+// MsgDetach is sent by the owner of a named session to leave it running
+// and close the connection, like detaching from tmux.
+const MsgDetach = wire.MsgDetach
+
+var (
+	errNotDetached = errors.New("session is still connected")
+	errNoName      = errors.New("only named sessions can be detached")
+)
+
+// detachLocked drops the owner connection and keeps the output that follows
+// for Reattach. wsMu must be held.
+func (t *Turn) detachLocked(conn *websocket.Conn) {
+	if t.WsConn != conn || conn == nil {
+		return
+	}
+	t.WsConn = nil
+	if t.resumeBuf == nil {
+		size := t.ResumeBuffer
+		if size <= 0 {
+			size = defaultResumeBuffer
+		}
+		t.resumeBuf = newRingBuffer(size)
+	}
+	t.logger().Info("session detached", "event", "detached")
+	// 没有owner来批准，等待中的加入请求都拒绝；wsMu还锁着，另起goroutine
+	go t.denyJoins()
+}
+
+// Detach closes the owner connection of a named session and keeps the
+// session for Reattach, up to DetachTTL.
+func (t *Turn) Detach() error {
+	if t.Name == "" {
+		return errNoName
+	}
+	t.wsMu.Lock()
+	conn := t.WsConn
+	if conn == nil {
+		t.wsMu.Unlock()
+		return nil
+	}
+	t.detached.Store(true)
+	t.detachLocked(conn)
+	t.wsMu.Unlock()
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "detached"),
+		time.Now().Add(time.Second))
+	return conn.Close()
+}
+
+// waitResume is called by LoopRead when the owner connection is gone. It
+// reports whether a new connection was attached within ResumeGrace, or
+// DetachTTL after Detach; if not the session is closed.
+func (t *Turn) waitResume(ctx context.Context, conn *websocket.Conn) bool {
+	wait := t.ResumeGrace
+	if t.detached.Load() {
+		wait = t.DetachTTL
+	} else if wait <= 0 {
+		return false
+	}
+	if t.ctx.Err() != nil {
+		return false
+	}
+	t.wsMu.Lock()
+	t.detachLocked(conn)
+	t.wsMu.Unlock()
+	var expired <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-t.resumed:
+		return true
+	case <-expired:
+		t.logger().Info("session not resumed", "wait", wait)
+		go t.Close()
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Reattach attaches wsConn to a session whose owner connection dropped. The
+// output produced in between, up to ResumeBuffer bytes, is sent first.
+func (t *Turn) Reattach(wsConn *websocket.Conn) error {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	if t.ctx.Err() != nil {
+		return ErrSessionNotFound
+	}
+	if t.WsConn != nil || t.resumeBuf == nil {
+		return errNotDetached
+	}
+	t.WsConn = wsConn
+	// 新连接还没有协商过
+	t.gzipOn.Store(false)
+	t.binaryIn.Store(false)
+	if p := t.resumeBuf.Bytes(); len(p) > 0 {
+		if err := wsConn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+			t.WsConn = nil
+			return err
+		}
+		t.bytesOut.Add(int64(len(p)))
+	}
+	t.resumeBuf = nil
+	t.detached.Store(false)
+	select {
+	case t.resumed <- struct{}{}:
+	default:
+	}
+	t.logger().Info("session reattached", "event", "reattached")
+	return nil
+}
+
+// Detached reports whether the session has no owner connection and waits
+// for Reattach.
+func (t *Turn) Detached() bool {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	return t.WsConn == nil && t.resumeBuf != nil
+}
+
+// Find returns the live session of owner with the given name.
+func (m *SessionManager) Find(owner, name string) *Turn {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, t := range m.sessions {
+		if t.Name == name && t.Owner == owner && t.ctx.Err() == nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// Reattach attaches wsConn to the detached session with the given id.
+func (m *SessionManager) Reattach(id string, wsConn *websocket.Conn) (*Turn, error) {
+	t := m.Get(id)
+	if t == nil {
+		return nil, ErrSessionNotFound
+	}
+	if err := t.Reattach(wsConn); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
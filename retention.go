@@ -0,0 +1,172 @@
+package webssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 修改时间在这么久之内的录像可能还在写，不会被删除
+const pruneGrace = time.Minute
+
+var errNotPrunable = errors.New("recording storage does not support removing recordings")
+
+// RecordingInfo describes a stored recording.
+type RecordingInfo struct {
+	Name string
+	// Size包括录像旁边的哈希链、纯文本和签名
+	Size    int64
+	ModTime time.Time
+}
+
+// PrunableStorage is a RecorderStorage that recordings can be removed
+// from, as RetentionPolicy needs.
+type PrunableStorage interface {
+	RecorderStorage
+	Stat(name string) (RecordingInfo, error)
+	// Remove removes the recording with its digest, transcript and
+	// signature.
+	Remove(name string) error
+}
+
+// recordingFiles are the files kept for the recording name.
+func recordingFiles(name string) []string {
+	return []string{name, name + digestSuffix, name + transcriptSuffix, name + signatureSuffix}
+}
+
+// RetentionPolicy removes recordings so that the disk does not silently
+// fill up: those older than MaxAge, then the oldest of a tenant over its
+// quota, then the oldest of all while they take more than MaxTotalSize.
+// Recordings of live sessions, as told by InUse, and those modified in the
+// last minute are never removed, they may still be written.
+type RetentionPolicy struct {
+	// MaxAge为0时不按时间删除
+	MaxAge time.Duration
+	// MaxTotalSize是所有录像最多占用的字节数，0不限制
+	MaxTotalSize int64
+	// Tenant返回录像所属的租户，TenantQuota返回租户最多占用的字节数，0不限制；
+	// 两个都设置了才按租户限制
+	Tenant      func(name string) string
+	TenantQuota func(tenant string) int64
+	// InUse报告录像是否还在被在线会话写入，这样的录像不删除；
+	// StartPruner默认用SessionManager.RecordingOpen
+	InUse func(name string) bool
+	// 每删除一个录像记一条recording_deleted事件(需要实现AuditEventLogger)，
+	// 每次清理后发布RecordingRotatedEvent
+	AuditLogger AuditLogger
+	Events      *EventBus
+	Logger      Logger
+}
+
+func (p *RetentionPolicy) logger() Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return DefaultLogger()
+}
+
+// Start runs Prune on s every interval until ctx is done.
+func (p *RetentionPolicy) Start(ctx context.Context, s RecorderStorage, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := p.Prune(s); err != nil {
+				p.logger().Error("prune recordings", "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Prune removes the recordings of s the policy does not keep and returns
+// their names. s must be a PrunableStorage.
+func (p *RetentionPolicy) Prune(s RecorderStorage) ([]string, error) {
+	ps, ok := s.(PrunableStorage)
+	if !ok {
+		return nil, errNotPrunable
+	}
+	names, err := ps.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var recs []RecordingInfo
+	for _, name := range names {
+		info, err := ps.Stat(name)
+		if err != nil {
+			continue
+		}
+		recs = append(recs, info)
+	}
+
+	var removed []string
+	var errs []error
+	remove := func(r RecordingInfo, reason string) bool {
+		if now.Sub(r.ModTime) < pruneGrace || (p.InUse != nil && p.InUse(r.Name)) {
+			return false
+		}
+		if err := ps.Remove(r.Name); err != nil {
+			errs = append(errs, fmt.Errorf("remove %s err:%s", r.Name, err))
+			return false
+		}
+		removed = append(removed, r.Name)
+		p.logger().Info("recording deleted", "event", "recording_deleted", "name", r.Name, "reason", reason, "size", r.Size)
+		if l, ok := p.AuditLogger.(AuditEventLogger); ok {
+			l.LogEvent("", "recording_deleted", r.Name+" "+reason)
+		}
+		return true
+	}
+
+	// recs按时间从旧到新，删掉的从中去掉
+	kept := recs[:0]
+	for _, r := range recs {
+		if p.MaxAge > 0 && now.Sub(r.ModTime) > p.MaxAge && remove(r, "max_age") {
+			continue
+		}
+		kept = append(kept, r)
+	}
+	recs = kept
+
+	if p.Tenant != nil && p.TenantQuota != nil {
+		used := make(map[string]int64)
+		for _, r := range recs {
+			used[p.Tenant(r.Name)] += r.Size
+		}
+		kept := recs[:0]
+		for _, r := range recs {
+			tenant := p.Tenant(r.Name)
+			if quota := p.TenantQuota(tenant); quota > 0 && used[tenant] > quota && remove(r, "tenant_quota") {
+				used[tenant] -= r.Size
+				continue
+			}
+			kept = append(kept, r)
+		}
+		recs = kept
+	}
+
+	if p.MaxTotalSize > 0 {
+		var total int64
+		for _, r := range recs {
+			total += r.Size
+		}
+		for _, r := range recs {
+			if total <= p.MaxTotalSize {
+				break
+			}
+			if remove(r, "max_total_size") {
+				total -= r.Size
+			}
+		}
+	}
+
+	if len(removed) > 0 {
+		p.Events.Publish(RecordingRotatedEvent{EventHeader: EventHeader{Time: now}, Removed: removed})
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,48 @@
+package webssh
+
+import "sync"
+
+// ringBuffer keeps the last size bytes written to it.
+type ringBuffer struct {
+	mu   sync.Mutex
+	size int
+	buf  []byte
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(p)
+	if n >= r.size {
+		r.buf = append(r.buf[:0], p[n-r.size:]...)
+		return n, nil
+	}
+	if over := len(r.buf) + n - r.size; over > 0 {
+		r.buf = append(r.buf[:0], r.buf[over:]...)
+	}
+	r.buf = append(r.buf, p...)
+	return n, nil
+}
+
+// Len is the number of bytes buffered; a nil buffer holds none.
+func (r *ringBuffer) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buf)
+}
+
+// Bytes returns a copy of the buffered data.
+func (r *ringBuffer) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := make([]byte, len(r.buf))
+	copy(b, r.buf)
+	return b
+}
@@ -0,0 +1,80 @@
+package webssh
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// 输出末尾不完整的UTF-8字符最多等这么久，之后原样发送
+const runeHoldTimeout = 50 * time.Millisecond
+
+// runeHolder keeps a UTF-8 sequence that a read from the pty cut in two out
+// of the frame, and sends it with the next output, so every frame holds
+// whole characters.
+type runeHolder struct {
+	mu    sync.Mutex
+	tail  []byte
+	timer *time.Timer
+	gen   int // 已经被取代的timer不再发送
+}
+
+// write passes p to w without an incomplete rune at its end, which is kept
+// for the next call. If no output follows within runeHoldTimeout the kept
+// bytes are sent as they are; the output may not be UTF-8 after all.
+func (h *runeHolder) write(p []byte, w func([]byte) (int, error)) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	if len(h.tail) > 0 {
+		p = append(h.tail, p...)
+		h.tail = nil
+	}
+	n := incompleteRune(p)
+	if n > 0 {
+		h.tail = append([]byte(nil), p[len(p)-n:]...)
+		p = p[:len(p)-n]
+		h.gen++
+		gen := h.gen
+		h.timer = time.AfterFunc(runeHoldTimeout, func() { h.flush(gen, w) })
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	_, err := w(p)
+	return err
+}
+
+func (h *runeHolder) flush(gen int, w func([]byte) (int, error)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if gen == h.gen && len(h.tail) > 0 {
+		w(h.tail)
+		h.tail = nil
+	}
+}
+
+// drain sends the kept bytes right away, e.g. when the process has exited.
+func (h *runeHolder) drain(w func([]byte) (int, error)) {
+	h.mu.Lock()
+	gen := h.gen
+	h.mu.Unlock()
+	h.flush(gen, w)
+}
+
+// incompleteRune returns the length of the incomplete UTF-8 sequence at the
+// end of p, or 0.
+func incompleteRune(p []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		if utf8.RuneStart(p[len(p)-i]) {
+			if utf8.FullRune(p[len(p)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,308 @@
+package webssh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage keeps recordings in an S3 compatible bucket. Recordings are
+// written to a temporary file and uploaded when the Recorder is closed.
+type S3Storage struct {
+	// Endpoint如https://s3.us-east-1.amazonaws.com，使用path-style访问bucket
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Client为空时使用http.DefaultClient
+	Client *http.Client
+}
+
+// NewGCSStorage returns storage for a Google Cloud Storage bucket accessed
+// through its S3 compatible XML API with HMAC keys.
+func NewGCSStorage(bucket, accessKey, secretKey string) *S3Storage {
+	return &S3Storage{
+		Endpoint:  "https://storage.googleapis.com",
+		Region:    "auto",
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+}
+
+type s3Upload struct {
+	s    *S3Storage
+	name string
+	f    *os.File
+	sum  hash.Hash
+}
+
+func (s *S3Storage) Create(name string) (io.WriteCloser, error) {
+	f, err := os.CreateTemp("", "webssh-rec-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{s: s, name: name, f: f, sum: sha256.New()}, nil
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	n, err := u.f.Write(p)
+	u.sum.Write(p[:n])
+	return n, err
+}
+
+// Close uploads the recording and removes the temporary file.
+func (u *s3Upload) Close() error {
+	defer os.Remove(u.f.Name())
+	defer u.f.Close()
+	size, err := u.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := u.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.s.objectURL(u.name), u.f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := u.s.do(req, hex.EncodeToString(u.sum.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Open(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+type s3ListResult struct {
+	IsTruncated bool `xml:"IsTruncated"`
+	Contents    []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+func (s *S3Storage) List() ([]string, error) {
+	type object struct {
+		name string
+		mod  time.Time
+	}
+	var objects []object
+	marker := ""
+	for {
+		q := url.Values{}
+		q.Set("prefix", s.Prefix)
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		req, err := http.NewRequest(http.MethodGet, s.bucketURL()+"?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(req, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list err:%s", err)
+		}
+		for _, c := range result.Contents {
+			marker = c.Key
+			name := strings.TrimPrefix(c.Key, s.Prefix)
+			if strings.HasSuffix(name, ".cast") {
+				objects = append(objects, object{name, c.LastModified})
+			}
+		}
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			break
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool { return objects[i].mod.Before(objects[j].mod) })
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = o.name
+	}
+	return names, nil
+}
+
+// Stat returns the size of the recording name with the objects next to
+// it, asking for each with HEAD.
+func (s *S3Storage) Stat(name string) (RecordingInfo, error) {
+	info := RecordingInfo{Name: name}
+	for i, f := range recordingFiles(name) {
+		req, err := http.NewRequest(http.MethodHead, s.objectURL(f), nil)
+		if err != nil {
+			return info, err
+		}
+		resp, err := s.do(req, emptySHA256)
+		if err != nil {
+			if i == 0 {
+				return info, err
+			}
+			continue
+		}
+		resp.Body.Close()
+		if i == 0 {
+			info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		}
+		info.Size += resp.ContentLength
+	}
+	return info, nil
+}
+
+// Remove deletes the recording name and the objects next to it. Deleting
+// an object that does not exist succeeds in S3.
+func (s *S3Storage) Remove(name string) error {
+	for _, f := range recordingFiles(name) {
+		req, err := http.NewRequest(http.MethodDelete, s.objectURL(f), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req, emptySHA256)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *S3Storage) bucketURL() string {
+	return strings.TrimRight(s.Endpoint, "/") + "/" + s3Escape(s.Bucket, false)
+}
+
+func (s *S3Storage) objectURL(name string) string {
+	return s.bucketURL() + "/" + s3Escape(s.Prefix+name, false)
+}
+
+// do signs and sends req, turning non-2xx responses into errors.
+func (s *S3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signV4(req, payloadHash, s.AccessKey, s.SecretKey, s.Region, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return resp, nil
+}
+
+// signV4 adds AWS signature version 4 headers to req. All headers already
+// set on req are signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonical := strings.Join([]string{
+		req.Method, path, strings.Join(pairs, "&"),
+		canonHeaders.String(), signed, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way signature v4 expects. Slashes are kept
+// unless inQuery is set.
+func s3Escape(s string, inQuery bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !inQuery:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package webssh
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// Sandbox runs a local session with less than the daemon's privileges:
+// as another user, inside a chroot and in namespaces of its own. Switching
+// user and chroot need the daemon to run as root; namespaces are only
+// available on linux, and windows supports none of it.
+type Sandbox struct {
+	// User是运行shell的用户名或uid，按它设置UID、GID、附加组以及HOME、USER、LOGNAME
+	User string
+	// UID和GID在User为空时使用；Groups是附加组，为空时不属于任何附加组
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+	// Chroot是根目录，Shell、Command和Dir都是其中的路径
+	Chroot string
+	// 以下只用于linux，会话进程在新的namespace中运行。NewPID时/proc仍是原来的，
+	// 需要的话在Chroot里另外挂载；NewNet时只有回环网卡并且没有启用
+	NewMount bool
+	NewPID   bool
+	NewNet   bool
+	NewIPC   bool
+	NewUTS   bool
+}
+
+// sandboxUser is who the session runs as.
+type sandboxUser struct {
+	uid, gid uint32
+	groups   []uint32
+	// env是按User设置的HOME、USER和LOGNAME
+	env  []string
+	home string
+}
+
+// user returns who the session runs as, nil if the user is not switched.
+func (s *Sandbox) user() (*sandboxUser, error) {
+	if s.User == "" {
+		if s.UID == 0 && s.GID == 0 {
+			return nil, nil
+		}
+		return &sandboxUser{uid: s.UID, gid: s.GID, groups: s.Groups}, nil
+	}
+	u, err := user.Lookup(s.User)
+	if err != nil {
+		if _, err := strconv.ParseUint(s.User, 10, 32); err != nil {
+			return nil, fmt.Errorf("sandbox user %q err:%s", s.User, err)
+		}
+		if u, err = user.LookupId(s.User); err != nil {
+			return nil, fmt.Errorf("sandbox user %q err:%s", s.User, err)
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox user %q uid %q", s.User, u.Uid)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("sandbox user %q gid %q", s.User, u.Gid)
+	}
+	su := &sandboxUser{uid: uint32(uid), gid: uint32(gid)}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if g, err := strconv.ParseUint(id, 10, 32); err == nil && uint32(g) != su.gid {
+			su.groups = append(su.groups, uint32(g))
+		}
+	}
+	su.env = []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	su.home = u.HomeDir
+	return su, nil
+}
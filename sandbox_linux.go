@@ -0,0 +1,26 @@
+//go:build linux
+
+package webssh
+
+import "syscall"
+
+// namespaces sets the clone flags for the namespaces of s.
+func (s *Sandbox) namespaces(attr *syscall.SysProcAttr) error {
+	if s.NewMount {
+		// Unshareflags里有CLONE_NEWNS时挂载点改为private，不会传播回主机
+		attr.Unshareflags |= syscall.CLONE_NEWNS
+	}
+	if s.NewPID {
+		attr.Cloneflags |= syscall.CLONE_NEWPID
+	}
+	if s.NewNet {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if s.NewIPC {
+		attr.Cloneflags |= syscall.CLONE_NEWIPC
+	}
+	if s.NewUTS {
+		attr.Cloneflags |= syscall.CLONE_NEWUTS
+	}
+	return nil
+}
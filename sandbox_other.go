@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package webssh
+
+import (
+	"errors"
+	"syscall"
+)
+
+// namespaces fails if s asks for namespaces, they only exist on linux.
+func (s *Sandbox) namespaces(attr *syscall.SysProcAttr) error {
+	if s.NewMount || s.NewPID || s.NewNet || s.NewIPC || s.NewUTS {
+		return errors.New("namespaces are only supported on linux")
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package webssh
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// 沙箱里的shell不继承daemon的环境变量，PATH和sshd的默认值一样
+const sandboxPath = "PATH=/usr/local/bin:/usr/bin:/bin"
+
+// applySandbox sets up cmd, whose SysProcAttr is already set, to run in
+// the sandbox s; tty is the pty it gets, handed to the user it runs as.
+// It returns the environment variables of that user. Without a Dir the
+// shell starts in the home directory of the user inside Chroot, or at its
+// root, never in the working directory of the daemon, which is outside.
+func applySandbox(cmd *exec.Cmd, s *Sandbox, tty *os.File) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	u, err := s.user()
+	if err != nil {
+		return nil, err
+	}
+	var env []string
+	if u != nil {
+		// 附加组为空时清空daemon的附加组
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: u.uid, Gid: u.gid, Groups: u.groups}
+		// 和sshd一样把pty交给登录的用户
+		if err := tty.Chown(int(u.uid), int(u.gid)); err != nil {
+			return nil, err
+		}
+		env = u.env
+	}
+	cmd.SysProcAttr.Chroot = s.Chroot
+	if s.Chroot != "" && cmd.Dir == "" {
+		cmd.Dir = "/"
+		if u != nil && u.home != "" {
+			if info, err := os.Stat(filepath.Join(s.Chroot, u.home)); err == nil && info.IsDir() {
+				cmd.Dir = u.home
+			}
+		}
+	}
+	return env, s.namespaces(cmd.SysProcAttr)
+}
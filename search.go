@@ -0,0 +1,113 @@
+package webssh
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgSearch is sent by the owner with {"id","query"} to search the
+// scrollback and screen of the virtual terminal, see
+// TurnConfig.VirtualTerminal. "regexp" makes the query a regular
+// expression, "case" makes it case sensitive, "limit" caps the matches
+// (default 100) and "context" adds that many lines around each. The
+// server answers with the same id and {"matches","total"}, or {"error"}.
+// Lines are counted from the oldest one kept, columns in characters.
+const MsgSearch = wire.MsgSearch
+
+// 默认最多返回这么多个匹配，上下文最多这么多行
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+	maxSearchContext   = 10
+	maxSearchQuery     = 1024
+)
+
+var errEmptyQuery = errors.New("empty search query")
+
+// SearchQuery is what Turn.Search looks for.
+type SearchQuery = wire.SearchQuery
+
+// SearchMatch is one match of a search.
+type SearchMatch = wire.SearchMatch
+
+// SearchResult is the answer to a SearchQuery. Total counts every match,
+// also those past the limit.
+type SearchResult = wire.SearchResult
+
+// Search looks for q in the scrollback and screen of the session.
+func (t *Turn) Search(q SearchQuery) (SearchResult, error) {
+	res := SearchResult{ID: q.ID, Matches: []SearchMatch{}}
+	if t.vterm == nil {
+		return res, ErrNoVirtualTerminal
+	}
+	if q.Query == "" {
+		return res, errEmptyQuery
+	}
+	if len(q.Query) > maxSearchQuery {
+		q.Query = q.Query[:maxSearchQuery]
+	}
+	expr := q.Query
+	if !q.Regexp {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if !q.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return res, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	limit = min(limit, maxSearchLimit)
+	context := min(max(q.Context, 0), maxSearchContext)
+
+	lines := trimBlankLines(t.vterm.lines(true))
+	text := make([]string, len(lines))
+	for i, line := range lines {
+		var b strings.Builder
+		for _, g := range line {
+			b.WriteRune(glyphChar(g))
+		}
+		text[i] = b.String()
+	}
+	res.Lines = len(text)
+	for i, line := range text {
+		for _, loc := range re.FindAllStringIndex(line, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			res.Total++
+			if len(res.Matches) >= limit {
+				continue
+			}
+			m := SearchMatch{
+				Line: i,
+				Col:  utf8.RuneCountInString(line[:loc[0]]),
+				Len:  utf8.RuneCountInString(line[loc[0]:loc[1]]),
+				Text: line,
+			}
+			if context > 0 {
+				m.Before = text[max(i-context, 0):i]
+				m.After = text[i+1 : min(i+1+context, len(text))]
+			}
+			res.Matches = append(res.Matches, m)
+		}
+	}
+	return res, nil
+}
+
+// handleSearch answers a MsgSearch of the owner.
+func (t *Turn) handleSearch(q SearchQuery) {
+	res, err := t.Search(q)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	t.writeControl(MsgSearch, res)
+}
@@ -0,0 +1,121 @@
+package webssh
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/gorilla/websocket"
+	"go.bug.st/serial"
+)
+
+// SerialConfig describes a local serial port, e.g. a USB-serial console.
+type SerialConfig struct {
+	// Device如/dev/ttyUSB0或COM3
+	Device string
+	// BaudRate默认115200，DataBits默认8
+	BaudRate int
+	DataBits int
+	// Parity为none(默认)、odd、even、mark或space
+	Parity string
+	// StopBits为1(默认)、1.5或2
+	StopBits string
+}
+
+func (c *SerialConfig) mode() (*serial.Mode, error) {
+	mode := &serial.Mode{BaudRate: c.BaudRate, DataBits: c.DataBits}
+	if mode.BaudRate <= 0 {
+		mode.BaudRate = 115200
+	}
+	if mode.DataBits <= 0 {
+		mode.DataBits = 8
+	}
+	switch c.Parity {
+	case "", "none":
+		mode.Parity = serial.NoParity
+	case "odd":
+		mode.Parity = serial.OddParity
+	case "even":
+		mode.Parity = serial.EvenParity
+	case "mark":
+		mode.Parity = serial.MarkParity
+	case "space":
+		mode.Parity = serial.SpaceParity
+	default:
+		return nil, fmt.Errorf("unknown parity %q", c.Parity)
+	}
+	switch c.StopBits {
+	case "", "1":
+		mode.StopBits = serial.OneStopBit
+	case "1.5":
+		mode.StopBits = serial.OnePointFiveStopBits
+	case "2":
+		mode.StopBits = serial.TwoStopBits
+	default:
+		return nil, fmt.Errorf("unknown stop bits %q", c.StopBits)
+	}
+	return mode, nil
+}
+
+type serialBackend struct {
+	port serial.Port
+	done chan struct{}
+	err  error
+}
+
+// StartSerial returns a StartFunc that opens the serial port of sconf.
+// A serial console has no window size, so Resize does nothing.
+func StartSerial(sconf *SerialConfig) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		mode, err := sconf.mode()
+		if err != nil {
+			return nil, err
+		}
+		port, err := serial.Open(sconf.Device, mode)
+		if err != nil {
+			return nil, fmt.Errorf("open serial port %s err:%s", sconf.Device, err)
+		}
+		b := &serialBackend{port: port, done: make(chan struct{})}
+		go func() {
+			defer close(b.done)
+			p := outputBuffer(out)
+			defer putBuffer(p)
+			buf := *p
+			for {
+				n, err := port.Read(buf)
+				if n > 0 {
+					if _, werr := out.Write(buf[:n]); werr != nil {
+						b.err = werr
+						return
+					}
+				}
+				if err != nil {
+					b.err = err
+					return
+				}
+			}
+		}()
+		return b, nil
+	}
+}
+
+func (b *serialBackend) Write(p []byte) (int, error) {
+	return b.port.Write(p)
+}
+
+func (b *serialBackend) Resize(rows, cols int) error {
+	return nil
+}
+
+func (b *serialBackend) Wait() error {
+	<-b.done
+	return b.err
+}
+
+func (b *serialBackend) Close() error {
+	return b.port.Close()
+}
+
+// NewSerialTurn attaches a session to the serial port of sconf.
+func NewSerialTurn(wsConn *websocket.Conn, sconf *SerialConfig, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	return NewBackendTurn(wsConn, StartSerial(sconf), rec, conf)
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package webssh
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// killSession kills the process group of sid and every other process of
+// the session sid leads, such as jobs the shell put in the background,
+// which have process groups of their own.
+func killSession(sid int) {
+	syscall.Kill(-sid, syscall.SIGKILL)
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil || pid == sid {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + d.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp session ...，comm里可能有空格和括号
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		fields := bytes.Fields(stat[i+1:])
+		if len(fields) < 4 {
+			continue
+		}
+		if s, err := strconv.Atoi(string(fields[3])); err == nil && s == sid {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package webssh
+
+import "syscall"
+
+// killSession kills the process group of sid. Other process groups of the
+// session are left alone, finding them is not portable.
+func killSession(sid int) {
+	syscall.Kill(-sid, syscall.SIGKILL)
+}
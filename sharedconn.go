@@ -0,0 +1,184 @@
+package webssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// 和sshd默认的MaxSessions一样
+	defaultShareConnsMax  = 10
+	defaultShareConnsIdle = time.Minute
+)
+
+// connShare lets sessions to the same host, user and credentials share an
+// ssh connection, each on a channel of its own, like OpenSSH's
+// ControlMaster. A connection carries up to max sessions and is kept idle
+// seconds after the last one has ended.
+type connShare struct {
+	max  int
+	idle time.Duration
+
+	mu    sync.Mutex
+	conns map[string][]*sharedConn
+}
+
+type sharedConn struct {
+	key    string
+	client *ssh.Client
+	// 连接建立好之前ready没有关闭，同时来的会话等它而不是各连一次
+	ready chan struct{}
+	err   error
+	refs  int
+	dead  bool
+	timer *time.Timer
+}
+
+func newConnShare(max int, idle time.Duration) *connShare {
+	if max <= 0 {
+		max = defaultShareConnsMax
+	}
+	if idle <= 0 {
+		idle = defaultShareConnsIdle
+	}
+	return &connShare{max: max, idle: idle, conns: map[string][]*sharedConn{}}
+}
+
+// get returns a connection for key, dialing one when none has room, and a
+// function to call when the session is done with it.
+func (s *connShare) get(key string, dial func() (*ssh.Client, error)) (*ssh.Client, func(), error) {
+	s.mu.Lock()
+	var c *sharedConn
+	for _, sc := range s.conns[key] {
+		if !sc.dead && sc.refs < s.max {
+			c = sc
+			break
+		}
+	}
+	dialing := c == nil
+	if dialing {
+		c = &sharedConn{key: key, ready: make(chan struct{})}
+		s.conns[key] = append(s.conns[key], c)
+	}
+	c.refs++
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	s.mu.Unlock()
+
+	if dialing {
+		c.client, c.err = dial()
+		if c.err == nil {
+			go s.watch(c)
+		} else {
+			s.mu.Lock()
+			s.remove(c)
+			s.mu.Unlock()
+		}
+		close(c.ready)
+	}
+	<-c.ready
+	if c.err != nil {
+		s.mu.Lock()
+		c.refs--
+		s.mu.Unlock()
+		return nil, nil, c.err
+	}
+	var once sync.Once
+	return c.client, func() { once.Do(func() { s.release(c) }) }, nil
+}
+
+// watch forgets c once the server or the network has closed it.
+func (s *connShare) watch(c *sharedConn) {
+	c.client.Wait()
+	s.mu.Lock()
+	s.remove(c)
+	s.mu.Unlock()
+}
+
+func (s *connShare) release(c *sharedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.refs--
+	if c.refs > 0 || c.dead {
+		return
+	}
+	c.timer = time.AfterFunc(s.idle, func() {
+		s.mu.Lock()
+		if c.refs > 0 || c.timer == nil {
+			s.mu.Unlock()
+			return
+		}
+		s.remove(c)
+		s.mu.Unlock()
+		c.client.Close()
+	})
+}
+
+// remove must be called with s.mu held.
+func (s *connShare) remove(c *sharedConn) {
+	c.dead = true
+	c.timer = nil
+	list := s.conns[c.key]
+	for i, sc := range list {
+		if sc == c {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(s.conns, c.key)
+	} else {
+		s.conns[c.key] = list
+	}
+}
+
+// shareKey is what sessions must have in common to share a connection to
+// conf: the route, the account and the credentials used to log in, so a
+// session never gets a connection it could not have opened itself.
+func shareKey(conf *SSHClientConfig, owner string) string {
+	h := sha256.New()
+	var add func(c *SSHClientConfig)
+	add = func(c *SSHClientConfig) {
+		fmt.Fprintf(h, "%q %q %q %q %q %q %q %q %v\n", c.HostAddr, c.User, c.Password,
+			c.KeyPath, c.Key, c.Passphrase, c.CertPath, c.Cert, c.AuthModels)
+		fmt.Fprintf(h, "%v %q %t\n", c.AuthModel, c.AgentSocket, c.GSSAPI != nil)
+	}
+	add(conf)
+	for _, j := range conf.Jumps {
+		add(j)
+	}
+	fmt.Fprintf(h, "%q %q\n", conf.Proxy, owner)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// connect returns an ssh connection for a session and a function that gives
+// it back. With ShareConns it may be shared with other sessions.
+func (w *WebSSH) connect(onRetry func(attempt, retries int, err error), challenge ssh.KeyboardInteractiveChallenge) (*ssh.Client, func(), error) {
+	// X11和agent转发要独占连接上的channel，答过二次验证的连接也不能给别人用
+	if w.conns == nil || w.X11 || w.ForwardAgent != nil || challenge != nil && w.Owner == "" {
+		client, err := w.dial(onRetry, challenge)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+	config, err := w.clientConfig(onRetry, challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+	owner := ""
+	if challenge != nil {
+		owner = w.Owner
+	}
+	return w.conns.get(shareKey(config, owner), func() (*ssh.Client, error) {
+		w.logger().Info("new shared connection", "user", config.User, "host", config.HostAddr)
+		return NewSSHClient(config)
+	})
+}
@@ -0,0 +1,144 @@
+package webssh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ShellOptions describes what a backend starts on its pty.
+type ShellOptions struct {
+	// Command为空时启动登录shell
+	Command string
+	// Env是KEY=VALUE形式的环境变量，加在默认环境之后
+	Env []string
+	// Dir是初始工作目录
+	Dir string
+	// Login为true时Command也在登录shell里运行(sh -lc)，会读取profile
+	Login bool
+	// Shell是本机会话使用的shell，为空时取$SHELL；windows上可以是pwsh、
+	// powershell、cmd或路径，为空时自动选择
+	Shell string
+	// KillSignal和KillGrace只用于unix上的本机会话：关闭时先给进程组发
+	// KillSignal(默认SIGHUP，shell会保存history)，KillGrace(默认3秒)后
+	// 还没退出就和会话里剩下的进程一起SIGKILL
+	KillSignal ssh.Signal
+	KillGrace  time.Duration
+	// ResizeQuirk只用于windows，创建ConPTY时带上PSEUDOCONSOLE_RESIZE_QUIRK，
+	// 改变窗口大小时ConPTY不再重绘整个屏幕
+	ResizeQuirk bool
+	// Limits只用于本机会话，限制进程树使用的CPU、内存和进程数，见ResourceLimits
+	Limits *ResourceLimits
+	// Sandbox只用于unix上的本机会话，以其他用户、在chroot或新的namespace中运行，见Sandbox
+	Sandbox *Sandbox
+
+	// 只用于ssh会话，见TurnConfig.X11
+	x11          *x11Forward
+	forwardAgent bool
+	// persist是tmux或screen，persistName是它的会话名，见TurnConfig.ReconnectVia
+	persist     string
+	persistName string
+
+	logger Logger
+}
+
+func (c *TurnConfig) shellOptions() ShellOptions {
+	return ShellOptions{
+		Command:     c.Command,
+		Env:         c.Env,
+		Dir:         c.Dir,
+		Login:       c.LoginShell,
+		Shell:       c.Shell,
+		ResizeQuirk: c.ConPTYResizeQuirk,
+		KillSignal:  c.KillSignal,
+		KillGrace:   c.KillGrace,
+		Limits:      c.Limits,
+		Sandbox:     c.Sandbox,
+		logger:      c.logger(),
+	}
+}
+
+func (o *ShellOptions) log() Logger {
+	if o.logger != nil {
+		return o.logger
+	}
+	return DefaultLogger()
+}
+
+// 远端用户的shell
+const remoteShell = `"${SHELL:-/bin/sh}"`
+
+// sshCommand returns the command line that applies opts on an ssh server;
+// exports holds the variables the server refused to set. An empty result
+// means the default login shell.
+func sshCommand(opts ShellOptions, exports []string) string {
+	cmd := opts.Command
+	if cmd != "" && opts.Login {
+		cmd = "exec " + remoteShell + " -lc " + shellQuote(cmd)
+	}
+	if opts.persist != "" {
+		cmd = persistCommand(opts.persist, opts.persistName, cmd)
+	}
+	if opts.Dir == "" && len(exports) == 0 {
+		return cmd
+	}
+	if cmd == "" {
+		// sshd启动的shell本来就是登录shell
+		cmd = "exec " + remoteShell + " -l"
+	}
+	var b strings.Builder
+	for _, kv := range exports {
+		k, v, _ := strings.Cut(kv, "=")
+		b.WriteString("export " + k + "=" + shellQuote(v) + "; ")
+	}
+	if opts.Dir != "" {
+		b.WriteString("cd " + shellQuote(opts.Dir) + " || exit 1; ")
+	}
+	b.WriteString(cmd)
+	return b.String()
+}
+
+// persistIn makes the command run in a tmux or screen session named after
+// the session ID, so starting it again after a reconnect attaches to it.
+func (o *ShellOptions) persistIn(via, id string) error {
+	switch via {
+	case "":
+		return nil
+	case "tmux", "screen":
+		o.persist, o.persistName = via, "webssh-"+id
+		return nil
+	}
+	return fmt.Errorf("unknown ReconnectVia %q", via)
+}
+
+// persistCommand attaches to the tmux or screen session name, creating it
+// with cmd, or the default shell, if it does not exist yet.
+func persistCommand(via, name, cmd string) string {
+	var b strings.Builder
+	if via == "tmux" {
+		b.WriteString("exec tmux new-session -A -s " + shellQuote(name))
+	} else {
+		b.WriteString("exec screen -D -RR -S " + shellQuote(name))
+	}
+	if cmd != "" {
+		b.WriteString(" " + remoteShell + " -c " + shellQuote(cmd))
+	}
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// validEnvName reports whether k can be exported by a shell.
+func validEnvName(k string) bool {
+	for i, c := range k {
+		if c != '_' && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return k != ""
+}
@@ -0,0 +1,228 @@
+package webssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// 签名保存在录像旁边，文件名加上这个后缀
+const signatureSuffix = ".sig"
+
+// 默认每这么多行签一次
+const defaultSignEvery = 64
+
+// RecordingSigner signs segments of a recording. Alg names the algorithm
+// in the signature file, so a verifier for another one is rejected.
+type RecordingSigner interface {
+	Alg() string
+	Sign(msg []byte) ([]byte, error)
+}
+
+// RecordingVerifier checks signatures made by a RecordingSigner.
+type RecordingVerifier interface {
+	Alg() string
+	Verify(msg, sig []byte) error
+}
+
+// HMACKey signs and verifies with HMAC-SHA256. Whoever can verify can also
+// sign; use Ed25519 when reviewers must not be able to.
+type HMACKey []byte
+
+func (k HMACKey) Alg() string { return "hmac-sha256" }
+
+func (k HMACKey) Sign(msg []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (k HMACKey) Verify(msg, sig []byte) error {
+	want, _ := k.Sign(msg)
+	if !hmac.Equal(sig, want) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// Ed25519Signer signs with priv; the recordings are checked with
+// Ed25519Verifier and the public key.
+func Ed25519Signer(priv ed25519.PrivateKey) RecordingSigner {
+	return ed25519Key{priv: priv}
+}
+
+func Ed25519Verifier(pub ed25519.PublicKey) RecordingVerifier {
+	return ed25519Key{pub: pub}
+}
+
+type ed25519Key struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+func (k ed25519Key) Alg() string { return "ed25519" }
+
+func (k ed25519Key) Sign(msg []byte) ([]byte, error) {
+	return ed25519.Sign(k.priv, msg), nil
+}
+
+func (k ed25519Key) Verify(msg, sig []byte) error {
+	if !ed25519.Verify(k.pub, msg, sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// segmentSigner signs the head of a hash chain over the recording every
+// few lines, so each signature covers everything recorded up to it, and
+// once more when the recording is closed.
+type segmentSigner struct {
+	w      io.Writer
+	s      RecordingSigner
+	every  int
+	chain  *HashChain
+	lines  int
+	signed int
+}
+
+// Sign makes rec write a signature of what it has recorded to w every
+// every lines (64 if zero) and when it is closed. It must be called before
+// anything is recorded.
+func (rec *Recorder) Sign(w io.Writer, s RecordingSigner, every int) {
+	if every <= 0 {
+		every = defaultSignEvery
+	}
+	rec.signer = &segmentSigner{w: w, s: s, every: every, chain: NewHashChain(io.Discard)}
+}
+
+func (g *segmentSigner) add(line []byte) error {
+	g.chain.next(line)
+	g.lines++
+	if g.lines-g.signed < g.every {
+		return nil
+	}
+	return g.sign(false)
+}
+
+func (g *segmentSigner) sign(final bool) error {
+	sig, err := g.s.Sign(signedSegment(g.lines, g.chain.prev[:], final))
+	if err != nil {
+		return fmt.Errorf("sign recording err:%s", err)
+	}
+	g.signed = g.lines
+	_, err = fmt.Fprintf(g.w, "%s %d %s %t %s\n", g.s.Alg(), g.lines,
+		hex.EncodeToString(g.chain.prev[:]), final, base64.StdEncoding.EncodeToString(sig))
+	return err
+}
+
+func (g *segmentSigner) close() error {
+	err := g.sign(true)
+	if c, ok := g.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// signedSegment is what a signature covers: the number of lines, the hash
+// chain after them and whether the recording ends there.
+func signedSegment(lines int, head []byte, final bool) []byte {
+	return []byte(fmt.Sprintf("webssh-recording-v1 %d %x %t", lines, head, final))
+}
+
+// VerifySignatures checks a recording against the signatures written next
+// to it. Lines is the number of lines covered by valid signatures and
+// FirstMismatch the first one that is not. The result is only OK if every
+// line is covered and the last signature says the recording was closed
+// there, so cutting off its end is detected too.
+func VerifySignatures(recording, signatures io.Reader, v RecordingVerifier) (*VerifyResult, error) {
+	lines := bufio.NewScanner(recording)
+	lines.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	sigs := bufio.NewScanner(signatures)
+	chain := NewHashChain(io.Discard)
+
+	res := &VerifyResult{}
+	fail := func(reason string) *VerifyResult {
+		res.FirstMismatch = res.Lines + 1
+		res.Reason = reason
+		return res
+	}
+	n := 0
+	final := false
+	for sigs.Scan() {
+		if final {
+			return fail("signature after the final one"), nil
+		}
+		fields := strings.Fields(sigs.Text())
+		if len(fields) != 5 {
+			return fail("malformed signature"), nil
+		}
+		if fields[0] != v.Alg() {
+			return fail("signed with " + fields[0]), nil
+		}
+		upTo, err := strconv.Atoi(fields[1])
+		head, herr := hex.DecodeString(fields[2])
+		sig, serr := base64.StdEncoding.DecodeString(fields[4])
+		if err != nil || herr != nil || serr != nil || upTo < n {
+			return fail("malformed signature"), nil
+		}
+		for n < upTo {
+			if !lines.Scan() {
+				if err := lines.Err(); err != nil {
+					return nil, err
+				}
+				return fail("recording is shorter than signed"), nil
+			}
+			n++
+			chain.next(bytes.TrimSuffix(lines.Bytes(), []byte("\r")))
+		}
+		final = fields[3] == "true"
+		if !bytes.Equal(chain.prev[:], head) {
+			return fail("segment does not match its signature"), nil
+		}
+		if err := v.Verify(signedSegment(upTo, head, final), sig); err != nil {
+			return fail("segment has a " + err.Error()), nil
+		}
+		res.Lines = n
+	}
+	if err := sigs.Err(); err != nil {
+		return nil, err
+	}
+	if lines.Scan() {
+		return fail("lines after the last signature"), nil
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	if !final {
+		return fail("recording was not closed"), nil
+	}
+	res.OK = true
+	return res, nil
+}
+
+// VerifyStoredRecording verifies the recording name in s against its
+// signatures.
+func VerifyStoredRecording(s RecorderStorage, name string, v RecordingVerifier) (*VerifyResult, error) {
+	rec, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Close()
+	sigs, err := s.Open(name + signatureSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer sigs.Close()
+	return VerifySignatures(rec, sigs, v)
+}
@@ -0,0 +1,219 @@
+package webssh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// 这么久没有输出就发一行注释，免得代理断开空闲连接
+	sseHeartbeat = 15 * time.Second
+	// 一次POST的输入最多这么大
+	maxSSEInput = 1 << 20
+)
+
+var (
+	errNoSSEConn = errors.New("event stream not found")
+	errSSEClosed = errors.New("event stream closed")
+)
+
+// 按id找SSE连接，POST的输入交给它
+var sseConns sync.Map
+
+// sseConn is the fallback transport for networks where websockets do not
+// get through: output goes to the browser as Server-Sent Events, input
+// comes in POSTs naming the connection.
+//
+// The first event is "open" with {"conn":id}. Messages of the usual
+// protocol follow as "text" events with the message as data, or "binary"
+// events with the message in base64. The last event is "close" with
+// {"code","reason"}, the websocket close code of the session. Each POST to
+// the same URL with ?conn=id carries one message, binary unless the
+// Content-Type is text/plain; POSTs must be sent one after another to keep
+// their order.
+type sseConn struct {
+	id      string
+	rw      http.ResponseWriter
+	flusher http.Flusher
+	in      chan sseMessage
+	done    chan struct{}
+	once    sync.Once
+
+	mu sync.Mutex
+	// 最近一次写出的时间，心跳据此判断是否空闲
+	last time.Time
+}
+
+type sseMessage struct {
+	msgType int
+	p       []byte
+}
+
+// isEventStream reports whether r asks for the event stream instead of a
+// websocket, as an EventSource does.
+func isEventStream(r *http.Request) bool {
+	return r.Method == http.MethodGet && !websocket.IsWebSocketUpgrade(r) &&
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// serveEventStream runs serve over an sseConn on rw until serve returns or
+// the browser goes away.
+func serveEventStream(rw http.ResponseWriter, r *http.Request, serve func(*websocket.Conn)) error {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return errors.New("streaming not supported")
+	}
+	c := &sseConn{
+		id:      newSessionID(),
+		rw:      rw,
+		flusher: flusher,
+		in:      make(chan sseMessage),
+		done:    make(chan struct{}),
+	}
+	h := rw.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	// nginx默认会缓存响应
+	h.Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	b, _ := json.Marshal(map[string]string{"conn": c.id})
+	if err := c.event("open", b); err != nil {
+		return err
+	}
+	sseConns.Store(c.id, c)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.heartbeat(r)
+	}()
+	bridgeMessages(c, serve)
+	c.Close()
+	wg.Wait()
+	return nil
+}
+
+// heartbeat keeps the stream alive until it is closed, and closes it when
+// the browser goes away.
+func (c *sseConn) heartbeat(r *http.Request) {
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			c.Close()
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			idle := time.Since(c.last) >= sseHeartbeat
+			c.mu.Unlock()
+			if idle && c.write([]byte(":\n\n")) != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *sseConn) ReadMessage() (int, []byte, error) {
+	select {
+	case m := <-c.in:
+		return m.msgType, m.p, nil
+	case <-c.done:
+		return 0, nil, errSSEClosed
+	}
+}
+
+func (c *sseConn) WriteMessage(msgType int, p []byte) error {
+	if msgType == websocket.BinaryMessage {
+		return c.event("binary", []byte(base64.StdEncoding.EncodeToString(p)))
+	}
+	return c.event("text", p)
+}
+
+// event writes one event; every line of data goes in its own data field.
+func (c *sseConn) event(name string, data []byte) error {
+	b := make([]byte, 0, len(name)+len(data)+16)
+	b = append(append(append(b, "event: "...), name...), '\n')
+	for _, line := range strings.Split(string(data), "\n") {
+		b = append(append(append(b, "data: "...), line...), '\n')
+	}
+	return c.write(append(b, '\n'))
+}
+
+func (c *sseConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return errSSEClosed
+	default:
+	}
+	if _, err := c.rw.Write(b); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	c.last = time.Now()
+	return nil
+}
+
+// CloseWithCode tells the browser how the session ended, see MessageConn.
+func (c *sseConn) CloseWithCode(code int, reason string) error {
+	b, _ := json.Marshal(map[string]interface{}{"code": code, "reason": reason})
+	c.event("close", b)
+	return c.Close()
+}
+
+func (c *sseConn) Close() error {
+	c.once.Do(func() {
+		sseConns.Delete(c.id)
+		// 拿着mu关闭，之后不会再写rw
+		c.mu.Lock()
+		close(c.done)
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// postEventInput hands the message in the body of a POST to the sseConn
+// named by its conn parameter.
+func postEventInput(r *http.Request) (int, error) {
+	v, ok := sseConns.Load(r.URL.Query().Get("conn"))
+	if !ok {
+		return http.StatusNotFound, errNoSSEConn
+	}
+	c := v.(*sseConn)
+	p, err := io.ReadAll(io.LimitReader(r.Body, maxSSEInput+1))
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("read input err:%s", err)
+	}
+	if len(p) > maxSSEInput {
+		return http.StatusRequestEntityTooLarge, errors.New("input too large")
+	}
+	m := sseMessage{msgType: websocket.BinaryMessage, p: p}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		m.msgType = websocket.TextMessage
+	}
+	select {
+	case c.in <- m:
+		return http.StatusNoContent, nil
+	case <-c.done:
+		return http.StatusGone, errSSEClosed
+	case <-r.Context().Done():
+		return http.StatusRequestTimeout, r.Context().Err()
+	}
+}
@@ -1,10 +1,17 @@
 package webssh
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type AuthModel int8
@@ -12,8 +19,20 @@ type AuthModel int8
 const (
 	PASSWORD AuthModel = iota + 1
 	PUBLICKEY
+	KEYBOARD_INTERACTIVE
+	AGENT
+	// CERTIFICATE用KeyPath的私钥和CertPath的OpenSSH证书认证
+	CERTIFICATE
+	// GSSAPI用Kerberos票据认证(gssapi-with-mic)，需要设置GSSAPI
+	GSSAPI
 )
 
+// GSSAPIClientFunc returns a fresh GSS-API client for user logging in to
+// host, e.g. one backed by the user's Kerberos ticket cache or by a keytab
+// of the server. It is called for every connection, since a client holds
+// the state of one security context.
+type GSSAPIClientFunc func(user, host string) (ssh.GSSAPIClient, error)
+
 type SSHClientConfig struct {
 	AuthModel AuthModel
 	HostAddr  string
@@ -21,6 +40,46 @@ type SSHClientConfig struct {
 	Password  string
 	KeyPath   string
 	Timeout   time.Duration
+
+	// AuthModels不为空时按顺序依次尝试，和OpenSSH客户端一样，
+	// 此时忽略AuthModel
+	AuthModels []AuthModel
+	// Passphrase用于解密加密的私钥
+	Passphrase string
+	// CertPath是私钥对应的证书(xxx-cert.pub)，为空时取KeyPath加-cert.pub
+	CertPath string
+	// Key和Cert是私钥和证书本身，比如从CredentialProvider取到的，不为空时替代KeyPath和CertPath
+	Key  []byte
+	Cert []byte
+	// GSSAPI提供Kerberos认证的客户端，GSSAPITarget是服务端的主机名(服务主体为host/<GSSAPITarget>)，
+	// 默认取HostAddr的主机部分，Kerberos一般要求是完整域名而不是IP
+	GSSAPI       GSSAPIClientFunc
+	GSSAPITarget string
+	// KeyboardInteractive为空时用Password回答所有问题
+	KeyboardInteractive ssh.KeyboardInteractiveChallenge
+	// AgentSocket是ssh-agent的unix socket，默认取SSH_AUTH_SOCK
+	AgentSocket string
+
+	// 主机公钥校验，默认对照~/.ssh/known_hosts。HostKeyCallback优先，
+	// TrustOnFirstUse时第一次见到的主机公钥写入KnownHostsFile
+	HostKeyCallback       ssh.HostKeyCallback
+	KnownHostsFile        string
+	TrustOnFirstUse       bool
+	InsecureIgnoreHostKey bool
+
+	// 网络错误时最多重试Retries次，间隔从RetryBackoff开始每次翻倍。
+	// 认证失败不重试
+	Retries      int
+	RetryBackoff time.Duration
+	// OnRetry在每次重试之前调用，attempt从1开始
+	OnRetry func(attempt, retries int, err error)
+
+	// Jumps是依次经过的跳板机，和ssh -J一样，每一跳有自己的认证和主机公钥校验。
+	// 跳板机的Retries和Jumps不起作用
+	Jumps []*SSHClientConfig
+	// Proxy是出站代理，socks5://或http://（CONNECT），可以带user:pass@。
+	// 有跳板机时只用于连接第一跳
+	Proxy string
 }
 
 func SSHClientConfigPassword(hostAddr, user, Password string) *SSHClientConfig {
@@ -44,32 +103,232 @@ func SSHClientConfigPulicKey(hostAddr, user, keyPath string) *SSHClientConfig {
 }
 
 func NewSSHClient(conf *SSHClientConfig) (*ssh.Client, error) {
+	backoff := conf.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		c, err := dialHops(conf)
+		if err == nil {
+			return c, nil
+		}
+		if isAuthError(err) || attempt >= conf.Retries {
+			return nil, err
+		}
+		if conf.OnRetry != nil {
+			conf.OnRetry(attempt+1, conf.Retries, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// dialHops connects to conf.HostAddr through conf.Jumps. The jump hosts
+// are disconnected once the returned client is closed.
+func dialHops(conf *SSHClientConfig) (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+	for i, hop := range append(append([]*SSHClientConfig{}, conf.Jumps...), conf) {
+		if i == 0 && hop.Proxy == "" && conf.Proxy != "" {
+			first := *hop
+			first.Proxy = conf.Proxy
+			hop = &first
+		}
+		var c *ssh.Client
+		var err error
+		if len(hops) == 0 {
+			c, err = dialOne(hop, nil)
+		} else {
+			c, err = dialOne(hop, hops[len(hops)-1])
+		}
+		if err != nil {
+			closeHops()
+			if i < len(conf.Jumps) {
+				return nil, fmt.Errorf("jump host %s err:%s", hop.HostAddr, err)
+			}
+			return nil, err
+		}
+		hops = append(hops, c)
+	}
+	client := hops[len(hops)-1]
+	if len(hops) > 1 {
+		hops = hops[:len(hops)-1]
+		go func() {
+			client.Wait()
+			closeHops()
+		}()
+	}
+	return client, nil
+}
+
+// dialOne connects to the host of conf, directly or, if via is not nil,
+// through a tunnel opened by via.
+func dialOne(conf *SSHClientConfig, via *ssh.Client) (*ssh.Client, error) {
+	hostKey, err := hostKeyCallback(conf)
+	if err != nil {
+		return nil, err
+	}
 	config := &ssh.ClientConfig{
 		Timeout:         conf.Timeout,
 		User:            conf.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //忽略know_hosts检查
+		HostKeyCallback: hostKey,
 	}
-	switch conf.AuthModel {
-	case PASSWORD:
-		config.Auth = []ssh.AuthMethod{ssh.Password(conf.Password)}
-	case PUBLICKEY:
-		signer, err := getKey(conf.KeyPath)
+	models := conf.AuthModels
+	if len(models) == 0 {
+		models = []AuthModel{conf.AuthModel}
+	}
+	for _, model := range models {
+		method, closer, err := authMethod(conf, model)
 		if err != nil {
 			return nil, err
 		}
-		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+		if closer != nil {
+			defer closer.Close()
+		}
+		config.Auth = append(config.Auth, method)
+	}
+	if via == nil && conf.Proxy == "" {
+		return ssh.Dial("tcp", conf.HostAddr, config)
+	}
+	var conn net.Conn
+	if via != nil {
+		conn, err = via.Dial("tcp", conf.HostAddr)
+	} else {
+		conn, err = dialProxy(conf.Proxy, conf.HostAddr, conf.Timeout)
 	}
-	c, err := ssh.Dial("tcp", conf.HostAddr, config)
 	if err != nil {
 		return nil, err
 	}
-	return c, nil
-}
-
-func getKey(keyPath string) (ssh.Signer, error) {
-	key, err := ioutil.ReadFile(keyPath)
+	c, chans, reqs, err := ssh.NewClientConn(conn, conf.HostAddr, config)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// isAuthError reports whether err means the server rejected our
+// credentials, which retrying will not fix.
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unable to authenticate")
+}
+
+// RetryNotice formats the message shown to the user before a retry.
+func RetryNotice(attempt, retries int, err error) string {
+	return fmt.Sprintf("connecting... retry %d/%d (%s)\r\n", attempt, retries, err)
+}
+
+// authMethod returns the ssh.AuthMethod for model. The returned closer, if
+// any, must be closed once the handshake is done.
+func authMethod(conf *SSHClientConfig, model AuthModel) (ssh.AuthMethod, io.Closer, error) {
+	switch model {
+	case PASSWORD:
+		return ssh.Password(conf.Password), nil, nil
+	case PUBLICKEY:
+		signer, err := conf.signer()
+		if err != nil {
+			return nil, nil, err
+		}
+		return ssh.PublicKeys(signer), nil, nil
+	case CERTIFICATE:
+		signer, err := conf.signer()
+		if err != nil {
+			return nil, nil, err
+		}
+		cert := conf.Cert
+		if cert == nil {
+			certPath := conf.CertPath
+			if certPath == "" {
+				certPath = conf.KeyPath + "-cert.pub"
+			}
+			if cert, err = ioutil.ReadFile(certPath); err != nil {
+				return nil, nil, err
+			}
+		}
+		certSigner, err := getCertSigner(cert, signer)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ssh.PublicKeys(certSigner), nil, nil
+	case GSSAPI:
+		if conf.GSSAPI == nil {
+			return nil, nil, errors.New("gssapi auth needs a GSSAPI client")
+		}
+		target := conf.GSSAPITarget
+		if target == "" {
+			target = conf.HostAddr
+			if host, _, err := net.SplitHostPort(conf.HostAddr); err == nil {
+				target = host
+			}
+		}
+		client, err := conf.GSSAPI(conf.User, target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("gssapi err:%s", err)
+		}
+		return ssh.GSSAPIWithMICAuthMethod(client, target), nil, nil
+	case KEYBOARD_INTERACTIVE:
+		challenge := conf.KeyboardInteractive
+		if challenge == nil {
+			challenge = passwordChallenge(conf.Password)
+		}
+		return ssh.KeyboardInteractive(challenge), nil, nil
+	case AGENT:
+		sock := conf.AgentSocket
+		if sock == "" {
+			sock = os.Getenv("SSH_AUTH_SOCK")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("connect ssh agent err:%s", err)
+		}
+		return ssh.PublicKeysCallback(agent.NewClient(conn).Signers), conn, nil
+	}
+	return nil, nil, fmt.Errorf("unknown auth model %d", model)
+}
+
+// passwordChallenge answers every keyboard-interactive question with
+// password, which is what PAM password prompts expect.
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = password
+		}
+		return answers, nil
+	}
+}
+
+// signer parses Key, or the key at KeyPath.
+func (conf *SSHClientConfig) signer() (ssh.Signer, error) {
+	key := conf.Key
+	if key == nil {
+		var err error
+		if key, err = ioutil.ReadFile(conf.KeyPath); err != nil {
+			return nil, err
+		}
+	}
+	return parseKey(key, conf.Passphrase)
+}
+
+func parseKey(key []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
 	return ssh.ParsePrivateKey(key)
 }
+
+func getCertSigner(b []byte, signer ssh.Signer) (ssh.Signer, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate err:%s", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
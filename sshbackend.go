@@ -0,0 +1,198 @@
+package webssh
+
+import (
+	"io"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+type sshBackend struct {
+	sess  *ssh.Session
+	stdin io.WriteCloser
+}
+
+// StartSSH returns a StartFunc that opens a session on client, requests a
+// pty and starts command, or the login shell if command is empty.
+func StartSSH(client *ssh.Client, command string) StartFunc {
+	return StartSSHShell(client, ShellOptions{Command: command})
+}
+
+// StartSSHShell is StartSSH with environment variables, a working directory
+// and a login shell. Variables the server refuses to set (see AcceptEnv in
+// sshd_config) are exported by the command line instead.
+func StartSSHShell(client *ssh.Client, opts ShellOptions) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		sess, err := client.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		stdin, err := sess.StdinPipe()
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+		sess.Stdout = out
+		sess.Stderr = out
+
+		var exports []string
+		for _, kv := range opts.Env {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || !validEnvName(k) {
+				continue
+			}
+			if sess.Setenv(k, v) != nil {
+				exports = append(exports, kv)
+			}
+		}
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,     // disable echo
+			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+		}
+		if opts.x11 != nil {
+			// 请求失败时会话照常使用，只是没有X11
+			if err := opts.x11.request(sess); err != nil {
+				DefaultLogger().Warn("x11 request", "err", err)
+			}
+		}
+		if opts.forwardAgent {
+			if err := agent.RequestAgentForwarding(sess); err != nil {
+				DefaultLogger().Warn("agent forwarding", "err", err)
+			}
+		}
+		if err := sess.RequestPty(term, rows, cols, modes); err != nil {
+			sess.Close()
+			return nil, err
+		}
+		if command := sshCommand(opts, exports); command != "" {
+			err = sess.Start(command)
+		} else {
+			err = sess.Shell()
+		}
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+		return &sshBackend{sess: sess, stdin: stdin}, nil
+	}
+}
+
+func (b *sshBackend) Write(p []byte) (int, error) {
+	return b.stdin.Write(p)
+}
+
+func (b *sshBackend) Resize(rows, cols int) error {
+	return b.sess.WindowChange(rows, cols)
+}
+
+func (b *sshBackend) Wait() error {
+	return b.sess.Wait()
+}
+
+func (b *sshBackend) Close() error {
+	return b.sess.Close()
+}
+
+func (b *sshBackend) Signal(sig ssh.Signal) error {
+	return b.sess.Signal(sig)
+}
+
+// NewTurn starts a shell, or TurnConfig.Command, on an established ssh
+// connection. The caller keeps ownership of sshClient.
+func NewTurn(wsConn *websocket.Conn, sshClient *ssh.Client, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	return newSSHTurn(wsConn, sshClient, nil, rec, conf)
+}
+
+// NewReconnectingTurn is NewTurn for a session that survives the loss of
+// its connection: with TurnConfig.Reconnect set, redial is called for a
+// new connection and the session is started on it again.
+func NewReconnectingTurn(wsConn *websocket.Conn, sshClient *ssh.Client, redial Redial, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	return newSSHTurn(wsConn, sshClient, redial, rec, conf)
+}
+
+func newSSHTurn(wsConn *websocket.Conn, sshClient *ssh.Client, redial Redial, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	if conf == nil {
+		conf = &TurnConfig{}
+	}
+	if conf.ReconnectVia != "" && conf.SessionID == "" {
+		// tmux/screen会话用会话ID命名，重连时才找得回来
+		c := *conf
+		c.SessionID = c.NewID()
+		conf = &c
+	}
+	opts := conf.shellOptions()
+	if err := opts.persistIn(conf.ReconnectVia, conf.SessionID); err != nil {
+		return nil, err
+	}
+	var x11Chans <-chan ssh.NewChannel
+	if conf.X11 {
+		var err error
+		if opts.x11, x11Chans, err = requestX11(sshClient); err != nil {
+			conf.logger().Warn("x11", "err", err)
+		}
+	}
+	if conf.ForwardAgent != nil {
+		if err := forwardAgent(sshClient, conf); err != nil {
+			conf.logger().Warn("agent forwarding", "err", err)
+		} else {
+			opts.forwardAgent = true
+		}
+	}
+	start := StartSSHShell(sshClient, opts)
+	var reconn *reconnBackend
+	if redial != nil && conf.Reconnect > 0 {
+		reconn = newReconnBackend(sshClient, redial, opts)
+		start = reconn.start
+	}
+	turn, err := NewBackendTurn(wsConn, start, rec, conf)
+	if err != nil {
+		return nil, err
+	}
+	if reconn != nil {
+		reconn.t = turn
+		turn.reconn = reconn
+	}
+	if opts.x11 != nil {
+		opts.x11.t = turn
+		turn.x11 = opts.x11
+		go opts.x11.accept(x11Chans)
+	}
+	b, ok := turn.backend.(*sshBackend)
+	if !ok {
+		b = reconn.cur
+	}
+	turn.Session = b.sess
+	turn.StdinPipe = b.stdin
+	turn.openFiles = openSFTP(sshClient)
+	turn.fwdClient = sshClient
+	if conf.SSHKeepAlive > 0 {
+		go turn.loopSSHKeepAlive(sshClient)
+	}
+	return turn, nil
+}
+
+// NewSSHTurn dials the server described by sshConf and starts a shell on it.
+// The connection is closed together with the Turn.
+func NewSSHTurn(wsConn *websocket.Conn, sshConf *SSHClientConfig, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	client, err := NewSSHClient(sshConf)
+	if err != nil {
+		return nil, err
+	}
+	turn, err := NewReconnectingTurn(wsConn, client, func() (*ssh.Client, func(), error) {
+		c, err := NewSSHClient(sshConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c, func() { c.Close() }, nil
+	}, rec, conf)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	turn.sshClient = client
+	return turn, nil
+}
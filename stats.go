@@ -0,0 +1,124 @@
+package webssh
+
+import (
+	"sort"
+	"time"
+)
+
+// 会话的状态，见Stats.State
+const (
+	StateRunning      = "running"
+	StateSuspended    = "suspended"
+	StateDetached     = "detached"
+	StateReconnecting = "reconnecting"
+	StateExited       = "exited"
+)
+
+// Stats is a snapshot of a live session, for health dashboards and idle
+// policies of the embedding application.
+type Stats struct {
+	SessionID  string    `json:"session_id"`
+	Owner      string    `json:"owner,omitempty"`
+	StartTime  time.Time `json:"start_time"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+	LastInput  time.Time `json:"last_input"`
+	LastOutput time.Time `json:"last_output"`
+	Rows       int       `json:"rows"`
+	Cols       int       `json:"cols"`
+	// PID只有本机会话才有
+	PID   int    `json:"pid,omitempty"`
+	State string `json:"state"`
+	// Clients是加入的viewer数
+	Clients int `json:"clients"`
+	// 给owner排队等待写出的输出：帧数、队列长度和字节数，Dropped是按OverflowPolicy丢掉的帧
+	QueuedFrames int   `json:"queued_frames"`
+	QueueSize    int   `json:"queue_size"`
+	QueuedBytes  int64 `json:"queued_bytes"`
+	Dropped      int64 `json:"dropped"`
+	// 断线期间等待Reattach的输出和回滚缓冲的字节数
+	ResumeBuffered int `json:"resume_buffered"`
+	Scrollback     int `json:"scrollback"`
+	// ProtocolViolations是客户端发来的被丢弃的格式不对或类型未知的消息数
+	ProtocolViolations int64 `json:"protocol_violations"`
+	// Latency是到owner的往返时间，见TurnConfig.LatencyInterval
+	Latency *LatencyStats `json:"latency,omitempty"`
+}
+
+// Health is the state of every live session together with the totals of
+// SessionManager.Snapshot.
+type Health struct {
+	Metrics
+	Sessions []Stats `json:"sessions"`
+}
+
+// Stats returns the current state of the session.
+func (t *Turn) Stats() Stats {
+	s := Stats{
+		SessionID:  t.ID,
+		Owner:      t.Owner,
+		StartTime:  t.StartTime,
+		BytesIn:    t.bytesIn.Load(),
+		BytesOut:   t.bytesOut.Load(),
+		LastInput:  time.Unix(0, t.lastInput.Load()),
+		Rows:       int(t.rows.Load()),
+		Cols:       int(t.cols.Load()),
+		State:      t.state(),
+		QueueSize:  cap(t.out.ch),
+		Dropped:    t.out.Dropped(),
+		Scrollback: t.scrollback.Len(),
+	}
+	s.ProtocolViolations = t.violations.Load()
+	s.Latency = t.Latency()
+	if out := t.lastOutput.Load(); out > 0 {
+		s.LastOutput = time.Unix(0, out)
+	}
+	if p, ok := t.backend.(pider); ok {
+		s.PID = p.PID()
+	}
+	s.QueuedFrames = len(t.out.ch)
+	s.QueuedBytes = t.out.queued.Load()
+	t.clientsMu.RLock()
+	s.Clients = len(t.clients)
+	t.clientsMu.RUnlock()
+	t.wsMu.Lock()
+	s.ResumeBuffered = t.resumeBuf.Len()
+	t.wsMu.Unlock()
+	return s
+}
+
+func (t *Turn) state() string {
+	select {
+	case <-t.waitDone:
+		return StateExited
+	default:
+	}
+	switch {
+	case t.reconn != nil && t.reconn.conn() == nil:
+		return StateReconnecting
+	case t.Detached():
+		return StateDetached
+	case t.Suspended():
+		return StateSuspended
+	}
+	return StateRunning
+}
+
+// Health returns the Stats of every live session, oldest first.
+func (m *SessionManager) Health() Health {
+	h := Health{Metrics: m.Snapshot()}
+	m.mu.RLock()
+	turns := make([]*Turn, 0, len(m.sessions))
+	for _, t := range m.sessions {
+		turns = append(turns, t)
+	}
+	m.mu.RUnlock()
+	h.Sessions = make([]Stats, 0, len(turns))
+	for _, t := range turns {
+		h.Sessions = append(h.Sessions, t.Stats())
+	}
+	sort.Slice(h.Sessions, func(i, j int) bool {
+		return h.Sessions[i].StartTime.Before(h.Sessions[j].StartTime)
+	})
+	return h
+}
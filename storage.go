@@ -0,0 +1,152 @@
+package webssh
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RecorderStorage is where recordings are kept. Names are plain file names
+// such as host_user_20060102_150405.cast; the digest of a recording, if any,
+// is stored next to it with digestSuffix appended.
+type RecorderStorage interface {
+	Create(name string) (io.WriteCloser, error)
+	Open(name string) (io.ReadCloser, error)
+	// List returns the names of the recordings, oldest first.
+	List() ([]string, error)
+}
+
+// NewStorageRecorder creates the recording name in s, and its digest if
+// digest is set.
+func NewStorageRecorder(s RecorderStorage, name string, digest bool) (*Recorder, error) {
+	w, err := s.Create(name)
+	if err != nil {
+		return nil, &RecordingError{Path: name, Err: err}
+	}
+	rec := NewRecorder(w)
+	if digest {
+		dw, err := s.Create(name + digestSuffix)
+		if err != nil {
+			w.Close()
+			return nil, &RecordingError{Path: name + digestSuffix, Err: err}
+		}
+		rec.digest = NewHashChain(dw)
+	}
+	return rec, nil
+}
+
+// LocalStorage keeps recordings in a directory on this machine. When
+// MaxFiles is greater than 0, the oldest recordings are removed as new ones
+// are created so that at most MaxFiles are kept.
+type LocalStorage struct {
+	Dir string
+	// DirPerm是自动创建目录时使用的权限，默认0755
+	DirPerm  os.FileMode
+	MaxFiles int
+	// Events不为空时删除旧录像后发布RecordingRotated
+	Events *EventBus
+}
+
+func (s *LocalStorage) Create(name string) (io.WriteCloser, error) {
+	perm := s.DirPerm
+	if perm == 0 {
+		perm = 0o755
+	}
+	if err := os.MkdirAll(s.Dir, perm); err != nil {
+		return nil, err
+	}
+	if s.MaxFiles > 0 && strings.HasSuffix(name, ".cast") {
+		s.rotate()
+	}
+	return os.OpenFile(s.path(name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) List() ([]string, error) {
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	type named struct {
+		name string
+		mod  int64
+	}
+	var recs []named
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".cast") {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		recs = append(recs, named{f.Name(), info.ModTime().UnixNano()})
+	}
+	sort.SliceStable(recs, func(i, j int) bool { return recs[i].mod < recs[j].mod })
+	names := make([]string, len(recs))
+	for i, r := range recs {
+		names[i] = r.name
+	}
+	return names, nil
+}
+
+// rotate removes the oldest recordings, and their digests, transcripts and
+// signatures, to make room for one more.
+func (s *LocalStorage) rotate() {
+	names, err := s.List()
+	if err != nil {
+		return
+	}
+	var removed []string
+	for len(names) >= s.MaxFiles {
+		s.Remove(names[0])
+		removed = append(removed, names[0])
+		names = names[1:]
+	}
+	if len(removed) > 0 {
+		s.Events.Publish(RecordingRotatedEvent{EventHeader: EventHeader{Time: time.Now()}, Removed: removed})
+	}
+}
+
+// Stat returns the size of the recording name with the files next to it.
+func (s *LocalStorage) Stat(name string) (RecordingInfo, error) {
+	info := RecordingInfo{Name: name}
+	for i, f := range recordingFiles(name) {
+		fi, err := os.Stat(s.path(f))
+		if err != nil {
+			if i == 0 {
+				return info, err
+			}
+			continue
+		}
+		if i == 0 {
+			info.ModTime = fi.ModTime()
+		}
+		info.Size += fi.Size()
+	}
+	return info, nil
+}
+
+// Remove removes the recording name and the files next to it.
+func (s *LocalStorage) Remove(name string) error {
+	var first error
+	for i, f := range recordingFiles(name) {
+		// 旁边的文件不一定有
+		err := os.Remove(s.path(f))
+		if err != nil && (i == 0 || !os.IsNotExist(err)) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// path keeps names inside Dir.
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.Dir, filepath.Base(name))
+}
@@ -0,0 +1,45 @@
+package webssh
+
+import "errors"
+
+// ErrSuspendUnsupported is returned by Suspend when the backend cannot stop
+// its processes and confirm it, such as an ssh session: sshd ignores the
+// "signal" request for SIGSTOP and does not answer it.
+var ErrSuspendUnsupported = errors.New("suspend not supported by this backend")
+
+// Suspend stops the process group of the shell with SIGSTOP so an idle
+// session stops using CPU. Only local sessions on unix support it.
+func (t *Turn) Suspend() error {
+	s, ok := t.backend.(stopper)
+	if !ok {
+		return ErrSuspendUnsupported
+	}
+	if !t.suspended.CompareAndSwap(false, true) {
+		return nil
+	}
+	if err := s.Stop(); err != nil {
+		t.suspended.Store(false)
+		return err
+	}
+	return nil
+}
+
+// Resume continues a session stopped by Suspend.
+func (t *Turn) Resume() error {
+	s, ok := t.backend.(stopper)
+	if !ok {
+		return nil
+	}
+	if !t.suspended.CompareAndSwap(true, false) {
+		return nil
+	}
+	if err := s.Continue(); err != nil {
+		t.suspended.Store(true)
+		return err
+	}
+	return nil
+}
+
+func (t *Turn) Suspended() bool {
+	return t.suspended.Load()
+}
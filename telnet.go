@@ -0,0 +1,235 @@
+package webssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// telnet命令和选项，见RFC 854/1073/1091
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptEcho  = 1
+	telnetOptSGA   = 3
+	telnetOptTType = 24
+	telnetOptNAWS  = 31
+
+	telnetTTypeIs   = 0
+	telnetTTypeSend = 1
+)
+
+// TelnetConfig describes a telnet server, for devices that have no ssh.
+type TelnetConfig struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+type telnetBackend struct {
+	conn net.Conn
+	term string
+	mu   sync.Mutex
+	rows int
+	cols int
+	naws bool // 服务端同意了NAWS
+	done chan struct{}
+	err  error
+}
+
+// StartTelnet returns a StartFunc that connects to the telnet server of
+// tconf. The window size is reported with NAWS when the server asks for it.
+func StartTelnet(tconf *TelnetConfig) StartFunc {
+	return func(out io.Writer, term string, rows, cols int) (Backend, error) {
+		timeout := tconf.Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		conn, err := net.DialTimeout("tcp", tconf.Addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		b := &telnetBackend{conn: conn, term: term, rows: rows, cols: cols, done: make(chan struct{})}
+		if _, err := conn.Write([]byte{telnetIAC, telnetWILL, telnetOptNAWS}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		go b.loopRead(out)
+		return b, nil
+	}
+}
+
+// loopRead copies the data the server sends to out and answers the option
+// negotiation in between.
+func (b *telnetBackend) loopRead(out io.Writer) {
+	defer close(b.done)
+	p := outputBuffer(out)
+	defer putBuffer(p)
+	var (
+		buf  = *p
+		data []byte
+		cmd  []byte // 未处理完的IAC序列
+	)
+	for {
+		n, err := b.conn.Read(buf)
+		data = data[:0]
+		for _, c := range buf[:n] {
+			switch {
+			case len(cmd) == 0:
+				if c == telnetIAC {
+					cmd = append(cmd, c)
+				} else {
+					data = append(data, c)
+				}
+			case len(cmd) == 1:
+				switch c {
+				case telnetIAC:
+					data = append(data, c)
+					cmd = cmd[:0]
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT, telnetSB:
+					cmd = append(cmd, c)
+				default:
+					// NOP、GA等单字节命令
+					cmd = cmd[:0]
+				}
+			case cmd[1] == telnetSB:
+				cmd = append(cmd, c)
+				if c == telnetSE && cmd[len(cmd)-2] == telnetIAC {
+					b.subnegotiate(cmd[2 : len(cmd)-2])
+					cmd = cmd[:0]
+				} else if len(cmd) > 512 {
+					cmd = cmd[:0]
+				}
+			default:
+				b.negotiate(cmd[1], c)
+				cmd = cmd[:0]
+			}
+		}
+		if len(data) > 0 {
+			if _, werr := out.Write(data); werr != nil {
+				b.err = werr
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				b.err = err
+			}
+			return
+		}
+	}
+}
+
+func (b *telnetBackend) negotiate(verb, opt byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch verb {
+	case telnetDO:
+		switch opt {
+		case telnetOptNAWS:
+			b.naws = true
+			b.sendSizeLocked()
+		case telnetOptTType, telnetOptSGA:
+			b.conn.Write([]byte{telnetIAC, telnetWILL, opt})
+		default:
+			b.conn.Write([]byte{telnetIAC, telnetWONT, opt})
+		}
+	case telnetDONT:
+		if opt == telnetOptNAWS {
+			b.naws = false
+		}
+		b.conn.Write([]byte{telnetIAC, telnetWONT, opt})
+	case telnetWILL:
+		// 远端回显和不发GA是终端需要的，其他选项一律拒绝
+		if opt == telnetOptEcho || opt == telnetOptSGA {
+			b.conn.Write([]byte{telnetIAC, telnetDO, opt})
+		} else {
+			b.conn.Write([]byte{telnetIAC, telnetDONT, opt})
+		}
+	}
+}
+
+func (b *telnetBackend) subnegotiate(sb []byte) {
+	if len(sb) < 2 || sb[0] != telnetOptTType || sb[1] != telnetTTypeSend {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg := []byte{telnetIAC, telnetSB, telnetOptTType, telnetTTypeIs}
+	msg = append(msg, b.term...)
+	b.conn.Write(append(msg, telnetIAC, telnetSE))
+}
+
+// sendSizeLocked sends the window size with NAWS. mu must be held.
+func (b *telnetBackend) sendSizeLocked() error {
+	var size [4]byte
+	binary.BigEndian.PutUint16(size[0:], uint16(b.cols))
+	binary.BigEndian.PutUint16(size[2:], uint16(b.rows))
+	msg := []byte{telnetIAC, telnetSB, telnetOptNAWS}
+	msg = append(msg, escapeIAC(size[:])...)
+	_, err := b.conn.Write(append(msg, telnetIAC, telnetSE))
+	return err
+}
+
+// escapeIAC doubles every 0xff byte so it is not taken for a command.
+func escapeIAC(p []byte) []byte {
+	if bytes.IndexByte(p, telnetIAC) < 0 {
+		return p
+	}
+	return bytes.ReplaceAll(p, []byte{telnetIAC}, []byte{telnetIAC, telnetIAC})
+}
+
+func (b *telnetBackend) Write(p []byte) (int, error) {
+	q := escapeIAC(p)
+	// 按NVT的规定，单独的CR后面跟NUL
+	if bytes.IndexByte(q, '\r') >= 0 {
+		var buf bytes.Buffer
+		for i, c := range q {
+			buf.WriteByte(c)
+			if c == '\r' && (i+1 == len(q) || q[i+1] != '\n') {
+				buf.WriteByte(0)
+			}
+		}
+		q = buf.Bytes()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.conn.Write(q); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *telnetBackend) Resize(rows, cols int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rows, b.cols = rows, cols
+	if !b.naws {
+		return nil
+	}
+	return b.sendSizeLocked()
+}
+
+func (b *telnetBackend) Wait() error {
+	<-b.done
+	return b.err
+}
+
+func (b *telnetBackend) Close() error {
+	return b.conn.Close()
+}
+
+// NewTelnetTurn connects to the telnet server of tconf.
+func NewTelnetTurn(wsConn *websocket.Conn, tconf *TelnetConfig, rec *Recorder, conf *TurnConfig) (*Turn, error) {
+	return NewBackendTurn(wsConn, StartTelnet(tconf), rec, conf)
+}
@@ -0,0 +1,69 @@
+package webssh
+
+import (
+	"bytes"
+	"net/url"
+
+	"golang.org/x/text/transform"
+)
+
+// MsgTermState carries a termState when the window title (OSC 0 or 2) or
+// the working directory reported by the shell (OSC 7) changes. The
+// sequences still reach the terminal.
+const MsgTermState = 'o'
+
+type termState struct {
+	Title string `json:"title,omitempty"`
+	Cwd   string `json:"cwd,omitempty"`
+}
+
+func (t *Turn) titleTransformer() transform.Transformer {
+	return oscStripper{
+		codes:   []int{0, 2, 7},
+		keep:    true,
+		onMatch: t.trackTermState,
+	}
+}
+
+// trackTermState handles the body of an OSC 0, 2 or 7 sequence.
+func (t *Turn) trackTermState(body []byte) {
+	code, value, ok := bytes.Cut(body, []byte(";"))
+	if !ok {
+		return
+	}
+	var state termState
+	switch string(code) {
+	case "0", "2":
+		if string(value) == t.Title() {
+			return
+		}
+		t.title.Store(string(value))
+		state.Title = string(value)
+	case "7":
+		// file://host/path，路径是百分号编码的
+		u, err := url.Parse(string(value))
+		if err != nil || u.Path == "" || u.Path == t.Cwd() {
+			return
+		}
+		t.cwd.Store(u.Path)
+		state.Cwd = u.Path
+	default:
+		return
+	}
+	t.writeControl(MsgTermState, state)
+}
+
+// Title returns the last window title set by the application, if
+// ReportTitle is on.
+func (t *Turn) Title() string {
+	s, _ := t.title.Load().(string)
+	return s
+}
+
+// Cwd returns the working directory last reported by the shell with OSC 7,
+// if ReportTitle is on. Most shells only report it when configured to,
+// e.g. by vte.sh.
+func (t *Turn) Cwd() string {
+	s, _ := t.cwd.Load().(string)
+	return s
+}
@@ -0,0 +1,63 @@
+package webssh
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/widaT/webssh"
+
+// TraceContextFromRequest returns the trace context propagated with r, for
+// TurnConfig.TraceContext, using the global propagator.
+func TraceContextFromRequest(r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+func (t *Turn) tracer() trace.Tracer {
+	tp := t.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSessionSpan starts the span covering the whole session.
+func (t *Turn) startSessionSpan() {
+	parent := t.TraceContext
+	if parent == nil {
+		parent = context.Background()
+	}
+	// 只保留span，不继承parent的取消
+	parent = trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(parent))
+	t.traceCtx, t.span = t.tracer().Start(parent, "webssh.session",
+		trace.WithAttributes(attribute.String("webssh.session_id", t.ID)))
+}
+
+// startSpan starts a child span of the session span.
+func (t *Turn) startSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	_, span := t.tracer().Start(t.traceCtx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endSessionSpan ends the session span once, with the exit code.
+func (t *Turn) endSessionSpan(err error) {
+	t.spanOnce.Do(func() {
+		t.span.SetAttributes(attribute.Int64("webssh.exit_code", t.exitCode.Load()))
+		endSpan(t.span, err)
+	})
+}
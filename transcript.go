@@ -0,0 +1,175 @@
+package webssh
+
+import (
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// 纯文本记录保存在录像旁边，文件名加上这个后缀
+const transcriptSuffix = ".txt"
+
+// Transcriber turns terminal output into plain text for indexing and
+// full-text search: escape sequences are dropped, carriage returns and
+// backspaces are applied to the current line, and each finished line is
+// written to W. Full screen programs such as vim or top produce little that
+// is useful.
+type Transcriber struct {
+	W io.Writer
+
+	line  []rune
+	col   int
+	state int
+	// 不完整的UTF-8字符
+	partial []byte
+}
+
+const (
+	stText = iota
+	stEsc
+	stCSI
+	stOSC
+	stOSCEsc // OSC里的ESC，后面是\就结束
+	stCharset
+)
+
+func NewTranscriber(w io.Writer) *Transcriber {
+	return &Transcriber{W: w}
+}
+
+func (tr *Transcriber) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(tr.partial) > 0 {
+		p = append(tr.partial, p...)
+		tr.partial = nil
+	}
+	for len(p) > 0 {
+		r, size := utf8.DecodeRune(p)
+		if r == utf8.RuneError && !utf8.FullRune(p) {
+			tr.partial = append([]byte(nil), p...)
+			break
+		}
+		p = p[size:]
+		if err := tr.feed(r); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (tr *Transcriber) feed(r rune) error {
+	switch tr.state {
+	case stEsc:
+		switch r {
+		case '[':
+			tr.state = stCSI
+		case ']':
+			tr.state = stOSC
+		case '(', ')', '*', '+', '#', '%':
+			tr.state = stCharset
+		default:
+			tr.state = stText
+		}
+		return nil
+	case stCSI:
+		// 参数和中间字节之后的0x40-0x7e结束序列
+		if r >= 0x40 && r <= 0x7e {
+			tr.state = stText
+			if r == 'K' {
+				// 清到行尾
+				if tr.col < len(tr.line) {
+					tr.line = tr.line[:tr.col]
+				}
+			}
+		}
+		return nil
+	case stOSC:
+		switch r {
+		case 0x07:
+			tr.state = stText
+		case 0x1b:
+			tr.state = stOSCEsc
+		}
+		return nil
+	case stOSCEsc:
+		if r == '\\' {
+			tr.state = stText
+		} else {
+			tr.state = stOSC
+		}
+		return nil
+	case stCharset:
+		tr.state = stText
+		return nil
+	}
+	switch r {
+	case 0x1b:
+		tr.state = stEsc
+	case '\n':
+		return tr.flushLine()
+	case '\r':
+		tr.col = 0
+	case '\b':
+		if tr.col > 0 {
+			tr.col--
+		}
+	case '\t':
+		tr.put(r)
+	default:
+		if r >= 0x20 && r != 0x7f {
+			tr.put(r)
+		}
+	}
+	return nil
+}
+
+func (tr *Transcriber) put(r rune) {
+	if tr.col < len(tr.line) {
+		tr.line[tr.col] = r
+	} else {
+		tr.line = append(tr.line, r)
+	}
+	tr.col++
+}
+
+func (tr *Transcriber) flushLine() error {
+	line := strings.TrimRight(string(tr.line), " \t")
+	tr.line = tr.line[:0]
+	tr.col = 0
+	_, err := io.WriteString(tr.W, line+"\n")
+	return err
+}
+
+// Close writes the unfinished line, if any, and closes W if it is an
+// io.Closer.
+func (tr *Transcriber) Close() error {
+	if len(tr.line) > 0 {
+		tr.flushLine()
+	}
+	if c, ok := tr.W.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WriteTranscript writes the plain text of the output in the recording r to
+// w.
+func WriteTranscript(w io.Writer, r io.Reader) error {
+	_, events, err := ReadRecording(r)
+	if err != nil {
+		return err
+	}
+	tr := NewTranscriber(w)
+	for _, e := range events {
+		if e.Type != OutPutType {
+			continue
+		}
+		if _, err := io.WriteString(tr, e.Data); err != nil {
+			return err
+		}
+	}
+	if len(tr.line) > 0 {
+		return tr.flushLine()
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TransferDirection restricts which way files may be transferred.
+type TransferDirection int
+
+const (
+	// TransferBoth允许上传和下载
+	TransferBoth TransferDirection = iota
+	// TransferUploadOnly只允许上传，MsgFile的get和sz被拒绝
+	TransferUploadOnly
+	// TransferDownloadOnly只允许下载，MsgFile的put、mkdir、remove和rz被拒绝
+	TransferDownloadOnly
+)
+
+// TransferPolicy limits the files a session transfers through MsgFile
+// and, as far as the raw stream allows, ZMODEM and trzsz: for those only
+// the direction and the bytes per session are enforced, by cancelling the
+// transfer. A refused operation is answered with CodeTransferDenied in the
+// code of the reply and recorded as a transfer_denied audit event.
+type TransferPolicy struct {
+	Direction TransferDirection
+	// MaxFileSize大于0时单个文件不能超过这么多字节
+	MaxFileSize int64
+	// MaxUpload/MaxDownload大于0时整个会话最多上传/下载这么多字节
+	MaxUpload   int64
+	MaxDownload int64
+	// Paths不为空时MsgFile只能访问这些目录和它们下面的文件，按解析符号链接之后的路径判断
+	Paths []string
+	// Extensions不为空时只能上传和下载这些扩展名的文件，如".log"，不区分大小写
+	Extensions []string
+}
+
+// TransferDeniedError is returned for a transfer refused by the
+// TransferPolicy.
+type TransferDeniedError struct {
+	Reason string
+}
+
+func (e *TransferDeniedError) Error() string {
+	return "transfer denied: " + e.Reason
+}
+
+func transferDenied(format string, args ...interface{}) error {
+	return &TransferDeniedError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// transferCode is the error code of a reply failing with err.
+func transferCode(err error) string {
+	var denied *TransferDeniedError
+	if errors.As(err, &denied) {
+		return CodeTransferDenied
+	}
+	return ""
+}
+
+// allowDirection checks that files may go to the client (download) or
+// come from it.
+func (p *TransferPolicy) allowDirection(download bool) error {
+	switch {
+	case p == nil:
+	case download && p.Direction == TransferUploadOnly:
+		return transferDenied("downloads are not allowed")
+	case !download && p.Direction == TransferDownloadOnly:
+		return transferDenied("uploads are not allowed")
+	}
+	return nil
+}
+
+// allowPath checks name against Paths and, for a file transferred, against
+// Extensions. Both are checked on the path name resolves to on fs, so a
+// symlink inside an allowed directory cannot lead out of it.
+func (p *TransferPolicy) allowPath(fs fileSystem, name string, file bool) error {
+	if p == nil {
+		return nil
+	}
+	real, err := realPath(fs, name)
+	if err != nil {
+		return transferDenied("path %s cannot be resolved", name)
+	}
+	// sftp的路径总是用/，本机的文件在windows上也统一成/再比较
+	clean := path.Clean(filepath.ToSlash(real))
+	if len(p.Paths) > 0 {
+		ok := false
+		for _, dir := range p.Paths {
+			// 允许的目录本身也可能是符号链接
+			if r, err := fs.RealPath(dir); err == nil {
+				dir = r
+			}
+			dir = path.Clean(filepath.ToSlash(dir))
+			if clean == dir || strings.HasPrefix(clean, strings.TrimSuffix(dir, "/")+"/") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return transferDenied("path %s is not allowed", clean)
+		}
+	}
+	if file && len(p.Extensions) > 0 {
+		ext := path.Ext(clean)
+		for _, e := range p.Extensions {
+			if strings.EqualFold(e, ext) {
+				return nil
+			}
+		}
+		return transferDenied("file type %q is not allowed", ext)
+	}
+	return nil
+}
+
+// realPath resolves name on fs. A name that does not exist yet, such as
+// the target of an upload or mkdir, is resolved through its directory;
+// anything that is there but cannot be resolved, such as a dangling
+// symlink, is an error.
+func realPath(fs fileSystem, name string) (string, error) {
+	real, err := fs.RealPath(name)
+	if err == nil {
+		return real, nil
+	}
+	if _, lerr := fs.Lstat(name); lerr == nil {
+		return "", err
+	}
+	dir, base := path.Split(path.Clean(filepath.ToSlash(name)))
+	if base == "" || base == "." || base == ".." {
+		return "", err
+	}
+	if dir == "" {
+		dir = "."
+	}
+	real, err = fs.RealPath(dir)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(filepath.ToSlash(real), base), nil
+}
+
+// allowSize checks a file of size bytes against MaxFileSize.
+func (p *TransferPolicy) allowSize(size int64) error {
+	if p != nil && p.MaxFileSize > 0 && size > p.MaxFileSize {
+		return transferDenied("file larger than %d bytes", p.MaxFileSize)
+	}
+	return nil
+}
+
+// countTransfer adds n bytes to the session total of its direction and
+// fails once that is over MaxDownload or MaxUpload.
+func (t *Turn) countTransfer(download bool, n int) error {
+	p := t.TransferPolicy
+	if p == nil {
+		return nil
+	}
+	if download {
+		if total := t.downloaded.Add(int64(n)); p.MaxDownload > 0 && total > p.MaxDownload {
+			return transferDenied("session download limit of %d bytes reached", p.MaxDownload)
+		}
+		return nil
+	}
+	if total := t.uploaded.Add(int64(n)); p.MaxUpload > 0 && total > p.MaxUpload {
+		return transferDenied("session upload limit of %d bytes reached", p.MaxUpload)
+	}
+	return nil
+}
+
+// denyTransfer records a refused transfer.
+func (t *Turn) denyTransfer(err error) {
+	t.auditEvent("transfer_denied", err.Error())
+}
+
+// 拦截trzsz时发给trz/tsz的Ctrl-C，它们在raw模式下读到后退出
+var trzszCancel = []byte{0x03}
+
+// checkStreamTransfer checks a ZMODEM or trzsz transfer starting in
+// direction, seen from the client.
+func (t *Turn) checkStreamTransfer(direction string) error {
+	p := t.TransferPolicy
+	download := direction == "download"
+	if err := p.allowDirection(download); err != nil {
+		return err
+	}
+	switch {
+	case p == nil:
+	case download && p.MaxDownload > 0 && t.downloaded.Load() >= p.MaxDownload:
+		return transferDenied("session download limit of %d bytes reached", p.MaxDownload)
+	case !download && p.MaxUpload > 0 && t.uploaded.Load() >= p.MaxUpload:
+		return transferDenied("session upload limit of %d bytes reached", p.MaxUpload)
+	}
+	t.streamDownload.Store(download)
+	return nil
+}
+
+// countStream counts n bytes of a running ZMODEM or trzsz transfer going
+// in the data direction of the transfer, cancelling it past the limit.
+func (t *Turn) countStream(download bool, n int) {
+	if t.TransferPolicy == nil || t.streamDownload.Load() != download {
+		return
+	}
+	err := t.countTransfer(download, n)
+	if err == nil {
+		return
+	}
+	t.denyTransfer(err)
+	if t.zmodem.CompareAndSwap(true, false) {
+		go t.writeInput(t.ctx, zmodemCancel)
+		t.writeControl(MsgZmodem, zmodemMsg{State: "abort", Error: err.Error(), Code: CodeTransferDenied})
+	}
+	if t.trzsz.CompareAndSwap(true, false) {
+		go t.writeInput(t.ctx, trzszCancel)
+		t.writeControl(MsgTrzsz, trzszMsg{State: "abort", Error: err.Error(), Code: CodeTransferDenied})
+	}
+}
@@ -0,0 +1,257 @@
+package webssh
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+
+	"golang.org/x/text/transform"
+)
+
+// NewTransformer creates a transformer for one session. Transformers keep
+// state between chunks, e.g. half of an escape sequence, so every session
+// needs its own.
+type NewTransformer func() transform.Transformer
+
+// 未结束的OSC序列最多缓存这么多字节，超过后原样输出
+const maxOSCLen = 4096
+
+// stream runs a transformer over a byte stream that arrives in chunks.
+type stream struct {
+	mu  sync.Mutex
+	t   transform.Transformer
+	src []byte // 上次没有处理完的输入
+	dst []byte
+}
+
+// newStream chains the transformers made by fs, or returns nil if there are
+// none.
+func newStream(fs []NewTransformer) *stream {
+	if len(fs) == 0 {
+		return nil
+	}
+	ts := make([]transform.Transformer, len(fs))
+	for i, f := range fs {
+		ts[i] = f()
+	}
+	if len(ts) == 1 {
+		return &stream{t: ts[0]}
+	}
+	return &stream{t: transform.Chain(ts...)}
+}
+
+// outputTransformers returns, in order, first if not nil, the clipboard
+// bridge, title reporting and OutputTransformers.
+func (t *Turn) outputTransformers(first NewTransformer) []NewTransformer {
+	var fs []NewTransformer
+	if first != nil {
+		fs = append(fs, first)
+	}
+	if t.Clipboard {
+		fs = append(fs, t.clipboardTransformer)
+	}
+	if t.ReportTitle {
+		fs = append(fs, t.titleTransformer)
+	}
+	return append(fs, t.OutputTransformers...)
+}
+
+// transform returns what p becomes. Bytes the transformer needs more input
+// for are held back until the next call. Output is valid until the next call.
+func (s *stream) transform(p []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src := p
+	if len(s.src) > 0 {
+		src = append(s.src, p...)
+	}
+	if cap(s.dst) < len(src) {
+		s.dst = make([]byte, len(src)+len(src)/2+64)
+	}
+	dst := s.dst[:cap(s.dst)]
+	out := 0
+	for {
+		nDst, nSrc, err := s.t.Transform(dst[out:], src, false)
+		out += nDst
+		src = src[nSrc:]
+		switch err {
+		case nil:
+			s.src = s.src[:0]
+			s.dst = dst
+			return dst[:out]
+		case transform.ErrShortDst:
+			grown := make([]byte, 2*len(dst)+len(src))
+			copy(grown, dst[:out])
+			dst = grown
+			continue
+		case transform.ErrShortSrc:
+			s.src = append(s.src[:0:0], src...)
+			s.dst = dst
+			return dst[:out]
+		}
+		// 转换失败时剩下的原样通过，重新开始
+		DefaultLogger().Warn("transform", "err", err)
+		s.t.Reset()
+		s.src = s.src[:0]
+		s.dst = dst
+		return append(dst[:out], src...)
+	}
+}
+
+// StripOSC removes OSC escape sequences (ESC ] code ; ... BEL or ESC \)
+// with the given codes from the output, e.g. 52 to keep programs from
+// setting the clipboard. Without codes every OSC sequence is removed.
+func StripOSC(codes ...int) NewTransformer {
+	return func() transform.Transformer {
+		return oscStripper{codes: codes}
+	}
+}
+
+type oscStripper struct {
+	transform.NopResetter
+	codes []int
+	// maxLen为0时用maxOSCLen
+	maxLen int
+	// onMatch收到匹配的序列在ESC ]和结束符之间的内容
+	onMatch func(body []byte)
+	// keep为true时匹配的序列照常输出
+	keep bool
+}
+
+func (s oscStripper) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	// copyOut只在整段都放得下时才前进
+	copyOut := func(p []byte) bool {
+		if len(dst)-nDst < len(p) {
+			err = transform.ErrShortDst
+			return false
+		}
+		nDst += copy(dst[nDst:], p)
+		nSrc += len(p)
+		return true
+	}
+	for nSrc < len(src) {
+		rest := src[nSrc:]
+		i := bytes.Index(rest, []byte("\x1b]"))
+		if i < 0 {
+			n := len(rest)
+			// 最后一个ESC可能是OSC的开头
+			if !atEOF && rest[n-1] == 0x1b {
+				n--
+			}
+			if !copyOut(rest[:n]) {
+				return
+			}
+			if nSrc < len(src) {
+				err = transform.ErrShortSrc
+			}
+			return
+		}
+		if !copyOut(rest[:i]) {
+			return
+		}
+		seq := rest[i:]
+		end := oscEnd(seq)
+		if end < 0 {
+			if !atEOF && len(seq) < s.limit() {
+				err = transform.ErrShortSrc
+				return
+			}
+			// 不会结束的序列原样输出
+			copyOut(seq)
+			return
+		}
+		if s.strip(seq[2:end]) {
+			if s.keep && !copyOut(seq[:end]) {
+				return
+			}
+			if s.onMatch != nil {
+				s.onMatch(oscBody(seq[:end]))
+			}
+			if !s.keep {
+				nSrc += end
+			}
+		} else if !copyOut(seq[:end]) {
+			return
+		}
+	}
+	return
+}
+
+// oscEnd returns the length of the OSC sequence at the start of seq, or -1
+// if it is not terminated yet.
+func oscEnd(seq []byte) int {
+	for i := 2; i < len(seq); i++ {
+		switch seq[i] {
+		case 0x07:
+			return i + 1
+		case 0x1b:
+			if i+1 < len(seq) && seq[i+1] == '\\' {
+				return i + 2
+			}
+		}
+	}
+	return -1
+}
+
+func (s oscStripper) limit() int {
+	if s.maxLen > 0 {
+		return s.maxLen
+	}
+	return maxOSCLen
+}
+
+// oscBody returns seq without ESC ] and the terminator.
+func oscBody(seq []byte) []byte {
+	body := seq[2:]
+	if bytes.HasSuffix(body, []byte("\x1b\\")) {
+		return body[:len(body)-2]
+	}
+	return body[:len(body)-1]
+}
+
+func (s oscStripper) strip(body []byte) bool {
+	if len(s.codes) == 0 {
+		return true
+	}
+	code, _, _ := bytes.Cut(body, []byte(";"))
+	n, err := strconv.Atoi(string(bytes.TrimRight(code, "\x07\x1b\\")))
+	if err != nil {
+		return false
+	}
+	for _, c := range s.codes {
+		if c == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Banner writes text to the client before the first output of the session.
+func Banner(text string) NewTransformer {
+	return func() transform.Transformer {
+		return &banner{text: []byte(text)}
+	}
+}
+
+type banner struct {
+	text []byte
+	done bool
+}
+
+func (b *banner) Reset() { b.done = false }
+
+func (b *banner) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !b.done {
+		if len(dst) < len(b.text) {
+			return 0, 0, transform.ErrShortDst
+		}
+		nDst = copy(dst, b.text)
+		b.done = true
+	}
+	n := copy(dst[nDst:], src)
+	nDst += n
+	if n < len(src) {
+		err = transform.ErrShortDst
+	}
+	return nDst, n, err
+}
@@ -0,0 +1,94 @@
+package webssh
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// MessageConn is a message oriented connection to a browser, the transport
+// under a session. *websocket.Conn is one; other transports carry the same
+// messages, msgType being websocket.TextMessage or BinaryMessage.
+//
+// A MessageConn that also has a method CloseWithCode(code int, reason
+// string) error is told the websocket close code and reason when the
+// session ends, instead of just being closed.
+type MessageConn interface {
+	ReadMessage() (msgType int, p []byte, err error)
+	WriteMessage(msgType int, p []byte) error
+	Close() error
+}
+
+type closeCoder interface {
+	CloseWithCode(code int, reason string) error
+}
+
+// ServeMessages authorizes r and runs its session over conn until it ends,
+// as ServeConn does over a websocket, for transports such as WebTransport.
+// r is the request that opened conn, clientIP the address of the browser.
+func (w WebSSH) ServeMessages(conn MessageConn, r *http.Request, clientIP string) {
+	bridgeMessages(conn, func(ws *websocket.Conn) {
+		w.serveRequest(ws, r, clientIP)
+	})
+}
+
+// bridgeMessages runs serve on a websocket whose messages are those of
+// conn, until serve returns.
+func bridgeMessages(conn MessageConn, serve func(*websocket.Conn)) {
+	if ws, ok := conn.(*websocket.Conn); ok {
+		serve(ws)
+		return
+	}
+	// 会话只认websocket，用一对内存里的websocket接过去，和ServeMux一样
+	server, client, err := pipeConns()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// 浏览器断开时关掉内存连接，会话按断线处理
+		defer client.Close()
+		for {
+			msgType, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := client.WriteMessage(msgType, p); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		code, reason := websocket.CloseNormalClosure, ""
+		for {
+			msgType, p, err := client.ReadMessage()
+			if err != nil {
+				var ce *websocket.CloseError
+				if errors.As(err, &ce) {
+					code, reason = ce.Code, ce.Text
+				} else {
+					code = websocket.CloseAbnormalClosure
+				}
+				break
+			}
+			if err := conn.WriteMessage(msgType, p); err != nil {
+				break
+			}
+		}
+		if cc, ok := conn.(closeCoder); ok {
+			cc.CloseWithCode(code, reason)
+		} else {
+			conn.Close()
+		}
+		client.Close()
+	}()
+	serve(server)
+	server.Close()
+	wg.Wait()
+}
@@ -0,0 +1,70 @@
+package webssh
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// MsgTrzsz tells the client that trz or tsz started on the remote host,
+// with {"state":"start","direction":"download"|"upload","version"}. The
+// client runs the transfer itself, e.g. with trzsz.js, and answers
+// {"state":"end"} when it is over. Meanwhile output and input are relayed
+// untouched, like during a ZMODEM transfer, and the TransferPolicy is
+// enforced the same way.
+const MsgTrzsz = 'p'
+
+// trz/tsz启动时输出的标记，S是tsz(下载)，R是trz(上传)，D是trz -d(上传目录)
+var trzszStart = regexp.MustCompile(`::TRZSZ:TRANSFER:([SRD]):(\d+\.\d+\.\d+)`)
+
+// 标记可能被拆开，保留这么多字节的结尾
+const trzszTailSize = 64
+
+type trzszMsg struct {
+	State     string `json:"state"`
+	Direction string `json:"direction,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// detectTrzsz looks for the start of a trzsz transfer in p, including a
+// marker split across the previous output. It returns the offset in p where
+// the marker starts.
+func (t *Turn) detectTrzsz(p []byte) (int, trzszMsg, bool) {
+	buf := append(t.trzTail, p...)
+	m := trzszStart.FindSubmatchIndex(buf)
+	// 版本号后面还没有出现别的字符时可能没收完
+	if m == nil || m[1] == len(buf) {
+		start := bytes.LastIndex(buf, []byte("::TRZSZ"))
+		if start < 0 || len(buf)-start > trzszTailSize {
+			start = len(buf) - len("::TRZSZ")
+			if start < 0 {
+				start = 0
+			}
+		}
+		t.trzTail = append(t.trzTail[:0], buf[start:]...)
+		return 0, trzszMsg{}, false
+	}
+	msg := trzszMsg{State: "start", Direction: "upload", Version: string(buf[m[4]:m[5]])}
+	if buf[m[2]] == 'S' {
+		msg.Direction = "download"
+	}
+	start := m[0] - len(t.trzTail)
+	if start < 0 {
+		start = 0
+	}
+	t.trzTail = t.trzTail[:0]
+	return start, msg, true
+}
+
+func (t *Turn) handleTrzsz(msg trzszMsg) {
+	if msg.State == "end" || msg.State == "abort" {
+		t.trzsz.Store(false)
+	}
+}
+
+// transferring reports whether a ZMODEM or trzsz transfer is in progress,
+// during which the data path is left untouched.
+func (t *Turn) transferring() bool {
+	return t.zmodem.Load() || t.trzsz.Load()
+}
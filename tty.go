@@ -0,0 +1,19 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoTTYName is returned by TTYName when the session's pty has no device
+// name visible to this process, e.g. a pty allocated on a remote ssh server.
+var ErrNoTTYName = fmt.Errorf("tty name not available: %w", errors.ErrUnsupported)
+
+// TTYName returns the name of the pty device of the session, such as
+// /dev/pts/5.
+func (t *Turn) TTYName() (string, error) {
+	if t.ttyName == "" {
+		return "", ErrNoTTYName
+	}
+	return t.ttyName, nil
+}
@@ -0,0 +1,135 @@
+package webssh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolBinary is the subprotocol websockify speaks, and noVNC asks for:
+// binary messages carrying the bytes of a TCP connection as they are.
+const ProtocolBinary = "binary"
+
+const (
+	// 连接隧道目标的超时
+	tunnelDialTimeout = 10 * time.Second
+	// 从TCP连接一次最多读这么多字节发给浏览器
+	tunnelBufSize = 32 << 10
+)
+
+// tunnelAddr returns the address a passthrough profile connects to, with
+// the port asked for in the query if the profile allows it.
+func (p *Profile) tunnelAddr(port string) (string, error) {
+	if port == "" {
+		return p.RemoteAddr, nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid port %q", ErrUnauthorized, port)
+	}
+	for _, allowed := range p.PassthroughPorts {
+		if n == allowed {
+			host, _, err := net.SplitHostPort(p.RemoteAddr)
+			if err != nil {
+				host = p.RemoteAddr
+			}
+			return net.JoinHostPort(host, port), nil
+		}
+	}
+	return "", fmt.Errorf("%w: port %d not allowed for profile %s", ErrUnauthorized, n, p.Name)
+}
+
+// serveTunnel bridges wsConn to addr over TCP, for a VNC server, an RDP
+// gateway or whatever else has no shell. The tunnel is a session of its
+// own in the SessionManager, so it is listed, counted in the quotas and
+// can be killed, and it is audited like a shell.
+func (w WebSSH) serveTunnel(wsConn *websocket.Conn, addr, clientIP string) {
+	conf := &TurnConfig{
+		SessionID:   w.SessionID,
+		Owner:       w.Owner,
+		Name:        w.Name,
+		AuditLogger: w.AuditLogger,
+		Events:      w.Events,
+		Logger:      w.Logger,
+	}
+	if conf.SessionID == "" {
+		conf.SessionID = w.NewID()
+	}
+	turn := newTurn(nil, conf)
+	turn.clientIP = clientIP
+	defer turn.Close()
+	if err := w.Sessions.Admit(turn); err != nil {
+		closeWithError(wsConn, errorFor(err))
+		return
+	}
+	defer w.Sessions.Remove(turn)
+
+	var conn net.Conn
+	var err error
+	if w.Proxy != "" {
+		conn, err = dialProxy(w.Proxy, addr, tunnelDialTimeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, tunnelDialTimeout)
+	}
+	if err != nil {
+		turn.logger().Warn("tunnel dial failed", "target", addr, "err", err)
+		closeWithError(wsConn, errorFor(err))
+		return
+	}
+	defer conn.Close()
+	turn.logger().Info("tunnel opened", "event", "tunnel_open", "target", addr)
+	turn.auditEvent("tunnel_open", addr)
+	w.Events.Publish(SessionStartedEvent{
+		EventHeader: turn.header(),
+		Owner:       turn.Owner,
+		Remote:      clientIP,
+		Host:        addr,
+	})
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			conn.Close()
+			wsConn.Close()
+		})
+	}
+	// Kill或服务关闭时结束隧道
+	go func() {
+		<-turn.Done()
+		stop()
+	}()
+	go func() {
+		defer stop()
+		buf := make([]byte, tunnelBufSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				turn.bytesOut.Add(int64(n))
+				if werr := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		_, p, err := wsConn.ReadMessage()
+		if err != nil {
+			break
+		}
+		turn.bytesIn.Add(int64(len(p)))
+		if _, err := conn.Write(p); err != nil {
+			break
+		}
+	}
+	stop()
+	turn.logger().Info("tunnel closed", "event", "tunnel_close", "target", addr,
+		"bytes_in", turn.bytesIn.Load(), "bytes_out", turn.bytesOut.Load())
+	turn.auditEvent("tunnel_close", fmt.Sprintf("%s in=%d out=%d", addr, turn.bytesIn.Load(), turn.bytesOut.Load()))
+}
@@ -8,80 +8,806 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
 const (
-	MsgData   = '1'
-	MsgResize = '2'
+	MsgData   = wire.MsgData
+	MsgResize = wire.MsgResize
 )
 
+// 大段粘贴按块写入pty，块之间检查会话是否已关闭
+const inputChunkSize = 4096
+
+const (
+	defaultTerm = "xterm"
+	defaultRows = 30
+	defaultCols = 150
+	// 等待客户端第一次resize的时间，超时后按默认大小写录像header
+	initialSizeWait = time.Second
+	maxLogBuffSize  = 1024 * 1024
+	// 默认输出队列长度
+	defaultOutputQueueSize = 64
+	// 客户端给出的窗口大小的上限
+	maxTermSize = 1000
+)
+
+type TurnConfig struct {
+	// SessionID为空时由IDGenerator生成，IDGenerator也为空时使用随机ID。
+	// 不检查ID是否重复
+	SessionID   string
+	IDGenerator func() string
+	// Name是命名会话的名字，同一个Owner下唯一。命名会话可以用MsgDetach
+	// 主动断开，之后按名字接回来。Owner一般是Authorizer给出的Identity
+	Name  string
+	Owner string
+	// DetachTTL是主动断开的会话最多保留的时间，0表示直到shell退出
+	DetachTTL time.Duration
+
+	DisconnectMessages map[Reason]string
+
+	// 窗口大小上限，0表示不限制
+	MaxRows int
+	MaxCols int
+	// ResizeTransform在窗口大小被MaxRows/MaxCols限制之后再处理每次resize请求
+	ResizeTransform func(rows, cols int) (int, int)
+
+	// 所有输出和控制消息先进入队列，由单独的goroutine按顺序写到websocket。
+	// OutputQueueSize是队列长度，默认64，队列满时按OverflowPolicy处理
+	OutputQueueSize int
+	OverflowPolicy  OverflowPolicy
+	// CoalesceDelay大于0时，间隔不超过它的小块输出（比如全屏程序逐个移动光标）合并成一个
+	// websocket消息，最多CoalesceSize字节(默认32KB)，减少帧的开销和浏览器重绘；一般设几毫秒
+	CoalesceDelay time.Duration
+	CoalesceSize  int
+	// ReadBufferSize是每次从pty或ssh channel读取输出的缓冲大小，默认32KB，缓冲从池里取
+	ReadBufferSize int
+	// OverflowBlock时队列里的数据超过HighWatermark字节就暂停读取输出，
+	// 降到LowWatermark(默认HighWatermark的一半)以下再继续，0表示只按帧数限制
+	HighWatermark int
+	LowWatermark  int
+
+	// CannedEcho把用户输入原样回显，只对NewCannedTurn有效
+	CannedEcho bool
+
+	// ReportEcho开启后，推断出的回显状态变化时发送MsgEcho，
+	// 前端据此决定能否做本地回显
+	ReportEcho bool
+
+	// RecordInput开启后录像里也记录用户输入("i"事件)
+	RecordInput bool
+	// MaskSecrets开启后，密码提示之后到回车之前的输入在录像和审计日志里记成*
+	MaskSecrets bool
+	// DetectPrivilege开启后检测输入的sudo、su等命令和提示符在普通用户与root之间的切换，
+	// 以privilege事件记入审计日志并调用OnPrivilege，PrivilegeMarkers开启时同时在录像里打标记
+	DetectPrivilege  bool
+	PrivilegeMarkers bool
+	OnPrivilege      func(t *Turn, e PrivilegeEvent)
+	// DLP中的规则匹配到输出时以dlp事件记入审计日志并调用OnDLP，再按规则的Action
+	// 在录像里打码或者结束会话，见DefaultDLPRules
+	DLP   []DLPRule
+	OnDLP func(t *Turn, m DLPMatch)
+
+	// 初始窗口大小，为0时使用默认值并等待客户端resize
+	Rows int
+	Cols int
+
+	// Term默认为xterm
+	Term string
+	// Command为空时启动交互shell
+	Command string
+	// Env、Dir和LoginShell见ShellOptions，Env里的TERM优先于Term
+	Env        []string
+	Dir        string
+	LoginShell bool
+	// Shell、ConPTYResizeQuirk、KillSignal和KillGrace只用于本机会话，见ShellOptions
+	Shell             string
+	ConPTYResizeQuirk bool
+	KillSignal        ssh.Signal
+	KillGrace         time.Duration
+	// Limits限制本机会话的CPU、内存和进程数，见ResourceLimits
+	Limits *ResourceLimits
+	// Sandbox让本机会话以其他用户、在chroot或新的namespace中运行，见Sandbox
+	Sandbox *Sandbox
+	// ExitHold大于0时命令退出后连接再保持这么久，显示退出状态，用户按任意键后关闭
+	ExitHold time.Duration
+
+	// 输出限速，单位字节/秒，0表示不限速。OutputBurst默认等于OutputRate
+	OutputRate  int
+	OutputBurst int
+	// 输入限速：InputRate是每秒字节数，InputMsgRate是每秒消息数，0表示不限。
+	// 超出时默认等待(读循环暂停，连接上自然形成背压)，InputDrop为true时直接丢弃
+	InputRate     int
+	InputBurst    int
+	InputMsgRate  int
+	InputMsgBurst int
+	InputDrop     bool
+
+	// 额外连接(Attach)的输出队列，队列满时按ClientOverflowPolicy处理。
+	// 为了不拖慢owner，OverflowBlock按OverflowDropOldest处理
+	ClientQueueSize      int
+	ClientOverflowPolicy OverflowPolicy
+
+	// AuditLogger收到用户输入的每一行命令，单行超过MaxCommandLength时分段
+	AuditLogger      AuditLogger
+	MaxCommandLength int
+	// CommandPolicy拦截不允许执行的命令，见applyPolicy
+	CommandPolicy CommandPolicy
+
+	// 会话的span挂在TraceContext里的span下面，可以用TraceContextFromRequest
+	// 从websocket升级请求中取出。TracerProvider为空时用otel的全局设置
+	TraceContext   context.Context
+	TracerProvider trace.TracerProvider
+
+	// Compression允许客户端通过MsgHello协商gzip压缩输出，
+	// 小于CompressThreshold字节的帧不压缩
+	Compression       bool
+	CompressThreshold int
+	// Deflate开启后在websocket上协商permessage-deflate，浏览器自己解压，
+	// 不再提供gzip。DeflateLevel是压缩级别(1-9，0表示默认)，
+	// 小于DeflateThreshold字节的数据帧不压缩
+	Deflate          bool
+	DeflateLevel     int
+	DeflateThreshold int
+	// Base64Only时不协商CapBinary，客户端消息只接受base64编码
+	Base64Only bool
+
+	// SSHKeepAlive大于0时按这个间隔发送ssh keepalive，
+	// 连续SSHKeepAliveMax次(默认3)没有响应就结束会话
+	SSHKeepAlive    time.Duration
+	SSHKeepAliveMax int
+
+	// PingInterval大于0时按这个间隔发送websocket ping，
+	// 两个间隔内没有收到pong或消息就断开连接
+	PingInterval time.Duration
+	// IdleTimeout大于0时，这么长时间没有输入就结束会话，
+	// 结束前IdleWarning(默认1分钟)提醒用户
+	IdleTimeout time.Duration
+	IdleWarning time.Duration
+
+	// LatencyInterval大于0时按这个间隔用MsgLatency测量到owner的往返时间，见Turn.Latency；
+	// ReportLatency开启后每次测量后把结果发给客户端，往返超过SlowRTT时记一条警告日志
+	LatencyInterval time.Duration
+	ReportLatency   bool
+	SlowRTT         time.Duration
+
+	// Events不为空时会话的开始、窗口大小变化、重连和结束发布到这里，见EventBus
+	Events *EventBus
+	// Logger不为空时这个会话的日志写到这里，否则用SetLogger设置的(默认是标准库的log)
+	Logger Logger
+	// 客户端发来无法解码、格式不对或者类型未知的消息时丢弃并计数，owner累计
+	// MaxProtocolViolations次(默认10，小于0时不限)后以ReasonProtocol关闭会话，viewer第一次就断开
+	MaxProtocolViolations int
+	// MaxMessageSize是客户端消息解码后的最大字节数，0时为wire.DefaultMaxMessageSize(1MB)，小于0不限制；
+	// 更长的消息读完后丢弃，算一次违反协议。FailSafe开启后解析和处理客户端消息时的panic
+	// 也按违反协议处理，不会让整个服务崩溃
+	MaxMessageSize int
+	FailSafe       bool
+	// LockAfter大于0时这么长时间没有输入就锁屏，重新认证通过Unlock后才恢复，见MsgLock。
+	// Unlock的r只带着客户端给出的凭据，ServeConn和Handler默认用UnlockWithAuthorizer(Authorizer)；
+	// 连续LockAttempts次(默认5)失败后结束会话
+	LockAfter    time.Duration
+	Unlock       func(t *Turn, r *http.Request) error
+	LockAttempts int
+	// MaxDuration大于0时会话最长持续这么久，Deadline不为零时在这个时间结束，
+	// 两者都设置时取较早的一个。结束前DeadlineWarning(默认5分钟)提醒用户，
+	// 结束时以ReasonMaxDuration关闭并记入审计日志
+	MaxDuration     time.Duration
+	Deadline        time.Time
+	DeadlineWarning time.Duration
+
+	// HandoffTTL是MsgHandoff生成的token的有效期，默认30秒
+	HandoffTTL time.Duration
+
+	// ScrollbackSize大于0时保留最近这么多字节的输出，新加入的连接先收到这些内容
+	ScrollbackSize int
+	// JoinApproval开启后，RequestJoin要等owner同意才能加入
+	JoinApproval   bool
+	JoinScrollback JoinScrollback
+	JoinTimeout    time.Duration
+	// MaxViewers是同时在线的viewer上限，0表示不限制
+	MaxViewers int
+
+	// Context结束时会话按Shutdown的方式结束，为空时不受外部控制
+	Context context.Context
+	// ShutdownTimeout是Context结束后等待进程退出的时间，默认5秒
+	ShutdownTimeout time.Duration
+
+	// Zmodem开启后检测输出里的rz/sz，传输期间输入输出原样转发，见MsgZmodem
+	Zmodem bool
+	// Trzsz开启后检测输出里的trz/tsz，同样原样转发，见MsgTrzsz
+	Trzsz bool
+
+	// FileTransfer开启后客户端可以通过MsgFile列目录、上传和下载文件，
+	// ssh会话使用sftp子系统
+	FileTransfer bool
+	// TransferPolicy不为空时限制MsgFile、ZMODEM和trzsz传输的方向、大小和路径
+	TransferPolicy *TransferPolicy
+	// PortForward开启后owner可以通过MsgForward打开-L/-R端口转发，
+	// 只支持ssh会话
+	PortForward bool
+	// X11开启后ssh会话请求X11转发，远端的图形程序经/ws/:id/x11的websocket
+	// 转到浏览器里的X server，见ServeX11
+	X11 bool
+	// ForwardAgent不为空时把它给出的ssh-agent转发给ssh会话(ssh -A)，远端可以用里面的key
+	// 继续登录别的主机，见SocketAgent和UserKeyrings
+	ForwardAgent AgentSource
+	// Reconnect大于0时ssh连接断开(网络中断、SSHKeepAlive超时)后不结束会话，而是最多重连
+	// 这么多次，间隔从ReconnectBackoff(默认1秒)开始每次加倍，最长30秒。ReconnectVia为
+	// tmux或screen时shell运行在以会话ID命名的tmux/screen会话里，重连后接回原来的会话，
+	// 否则重连后是一个新的shell
+	Reconnect        int
+	ReconnectBackoff time.Duration
+	ReconnectVia     string
+
+	// ResumeGrace大于0时owner断线后会话保留这么长时间，期间的输出最多保留
+	// ResumeBuffer字节(默认64KB)，新连接用会话ID通过Reattach接回来
+	ResumeGrace  time.Duration
+	ResumeBuffer int
+
+	// Hooks依次包在输入、输出和resize外面，见Hook
+	Hooks []Hook
+	// InputTransformers和OutputTransformers按顺序改写输入和输出的字节流，
+	// 在Hooks之前执行，zmodem和trzsz传输期间不经过它们
+	InputTransformers  []NewTransformer
+	OutputTransformers []NewTransformer
+	// MsgPaste的内容按PasteChunkSize(默认1024字节)分块写入pty，
+	// 块之间等待PasteDelay(默认10ms)，防止大段粘贴撑满pty的输入缓冲
+	PasteChunkSize int
+	PasteDelay     time.Duration
+	// ReportTitle开启后窗口标题和shell报告的当前目录变化时发送MsgTermState
+	ReportTitle bool
+	// Clipboard开启后程序用OSC 52设置或读取的剪贴板通过MsgClipboard转给浏览器
+	Clipboard bool
+	// Charset是远端的字符集，如gbk、big5、euc-jp，输出转成UTF-8给浏览器，
+	// 输入转回这个字符集。为空时不转换
+	Charset string
+	// Watermark不为空时每隔WatermarkEvery(默认30秒)在屏幕右上角淡色显示这段文字，
+	// 防止截图外泄。它是text/template模板，数据见WatermarkData，不会写进录像
+	Watermark      string
+	WatermarkEvery time.Duration
+	// Banner不为空时在会话的输出之前显示，如登录提示和使用规定。它是text/template模板，
+	// 数据见BannerData，BannerPolicy是其中的Policy；WebSSH把BannerUser和BannerHost
+	// 设为User和RemoteAddr
+	Banner       string
+	BannerPolicy string
+	BannerUser   string
+	BannerHost   string
+	// BannerAck为true时显示Banner后暂停输出，用户按任意键确认后才继续，这个键不会发给shell
+	BannerAck bool
+	// VirtualTerminal开启后在服务端维护会话的虚拟终端，可以用CaptureText和CaptureHTML
+	// 取出屏幕内容和VTScrollback(默认1000)行滚出屏幕的内容
+	VirtualTerminal bool
+	VTScrollback    int
+	// Policies不为空时命令规则、限速、空闲超时和可以连接的主机可以在运行时替换，见PolicyStore
+	Policies *PolicyStore
+}
+
 type Turn struct {
-	StdinPipe io.WriteCloser
-	Session   *ssh.Session
+	*TurnConfig
+	ID        string
+	StartTime time.Time
 	WsConn    *websocket.Conn
 	Recorder  *Recorder
+	// ssh会话的Turn才有Session和StdinPipe
+	StdinPipe io.WriteCloser
+	Session   *ssh.Session
+
+	backend Backend
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wsMu   sync.Mutex
+	inMu   sync.Mutex
+	out    *outputQueue
+	outLim *rate.Limiter
+	inLim  *rate.Limiter
+	msgLim *rate.Limiter
+	// shared是加入的SessionManager，输出时读取全局限速
+	shared atomic.Pointer[SessionManager]
+	// identity和identLim见SessionManager.Admit
+	identity string
+	identLim atomic.Pointer[rate.Limiter]
+	// 正在丢弃超限的输入，只在开始丢弃时记一次日志
+	inDropping atomic.Bool
+
+	manager   *SessionManager
+	sshClient *ssh.Client // 池中的Turn自己持有连接
+	ttyName   string
+	pending   *bytes.Buffer
+	// 断线等待Reattach期间的输出
+	resumeBuf *ringBuffer
+	resumed   chan struct{}
+	detached  atomic.Bool // 由MsgDetach主动断开
+
+	clientsMu sync.RWMutex
+	clients   map[*client]struct{}
+	// writer是拿到写令牌的viewer，为空时只有owner可以输入
+	writer     *client
+	joins      map[string]*joinRequest
+	scrollback *ringBuffer
+	lines      *lineBuffer
+	// 给CommandPolicy用的当前输入行
+	cmdLine    *lineBuffer
+	cmdTooLong error
+
+	traceCtx context.Context
+	span     trace.Span
+	spanOnce sync.Once
+
+	filesMu   sync.Mutex
+	files     fileSystem
+	openFiles func() (fileSystem, error)
+	uploads   map[string]*upload
+	// TransferPolicy的会话累计，streamDownload是正在进行的zmodem/trzsz传输的方向
+	uploaded       atomic.Int64
+	downloaded     atomic.Int64
+	streamDownload atomic.Bool
+
+	fwdMu     sync.Mutex
+	fwdClient *ssh.Client
+	fwdSeq    int
+	forwards  map[string]*Forward
+
+	x11    *x11Forward
+	reconn *reconnBackend // 开启Reconnect的ssh会话才有
+
+	deadlineMu      sync.Mutex
+	deadlineAt      time.Time // SetDeadline设置的时间
+	deadlineSet     bool
+	deadlineOnce    sync.Once
+	deadlineChanged chan struct{}
+
+	hooksClosed sync.Once
+	inTr        *stream
+	outTr       *stream
+	encIn       *stream     // 写入pty前转成Charset
+	runes       *runeHolder // 不把一个UTF-8字符拆到两帧里
+	// transformOut就是transformOutput，存下来免得每次输出都分配一个方法值
+	transformOut func([]byte) (int, error)
+	closeReason  atomic.Value // CloseWithReason给出的Reason
+
+	cannedDone chan struct{}
+	wmMu       sync.Mutex
+	wmEscape   byte // 输出停在哪种控制序列中间，0表示不在
+	dlpMu      sync.Mutex
+	dlpTail    []byte
+	dlpStop    atomic.Bool
+	privMu     sync.Mutex
+	priv       *privilege
+	echoMu     sync.Mutex
+	echoOff    bool
+	exited     atomic.Bool
+	exitTime   atomic.Int64 // 进程退出的时间，见Reap
+	closeTime  atomic.Int64
+	waitDone   chan struct{}
+	sizeKnown  atomic.Bool
+	initRows   atomic.Int32
+	initCols   atomic.Int32
+	exitCode   atomic.Int64
+	exitSignal atomic.Value
+	anyKey     chan struct{}
+
+	// 违反协议的消息数，ownerViolations只算owner的
+	violations      atomic.Int64
+	ownerViolations atomic.Int64
+	// 见MaxMessageSize
+	parser *wire.Parser
+
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	suspended atomic.Bool
+	gzipOn    atomic.Bool
+	binaryIn  atomic.Bool
+	secret    atomic.Bool
+	flow      *flowGate
+	lastInput atomic.Int64
+	// 最后一次输出的时间和当前的终端大小，见Stats
+	lastOutput atomic.Int64
+	rows       atomic.Int32
+	cols       atomic.Int32
+	zmodem     atomic.Bool
+	zmTail     []byte
+	trzsz      atomic.Bool
+	trzTail    []byte
+	bracketed  atomic.Bool // 程序开启了bracketed paste
+	pasteTail  []byte
+	title      atomic.Value
+	cwd        atomic.Value
+
+	// 正在分块写入的粘贴和排在它后面的输入，见loopPaste；pasting是还没写完的条数
+	pasteOnce sync.Once
+	pasteQ    chan pasteItem
+	pasting   atomic.Int64
+	// 锁屏状态，upgradeReq是建立会话的请求，解锁时用它的路径和地址
+	locked         atomic.Bool
+	unlockFailures atomic.Int32
+	upgradeReq     *http.Request
+	// clientIP是浏览器的地址，记在日志里
+	clientIP   string
+	exitedOnce sync.Once
+
+	// BannerAck时还在等用户按键
+	bannerPending atomic.Bool
+	// 见VirtualTerminal
+	vterm *vterm
+	// 见LatencyInterval
+	latency *latency
+	// 录像的名字或路径，见Result.RecordingPath
+	recording string
 }
 
-func NewTurn(wsConn *websocket.Conn, sshClient *ssh.Client, rec *Recorder) (*Turn, error) {
-	sess, err := sshClient.NewSession()
-	if err != nil {
-		return nil, err
+func newTurn(wsConn *websocket.Conn, conf *TurnConfig) *Turn {
+	if conf == nil {
+		conf = &TurnConfig{}
+	}
+	turn := &Turn{
+		TurnConfig: conf,
+		ID:         conf.SessionID,
+		StartTime:  time.Now(),
+		WsConn:     wsConn,
+	}
+	if turn.ID == "" {
+		turn.ID = conf.NewID()
+	}
+	turn.ctx, turn.cancel = context.WithCancel(context.Background())
+	turn.waitDone = make(chan struct{})
+	turn.anyKey = make(chan struct{}, 1)
+	turn.resumed = make(chan struct{}, 1)
+	turn.deadlineChanged = make(chan struct{}, 1)
+	turn.exitCode.Store(-1)
+	turn.parser = conf.newParser()
+	if conf.Policies != nil {
+		turn.outLim = newReloadableLimiter(conf.OutputRate, conf.OutputBurst)
+		turn.inLim = newReloadableLimiter(conf.InputRate, conf.InputBurst)
+		turn.msgLim = newReloadableLimiter(conf.InputMsgRate, conf.InputMsgBurst)
+		conf.Policies.add(turn)
+	} else {
+		turn.outLim = newByteLimiter(conf.OutputRate, conf.OutputBurst)
+		turn.inLim = newByteLimiter(conf.InputRate, conf.InputBurst)
+		turn.msgLim = newByteLimiter(conf.InputMsgRate, conf.InputMsgBurst)
+	}
+	turn.inTr = newStream(conf.InputTransformers)
+	turn.outTr = newStream(turn.outputTransformers(nil))
+	turn.runes = &runeHolder{}
+	turn.transformOut = turn.transformOutput
+	turn.touch()
+	turn.startSessionSpan()
+	if conf.AuditLogger != nil {
+		turn.lines = newLineBuffer(conf.MaxCommandLength, func(line string, truncated bool) {
+			conf.AuditLogger.LogCommand(turn.ID, line, truncated)
+		})
+	}
+	if conf.DetectPrivilege {
+		turn.priv = turn.newPrivilege()
+	}
+	if conf.CommandPolicy != nil || conf.Policies != nil {
+		turn.cmdLine = newLineBuffer(conf.MaxCommandLength, func(string, bool) {
+			turn.cmdTooLong = errCommandTooLong
+		})
+	}
+	if conf.ScrollbackSize > 0 {
+		turn.scrollback = newRingBuffer(conf.ScrollbackSize)
+	}
+	if conf.VirtualTerminal {
+		rows, cols := turn.initialSize()
+		turn.vterm = newVterm(rows, cols, conf.VTScrollback)
+	}
+	size := conf.OutputQueueSize
+	if size <= 0 {
+		size = defaultOutputQueueSize
+	}
+	turn.out = newOutputQueue(size, conf.OverflowPolicy, turn.ctx.Done())
+	turn.out.evict = func(f frame) { turn.writeFrame(f) }
+	turn.out.onQueued = turn.queuedChanged
+	turn.flow = newFlowGate()
+	go turn.loopWrite()
+	if conf.PingInterval > 0 {
+		go turn.loopPing()
+	}
+	if conf.LatencyInterval > 0 {
+		turn.latency = newLatency()
+		go turn.loopLatency()
+	}
+	if conf.IdleTimeout > 0 || conf.Policies != nil {
+		go turn.loopIdle()
+	}
+	if conf.Watermark != "" {
+		go turn.loopWatermark()
+	}
+	if conf.LockAfter > 0 {
+		if conf.Unlock == nil {
+			turn.logger().Warn("LockAfter without Unlock, a locked screen cannot be unlocked")
+		}
+		go turn.loopLock()
+	}
+	if conf.MaxDuration > 0 || !conf.Deadline.IsZero() {
+		turn.deadlineOnce.Do(func() { go turn.loopDeadline() })
+	}
+	if conf.Context != nil {
+		context.AfterFunc(conf.Context, func() {
+			timeout := conf.ShutdownTimeout
+			if timeout <= 0 {
+				timeout = defaultShutdownTimeout
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			turn.Shutdown(ctx)
+		})
+	}
+	return turn
+}
+
+// initialSize returns the configured initial size after applying the resize
+// policy, or the default size.
+func (t *Turn) initialSize() (int, int) {
+	if rows, cols, ok := t.resizeTo(t.Rows, t.Cols); ok {
+		return rows, cols
+	}
+	return defaultRows, defaultCols
+}
+
+func (t *Turn) Write(p []byte) (n int, err error) {
+	if t.runes != nil && !t.transferring() {
+		if err := t.runes.write(p, t.transformOut); err != nil {
+			return 0, err
+		}
+		return len(p), nil
 	}
+	return t.transformOutput(p)
+}
 
-	stdinPipe, err := sess.StdinPipe()
+// transformOutput passes p through OutputTransformers and Hooks.
+func (t *Turn) transformOutput(p []byte) (n int, err error) {
+	if t.transferring() || (len(t.Hooks) == 0 && t.outTr == nil) {
+		return t.write(p)
+	}
+	q := p
+	if t.outTr != nil {
+		if q = t.outTr.transform(p); len(q) == 0 {
+			return len(p), nil
+		}
+	}
+	if len(t.Hooks) > 0 {
+		err = t.hookOutput(q, func(p []byte) error {
+			_, err := t.write(p)
+			return err
+		})
+	} else {
+		_, err = t.write(q)
+	}
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	turn := &Turn{StdinPipe: stdinPipe, Session: sess, WsConn: wsConn}
-	sess.Stdout = turn
-	sess.Stderr = turn
+func (t *Turn) write(p []byte) (n int, err error) {
+	if err := t.flow.wait(t.ctx); err != nil {
+		return 0, err
+	}
+	if t.outLim != nil {
+		if err := waitBytes(t.ctx, t.outLim, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	if l := t.identLim.Load(); l != nil {
+		if err := waitBytes(t.ctx, l, len(p)); err != nil {
+			return 0, err
+		}
+	}
+	if m := t.shared.Load(); m != nil {
+		if l := m.outLim.Load(); l != nil {
+			if err := waitBytes(t.ctx, l, len(p)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if t.transferring() {
+		t.countStream(true, len(p))
+		return len(p), t.push(p)
+	}
+	if t.Trzsz {
+		if i, msg, ok := t.detectTrzsz(p); ok {
+			if _, err := t.writeOutput(p[:i]); err != nil {
+				return 0, err
+			}
+			if err := t.checkStreamTransfer(msg.Direction); err != nil {
+				t.denyTransfer(err)
+				t.writeControl(MsgTrzsz, trzszMsg{State: "abort", Direction: msg.Direction, Error: err.Error(), Code: CodeTransferDenied})
+				return len(p), t.writeInput(t.ctx, trzszCancel)
+			}
+			t.trzsz.Store(true)
+			t.writeControl(MsgTrzsz, msg)
+			return len(p), t.push(p[i:])
+		}
+	}
+	if t.Zmodem {
+		if i, direction, ok := t.detectZmodem(p); ok {
+			if _, err := t.writeOutput(p[:i]); err != nil {
+				return 0, err
+			}
+			if err := t.checkStreamTransfer(direction); err != nil {
+				t.denyTransfer(err)
+				t.writeControl(MsgZmodem, zmodemMsg{State: "abort", Direction: direction, Error: err.Error(), Code: CodeTransferDenied})
+				return len(p), t.writeInput(t.ctx, zmodemCancel)
+			}
+			t.zmodem.Store(true)
+			t.writeControl(MsgZmodem, zmodemMsg{State: "start", Direction: direction})
+			return len(p), t.push(p[i:])
+		}
+	}
+	return t.writeOutput(p)
+}
 
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,     // disable echo
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+// writeOutput records p and sends it to all clients.
+func (t *Turn) writeOutput(p []byte) (int, error) {
+	rec, stop := t.scanDLP(p)
+	if stop {
+		return len(p), nil
 	}
-	if err := sess.RequestPty("xterm", 150, 30, modes); err != nil {
-		return nil, err
+	if t.Recorder != nil {
+		t.Recorder.Lock()
+		t.Recorder.WriteBytes(OutPutType, rec)
+		t.Recorder.Unlock()
+	}
+	t.lastOutput.Store(time.Now().UnixNano())
+	t.trackEchoOutput(p)
+	t.trackSecretOutput(p)
+	t.trackPrivilegeOutput(p)
+	t.trackPasteOutput(p)
+	if t.vterm != nil {
+		t.vterm.write(p)
 	}
-	if err := sess.Shell(); err != nil {
-		return nil, err
+	if t.Watermark != "" {
+		// 水印不能插在控制序列中间
+		t.wmMu.Lock()
+		defer t.wmMu.Unlock()
+		t.trackWatermarkOutput(p)
+	}
+	t.broadcast(p)
+	if err := t.push(p); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	if rec != nil {
-		turn.Recorder = rec
-		turn.Recorder.Lock()
-		turn.Recorder.WriteHeader(30, 150)
-		turn.Recorder.Unlock()
+// push queues p for the owner connection.
+func (t *Turn) push(p []byte) error {
+	if err := t.out.Push(p); err != nil {
+		if err == ErrSlowClient {
+			go t.CloseWithReason(ReasonSlowClient)
+		}
+		return err
 	}
+	return nil
+}
 
-	return turn, nil
+func (t *Turn) writeData(p []byte) (n int, err error) {
+	t.wsMu.Lock()
+	defer t.wsMu.Unlock()
+	if t.WsConn == nil {
+		if t.resumeBuf != nil {
+			return t.resumeBuf.Write(p)
+		}
+		return t.bufferPending(p)
+	}
+	n, err = t.writeDataLocked(p)
+	if err != nil && t.ResumeGrace > 0 && t.ctx.Err() == nil {
+		// 连接断了，后面的输出留给Reattach
+		t.detachLocked(t.WsConn)
+		return t.resumeBuf.Write(p)
+	}
+	return n, err
 }
 
-func (t *Turn) Write(p []byte) (n int, err error) {
+// writeDataLocked sends p as a data frame. wsMu must be held.
+func (t *Turn) writeDataLocked(p []byte) (n int, err error) {
+	t.enableDeflate(len(p))
 	writer, err := t.WsConn.NextWriter(websocket.BinaryMessage)
 	if err != nil {
 		return 0, err
 	}
 	defer writer.Close()
-	if t.Recorder != nil {
-		t.Recorder.Lock()
-		t.Recorder.WriteData(OutPutType, string(p))
-		t.Recorder.Unlock()
-	}
 
 	//fmt.Printf("%s", p)
-	return writer.Write(p)
+	if t.gzipOn.Load() {
+		n, err = t.writeTagged(writer, p)
+	} else {
+		n, err = writer.Write(p)
+	}
+	t.bytesOut.Add(int64(n))
+	return n, err
 }
+
+func (t *Turn) loopWrite() {
+	co := newCoalescer(t.CoalesceDelay, t.CoalesceSize)
+	// next是结束上一次合并的帧，先处理它
+	var next *frame
+	for {
+		var f frame
+		if next != nil {
+			f, next = *next, nil
+		} else {
+			select {
+			case <-t.ctx.Done():
+				return
+			case f = <-t.out.ch:
+				t.out.taken(f)
+			}
+		}
+		// 传输文件时不合并，数据原样转发
+		if !t.transferring() {
+			f, next = co.next(t.out, f)
+		}
+		err := t.writeFrame(f)
+		f.release()
+		if err != nil {
+			t.countWSError()
+			return
+		}
+	}
+}
+
+func (t *Turn) writeFrame(f frame) error {
+	if f.flushed != nil {
+		close(f.flushed)
+		return nil
+	}
+	if f.msgType == websocket.TextMessage {
+		t.wsMu.Lock()
+		defer t.wsMu.Unlock()
+		if t.WsConn == nil {
+			return nil
+		}
+		err := t.WsConn.WriteMessage(websocket.TextMessage, f.p)
+		if err != nil && t.ResumeGrace > 0 && t.ctx.Err() == nil {
+			// 断线期间的控制消息不保留
+			t.detachLocked(t.WsConn)
+			return nil
+		}
+		return err
+	}
+	_, err := t.writeData(f.p)
+	return err
+}
+
 func (t *Turn) Close() error {
-	if t.Session != nil {
-		t.Session.Close()
+	span := t.startSpan("webssh.close")
+	defer span.End()
+	defer t.endSessionSpan(nil)
+	t.closeTime.CompareAndSwap(0, time.Now().UnixNano())
+	t.cancel()
+	t.closeHooks()
+	t.publishExited()
+	t.closeClients()
+	t.closeFiles()
+	t.closeForwards()
+	if t.x11 != nil {
+		t.x11.close()
+	}
+	if t.backend != nil {
+		t.backend.Close()
+	}
+	if t.sshClient != nil {
+		t.sshClient.Close()
 	}
-	return t.WsConn.Close()
+	if conn := t.conn(); conn != nil {
+		return conn.Close()
+	}
+	return nil
 }
 
 func (t *Turn) Read(p []byte) (n int, err error) {
@@ -98,47 +824,525 @@ func (t *Turn) Read(p []byte) (n int, err error) {
 }
 
 func (t *Turn) LoopRead(logBuff *bytes.Buffer, context context.Context) error {
+	var watched *websocket.Conn
 	for {
 		select {
 		case <-context.Done():
 			return errors.New("LoopRead exit")
 		default:
-			_, wsData, err := t.WsConn.ReadMessage()
-			if err != nil {
-				return fmt.Errorf("reading webSocket message err:%s", err)
-			}
-			body := decode(wsData[1:])
-			switch wsData[0] {
-			case MsgResize:
-				var args Resize
-				err := json.Unmarshal(body, &args)
-				if err != nil {
-					return fmt.Errorf("ssh pty resize windows err:%s", err)
+			conn := t.conn()
+			if conn == nil {
+				// 写输出时发现断线了
+				if t.waitResume(context, nil) {
+					continue
 				}
-				if args.Columns > 0 && args.Rows > 0 {
-					if err := t.Session.WindowChange(args.Rows, args.Columns); err != nil {
-						return fmt.Errorf("ssh pty resize windows err:%s", err)
-					}
-				}
-			case MsgData:
-				if _, err := t.StdinPipe.Write(body); err != nil {
-					return fmt.Errorf("StdinPipe write err:%s", err)
+				return errors.New("session detached")
+			}
+			if t.PingInterval > 0 && conn != watched {
+				t.watchPong(conn)
+				watched = conn
+			}
+			msg, err := t.readMessage(conn, t.binaryIn.Load())
+			if err != nil && !wire.Malformed(err) {
+				// Rebind换了连接，继续读新连接
+				if t.ctx.Err() == nil && t.conn() != conn && t.conn() != nil {
+					continue
 				}
-				if _, err := logBuff.Write(body); err != nil {
-					return fmt.Errorf("logBuff write err:%s", err)
+				if t.waitResume(context, conn) {
+					continue
 				}
+				return fmt.Errorf("reading webSocket message err:%s", err)
+			}
+			if t.PingInterval > 0 {
+				conn.SetReadDeadline(time.Now().Add(2 * t.PingInterval))
+			}
+			if err := t.handleParsed(context, RoleOwner, msg, err, logBuff); err != nil {
+				return err
 			}
 		}
 	}
 }
 
-func (t *Turn) SessionWait() error {
-	if err := t.Session.Wait(); err != nil {
+// handleMessage handles one message from a client with the given role.
+// logBuff may be nil.
+func (t *Turn) handleMessage(ctx context.Context, role Role, msgType int, wsData []byte, logBuff *bytes.Buffer) error {
+	msg, err := t.parse(msgType, wsData)
+	return t.handleParsed(ctx, role, msg, err, logBuff)
+}
+
+// handleParsed handles a message parsed from a client with the given role,
+// err is the error of parsing it.
+func (t *Turn) handleParsed(ctx context.Context, role Role, msg wire.Message, err error, logBuff *bytes.Buffer) (rerr error) {
+	if errors.Is(err, wire.ErrEmpty) {
+		return nil
+	}
+	if err != nil {
+		// 格式不对或太长的消息丢弃，不再当作空内容处理
+		return t.protocolViolation(role, msg.Type, err)
+	}
+	if !t.throttleInput(ctx, t.msgLim, 1) {
+		return nil
+	}
+	if t.lockedDrops(msg.Type) {
+		return nil
+	}
+	if t.FailSafe {
+		defer func() {
+			if v := recover(); v != nil {
+				t.logger().Error("panic handling message", "type", string(msg.Type), "panic", v, "stack", string(debug.Stack()))
+				rerr = t.protocolViolation(role, msg.Type, fmt.Errorf("%w: %v", wire.ErrInternal, v))
+			}
+		}()
+	}
+	typ, body := msg.Type, msg.Payload
+	switch typ {
+	case MsgResize:
+		// 只有owner可以改变pty大小，viewer的请求直接忽略
+		if role != RoleOwner {
+			return nil
+		}
+		var args Resize
+		if err := json.Unmarshal(body, &args); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("resize message err:%s", err))
+		}
+		if err := t.Resize(args.Rows, args.Columns); err != nil {
+			return fmt.Errorf("ssh pty resize windows err:%s", err)
+		}
+	case MsgHello:
+		if role != RoleOwner {
+			return nil
+		}
+		var hello helloMsg
+		if err := json.Unmarshal(body, &hello); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("hello message err:%s", err))
+		}
+		return t.negotiate(hello)
+	case MsgHandoff:
+		if role != RoleOwner || t.manager == nil {
+			return nil
+		}
+		return t.writeControl(MsgHandoff, t.manager.NewHandoffToken(t, t.HandoffTTL))
+	case MsgFile:
+		if role != RoleOwner {
+			return nil
+		}
+		var req fileReq
+		if err := json.Unmarshal(body, &req); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("file message err:%s", err))
+		}
+		t.handleFile(req)
+	case MsgForward:
+		if role != RoleOwner {
+			return nil
+		}
+		var req forwardReq
+		if err := json.Unmarshal(body, &req); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("forward message err:%s", err))
+		}
+		t.handleForward(req)
+	case MsgClipboard:
+		if role != RoleOwner || !t.Clipboard {
+			return nil
+		}
+		var msg clipboardMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("clipboard message err:%s", err))
+		}
+		if err := t.answerClipboard(msg); err != nil {
+			return fmt.Errorf("pty write err:%s", err)
+		}
+	case MsgDetach:
+		if role != RoleOwner {
+			return nil
+		}
+		if err := t.Detach(); err != nil {
+			t.logger().Warn("detach", "err", err)
+		}
+	case MsgZmodem:
+		if role != RoleOwner {
+			return nil
+		}
+		var msg zmodemMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("zmodem message err:%s", err))
+		}
+		return t.handleZmodem(msg)
+	case MsgMarker:
+		if role != RoleOwner {
+			return nil
+		}
+		var msg markerMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("marker message err:%s", err))
+		}
+		t.handleMarker(msg)
+	case MsgTrzsz:
+		if role != RoleOwner {
+			return nil
+		}
+		var msg trzszMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("trzsz message err:%s", err))
+		}
+		t.handleTrzsz(msg)
+	case MsgJoinReply:
+		if role != RoleOwner {
+			return nil
+		}
+		var reply joinReply
+		if err := json.Unmarshal(body, &reply); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("join reply err:%s", err))
+		}
+		t.answerJoin(reply.ID, reply.Approve)
+	case MsgControl:
+		if role != RoleOwner {
+			return nil
+		}
+		var msg controlMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("control message err:%s", err))
+		}
+		t.handleControl(nil, msg)
+	case MsgLock:
+		if role != RoleOwner {
+			return nil
+		}
+		var req lockReq
+		if err := json.Unmarshal(body, &req); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("lock message err:%s", err))
+		}
+		t.handleLock(req)
+	case MsgSearch:
+		if role != RoleOwner {
+			return nil
+		}
+		var q SearchQuery
+		if err := json.Unmarshal(body, &q); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("search message err:%s", err))
+		}
+		t.handleSearch(q)
+	case MsgLatency:
+		if role != RoleOwner {
+			return nil
+		}
+		var msg latencyMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("latency message err:%s", err))
+		}
+		t.handleLatency(msg)
+	case MsgFlow:
+		if role != RoleOwner {
+			return nil
+		}
+		var msg flowMsg
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return t.protocolViolation(role, typ, fmt.Errorf("flow message err:%s", err))
+		}
+		if msg.Pause {
+			t.PauseOutput()
+		} else {
+			t.ResumeOutput()
+		}
+	case MsgData:
+		// viewer拿到写令牌时owner的输入被忽略
+		if role != RoleOwner || t.Writer() != "" {
+			return nil
+		}
+		return t.handleTyped(ctx, body, logBuff)
+	case MsgPaste:
+		if role != RoleOwner || t.Writer() != "" || t.bannerPending.Load() {
+			return nil
+		}
+		return t.handlePaste(ctx, body, logBuff)
+	default:
+		return t.protocolViolation(role, typ, errUnknownMessage)
+	}
+	return nil
+}
+
+// handleInput writes what the user typed to the pty.
+func (t *Turn) handleInput(ctx context.Context, body []byte, logBuff *bytes.Buffer) error {
+	if !t.throttleInput(ctx, t.inLim, len(body)) {
+		return nil
+	}
+	t.touch()
+	if t.ackBanner() {
+		return nil
+	}
+	if t.exited.Load() {
+		select {
+		case t.anyKey <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	if t.backend == nil {
+		if t.CannedEcho {
+			t.writeOutput(body)
+		}
+		return nil
+	}
+	// 挂起的会话收到输入时先恢复，避免输入堆积在pty里
+	if t.Suspended() {
+		if err := t.Resume(); err != nil {
+			return fmt.Errorf("resume session err:%s", err)
+		}
+	}
+	if t.transferring() {
+		t.countStream(false, len(body))
+		// 传输的二进制数据不做回显推断和审计
+		t.inMu.Lock()
+		_, err := t.backend.Write(body)
+		t.inMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("pty write err:%s", err)
+		}
+		return nil
+	}
+	if t.inTr != nil {
+		if body = t.inTr.transform(body); len(body) == 0 {
+			return nil
+		}
+	}
+	if len(t.Hooks) > 0 {
+		return t.hookInput(body, func(p []byte) error {
+			return t.writeUserInput(ctx, p, logBuff)
+		})
+	}
+	return t.writeUserInput(ctx, body, logBuff)
+}
+
+// writeUserInput applies CommandPolicy to body, writes it to the pty and
+// logs it.
+func (t *Turn) writeUserInput(ctx context.Context, body []byte, logBuff *bytes.Buffer) error {
+	if t.cmdLine != nil {
+		body = t.applyPolicy(body)
+	}
+	secret := t.secret.Load()
+	// 录像和审计里用的输入，密码已经被替换
+	logged := t.maskSecret(body)
+	if err := t.writeInputRec(ctx, body, logged); err != nil {
+		return fmt.Errorf("pty write err:%s", err)
+	}
+	t.trackEchoInput(body)
+	t.trackPrivilegeInput(body, secret)
+	if t.lines != nil {
+		t.lines.Write(logged)
+	}
+	body = logged
+	// logBuff只保留前maxLogBuffSize字节，防止大量粘贴占满内存
+	if logBuff != nil && logBuff.Len() < maxLogBuffSize {
+		if room := maxLogBuffSize - logBuff.Len(); len(body) > room {
+			body = body[:room]
+		}
+		if _, err := logBuff.Write(body); err != nil {
+			return fmt.Errorf("logBuff write err:%s", err)
+		}
+	}
+	return nil
+}
+
+// Resize changes the pty size, subject to MaxRows, MaxCols, ResizeTransform
+// and Hooks.
+func (t *Turn) Resize(rows, cols int) error {
+	rows, cols, ok := t.resizeTo(rows, cols)
+	if !ok || t.backend == nil {
+		return nil
+	}
+	if len(t.Hooks) > 0 {
+		return t.hookResize(rows, cols, t.resize)
+	}
+	return t.resize(rows, cols)
+}
+
+func (t *Turn) resize(rows, cols int) error {
+	span := t.startSpan("webssh.resize", attribute.Int("webssh.rows", rows), attribute.Int("webssh.cols", cols))
+	err := t.backend.Resize(rows, cols)
+	endSpan(span, err)
+	if err != nil {
 		return err
 	}
+	t.rows.Store(int32(rows))
+	t.cols.Store(int32(cols))
+	if !t.setInitialSize(rows, cols) && t.Recorder != nil {
+		t.Recorder.Lock()
+		t.Recorder.WriteResize(rows, cols)
+		t.Recorder.Unlock()
+	}
+	if t.vterm != nil {
+		t.vterm.resize(rows, cols)
+	}
+	t.Events.Publish(ResizedEvent{EventHeader: t.header(), Rows: rows, Cols: cols})
+	return nil
+}
+
+// SendInput writes p to the pty as if the user had typed it.
+func (t *Turn) SendInput(p []byte) error {
+	if t.backend == nil {
+		return nil
+	}
+	return t.writeInput(t.ctx, p)
+}
+
+// writeInput writes p to the pty in chunks, giving up between chunks once
+// ctx is done or the turn is closed. Writes from different sources are
+// serialized so one input is never interleaved with another.
+func (t *Turn) writeInput(ctx context.Context, p []byte) error {
+	return t.writeInputRec(ctx, p, p)
+}
+
+// writeInputRec is writeInput recording rec instead of p.
+func (t *Turn) writeInputRec(ctx context.Context, p, rec []byte) error {
+	t.inMu.Lock()
+	defer t.inMu.Unlock()
+	if t.RecordInput && t.Recorder != nil {
+		t.Recorder.Lock()
+		t.Recorder.WriteBytes(InputType, rec)
+		t.Recorder.Unlock()
+	}
+	if t.encIn != nil {
+		p = t.encIn.transform(p)
+	}
+	for len(p) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.ctx.Done():
+			return t.ctx.Err()
+		default:
+		}
+		n := len(p)
+		if n > inputChunkSize {
+			n = inputChunkSize
+		}
+		n, err := t.backend.Write(p[:n])
+		t.bytesIn.Add(int64(n))
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
 	return nil
 }
 
+func (t *Turn) SessionWait() error {
+	if t.backend == nil {
+		select {
+		case <-t.cannedDone:
+			t.flush(controlWait)
+		case <-t.ctx.Done():
+		}
+		return nil
+	}
+	err := t.backend.Wait()
+	close(t.waitDone)
+	t.exitTime.Store(time.Now().UnixNano())
+	if err != nil && exitCode(err) < 0 && exitSignal(err) == "" {
+		t.countPtyError()
+		t.span.RecordError(err)
+		t.span.SetStatus(codes.Error, err.Error())
+	}
+	if t.runes != nil {
+		t.runes.drain(t.transformOut)
+	}
+	t.exitCode.Store(int64(exitCode(err)))
+	if sig := exitSignal(err); sig != "" {
+		t.exitSignal.Store(sig)
+	}
+	t.writeExit()
+	if t.ExitHold > 0 {
+		t.holdAfterExit()
+	}
+	// 关闭连接之前把剩下的输出写完
+	t.flush(controlWait)
+	t.closeExited()
+	return err
+}
+
+func (t *Turn) holdAfterExit() {
+	t.exited.Store(true)
+	status := "exited"
+	if code := t.exitCode.Load(); code >= 0 {
+		status = fmt.Sprintf("exited with code %d", code)
+	}
+	t.writeOutput([]byte(fmt.Sprintf("\r\n[%s - press any key to close]\r\n", status)))
+
+	timer := time.NewTimer(t.ExitHold)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.anyKey:
+	case <-t.ctx.Done():
+	}
+}
+
+// resizeTo applies the geometry policy to a requested size. ok is false
+// when the request should be ignored.
+func (t *Turn) resizeTo(rows, cols int) (int, int, bool) {
+	if rows <= 0 || cols <= 0 {
+		return 0, 0, false
+	}
+	if rows > maxTermSize {
+		rows = maxTermSize
+	}
+	if cols > maxTermSize {
+		cols = maxTermSize
+	}
+	if t.MaxRows > 0 && rows > t.MaxRows {
+		rows = t.MaxRows
+	}
+	if t.MaxCols > 0 && cols > t.MaxCols {
+		cols = t.MaxCols
+	}
+	if t.ResizeTransform != nil {
+		rows, cols = t.ResizeTransform(rows, cols)
+	}
+	return rows, cols, rows > 0 && cols > 0
+}
+
+func (t *Turn) term() string {
+	if t.Term != "" {
+		return t.Term
+	}
+	return defaultTerm
+}
+
+// waitInitialSize falls back to the default size if the client has not sent
+// a resize shortly after connecting.
+func (t *Turn) waitInitialSize() {
+	rows, cols := t.initialSize()
+	if t.Rows > 0 && t.Cols > 0 {
+		// 连接时已经给出大小，不用再等
+		t.setInitialSize(rows, cols)
+		return
+	}
+	time.AfterFunc(initialSizeWait, func() {
+		t.setInitialSize(rows, cols)
+	})
+}
+
+// setInitialSize records the geometry the session effectively started with
+// and writes the recording header. It returns false if that already
+// happened.
+func (t *Turn) setInitialSize(rows, cols int) bool {
+	if !t.sizeKnown.CompareAndSwap(false, true) {
+		return false
+	}
+	t.initRows.Store(int32(rows))
+	t.initCols.Store(int32(cols))
+	t.rows.CompareAndSwap(0, int32(rows))
+	t.cols.CompareAndSwap(0, int32(cols))
+	t.logger().Debug("start terminal", "term", t.term(), "cols", cols, "rows", rows)
+	if t.Recorder != nil {
+		t.Recorder.Lock()
+		t.Recorder.Term = t.term()
+		t.Recorder.Command = t.Command
+		t.Recorder.WriteHeader(rows, cols)
+		t.Recorder.Unlock()
+	}
+	return true
+}
+
 func decode(p []byte) []byte {
 	decodeString, _ := base64.StdEncoding.DecodeString(string(p))
 	return decodeString
@@ -149,7 +1353,4 @@ func encode(p []byte) []byte {
 	return []byte(encodeToString)
 }
 
-type Resize struct {
-	Columns int
-	Rows    int
-}
+type Resize = wire.Resize
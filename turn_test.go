@@ -0,0 +1,72 @@
+package webssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingBackend blocks every Write until release is closed, telling
+// started about each one.
+type blockingBackend struct {
+	started chan struct{}
+	release chan struct{}
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (b *blockingBackend) Write(p []byte) (int, error) {
+	b.started <- struct{}{}
+	<-b.release
+	b.mu.Lock()
+	b.written = append(b.written, append([]byte(nil), p...))
+	b.mu.Unlock()
+	return len(p), nil
+}
+
+func (b *blockingBackend) Resize(rows, cols int) error { return nil }
+func (b *blockingBackend) Wait() error                 { return nil }
+func (b *blockingBackend) Close() error                { return nil }
+
+func TestWriteInputCancelMidway(t *testing.T) {
+	turn := newTurn(nil, &TurnConfig{})
+	defer turn.cancel()
+	b := &blockingBackend{started: make(chan struct{}, 16), release: make(chan struct{})}
+	turn.backend = b
+
+	input := bytes.Repeat([]byte("x"), 10*inputChunkSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- turn.writeInput(ctx, input)
+	}()
+
+	select {
+	case <-b.started:
+	case <-time.After(time.Second):
+		t.Fatal("first chunk was not written")
+	}
+	// 第一块还卡在pty里时取消
+	cancel()
+	close(b.release)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writeInput did not return after cancel")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.written) != 1 || len(b.written[0]) != inputChunkSize {
+		t.Fatalf("wrote %d chunks, want only the one in flight", len(b.written))
+	}
+	if n := turn.bytesIn.Load(); n != inputChunkSize {
+		t.Fatalf("bytesIn %d, want %d", n, inputChunkSize)
+	}
+}
@@ -0,0 +1,67 @@
+package webssh
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	utmpUserProcess = 7
+	utmpDeadProcess = 8
+)
+
+type utmpEntry struct {
+	Type int16
+	Pid  int32
+	Line string
+	ID   string
+	User string
+	Host string
+	Time time.Time
+}
+
+// utmpLine returns the line a session is accounted under: its tty without
+// the /dev/ prefix, or web/<session id> when the pty is remote.
+func (t *Turn) utmpLine() string {
+	if name, err := t.TTYName(); err == nil {
+		return strings.TrimPrefix(name, "/dev/")
+	}
+	id := t.ID
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return "web/" + id
+}
+
+func utmpID(line string) string {
+	if len(line) > 4 {
+		return line[len(line)-4:]
+	}
+	return line
+}
+
+// UtmpLogin writes a login record for the session to utmp and wtmp so it
+// shows up in who(1) and last(1).
+func (t *Turn) UtmpLogin(user, host string) error {
+	line := t.utmpLine()
+	return writeUtmp(utmpEntry{
+		Type: utmpUserProcess,
+		Line: line,
+		ID:   utmpID(line),
+		User: user,
+		Host: host,
+		Time: time.Now(),
+	})
+}
+
+// UtmpLogout marks the session's utmp record as ended and appends a logout
+// record to wtmp.
+func (t *Turn) UtmpLogout() error {
+	line := t.utmpLine()
+	return writeUtmp(utmpEntry{
+		Type: utmpDeadProcess,
+		Line: line,
+		ID:   utmpID(line),
+		Time: time.Now(),
+	})
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package webssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	utmpFile = "/var/run/utmp"
+	wtmpFile = "/var/log/wtmp"
+)
+
+// glibc的struct utmp，64位平台上为384字节
+type utmpRecord struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Sec     int32
+	Usec    int32
+	Addr    [4]int32
+	_       [20]byte
+}
+
+func newUtmpRecord(e utmpEntry) *utmpRecord {
+	r := &utmpRecord{
+		Type: e.Type,
+		Pid:  e.Pid,
+		Sec:  int32(e.Time.Unix()),
+		Usec: int32(e.Time.Nanosecond() / 1000),
+	}
+	copy(r.Line[:], e.Line)
+	copy(r.ID[:], e.ID)
+	copy(r.User[:], e.User)
+	copy(r.Host[:], e.Host)
+	return r
+}
+
+func writeUtmp(e utmpEntry) error {
+	r := newUtmpRecord(e)
+	if err := updateUtmp(r); err != nil {
+		return err
+	}
+	return appendWtmp(r)
+}
+
+// updateUtmp overwrites the record with the same id, or appends one.
+func updateUtmp(r *utmpRecord) error {
+	f, err := os.OpenFile(utmpFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	size := int64(binary.Size(r))
+	var offset int64
+	for ; ; offset += size {
+		var cur utmpRecord
+		if err := binary.Read(f, binary.LittleEndian, &cur); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		if cur.ID == r.ID && (cur.Type == utmpUserProcess || cur.Type == utmpDeadProcess) {
+			break
+		}
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, r)
+	_, err = f.WriteAt(buf.Bytes(), offset)
+	return err
+}
+
+func appendWtmp(r *utmpRecord) error {
+	f, err := os.OpenFile(wtmpFile, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, r)
+	_, err = f.Write(buf.Bytes())
+	return err
+}
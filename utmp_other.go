@@ -0,0 +1,11 @@
+//go:build !linux
+
+package webssh
+
+import (
+	"errors"
+)
+
+func writeUtmp(e utmpEntry) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,31 @@
+package webssh
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 默认owner违反协议这么多次后关闭会话
+const defaultMaxProtocolViolations = 10
+
+var errUnknownMessage = errors.New("unknown message type")
+
+// protocolViolation records a message from a client of role that could not
+// be decoded, did not parse or has an unknown type. The message is dropped.
+// A viewer is disconnected right away by the error returned; the session is
+// closed with ReasonProtocol once the owner reaches MaxProtocolViolations.
+func (t *Turn) protocolViolation(role Role, typ byte, err error) error {
+	t.violations.Add(1)
+	t.logger().Warn("drop malformed message", "event", "protocol_violation", "role", role, "type", string(typ), "err", err)
+	if role != RoleOwner {
+		return fmt.Errorf("protocol violation: %s", err)
+	}
+	limit := t.MaxProtocolViolations
+	if limit == 0 {
+		limit = defaultMaxProtocolViolations
+	}
+	if limit > 0 && t.ownerViolations.Add(1) == int64(limit) {
+		go t.CloseWithReason(ReasonProtocol)
+	}
+	return nil
+}
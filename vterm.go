@@ -0,0 +1,241 @@
+package webssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+
+	"github.com/hinshun/vt10x"
+)
+
+// 虚拟终端默认保留这么多行滚出屏幕的内容
+const defaultVTScrollback = 1000
+
+// ErrNoVirtualTerminal is returned by the capture methods of a session
+// without TurnConfig.VirtualTerminal.
+var ErrNoVirtualTerminal = errors.New("session has no virtual terminal")
+
+// 和vt10x的Glyph.Mode一致
+const (
+	vtReverse = 1 << iota
+	vtUnderline
+	vtBold
+)
+
+// vterm is the server side copy of the terminal of a session, so its
+// contents can be captured without the browser. Lines scrolled off the top
+// of the main screen by a newline are kept as scrollback; the alternate
+// screen of full screen programs has none.
+type vterm struct {
+	mu      sync.Mutex
+	vt      vt10x.Terminal
+	history [][]vt10x.Glyph
+	max     int
+	// 上次写入时被截断的半个UTF-8字符
+	tail []byte
+}
+
+func newVterm(rows, cols, scrollback int) *vterm {
+	if scrollback <= 0 {
+		scrollback = defaultVTScrollback
+	}
+	return &vterm{vt: vt10x.New(vt10x.WithSize(cols, rows)), max: scrollback}
+}
+
+func (v *vterm) write(p []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	p = append(v.tail, p...)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			break
+		}
+		v.vt.Write(p[:i])
+		// 光标在最后一行时换行会把第一行滚出屏幕
+		_, rows := v.vt.Size()
+		if v.vt.Mode()&vt10x.ModeAltScreen == 0 && v.vt.Cursor().Y == rows-1 {
+			v.keep(v.row(0))
+		}
+		v.vt.Write(p[i : i+1])
+		p = p[i+1:]
+	}
+	n, _ := v.vt.Write(p)
+	v.tail = append(v.tail[:0], p[n:]...)
+}
+
+// keep adds a line to the scrollback.
+func (v *vterm) keep(line []vt10x.Glyph) {
+	v.history = append(v.history, line)
+	if len(v.history) >= 2*v.max {
+		v.history = append([][]vt10x.Glyph(nil), v.history[len(v.history)-v.max:]...)
+	}
+}
+
+// row returns line y of the screen without the blanks at its end.
+func (v *vterm) row(y int) []vt10x.Glyph {
+	cols, _ := v.vt.Size()
+	n := cols
+	for n > 0 {
+		if c := v.vt.Cell(n-1, y).Char; c != ' ' && c != 0 {
+			break
+		}
+		n--
+	}
+	line := make([]vt10x.Glyph, n)
+	for x := range line {
+		line[x] = v.vt.Cell(x, y)
+	}
+	return line
+}
+
+func (v *vterm) resize(rows, cols int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.vt.Resize(cols, rows)
+}
+
+// lines returns the scrollback, if asked for, and the lines of the screen.
+func (v *vterm) lines(scrollback bool) [][]vt10x.Glyph {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var lines [][]vt10x.Glyph
+	if scrollback {
+		h := v.history
+		if len(h) > v.max {
+			h = h[len(h)-v.max:]
+		}
+		lines = append(lines, h...)
+	}
+	_, rows := v.vt.Size()
+	for y := 0; y < rows; y++ {
+		lines = append(lines, v.row(y))
+	}
+	return lines
+}
+
+// CaptureText returns the screen of the session as plain text, after the
+// scrollback if scrollback is set. Blank lines at the end are dropped.
+func (t *Turn) CaptureText(scrollback bool) (string, error) {
+	if t.vterm == nil {
+		return "", ErrNoVirtualTerminal
+	}
+	lines := trimBlankLines(t.vterm.lines(scrollback))
+	var b strings.Builder
+	for _, line := range lines {
+		for _, g := range line {
+			b.WriteRune(glyphChar(g))
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// CaptureHTML is CaptureText as a <pre> element with the colors, bold and
+// underline of the terminal.
+func (t *Turn) CaptureHTML(scrollback bool) (string, error) {
+	if t.vterm == nil {
+		return "", ErrNoVirtualTerminal
+	}
+	lines := trimBlankLines(t.vterm.lines(scrollback))
+	var b strings.Builder
+	b.WriteString(`<pre class="webssh-capture" style="color:#e5e5e5;background:#000">`)
+	for _, line := range lines {
+		style := ""
+		for _, g := range line {
+			if s := glyphStyle(g); s != style {
+				if style != "" {
+					b.WriteString("</span>")
+				}
+				if s != "" {
+					b.WriteString(`<span style="` + s + `">`)
+				}
+				style = s
+			}
+			b.WriteString(html.EscapeString(string(glyphChar(g))))
+		}
+		if style != "" {
+			b.WriteString("</span>")
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString("</pre>")
+	return b.String(), nil
+}
+
+func trimBlankLines(lines [][]vt10x.Glyph) [][]vt10x.Glyph {
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func glyphChar(g vt10x.Glyph) rune {
+	if g.Char == 0 {
+		return ' '
+	}
+	return g.Char
+}
+
+// glyphStyle returns the CSS of a cell, empty for the default attributes.
+func glyphStyle(g vt10x.Glyph) string {
+	fg, bg := g.FG, g.BG
+	if g.Mode&vtBold != 0 && fg < 8 {
+		fg += 8
+	}
+	if g.Mode&vtReverse != 0 {
+		fg, bg = bg, fg
+		// 反显默认颜色
+		if fg == vt10x.DefaultBG {
+			fg = 0
+		}
+		if bg == vt10x.DefaultFG {
+			bg = 7
+		}
+	}
+	var s []string
+	if c, ok := cssColor(fg); ok {
+		s = append(s, "color:"+c)
+	}
+	if c, ok := cssColor(bg); ok {
+		s = append(s, "background:"+c)
+	}
+	if g.Mode&vtBold != 0 {
+		s = append(s, "font-weight:bold")
+	}
+	if g.Mode&vtUnderline != 0 {
+		s = append(s, "text-decoration:underline")
+	}
+	return strings.Join(s, ";")
+}
+
+// xterm的前16色
+var ansiColors = [16]uint32{
+	0x000000, 0xcd0000, 0x00cd00, 0xcdcd00, 0x0000ee, 0xcd00cd, 0x00cdcd, 0xe5e5e5,
+	0x7f7f7f, 0xff0000, 0x00ff00, 0xffff00, 0x5c5cff, 0xff00ff, 0x00ffff, 0xffffff,
+}
+
+// cssColor returns an xterm 256 or 24 bit color as #rrggbb, false for the
+// default color.
+func cssColor(c vt10x.Color) (string, bool) {
+	var rgb uint32
+	switch {
+	case c >= vt10x.DefaultFG:
+		return "", false
+	case c < 16:
+		rgb = ansiColors[c]
+	case c < 232:
+		levels := [6]uint32{0, 95, 135, 175, 215, 255}
+		i := uint32(c) - 16
+		rgb = levels[i/36]<<16 | levels[i/6%6]<<8 | levels[i%6]
+	case c < 256:
+		v := 8 + (uint32(c)-232)*10
+		rgb = v<<16 | v<<8 | v
+	default:
+		rgb = uint32(c) & 0xffffff
+	}
+	return fmt.Sprintf("#%06x", rgb), true
+}
@@ -0,0 +1,108 @@
+package webssh
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// 默认每隔这么久画一次水印
+const defaultWatermarkEvery = 30 * time.Second
+
+// WatermarkData is passed to the Watermark template.
+type WatermarkData struct {
+	SessionID string
+	Owner     string
+	Time      string
+}
+
+// loopWatermark draws the watermark every WatermarkEvery.
+func (t *Turn) loopWatermark() {
+	tmpl, err := template.New("watermark").Parse(t.Watermark)
+	if err != nil {
+		t.logger().Error("watermark template", "err", err)
+		return
+	}
+	every := t.WatermarkEvery
+	if every <= 0 {
+		every = defaultWatermarkEvery
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var buf bytes.Buffer
+		err := tmpl.Execute(&buf, WatermarkData{
+			SessionID: t.ID,
+			Owner:     t.Owner,
+			Time:      time.Now().Format("2006-01-02 15:04:05"),
+		})
+		if err != nil {
+			continue
+		}
+		t.drawWatermark(buf.String())
+	}
+}
+
+// drawWatermark writes text dimmed in the top right corner of the screen.
+// DECSC/DECRC save and restore the cursor and its attributes around it, so
+// the application does not notice. It is only sent to the clients, not
+// recorded, and skipped while the output is in the middle of an escape
+// sequence or a file transfer.
+func (t *Turn) drawWatermark(text string) {
+	cols := int(t.cols.Load())
+	if cols <= 0 || text == "" {
+		return
+	}
+	runes := []rune(text)
+	if len(runes) > cols {
+		runes = runes[:cols]
+	}
+	text = string(runes)
+	col := cols - utf8.RuneCountInString(text) + 1
+	t.wmMu.Lock()
+	defer t.wmMu.Unlock()
+	if t.wmEscape != 0 || t.transferring() {
+		return
+	}
+	p := []byte(fmt.Sprintf("\x1b7\x1b[1;%dH\x1b[0;2m%s\x1b8", col, text))
+	t.broadcast(p)
+	t.push(p)
+}
+
+// trackWatermarkOutput notes whether p ends inside an escape sequence, where
+// the watermark must not be inserted. The caller holds wmMu.
+func (t *Turn) trackWatermarkOutput(p []byte) {
+	if i := bytes.LastIndexByte(p, 0x1b); i >= 0 {
+		t.wmEscape, p = 0x1b, p[i+1:]
+	}
+	if t.wmEscape == 0x1b && len(p) > 0 {
+		switch p[0] {
+		case '[', ']':
+			t.wmEscape, p = p[0], p[1:]
+		default:
+			t.wmEscape = 0
+		}
+	}
+	switch t.wmEscape {
+	case '[':
+		if bytes.IndexFunc(p, isEscapeFinal) >= 0 {
+			t.wmEscape = 0
+		}
+	case ']':
+		// OSC以BEL或者ST(ESC \)结束，ST的ESC已经在上面处理了
+		if bytes.IndexByte(p, 0x07) >= 0 {
+			t.wmEscape = 0
+		}
+	}
+}
+
+func isEscapeFinal(r rune) bool {
+	return r >= 0x40 && r <= 0x7e
+}
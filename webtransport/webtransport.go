@@ -0,0 +1,134 @@
+// Package webtransport serves webssh sessions over WebTransport (HTTP/3),
+// next to the websocket of ServeConn. QUIC has no head of line blocking
+// between streams and survives a change of network, which is felt on lossy
+// mobile connections.
+//
+// The browser opens a WebTransport session on the path of Handler and one
+// bidirectional stream on it. Each message of the usual protocol goes on
+// the stream as one byte of type (1 text, 2 binary, as in websocket), the
+// length of the payload as a 4 byte big endian number and the payload.
+// When the session ends the WebTransport session is closed with the
+// websocket close code and reason.
+package webtransport
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go/http3"
+	wt "github.com/quic-go/webtransport-go"
+	"github.com/widaT/webssh"
+)
+
+const (
+	// 建好会话后等浏览器开流最多这么久
+	acceptTimeout = 10 * time.Second
+	// 单条消息的上限，和websocket那边差不多
+	maxMessage = 16 << 20
+)
+
+// NewServer returns a WebTransport server on addr, a UDP address like
+// :443, that serves w on path. Start it with ListenAndServeTLS; browsers
+// only connect to HTTP/3 with a certificate they trust.
+func NewServer(addr, path string, w webssh.WebSSH) *wt.Server {
+	mux := http.NewServeMux()
+	s := &wt.Server{
+		H3: http3.Server{Addr: addr, Handler: mux},
+		// 和websocket的upgrader一样不限制Origin，由Authorizer把关
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	mux.Handle(path, Handler(w, s))
+	return s
+}
+
+// Handler upgrades the CONNECT requests it gets to WebTransport sessions
+// on s and runs a webssh session on the first stream the browser opens.
+// The request is authorized as the one of ServeConn.
+func Handler(w webssh.WebSSH, s *wt.Server) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		sess, err := s.Upgrade(rw, r)
+		if err != nil {
+			webssh.DefaultLogger().Warn("webtransport upgrade", "err", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), acceptTimeout)
+		str, err := sess.AcceptStream(ctx)
+		cancel()
+		if err != nil {
+			sess.CloseWithError(websocket.CloseProtocolError, "no stream")
+			return
+		}
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		w.ServeMessages(newConn(sess, str), r, clientIP)
+	})
+}
+
+// conn is a webssh.MessageConn on a WebTransport stream.
+type conn struct {
+	sess *wt.Session
+	str  wt.Stream
+	r    *bufio.Reader
+
+	mu sync.Mutex
+	// 消息头和内容拼好一次写出，在mu下使用
+	buf []byte
+}
+
+func newConn(sess *wt.Session, str wt.Stream) *conn {
+	return &conn{sess: sess, str: str, r: bufio.NewReader(str)}
+}
+
+func (c *conn) ReadMessage() (int, []byte, error) {
+	var head [5]byte
+	if _, err := io.ReadFull(c.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	msgType, n := int(head[0]), binary.BigEndian.Uint32(head[1:])
+	if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
+		return 0, nil, fmt.Errorf("invalid message type %d", msgType)
+	}
+	if n > maxMessage {
+		return 0, nil, errors.New("message too large")
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(c.r, p); err != nil {
+		return 0, nil, err
+	}
+	return msgType, p, nil
+}
+
+func (c *conn) WriteMessage(msgType int, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf = binary.BigEndian.AppendUint32(append(c.buf[:0], byte(msgType)), uint32(len(p)))
+	c.buf = append(c.buf, p...)
+	_, err := c.str.Write(c.buf)
+	if cap(c.buf) > 64<<10 {
+		c.buf = nil
+	}
+	return err
+}
+
+func (c *conn) Close() error {
+	return c.CloseWithCode(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithCode ends the WebTransport session with the websocket close
+// code of the webssh session, see webssh.MessageConn.
+func (c *conn) CloseWithCode(code int, reason string) error {
+	c.str.Close()
+	return c.sess.CloseWithError(wt.SessionErrorCode(code), reason)
+}
@@ -0,0 +1,201 @@
+package wire
+
+import "time"
+
+// Message types shared by the server and its clients. The root webssh
+// package documents what each of them carries.
+const (
+	MsgData    = '1'
+	MsgResize  = '2'
+	MsgHello   = 'a'
+	MsgHandoff = 'b'
+	MsgExit    = 'c'
+	MsgFile    = 'd'
+	MsgFlow    = 'h'
+	MsgPrompt  = 'i'
+	MsgDetach  = 'k'
+	MsgError   = 'l'
+	MsgPaste   = 'n'
+	MsgMarker  = 'q'
+	MsgSearch  = 's'
+	MsgLatency = 't'
+)
+
+// Capabilities negotiated with MsgHello.
+const (
+	CapGzip = "gzip"
+	// CapBinary lets the client send BinaryMessage frames whose payload
+	// follows the type byte as is, without base64. TextMessage frames keep
+	// the base64 encoding.
+	CapBinary = "binary"
+)
+
+// 协商gzip之后服务端每个数据帧第一个字节是标记
+const (
+	OutputRaw  = 0
+	OutputGzip = 1
+)
+
+// Error codes sent in ErrorMsg.
+const (
+	CodeAuthFailed      = "auth_failed"
+	CodeUnauthorized    = "unauthorized"
+	CodeHostUnreachable = "host_unreachable"
+	CodeHostKey         = "host_key_mismatch"
+	CodeSessionExpired  = "session_expired"
+	CodeIdle            = "idle"
+	CodeTerminated      = "terminated"
+	CodeShutdown        = "server_shutdown"
+	CodeSlowClient      = "slow_client"
+	CodeTransferred     = "transferred"
+	CodeBackendLost     = "backend_lost"
+	CodeQuotaExceeded   = "quota_exceeded"
+	CodeNotFound        = "not_found"
+	CodeInUse           = "session_in_use"
+	CodeInternal        = "internal"
+	CodeProtocolError   = "protocol_error"
+	// CodeTransferDenied不关闭连接，只出现在文件传输的回复里
+	CodeTransferDenied = "transfer_denied"
+)
+
+// ErrorMsg tells the client why its connection is closed. Retryable is set
+// when connecting again may succeed without the user changing anything.
+type ErrorMsg struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
+
+// Hello is the payload of MsgHello in both directions.
+type Hello struct {
+	Caps    []string `json:"caps"`
+	Session string   `json:"session,omitempty"`
+}
+
+// Resize is the payload of MsgResize.
+type Resize struct {
+	Columns int
+	Rows    int
+}
+
+// ExitStatus is how the remote command ended, the payload of MsgExit.
+type ExitStatus struct {
+	// Code为-1表示远端没有给出退出码
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// FileRequest is sent by the client. Op is one of list, get, put, mkdir
+// and remove. An upload is a series of put requests with the same id, the
+// last one with eof set.
+type FileRequest struct {
+	ID   string `json:"id"`
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Data []byte `json:"data,omitempty"`
+	EOF  bool   `json:"eof,omitempty"`
+}
+
+// FileReply answers a FileRequest. A download is answered with a series
+// of replies carrying data, the last one with eof set.
+type FileReply struct {
+	ID    string     `json:"id"`
+	Error string     `json:"error,omitempty"`
+	Files []FileInfo `json:"files,omitempty"`
+	Data  []byte     `json:"data,omitempty"`
+	EOF   bool       `json:"eof,omitempty"`
+	// Code是CodeTransferDenied时请求被TransferPolicy拒绝
+	Code string `json:"code,omitempty"`
+}
+
+// FileInfo describes a file of the session host.
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir"`
+}
+
+// Latency is the payload of MsgLatency: a probe of the server with seq, a
+// probe of the client with id, answered with pong, or a report with rtt
+// and stats.
+type Latency struct {
+	Seq   uint64        `json:"seq,omitempty"`
+	ID    int           `json:"id,omitempty"`
+	Pong  bool          `json:"pong,omitempty"`
+	RTT   float64       `json:"rtt,omitempty"`
+	Stats *LatencyStats `json:"stats,omitempty"`
+}
+
+// LatencyStats are the round trips of the last probes, in milliseconds.
+// Jitter is the mean difference between consecutive samples.
+type LatencyStats struct {
+	Samples int       `json:"samples"`
+	Last    float64   `json:"last"`
+	Min     float64   `json:"min"`
+	Avg     float64   `json:"avg"`
+	Max     float64   `json:"max"`
+	Jitter  float64   `json:"jitter"`
+	Lost    int64     `json:"lost"`
+	Time    time.Time `json:"time"`
+}
+
+// SearchQuery is what a MsgSearch looks for.
+type SearchQuery struct {
+	ID            int    `json:"id,omitempty"`
+	Query         string `json:"query"`
+	Regexp        bool   `json:"regexp,omitempty"`
+	CaseSensitive bool   `json:"case,omitempty"`
+	Limit         int    `json:"limit,omitempty"`
+	Context       int    `json:"context,omitempty"`
+}
+
+// SearchMatch is one match of a search.
+type SearchMatch struct {
+	Line   int      `json:"line"`
+	Col    int      `json:"col"`
+	Len    int      `json:"len"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// SearchResult is the answer to a SearchQuery. Total counts every match,
+// also those past the limit.
+type SearchResult struct {
+	ID      int           `json:"id,omitempty"`
+	Matches []SearchMatch `json:"matches"`
+	Total   int           `json:"total"`
+	Lines   int           `json:"lines"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// Prompt is a set of keyboard-interactive questions sent with MsgPrompt.
+type Prompt struct {
+	Instruction string     `json:"instruction,omitempty"`
+	Questions   []Question `json:"questions"`
+}
+
+// Question is a keyboard-interactive question.
+type Question struct {
+	Prompt string `json:"prompt"`
+	Echo   bool   `json:"echo"`
+}
+
+// PromptReply answers a Prompt, one answer per question.
+type PromptReply struct {
+	Answers []string `json:"answers"`
+}
+
+// Handoff is the answer to MsgHandoff, a token another connection redeems
+// to take over the session.
+type Handoff struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Flow is the payload of MsgFlow.
+type Flow struct {
+	Pause bool `json:"pause"`
+}
@@ -0,0 +1,287 @@
+// Package wire parses what clients send over the native webssh protocol:
+// one byte of message type followed by the payload, base64 encoded in text
+// messages and, once the client negotiated it, as is in binary messages.
+//
+// Every message goes through the same state machine, whether it is read
+// from a websocket or already in memory. It never buffers more than a
+// base64 encoded MaxMessageSize of payload: a longer message is read to
+// its end and dropped, so one client can neither exhaust the memory of the
+// server nor desynchronize the stream, and the next message is read as
+// usual. Errors
+// about a message are *ParseError and leave the parser ready for the next
+// one; any other error comes from the reader and ends the connection.
+//
+// The message types, capabilities, error codes and message payloads of the
+// protocol are defined here too, so clients can speak it without importing
+// the server.
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame types, the websocket opcodes gorilla/websocket uses as message
+// types.
+const (
+	TextFrame   = 1
+	BinaryFrame = 2
+)
+
+// DefaultMaxMessageSize is the largest payload when Config.MaxMessageSize
+// is 0.
+const DefaultMaxMessageSize = 1 << 20
+
+var (
+	ErrEmpty     = errors.New("empty message")
+	ErrTooLarge  = errors.New("message too large")
+	ErrEncoding  = errors.New("invalid base64 payload")
+	ErrFrameType = errors.New("unsupported frame type")
+	// ErrInternal is returned instead of a panic in fail-safe mode.
+	ErrInternal = errors.New("internal parser error")
+)
+
+// ParseError is a message that was dropped. Type is its message type, 0
+// if there was none.
+type ParseError struct {
+	Type byte
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Type == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("message %q: %s", e.Type, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Malformed reports whether err is about one message, which was dropped,
+// rather than about the connection.
+func Malformed(err error) bool {
+	var pe *ParseError
+	return errors.As(err, &pe)
+}
+
+// Message is a parsed client message.
+type Message struct {
+	Type    byte
+	Payload []byte
+}
+
+// Config configures a Parser.
+type Config struct {
+	// MaxMessageSize是负载解码后的最大字节数，0时为DefaultMaxMessageSize，小于0不限制
+	MaxMessageSize int
+	// FailSafe开启后解析中的panic被恢复成ErrInternal，这条消息丢弃，连接继续
+	FailSafe bool
+}
+
+// Parser parses client messages. It keeps no state between messages and
+// may be used from several goroutines.
+type Parser struct {
+	max      int
+	failSafe bool
+}
+
+func NewParser(c Config) *Parser {
+	max := c.MaxMessageSize
+	if max == 0 {
+		max = DefaultMaxMessageSize
+	}
+	return &Parser{max: max, failSafe: c.FailSafe}
+}
+
+// MaxMessageSize is the largest payload accepted, negative for no limit.
+func (p *Parser) MaxMessageSize() int {
+	return p.max
+}
+
+// 一条消息的解析状态
+type state int
+
+const (
+	stateFrame   state = iota // 检查帧类型
+	stateType                 // 读类型字节
+	statePayload              // 读负载，最多frameLimit字节
+	stateDiscard              // 负载太长，读到消息结尾丢掉
+	stateDecode               // 解码负载
+	stateDone
+)
+
+// machine is the state of one message on its way through the parser.
+type machine struct {
+	p         *Parser
+	frameType int
+	binary    bool
+	r         io.Reader
+	// frame是整条消息，类型字节加编码的负载
+	frame []byte
+	msg   Message
+	err   error
+	state state
+}
+
+// frameLimit is the longest encoded message that may carry a payload of
+// at most max bytes, with its type byte.
+func (p *Parser) frameLimit() int64 {
+	if p.max < 0 {
+		return -1
+	}
+	return int64(base64.StdEncoding.EncodedLen(p.max)) + 1
+}
+
+// step runs one transition. It returns false once the machine stopped,
+// with msg or err set.
+func (m *machine) step() bool {
+	switch m.state {
+	case stateFrame:
+		if m.frameType != TextFrame && m.frameType != BinaryFrame {
+			m.fail(ErrFrameType)
+			m.state = stateDiscard
+			return true
+		}
+		m.state = stateType
+	case stateType:
+		if m.r == nil {
+			if len(m.frame) == 0 {
+				return m.stop(ErrEmpty)
+			}
+			m.msg.Type = m.frame[0]
+			if limit := m.p.frameLimit(); limit >= 0 && int64(len(m.frame)) > limit {
+				return m.stop(ErrTooLarge)
+			}
+			m.state = stateDecode
+			return true
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(m.r, b[:]); err != nil {
+			if err == io.EOF {
+				return m.stop(ErrEmpty)
+			}
+			m.err = err
+			return false
+		}
+		m.msg.Type = b[0]
+		m.frame = []byte{b[0]}
+		m.state = statePayload
+	case statePayload:
+		buf := bytes.NewBuffer(m.frame)
+		r := m.r
+		limit := m.p.frameLimit()
+		if limit >= 0 {
+			// 类型字节已经读了，负载多读一个字节才知道是不是超长
+			r = io.LimitReader(m.r, limit)
+		}
+		if _, err := buf.ReadFrom(r); err != nil {
+			m.err = err
+			return false
+		}
+		m.frame = buf.Bytes()
+		if limit >= 0 && int64(len(m.frame)) > limit {
+			m.fail(ErrTooLarge)
+			m.state = stateDiscard
+			return true
+		}
+		m.state = stateDone
+	case stateDiscard:
+		m.frame = nil
+		if m.r != nil {
+			if _, err := io.Copy(io.Discard, m.r); err != nil {
+				m.err = err
+			}
+		}
+		return false
+	case stateDecode:
+		payload := m.frame[1:]
+		if !(m.frameType == BinaryFrame && m.binary) {
+			dec := make([]byte, base64.StdEncoding.DecodedLen(len(payload)))
+			n, err := base64.StdEncoding.Decode(dec, payload)
+			if err != nil {
+				return m.stop(ErrEncoding)
+			}
+			payload = dec[:n]
+		}
+		if m.p.max >= 0 && len(payload) > m.p.max {
+			return m.stop(ErrTooLarge)
+		}
+		m.msg.Payload = payload
+		m.state = stateDone
+	case stateDone:
+		return false
+	}
+	return true
+}
+
+// fail records err as the error of the message, keeping the machine
+// going, e.g. to discard the rest of it.
+func (m *machine) fail(err error) {
+	m.err = &ParseError{Type: m.msg.Type, Err: err}
+}
+
+// stop records err as the error of the message and stops the machine.
+func (m *machine) stop(err error) bool {
+	m.fail(err)
+	return false
+}
+
+func (m *machine) run() (err error) {
+	if m.p.failSafe {
+		defer func() {
+			if v := recover(); v != nil {
+				err = &ParseError{Type: m.msg.Type, Err: fmt.Errorf("%w: %v", ErrInternal, v)}
+				if m.r != nil {
+					// 剩下的部分丢掉，下一条消息从头开始；丢弃时再panic就不管了
+					func() {
+						defer func() { recover() }()
+						io.Copy(io.Discard, m.r)
+					}()
+				}
+			}
+		}()
+	}
+	for m.step() {
+	}
+	return m.err
+}
+
+// ReadFrame reads one message of frameType from r, which ends where the
+// message ends, without decoding its payload. The frame is checked against
+// MaxMessageSize as a base64 payload.
+func (p *Parser) ReadFrame(frameType int, r io.Reader) ([]byte, error) {
+	m := &machine{p: p, frameType: frameType, r: r}
+	if err := m.run(); err != nil {
+		return nil, err
+	}
+	return m.frame, nil
+}
+
+// Parse parses a message of frameType. binary tells whether the client
+// negotiated raw payloads in binary messages.
+func (p *Parser) Parse(frameType int, data []byte, binary bool) (Message, error) {
+	m := &machine{p: p, frameType: frameType, binary: binary, frame: data}
+	if err := m.run(); err != nil {
+		return Message{Type: m.msg.Type}, err
+	}
+	return m.msg, nil
+}
+
+// Read reads and parses one message of frameType from r, which ends where
+// the message ends.
+func (p *Parser) Read(frameType int, r io.Reader, binary bool) (Message, error) {
+	frame, err := p.ReadFrame(frameType, r)
+	if err != nil {
+		var pe *ParseError
+		if errors.As(err, &pe) {
+			return Message{Type: pe.Type}, err
+		}
+		return Message{}, err
+	}
+	return p.Parse(frameType, frame, binary)
+}
@@ -0,0 +1,257 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func text(typ byte, payload string) []byte {
+	return append([]byte{typ}, base64.StdEncoding.EncodeToString([]byte(payload))...)
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		frameType int
+		data      []byte
+		binary    bool
+		want      Message
+		err       error
+	}{
+		{name: "text", frameType: TextFrame, data: text('1', "ls\r"), want: Message{'1', []byte("ls\r")}},
+		{name: "text type only", frameType: TextFrame, data: []byte("k"), want: Message{'k', []byte{}}},
+		{name: "binary raw", frameType: BinaryFrame, data: []byte("1ls\r"), binary: true, want: Message{'1', []byte("ls\r")}},
+		{name: "binary not negotiated", frameType: BinaryFrame, data: text('1', "ls"), want: Message{'1', []byte("ls")}},
+		{name: "text after binary negotiated", frameType: TextFrame, data: text('1', "ls"), binary: true, want: Message{'1', []byte("ls")}},
+		{name: "empty", frameType: TextFrame, data: nil, err: ErrEmpty},
+		{name: "frame type", frameType: 9, data: text('1', "ls"), err: ErrFrameType},
+		{name: "bad base64", frameType: TextFrame, data: []byte("1!!!!"), want: Message{Type: '1'}, err: ErrEncoding},
+		{name: "truncated base64", frameType: TextFrame, data: []byte("1bHM"[:3]), want: Message{Type: '1'}, err: ErrEncoding},
+		{name: "at limit", max: 4, frameType: TextFrame, data: text('1', "abcd"), want: Message{'1', []byte("abcd")}},
+		{name: "over limit", max: 4, frameType: TextFrame, data: text('1', "abcde"), want: Message{Type: '1'}, err: ErrTooLarge},
+		{name: "binary over limit", max: 4, frameType: BinaryFrame, binary: true, data: []byte("1abcdefghijk"), want: Message{Type: '1'}, err: ErrTooLarge},
+		// 编码后的长度没超，解码后超了
+		{name: "binary decoded over limit", max: 4, frameType: BinaryFrame, binary: true, data: []byte("1abcdefgh"), want: Message{Type: '1'}, err: ErrTooLarge},
+		{name: "unlimited", max: -1, frameType: TextFrame, data: text('1', strings.Repeat("x", 3<<20)), want: Message{'1', []byte(strings.Repeat("x", 3<<20))}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser(Config{MaxMessageSize: tt.max})
+			for _, read := range []bool{false, true} {
+				var msg Message
+				var err error
+				if read {
+					msg, err = p.Read(tt.frameType, bytes.NewReader(tt.data), tt.binary)
+				} else {
+					msg, err = p.Parse(tt.frameType, tt.data, tt.binary)
+				}
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("read=%v: err %v, want %v", read, err, tt.err)
+				}
+				if err != nil {
+					if !Malformed(err) {
+						t.Fatalf("read=%v: %v is not a ParseError", read, err)
+					}
+					if msg.Type != tt.want.Type {
+						t.Fatalf("read=%v: type %q, want %q", read, msg.Type, tt.want.Type)
+					}
+					continue
+				}
+				if msg.Type != tt.want.Type || !bytes.Equal(msg.Payload, tt.want.Payload) {
+					t.Fatalf("read=%v: got %q %q, want %q %q", read, msg.Type, msg.Payload, tt.want.Type, tt.want.Payload)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultMaxMessageSize(t *testing.T) {
+	p := NewParser(Config{})
+	if p.MaxMessageSize() != DefaultMaxMessageSize {
+		t.Fatalf("max %d", p.MaxMessageSize())
+	}
+	if _, err := p.Parse(TextFrame, text('1', strings.Repeat("x", DefaultMaxMessageSize)), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Parse(TextFrame, text('1', strings.Repeat("x", DefaultMaxMessageSize+1)), false); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("err %v", err)
+	}
+}
+
+// countingReader records how much was read from it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestReadDiscardsOversize(t *testing.T) {
+	p := NewParser(Config{MaxMessageSize: 16})
+	data := text('1', strings.Repeat("x", 1<<20))
+	r := &countingReader{r: bytes.NewReader(data)}
+	frame, err := p.ReadFrame(TextFrame, r)
+	if !errors.Is(err, ErrTooLarge) || frame != nil {
+		t.Fatalf("frame %d bytes, err %v", len(frame), err)
+	}
+	// 读到消息结尾，下一条从头开始
+	if r.n != len(data) {
+		t.Fatalf("read %d of %d bytes", r.n, len(data))
+	}
+}
+
+func TestReadDiscardsFrameType(t *testing.T) {
+	p := NewParser(Config{})
+	r := bytes.NewReader(text('1', "ls"))
+	if _, err := p.Read(8, r, false); !errors.Is(err, ErrFrameType) {
+		t.Fatalf("err %v", err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d bytes left", r.Len())
+	}
+}
+
+// errReader returns data, then err.
+type errReader struct {
+	data []byte
+	err  error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	if len(e.data) == 0 {
+		return 0, e.err
+	}
+	n := copy(p, e.data)
+	e.data = e.data[n:]
+	return n, nil
+}
+
+func TestReadTruncated(t *testing.T) {
+	p := NewParser(Config{MaxMessageSize: 16})
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"before type", nil},
+		{"in payload", text('1', "abc")[:3]},
+		{"while discarding", text('1', strings.Repeat("x", 64))[:40]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.Read(TextFrame, &errReader{data: tt.data, err: io.ErrUnexpectedEOF}, false)
+			if !errors.Is(err, io.ErrUnexpectedEOF) || Malformed(err) {
+				t.Fatalf("err %v, want the error of the reader", err)
+			}
+		})
+	}
+}
+
+// panicReader panics on the first panics reads, then returns data.
+type panicReader struct {
+	panics int
+	r      io.Reader
+}
+
+func (p *panicReader) Read(b []byte) (int, error) {
+	if p.panics > 0 {
+		p.panics--
+		panic("boom")
+	}
+	return p.r.Read(b)
+}
+
+func TestFailSafe(t *testing.T) {
+	p := NewParser(Config{FailSafe: true})
+	r := &panicReader{panics: 1, r: bytes.NewReader(text('1', "rest"))}
+	msg, err := p.Read(TextFrame, r, false)
+	if !errors.Is(err, ErrInternal) || !Malformed(err) {
+		t.Fatalf("err %v", err)
+	}
+	if msg.Type != 0 {
+		t.Fatalf("type %q", msg.Type)
+	}
+	// 剩下的部分被丢掉
+	if n, _ := r.Read(make([]byte, 8)); n != 0 {
+		t.Fatalf("%d bytes left", n)
+	}
+
+	// 丢弃时又panic也不能让进程崩溃
+	r = &panicReader{panics: 2, r: bytes.NewReader(text('1', "rest"))}
+	if _, err := p.Read(TextFrame, r, false); !errors.Is(err, ErrInternal) {
+		t.Fatalf("err %v", err)
+	}
+
+	// 之后照常解析
+	msg, err = p.Read(TextFrame, bytes.NewReader(text('2', "ok")), false)
+	if err != nil || msg.Type != '2' || string(msg.Payload) != "ok" {
+		t.Fatalf("got %q %q %v", msg.Type, msg.Payload, err)
+	}
+}
+
+func TestFailSafeAfterType(t *testing.T) {
+	p := NewParser(Config{FailSafe: true})
+	r := io.MultiReader(strings.NewReader("1"), &panicReader{panics: 1, r: strings.NewReader("")})
+	msg, err := p.Read(TextFrame, r, false)
+	if !errors.Is(err, ErrInternal) || msg.Type != '1' {
+		t.Fatalf("got %q %v", msg.Type, err)
+	}
+}
+
+func TestNoFailSafe(t *testing.T) {
+	p := NewParser(Config{})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("panic was recovered without FailSafe")
+		}
+	}()
+	p.Read(TextFrame, &panicReader{panics: 1}, false)
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte("1bHM="), uint8(TextFrame), false, int16(0))
+	f.Add([]byte("1ls"), uint8(BinaryFrame), true, int16(2))
+	f.Add([]byte(""), uint8(TextFrame), false, int16(-1))
+	f.Add([]byte("2eyJDb2x1bW5zIjo4MCwiUm93cyI6MjR9"), uint8(TextFrame), false, int16(8))
+	f.Add([]byte("1!!"), uint8(3), true, int16(1))
+	f.Fuzz(func(t *testing.T, data []byte, frameType uint8, binary bool, max int16) {
+		p := NewParser(Config{MaxMessageSize: int(max)})
+		msg, err := p.Parse(int(frameType), data, binary)
+		r := bytes.NewReader(data)
+		rmsg, rerr := p.Read(int(frameType), r, binary)
+		if r.Len() != 0 {
+			t.Fatalf("Read left %d bytes", r.Len())
+		}
+		if (err == nil) != (rerr == nil) || msg.Type != rmsg.Type || !bytes.Equal(msg.Payload, rmsg.Payload) {
+			t.Fatalf("Parse %q %v, Read %q %v", msg.Payload, err, rmsg.Payload, rerr)
+		}
+		if err != nil {
+			if !Malformed(err) {
+				t.Fatalf("%v is not a ParseError", err)
+			}
+			if msg.Payload != nil {
+				t.Fatalf("payload %q with error %v", msg.Payload, err)
+			}
+			return
+		}
+		if max := p.MaxMessageSize(); max >= 0 && len(msg.Payload) > max {
+			t.Fatalf("payload of %d bytes, max %d", len(msg.Payload), max)
+		}
+		if len(data) == 0 || msg.Type != data[0] {
+			t.Fatalf("type %q of %q", msg.Type, data)
+		}
+		if frame, err := p.ReadFrame(int(frameType), bytes.NewReader(data)); err != nil {
+			t.Fatalf("ReadFrame: %v", err)
+		} else if limit := p.frameLimit(); limit >= 0 && int64(len(frame)) > limit {
+			t.Fatalf("frame of %d bytes, limit %d", len(frame), limit)
+		}
+	})
+}
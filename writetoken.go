@@ -0,0 +1,139 @@
+package webssh
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/widaT/webssh/wire"
+)
+
+// MsgControl carries the write token of a shared session. A viewer sends
+// {"op":"request"} to ask for control and the owner gets
+// {"op":"request","id":...,"remote":...}. The owner hands the token over
+// with {"op":"grant","id":...} and takes it back with {"op":"revoke"}; the
+// viewer holding it may give it back with {"op":"release"}. Every change is
+// sent to all connections as {"op":"granted","id":...} or {"op":"revoked"}.
+// While a viewer holds the token only that viewer can type.
+const MsgControl = 'g'
+
+type controlMsg struct {
+	Op     string `json:"op"`
+	ID     string `json:"id,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// handleControl handles a MsgControl from c, or from the connection the
+// session was started with when c is nil.
+func (t *Turn) handleControl(c *client, msg controlMsg) {
+	owner := c == nil || c.Role == RoleOwner
+	switch msg.Op {
+	case "request":
+		if !owner {
+			t.writeControl(MsgControl, controlMsg{Op: "request", ID: c.ID, Remote: c.Remote})
+		}
+	case "grant":
+		if owner {
+			t.Grant(msg.ID)
+		}
+	case "revoke":
+		if owner {
+			t.Revoke()
+		}
+	case "release":
+		if c != nil {
+			t.clientsMu.RLock()
+			held := t.writer == c
+			t.clientsMu.RUnlock()
+			if held {
+				t.Revoke()
+			}
+		}
+	}
+}
+
+// Grant gives the write token to the attached viewer with the given id.
+// It reports whether such a viewer exists. A locked session keeps control
+// with the owner.
+func (t *Turn) Grant(id string) bool {
+	if t.Locked() {
+		return false
+	}
+	t.clientsMu.Lock()
+	var to *client
+	for c := range t.clients {
+		if c.ID == id && c.Role == RoleViewer {
+			to = c
+			break
+		}
+	}
+	if to == nil {
+		t.clientsMu.Unlock()
+		return false
+	}
+	t.writer = to
+	t.clientsMu.Unlock()
+	t.sendControlAll(controlMsg{Op: "granted", ID: id})
+	return true
+}
+
+// Revoke gives control back to the owner.
+func (t *Turn) Revoke() {
+	t.clientsMu.Lock()
+	held := t.writer != nil
+	t.writer = nil
+	t.clientsMu.Unlock()
+	if held {
+		t.sendControlAll(controlMsg{Op: "revoked"})
+	}
+}
+
+// handleWriterInput handles MsgData or MsgPaste from the viewer holding
+// the write token, with the checks input of the owner goes through.
+func (t *Turn) handleWriterInput(ctx context.Context, m wire.Message) error {
+	if !t.throttleInput(ctx, t.msgLim, 1) || t.lockedDrops(m.Type) {
+		return nil
+	}
+	if m.Type == MsgPaste {
+		if t.bannerPending.Load() {
+			return nil
+		}
+		return t.handlePaste(ctx, m.Payload, nil)
+	}
+	return t.handleTyped(ctx, m.Payload, nil)
+}
+
+// Writer returns the id of the viewer holding the write token, or "" if
+// the owner has control.
+func (t *Turn) Writer() string {
+	t.clientsMu.RLock()
+	defer t.clientsMu.RUnlock()
+	if t.writer == nil {
+		return ""
+	}
+	return t.writer.ID
+}
+
+func (t *Turn) isWriter(c *client) bool {
+	t.clientsMu.RLock()
+	defer t.clientsMu.RUnlock()
+	return t.writer == c
+}
+
+// sendControlAll sends a control message to the owner and every attached
+// connection.
+func (t *Turn) sendControlAll(msg controlMsg) {
+	b, _ := json.Marshal(msg)
+	f := frame{msgType: websocket.TextMessage, p: controlFrame(MsgControl, b)}
+	t.out.pushWait(f, controlWait)
+
+	t.clientsMu.RLock()
+	clients := make([]*client, 0, len(t.clients))
+	for c := range t.clients {
+		clients = append(clients, c)
+	}
+	t.clientsMu.RUnlock()
+	for _, c := range clients {
+		c.out.pushWait(f, controlWait)
+	}
+}
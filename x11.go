@@ -0,0 +1,313 @@
+package webssh
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+const x11AuthProto = "MIT-MAGIC-COOKIE-1"
+
+var errNoX11 = errors.New("x11 forwarding not enabled")
+
+// x11Msg is a text message on the X11 websocket. The server sends
+// {"op":"open","id":1,"origin":"..."} when a remote X client connects and
+// {"op":"close","id":1} when it is gone; the client may send close too.
+// The X traffic itself goes in binary messages that start with the id as a
+// 4 byte big endian number.
+type x11Msg struct {
+	Op     string `json:"op"`
+	ID     uint32 `json:"id"`
+	Origin string `json:"origin,omitempty"`
+}
+
+type x11Forward struct {
+	t      *Turn
+	cookie []byte
+
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	ws      *websocket.Conn
+	chans   map[uint32]ssh.Channel
+	seq     uint32
+}
+
+// x11Request is the payload of the x11-req channel request, RFC 4254 6.3.1.
+type x11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+// requestX11 asks the server to forward X11 to client, with a fake cookie
+// that is checked and taken out again before the traffic reaches the
+// browser. The x11 channels must be claimed before the shell starts.
+func requestX11(client *ssh.Client) (*x11Forward, <-chan ssh.NewChannel, error) {
+	chans := client.HandleChannelOpen("x11")
+	if chans == nil {
+		return nil, nil, errors.New("x11 channels already handled on this connection")
+	}
+	cookie := make([]byte, 16)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, nil, err
+	}
+	return &x11Forward{cookie: cookie, chans: map[uint32]ssh.Channel{}}, chans, nil
+}
+
+func (x *x11Forward) request(sess *ssh.Session) error {
+	ok, err := sess.SendRequest("x11-req", true, ssh.Marshal(&x11Request{
+		AuthProtocol: x11AuthProto,
+		AuthCookie:   hex.EncodeToString(x.cookie),
+	}))
+	if err == nil && !ok {
+		err = errors.New("x11 forwarding refused by the server")
+	}
+	return err
+}
+
+func (x *x11Forward) accept(chans <-chan ssh.NewChannel) {
+	for nc := range chans {
+		x.mu.Lock()
+		ws := x.ws
+		x.mu.Unlock()
+		if ws == nil {
+			nc.Reject(ssh.ConnectionFailed, "no X server attached")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go ssh.DiscardRequests(reqs)
+		go x.serve(ch, x11Origin(nc.ExtraData()))
+	}
+}
+
+// x11Origin is the address of the X client from the channel open message.
+func x11Origin(extra []byte) string {
+	var origin struct {
+		Addr string
+		Port uint32
+	}
+	if ssh.Unmarshal(extra, &origin) != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", origin.Addr, origin.Port)
+}
+
+func (x *x11Forward) serve(ch ssh.Channel, origin string) {
+	defer ch.Close()
+	setup, err := x.checkSetup(ch)
+	if err != nil {
+		x.t.logger().Warn("x11 connection", "origin", origin, "err", err)
+		return
+	}
+	x.mu.Lock()
+	if x.ws == nil {
+		x.mu.Unlock()
+		return
+	}
+	x.seq++
+	id := x.seq
+	x.chans[id] = ch
+	x.mu.Unlock()
+	defer x.drop(id, true)
+
+	x.writeMsg(x11Msg{Op: "open", ID: id, Origin: origin})
+	if x.writeData(id, setup) != nil {
+		return
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := ch.Read(buf)
+		if n > 0 && x.writeData(id, buf[:n]) != nil {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkSetup reads the connection setup of an X client, checks the fake
+// cookie and returns the setup without it: the X server in the browser
+// never sees the cookie, and a client without it gets nothing.
+func (x *x11Forward) checkSetup(r io.Reader) ([]byte, error) {
+	head := make([]byte, 12)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch head[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, errors.New("bad byte order in x11 setup")
+	}
+	nameLen, dataLen := int(order.Uint16(head[6:])), int(order.Uint16(head[8:]))
+	auth := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, auth); err != nil {
+		return nil, err
+	}
+	name, data := auth[:nameLen], auth[pad4(nameLen):pad4(nameLen)+dataLen]
+	if string(name) != x11AuthProto || subtle.ConstantTimeCompare(data, x.cookie) != 1 {
+		return nil, errors.New("x11 cookie does not match")
+	}
+	order.PutUint16(head[6:], 0)
+	order.PutUint16(head[8:], 0)
+	return head, nil
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func (x *x11Forward) writeMsg(m x11Msg) error {
+	b, _ := json.Marshal(m)
+	return x.write(websocket.TextMessage, b)
+}
+
+func (x *x11Forward) writeData(id uint32, p []byte) error {
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(p)), id)
+	return x.write(websocket.BinaryMessage, append(frame, p...))
+}
+
+func (x *x11Forward) write(msgType int, p []byte) error {
+	x.mu.Lock()
+	ws := x.ws
+	x.mu.Unlock()
+	if ws == nil {
+		return errors.New("no X server attached")
+	}
+	x.writeMu.Lock()
+	defer x.writeMu.Unlock()
+	return ws.WriteMessage(msgType, p)
+}
+
+// drop forgets the X connection id and tells the browser if notify is set.
+func (x *x11Forward) drop(id uint32, notify bool) {
+	x.mu.Lock()
+	ch, ok := x.chans[id]
+	delete(x.chans, id)
+	x.mu.Unlock()
+	if !ok {
+		return
+	}
+	ch.Close()
+	if notify {
+		x.writeMsg(x11Msg{Op: "close", ID: id})
+	}
+}
+
+// attach makes ws the X server of the session until ws is closed. A new
+// connection replaces the previous one and its X connections.
+func (x *x11Forward) attach(ws *websocket.Conn) {
+	x.mu.Lock()
+	old := x.ws
+	x.ws = ws
+	x.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	defer x.detach(ws)
+	for {
+		msgType, p, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if msgType == websocket.TextMessage {
+			var m x11Msg
+			if json.Unmarshal(p, &m) == nil && m.Op == "close" {
+				x.drop(m.ID, false)
+			}
+			continue
+		}
+		if len(p) < 4 {
+			continue
+		}
+		x.mu.Lock()
+		ch := x.chans[binary.BigEndian.Uint32(p)]
+		x.mu.Unlock()
+		if ch != nil {
+			ch.Write(p[4:])
+		}
+	}
+}
+
+func (x *x11Forward) detach(ws *websocket.Conn) {
+	x.mu.Lock()
+	if x.ws != ws {
+		x.mu.Unlock()
+		return
+	}
+	x.ws = nil
+	chans := x.chans
+	x.chans = map[uint32]ssh.Channel{}
+	x.mu.Unlock()
+	for _, ch := range chans {
+		ch.Close()
+	}
+}
+
+func (x *x11Forward) close() {
+	x.mu.Lock()
+	ws := x.ws
+	x.mu.Unlock()
+	if ws != nil {
+		ws.Close()
+		x.detach(ws)
+	}
+}
+
+// AttachX11 makes ws the X server for the X11 connections of the session
+// until ws is closed.
+func (t *Turn) AttachX11(ws *websocket.Conn) error {
+	if t.x11 == nil {
+		return errNoX11
+	}
+	t.x11.attach(ws)
+	return nil
+}
+
+// ServeX11 tunnels the X11 connections of the session named by the id
+// parameter over this connection, see x11Msg. With an Authorizer only the
+// owner of the session may attach.
+func (w WebSSH) ServeX11(c *gin.Context) {
+	turn := w.Sessions.Get(c.Param("id"))
+	if turn == nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": "session not found"})
+		return
+	}
+	if w.Authorizer != nil {
+		target, err := w.authorize(c.Request)
+		if err != nil || target == nil || target.Identity != turn.Owner {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"ok": false, "msg": ErrUnauthorized.Error()})
+			return
+		}
+	}
+	if turn.x11 == nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": errNoX11.Error()})
+		return
+	}
+	wsConn, err := w.upgrade(c.Writer, c.Request)
+	if err != nil {
+		c.AbortWithStatusJSON(200, gin.H{"ok": false, "msg": err.Error()})
+		return
+	}
+	defer wsConn.Close()
+	turn.AttachX11(wsConn)
+}
@@ -0,0 +1,76 @@
+package webssh
+
+import (
+	"bytes"
+)
+
+// MsgZmodem tells the client that a ZMODEM transfer started, with
+// {"state":"start","direction":"download"|"upload"}. The client answers
+// {"state":"end"} when the transfer is over, or {"state":"abort"} to cancel
+// it. A transfer refused by the TransferPolicy is cancelled and reported as
+// {"state":"abort","error","code":"transfer_denied"}. While a transfer runs, output and input are relayed untouched and are
+// not recorded.
+const MsgZmodem = 'e'
+
+// sz和rz启动时发出的ZHEX头：**ZDLE B 0 后面是帧类型，00为ZRQINIT(sz)，01为ZRINIT(rz)
+var zmodemStart = []byte("**\x18B0")
+
+// 取消传输：8个CAN再加退格清掉回显
+var zmodemCancel = []byte("\x18\x18\x18\x18\x18\x18\x18\x18\x08\x08\x08\x08\x08\x08\x08\x08")
+
+type zmodemMsg struct {
+	State     string `json:"state"`
+	Direction string `json:"direction,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// detectZmodem looks for the start of a ZMODEM transfer in p, including a
+// header split across the previous output. It returns the offset in p where
+// the transfer starts and its direction seen from the client.
+func (t *Turn) detectZmodem(p []byte) (int, string, bool) {
+	buf := append(t.zmTail, p...)
+	i := bytes.Index(buf, zmodemStart)
+	if i < 0 || i+len(zmodemStart) >= len(buf) {
+		// 保留可能是头部一部分的结尾
+		keep := len(zmodemStart)
+		if len(buf) < keep {
+			keep = len(buf)
+		}
+		t.zmTail = append(t.zmTail[:0], buf[len(buf)-keep:]...)
+		return 0, "", false
+	}
+	var direction string
+	switch buf[i+len(zmodemStart)] {
+	case '0':
+		direction = "download"
+	case '1':
+		direction = "upload"
+	default:
+		t.zmTail = t.zmTail[:0]
+		return 0, "", false
+	}
+	start := i - len(t.zmTail)
+	if start < 0 {
+		start = 0
+	}
+	t.zmTail = t.zmTail[:0]
+	return start, direction, true
+}
+
+func (t *Turn) handleZmodem(msg zmodemMsg) error {
+	switch msg.State {
+	case "end":
+		t.zmodem.Store(false)
+	case "abort":
+		if t.zmodem.CompareAndSwap(true, false) {
+			return t.writeInput(t.ctx, zmodemCancel)
+		}
+	}
+	return nil
+}
+
+// ZmodemActive reports whether a ZMODEM transfer is in progress.
+func (t *Turn) ZmodemActive() bool {
+	return t.zmodem.Load()
+}